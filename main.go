@@ -16,6 +16,7 @@ package main
 //go:generate go run server/errors_gen.go
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -53,6 +54,8 @@ Logging Options:
 JetStream Options:
     -js, --jetstream                 Enable JetStream functionality.
     -sd, --store_dir <dir>           Set the storage directory.
+        --js-verify <dir>            Check a storage directory, report as JSON and exit
+        --js-repair                  Truncate corrupt blocks and rebuild indexes with --js-verify
 
 Authorization Options:
         --user <user>                User required for connections
@@ -86,6 +89,25 @@ func usage() {
 	os.Exit(0)
 }
 
+// verifyJetStreamStore will check a JetStream storage directory, print the
+// report as JSON and exit. No listeners are started.
+func verifyJetStreamStore(exe, storeDir string, repair bool) {
+	report, err := server.VerifyJetStreamStore(storeDir, repair)
+	if err != nil {
+		server.PrintAndDie(fmt.Sprintf("%s: %s", exe, err))
+	}
+	b, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(b))
+	if report.Errors > 0 {
+		os.Exit(1)
+	}
+	// Some streams, e.g. encrypted ones, could not be checked.
+	if report.Unchecked > 0 {
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
 func main() {
 	exe := "nats-server"
 
@@ -103,6 +125,8 @@ func main() {
 	} else if opts.CheckConfig {
 		fmt.Fprintf(os.Stderr, "%s: configuration file %s is valid\n", exe, opts.ConfigFile)
 		os.Exit(0)
+	} else if opts.JetStreamVerify != "" {
+		verifyJetStreamStore(exe, opts.JetStreamVerify, opts.JetStreamRepair)
 	}
 
 	// Create the server with appropriate options.
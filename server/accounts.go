@@ -4370,6 +4370,23 @@ func (tr *transform) transform(tokens []string) (string, error) {
 	return b.String(), nil
 }
 
+// destPattern returns the destination subject with any placeholders or
+// mapping functions replaced by partial wildcards, e.g. foo.{{wildcard(1)}} -> foo.*
+func (tr *transform) destPattern() string {
+	if len(tr.dtpi) == 0 {
+		return tr.dest
+	}
+	toks := make([]string, 0, len(tr.dtoks))
+	for i, index := range tr.dtpi {
+		if index[0] < 0 {
+			toks = append(toks, tr.dtoks[i])
+		} else {
+			toks = append(toks, pwcs)
+		}
+	}
+	return strings.Join(toks, tsep)
+}
+
 // Reverse a transform.
 func (tr *transform) reverse() *transform {
 	if len(tr.dtpi) == 0 {
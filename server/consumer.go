@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"math/rand"
 	"reflect"
 	"sort"
@@ -33,18 +34,27 @@ import (
 )
 
 type ConsumerInfo struct {
-	Stream         string          `json:"stream_name"`
-	Name           string          `json:"name"`
-	Created        time.Time       `json:"created"`
-	Config         *ConsumerConfig `json:"config,omitempty"`
-	Delivered      SequenceInfo    `json:"delivered"`
-	AckFloor       SequenceInfo    `json:"ack_floor"`
-	NumAckPending  int             `json:"num_ack_pending"`
-	NumRedelivered int             `json:"num_redelivered"`
-	NumWaiting     int             `json:"num_waiting"`
-	NumPending     uint64          `json:"num_pending"`
-	Cluster        *ClusterInfo    `json:"cluster,omitempty"`
-	PushBound      bool            `json:"push_bound,omitempty"`
+	Stream         string               `json:"stream_name"`
+	Name           string               `json:"name"`
+	Created        time.Time            `json:"created"`
+	Config         *ConsumerConfig      `json:"config,omitempty"`
+	Delivered      SequenceInfo         `json:"delivered"`
+	AckFloor       SequenceInfo         `json:"ack_floor"`
+	NumAckPending  int                  `json:"num_ack_pending"`
+	NumRedelivered int                  `json:"num_redelivered"`
+	NumWaiting     int                  `json:"num_waiting"`
+	NumPending     uint64               `json:"num_pending"`
+	Cluster        *ClusterInfo         `json:"cluster,omitempty"`
+	PushBound      bool                 `json:"push_bound,omitempty"`
+	Paused         bool                 `json:"paused,omitempty"`
+	PauseRemaining time.Duration        `json:"pause_remaining,omitempty"`
+	PriorityGroups []PriorityGroupState `json:"priority_groups,omitempty"`
+}
+
+// PriorityGroupState is the current state of a priority group, e.g. the pinned client if any.
+type PriorityGroupState struct {
+	Group          string `json:"group"`
+	PinnedClientID string `json:"pinned_client_id,omitempty"`
 }
 
 type ConsumerConfig struct {
@@ -58,8 +68,10 @@ type ConsumerConfig struct {
 	MaxDeliver      int             `json:"max_deliver,omitempty"`
 	BackOff         []time.Duration `json:"backoff,omitempty"`
 	FilterSubject   string          `json:"filter_subject,omitempty"`
+	FilterSubjects  []string        `json:"filter_subjects,omitempty"`
 	ReplayPolicy    ReplayPolicy    `json:"replay_policy"`
-	RateLimit       uint64          `json:"rate_limit_bps,omitempty"` // Bits per sec
+	RateLimit       uint64          `json:"rate_limit_bps,omitempty"`  // Bits per sec
+	RateLimitMsgs   uint64          `json:"rate_limit_msgs,omitempty"` // Messages per sec
 	SampleFrequency string          `json:"sample_freq,omitempty"`
 	MaxWaiting      int             `json:"max_waiting,omitempty"`
 	MaxAckPending   int             `json:"max_ack_pending,omitempty"`
@@ -68,8 +80,14 @@ type ConsumerConfig struct {
 	HeadersOnly     bool            `json:"headers_only,omitempty"`
 
 	// Pull based options.
-	MaxRequestBatch   int           `json:"max_batch,omitempty"`
-	MaxRequestExpires time.Duration `json:"max_expires,omitempty"`
+	MaxRequestBatch    int           `json:"max_batch,omitempty"`
+	MaxRequestExpires  time.Duration `json:"max_expires,omitempty"`
+	MaxRequestMaxBytes int           `json:"max_bytes,omitempty"`
+
+	// Priority groups for pull based consumers.
+	PriorityGroups []string       `json:"priority_groups,omitempty"`
+	PriorityPolicy PriorityPolicy `json:"priority_policy,omitempty"`
+	PinnedTTL      time.Duration  `json:"priority_timeout,omitempty"`
 
 	// Push based consumers.
 	DeliverSubject string `json:"deliver_subject,omitempty"`
@@ -78,8 +96,25 @@ type ConsumerConfig struct {
 	// Ephemeral inactivity threshold.
 	InactiveThreshold time.Duration `json:"inactive_threshold,omitempty"`
 
+	// Generally inherited from the parent stream, but can be set to run on fewer peers or in memory.
+	Replicas      int  `json:"num_replicas,omitempty"`
+	MemoryStorage bool `json:"mem_storage,omitempty"`
+
 	// Don't add to general clients.
 	Direct bool `json:"direct,omitempty"`
+
+	// Metadata is a set of application defined key/value pairs.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// DeadLetter preserves messages that exhaust MaxDeliver or are terminated.
+	DeadLetter *DeadLetter `json:"dead_letter,omitempty"`
+
+	// Partition keeps messages with the same key on the same pull client.
+	Partition *PartitionConfig `json:"partition,omitempty"`
+
+	// HeaderFilter only delivers messages whose headers match all predicates.
+	// Headers are only checked as messages are reached, so NumPending is an upper bound.
+	HeaderFilter []HeaderPredicate `json:"header_filter,omitempty"`
 }
 
 // SequenceInfo has both the consumer and the stream sequence and last activity.
@@ -96,7 +131,26 @@ type CreateConsumerRequest struct {
 
 // ConsumerNakOptions is for optional NAK values, e.g. delay.
 type ConsumerNakOptions struct {
-	Delay time.Duration `json:"delay"`
+	Delay  time.Duration `json:"delay"`
+	Reason string        `json:"reason,omitempty"`
+}
+
+// DeadLetter is where a consumer copies messages that have exhausted MaxDeliver or have been
+// terminated. The original message is published to the subject with headers describing where it
+// came from, so a stream capturing the subject can preserve it for later inspection or replay.
+// If a stream is named, only that stream will accept the message.
+type DeadLetter struct {
+	Stream  string `json:"stream,omitempty"`
+	Subject string `json:"subject"`
+}
+
+// HeaderPredicate matches a message header. With a value the header needs to be an exact match,
+// with a prefix the header needs to start with it, and with neither the header only needs to be present.
+// Messages that do not match are skipped and treated as acknowledged.
+type HeaderPredicate struct {
+	Header string `json:"header"`
+	Value  string `json:"value,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
 }
 
 // DeliverPolicy determines how the consumer should select the first message to deliver.
@@ -178,6 +232,44 @@ func (r ReplayPolicy) String() string {
 	}
 }
 
+// PartitionConfig is for key affinity on pull based consumers. Messages are assigned to a partition by
+// hashing wildcard tokens of their subject, the same as the partition() subject mapping function, and
+// each partition is pinned to one of the pull clients that are active. Pull clients are identified by
+// the reply subject of their requests, so each client should use a single inbox for all of its requests.
+type PartitionConfig struct {
+	// Subject is matched against message subjects, its wildcard tokens are used for the key.
+	Subject string `json:"subject"`
+	// Wildcards are the 1 based positions of the wildcard tokens in Subject that form the key.
+	Wildcards []int `json:"wildcards"`
+	// Partitions is the number of partitions to hash keys into.
+	Partitions int `json:"partitions"`
+	// Timeout is how long a client can go without pulling before its partitions move to others.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// PriorityPolicy determines how pull requests within a priority group are served.
+type PriorityPolicy int
+
+const (
+	// PriorityNone serves all pull requests in the order they were received.
+	PriorityNone PriorityPolicy = iota
+	// PriorityOverflow only serves requests asking for a minimum pending once that threshold is reached.
+	PriorityOverflow
+	// PriorityPinnedClient serves a single pinned client per group, with others taking over once it goes away.
+	PriorityPinnedClient
+)
+
+func (p PriorityPolicy) String() string {
+	switch p {
+	case PriorityOverflow:
+		return "overflow"
+	case PriorityPinnedClient:
+		return "pinned_client"
+	default:
+		return "none"
+	}
+}
+
 // OK
 const OK = "+OK"
 
@@ -223,10 +315,16 @@ type consumer struct {
 	qgroup            string
 	lss               *lastSeqSkipList
 	rlimit            *rate.Limiter
+	mlimit            *rate.Limiter
 	reqSub            *subscription
 	ackSub            *subscription
+	ackBatchSub       *subscription
 	ackReplyT         string
 	ackSubj           string
+	ackBatchSubj      string
+	dlSub             *subscription
+	dlReplyT          string
+	dlSubj            string
 	nextMsgSubj       string
 	maxp              int
 	pblimit           int
@@ -241,7 +339,15 @@ type consumer struct {
 	rdq               []uint64
 	rdqi              map[uint64]struct{}
 	rdc               map[uint64]uint64
+	nakr              map[uint64]string
 	maxdc             uint64
+	sched             *msgTimers
+	rtq               []uint64
+	schedTmr          *time.Timer
+	pauseUntil        time.Time
+	pauseTmr          *time.Timer
+	pinned            map[string]*pinnedClient
+	part              *partitioner
 	waiting           *waitQueue
 	cfg               ConsumerConfig
 	ici               *ConsumerInfo
@@ -249,6 +355,9 @@ type consumer struct {
 	active            bool
 	replay            bool
 	filterWC          bool
+	subjf             []string
+	subjfOverlap      bool
+	fpos              []filterPos
 	dtmr              *time.Timer
 	gwdtmr            *time.Timer
 	dthresh           time.Duration
@@ -268,7 +377,7 @@ type consumer struct {
 	node    RaftNode
 	infoSub *subscription
 	lqsent  time.Time
-	prm     map[string]struct{}
+	prm     map[string]*pullRequestState
 	prOk    bool
 
 	// R>1 proposals
@@ -340,6 +449,23 @@ func checkConsumerCfg(config *ConsumerConfig, lim *JSLimitOpts, cfg *StreamConfi
 		return NewJSConsumerDescriptionTooLongError(JSMaxDescriptionLen)
 	}
 
+	if metadataSize(config.Metadata) > JSMaxMetadataLen {
+		return NewJSConsumerMetadataLengthError(JSMaxMetadataLen)
+	}
+
+	// Consumers can run on a subset of the stream's peers, but not more.
+	sr := cfg.Replicas
+	if sr < 1 {
+		sr = 1
+	}
+	if config.Replicas < 0 || config.Replicas > sr {
+		return NewJSConsumerReplicasExceedsStreamError()
+	}
+	// Interest and work queue streams rely on all peers seeing the acks.
+	if config.Replicas > 0 && cfg.Retention != LimitsPolicy && config.Replicas != sr {
+		return NewJSConsumerReplicasShouldMatchStreamError()
+	}
+
 	// For now expect a literal subject if its not empty. Empty means work queue mode (pull mode).
 	if config.DeliverSubject != _EMPTY_ {
 		if !subjectIsLiteral(config.DeliverSubject) {
@@ -360,14 +486,14 @@ func checkConsumerCfg(config *ConsumerConfig, lim *JSLimitOpts, cfg *StreamConfi
 		if config.Heartbeat > 0 && config.Heartbeat < 100*time.Millisecond {
 			return NewJSConsumerSmallHeartbeatError()
 		}
+		if len(config.PriorityGroups) > 0 || config.PriorityPolicy != PriorityNone {
+			return NewJSConsumerPushWithPriorityGroupError()
+		}
 	} else {
 		// Pull mode / work queue mode require explicit ack.
 		if config.AckPolicy == AckNone {
 			return NewJSConsumerPullRequiresAckError()
 		}
-		if config.RateLimit > 0 {
-			return NewJSConsumerPullWithRateLimitError()
-		}
 		if config.MaxWaiting < 0 {
 			return NewJSConsumerMaxWaitingNegativeError()
 		}
@@ -398,6 +524,16 @@ func checkConsumerCfg(config *ConsumerConfig, lim *JSLimitOpts, cfg *StreamConfi
 		}
 	}
 
+	// Priority groups need valid names and are required for a priority policy.
+	if config.PriorityPolicy != PriorityNone && len(config.PriorityGroups) == 0 {
+		return NewJSConsumerPriorityPolicyWithoutGroupError()
+	}
+	for _, group := range config.PriorityGroups {
+		if !isValidPriorityGroup(group) {
+			return NewJSConsumerInvalidGroupNameError()
+		}
+	}
+
 	// As best we can make sure the filtered subject is valid.
 	if config.FilterSubject != _EMPTY_ {
 		subjects, hasExt := allSubjects(cfg, acc)
@@ -406,6 +542,64 @@ func checkConsumerCfg(config *ConsumerConfig, lim *JSLimitOpts, cfg *StreamConfi
 		}
 	}
 
+	// Same for multiple filter subjects, which can not be combined with a single filter subject.
+	if len(config.FilterSubjects) > 0 {
+		if config.FilterSubject != _EMPTY_ {
+			return NewJSConsumerMultipleFiltersNotAllowedError()
+		}
+		subjects, hasExt := allSubjects(cfg, acc)
+		for _, filter := range config.FilterSubjects {
+			if !validFilteredSubject(filter, subjects) && !hasExt {
+				return NewJSConsumerFilterNotSubsetError()
+			}
+		}
+	}
+
+	// Check partitioned delivery.
+	if config.Partition != nil {
+		if config.DeliverSubject != _EMPTY_ {
+			return NewJSConsumerPartitionInvalidError(errors.New("push consumers can not be partitioned"))
+		}
+		if config.AckPolicy != AckExplicit {
+			return NewJSConsumerPartitionInvalidError(errors.New("ack policy must be explicit"))
+		}
+		if len(config.PriorityGroups) > 0 {
+			return NewJSConsumerPartitionInvalidError(errors.New("can not be combined with priority groups"))
+		}
+		if _, err := newPartitioner(config.Partition); err != nil {
+			return NewJSConsumerPartitionInvalidError(err)
+		}
+	}
+
+	// Check header filters.
+	for _, hp := range config.HeaderFilter {
+		if hp.Header == _EMPTY_ || strings.ContainsAny(hp.Header, ": \t\r\n") {
+			return NewJSConsumerHeaderFilterInvalidError(fmt.Errorf("invalid header name %q", hp.Header))
+		}
+		if hp.Value != _EMPTY_ && hp.Prefix != _EMPTY_ {
+			return NewJSConsumerHeaderFilterInvalidError(errors.New("value and prefix are mutually exclusive"))
+		}
+	}
+
+	// Check the dead letter destination.
+	if dl := config.DeadLetter; dl != nil {
+		if config.AckPolicy == AckNone {
+			return NewJSConsumerDeadLetterInvalidError(errors.New("ack policy none can not dead letter messages"))
+		}
+		if !IsValidLiteralSubject(dl.Subject) {
+			return NewJSConsumerDeadLetterInvalidError(errors.New("subject must be a valid literal subject"))
+		}
+		if deliveryFormsCycle(cfg, dl.Subject) {
+			return NewJSConsumerDeadLetterInvalidError(errors.New("subject forms a cycle"))
+		}
+		if subjectIsSubsetMatch(dl.Subject, "$JS.API.>") {
+			return NewJSConsumerDeadLetterInvalidError(errors.New("subject overlaps with jetstream api"))
+		}
+		if dl.Stream != _EMPTY_ && (!isValidName(dl.Stream) || dl.Stream == cfg.Name) {
+			return NewJSConsumerDeadLetterInvalidError(errors.New("invalid stream name"))
+		}
+	}
+
 	// Helper function to formulate similar errors.
 	badStart := func(dp, start string) error {
 		return fmt.Errorf("consumer delivery policy is deliver %s, but optional start %s is also set", dp, start)
@@ -437,7 +631,7 @@ func checkConsumerCfg(config *ConsumerConfig, lim *JSLimitOpts, cfg *StreamConfi
 		if config.OptStartTime != nil {
 			return NewJSConsumerInvalidPolicyError(badStart("last per subject", "time"))
 		}
-		if config.FilterSubject == _EMPTY_ {
+		if config.FilterSubject == _EMPTY_ && len(config.FilterSubjects) == 0 {
 			return NewJSConsumerInvalidPolicyError(notSet("last per subject", "filter subject"))
 		}
 	case DeliverNew:
@@ -569,10 +763,10 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 		}
 
 		if len(mset.consumers) > 0 {
-			if config.FilterSubject == _EMPTY_ {
+			if filters := config.filterSubjects(); len(filters) == 0 {
 				mset.mu.Unlock()
 				return nil, NewJSConsumerWQMultipleUnfilteredError()
-			} else if !mset.partitionUnique(config.FilterSubject) {
+			} else if !mset.partitionUnique(filters) {
 				// We have a partition but it is not unique amongst the others.
 				mset.mu.Unlock()
 				return nil, NewJSConsumerWQConsumerNotUniqueError()
@@ -633,11 +827,26 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 	if o.isPullMode() {
 		o.waiting = newWaitQueue(config.MaxWaiting)
 	}
+	// Config has been checked already.
+	if config.Partition != nil {
+		o.part, _ = newPartitioner(config.Partition)
+	}
 
 	// Check if we have  filtered subject that is a wildcard.
 	if config.FilterSubject != _EMPTY_ && subjectHasWildcard(config.FilterSubject) {
 		o.filterWC = true
 	}
+	// Multiple filters are reduced so that no message is matched or counted twice.
+	if len(config.FilterSubjects) > 0 {
+		o.subjf, o.subjfOverlap = reduceFilterSubjects(config.FilterSubjects)
+		if len(o.subjf) == 1 && subjectHasWildcard(o.subjf[0]) {
+			o.filterWC = true
+		} else if len(o.subjf) > 1 {
+			o.fpos = make([]filterPos, len(o.subjf))
+		}
+	} else if config.FilterSubject != _EMPTY_ {
+		o.subjf = []string{config.FilterSubject}
+	}
 
 	// already under lock, mset.Name() would deadlock
 	o.stream = mset.cfg.Name
@@ -697,7 +906,15 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 	pre := fmt.Sprintf(jsAckT, mn, o.name)
 	o.ackReplyT = fmt.Sprintf("%s.%%d.%%d.%%d.%%d.%%d", pre)
 	o.ackSubj = fmt.Sprintf("%s.*.*.*.*.*", pre)
+	// Batched acks for many stream sequences at once come in on the prefix itself.
+	o.ackBatchSubj = pre
 	o.nextMsgSubj = fmt.Sprintf(JSApiRequestNextT, mn, o.name)
+	// Dead lettered messages are published with a reply so we know when they were stored.
+	if config.DeadLetter != nil {
+		dlpre := fmt.Sprintf(jsDeadLetterAckT, mn, o.name)
+		o.dlReplyT = fmt.Sprintf("%s.%%d.%%d.%%d", dlpre)
+		o.dlSubj = fmt.Sprintf("%s.*.*.*", dlpre)
+	}
 
 	// If not durable determine the inactive threshold.
 	if !o.isDurable() {
@@ -727,8 +944,8 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 	}
 
 	// Check if we have a rate limit set.
-	if config.RateLimit != 0 {
-		o.setRateLimit(config.RateLimit)
+	if config.RateLimit != 0 || config.RateLimitMsgs != 0 {
+		o.setRateLimit(config.RateLimit, config.RateLimitMsgs)
 	}
 
 	mset.setConsumer(o)
@@ -826,6 +1043,9 @@ func (o *consumer) setLeader(isLeader bool) {
 		s, jsa, stream, lseq := mset.srv, mset.jsa, mset.cfg.Name, mset.lseq
 		mset.mu.RUnlock()
 
+		// Grab any scheduled messages that are not yet due.
+		sched := mset.store.MsgSchedules()
+
 		o.mu.Lock()
 		// Restore our saved state. During non-leader status we just update our underlying store.
 		o.readStoredState(lseq)
@@ -843,6 +1063,11 @@ func (o *consumer) setLeader(isLeader bool) {
 			o.deleteWithoutAdvisory()
 			return
 		}
+		if o.ackBatchSub, err = o.subscribeInternal(o.ackBatchSubj, o.pushAck); err != nil {
+			o.mu.Unlock()
+			o.deleteWithoutAdvisory()
+			return
+		}
 
 		// Setup the internal sub for next message requests regardless.
 		// Will error if wrong mode to provide feedback to users.
@@ -852,6 +1077,15 @@ func (o *consumer) setLeader(isLeader bool) {
 			return
 		}
 
+		// Publish acks for dead lettered messages.
+		if o.dlSubj != _EMPTY_ {
+			if o.dlSub, err = o.subscribeInternal(o.dlSubj, o.processDeadLetterAck); err != nil {
+				o.mu.Unlock()
+				o.deleteWithoutAdvisory()
+				return
+			}
+		}
+
 		// Check on flow control settings.
 		if o.cfg.FlowControl {
 			o.setMaxPendingBytes(JsFlowControlMaxPending)
@@ -866,6 +1100,17 @@ func (o *consumer) setLeader(isLeader bool) {
 		// Setup initial pending and proper start sequence.
 		o.setInitialPendingAndStart()
 
+		// Pick back up any messages held back for partitions or schedules.
+		o.restoreHeld(sched)
+
+		// Pins are replicated, so give pinned clients the full TTL to find us.
+		for _, pin := range o.pinned {
+			pin.last = time.Now()
+		}
+
+		// If we are paused make sure we resume on time.
+		o.setPauseTimer()
+
 		// If push mode, register for notifications on interest.
 		if o.isPushMode() {
 			o.inch = make(chan bool, 8)
@@ -923,9 +1168,11 @@ func (o *consumer) setLeader(isLeader bool) {
 		o.mu.Lock()
 		// ok if they are nil, we protect inside unsubscribe()
 		o.unsubscribe(o.ackSub)
+		o.unsubscribe(o.ackBatchSub)
 		o.unsubscribe(o.reqSub)
 		o.unsubscribe(o.fcSub)
-		o.ackSub, o.reqSub, o.fcSub = nil, nil, nil
+		o.unsubscribe(o.dlSub)
+		o.ackSub, o.ackBatchSub, o.reqSub, o.fcSub, o.dlSub = nil, nil, nil, nil, nil
 		if o.infoSub != nil {
 			o.srv.sysUnsubscribe(o.infoSub)
 			o.infoSub = nil
@@ -938,6 +1185,13 @@ func (o *consumer) setLeader(isLeader bool) {
 		if o.isPullMode() {
 			o.waiting = newWaitQueue(o.cfg.MaxWaiting)
 		}
+		// The next leader will pick these back up from the stream.
+		o.sched, o.rtq = nil, nil
+		if o.part != nil {
+			o.part.reset()
+		}
+		stopAndClearTimer(&o.schedTmr)
+		stopAndClearTimer(&o.pauseTmr)
 		o.mu.Unlock()
 	}
 }
@@ -1261,14 +1515,19 @@ func (o *consumer) setRateLimitNeedsLocks() {
 
 	mset.mu.RLock()
 	o.mu.Lock()
-	o.setRateLimit(o.cfg.RateLimit)
+	o.setRateLimit(o.cfg.RateLimit, o.cfg.RateLimitMsgs)
 	o.mu.Unlock()
 	mset.mu.RUnlock()
 }
 
-// Set the rate limiter
+// Set the rate limiters, for bits and messages per second. Applies to push and pull delivery.
 // Both mset and consumer lock should be held.
-func (o *consumer) setRateLimit(bps uint64) {
+func (o *consumer) setRateLimit(bps, mps uint64) {
+	if mps == 0 {
+		o.mlimit = nil
+	} else {
+		o.mlimit = rate.NewLimiter(rate.Limit(mps), 1)
+	}
 	if bps == 0 {
 		o.rlimit = nil
 		return
@@ -1302,6 +1561,24 @@ func (acc *Account) checkNewConsumerConfig(cfg, ncfg *ConsumerConfig) error {
 	if cfg.FilterSubject != ncfg.FilterSubject {
 		return errors.New("filter subject can not be updated")
 	}
+	if !reflect.DeepEqual(cfg.FilterSubjects, ncfg.FilterSubjects) {
+		return errors.New("filter subjects can not be updated")
+	}
+	if !reflect.DeepEqual(cfg.PriorityGroups, ncfg.PriorityGroups) || cfg.PriorityPolicy != ncfg.PriorityPolicy {
+		return errors.New("priority groups can not be updated")
+	}
+	if !reflect.DeepEqual(cfg.Partition, ncfg.Partition) {
+		return errors.New("partition can not be updated")
+	}
+	if !reflect.DeepEqual(cfg.HeaderFilter, ncfg.HeaderFilter) {
+		return errors.New("header filter can not be updated")
+	}
+	if cfg.Replicas != ncfg.Replicas {
+		return errors.New("replicas can not be updated")
+	}
+	if cfg.MemoryStorage != ncfg.MemoryStorage {
+		return errors.New("storage type can not be updated")
+	}
 	if cfg.DeliverPolicy != ncfg.DeliverPolicy {
 		return errors.New("deliver policy can not be updated")
 	}
@@ -1374,7 +1651,7 @@ func (o *consumer) updateConfig(cfg *ConsumerConfig) error {
 		}
 	}
 	// Rate Limit
-	if cfg.RateLimit != o.cfg.RateLimit {
+	if cfg.RateLimit != o.cfg.RateLimit || cfg.RateLimitMsgs != o.cfg.RateLimitMsgs {
 		// We need both locks here so do in Go routine.
 		go o.setRateLimitNeedsLocks()
 	}
@@ -1387,7 +1664,7 @@ func (o *consumer) updateConfig(cfg *ConsumerConfig) error {
 	}
 
 	// Record new config for others that do not need special handling.
-	// Allowed but considered no-op, [Description, MaxDeliver, SampleFrequency, MaxWaiting, HeadersOnly]
+	// Allowed but considered no-op, [Description, Metadata, MaxDeliver, SampleFrequency, MaxWaiting, HeadersOnly]
 	o.cfg = *cfg
 
 	return nil
@@ -1483,6 +1760,22 @@ func (o *consumer) processAck(subject, reply string, hdr int, rmsg []byte) {
 		msg = rmsg
 	}
 
+	// Batched acks with ranges of stream sequences.
+	if subject == o.ackBatchSubj {
+		if !bytes.HasPrefix(msg, AckAck) {
+			return
+		}
+		ranges, err := parseAckRanges(msg[len(AckAck):])
+		if err != nil {
+			return
+		}
+		o.processAckBatch(ranges)
+		if len(reply) > 0 {
+			o.sendAckReply(reply)
+		}
+		return
+	}
+
 	sseq, dseq, dc := ackReplyInfo(subject)
 
 	skipAckReply := sseq == 0
@@ -1498,8 +1791,8 @@ func (o *consumer) processAck(subject, reply string, hdr int, rmsg []byte) {
 		o.processNak(sseq, dseq, dc, msg)
 	case bytes.Equal(msg, AckProgress):
 		o.progressUpdate(sseq)
-	case bytes.Equal(msg, AckTerm):
-		o.processTerm(sseq, dseq, dc)
+	case bytes.HasPrefix(msg, AckTerm):
+		o.processTerm(sseq, dseq, dc, string(bytes.TrimSpace(msg[len(AckTerm):])))
 	}
 
 	// Ack the ack if requested.
@@ -1623,6 +1916,25 @@ func (o *consumer) updateDelivered(dseq, sseq, dc uint64, ts int64) {
 	o.ldt = time.Now()
 }
 
+// Track a message held back for a partition or schedule, or released, so a new leader can pick it back up.
+// Lock should be held.
+func (o *consumer) updateHeld(sseq uint64, held bool) {
+	if o.node != nil {
+		var b [binary.MaxVarintLen64 + 2]byte
+		b[0] = byte(updateHeldOp)
+		n := 1
+		n += binary.PutUvarint(b[n:], sseq)
+		if held {
+			b[n] = 1
+		}
+		n++
+		o.propose(b[:n])
+	}
+	if o.store != nil {
+		o.store.UpdateHeld(sseq, held)
+	}
+}
+
 // Lock should be held.
 func (o *consumer) updateAcks(dseq, sseq uint64) {
 	if o.node != nil {
@@ -1640,15 +1952,55 @@ func (o *consumer) updateAcks(dseq, sseq uint64) {
 	o.lat = time.Now()
 }
 
-// Communicate to the cluster an addition of a pending request.
+// updateAcksBatch will record a batch of acks, sending them to our peers as a single proposal.
+// Lock should be held.
+func (o *consumer) updateAcksBatch(acks []SequencePair) {
+	if o.node != nil {
+		b := make([]byte, 1+(1+2*len(acks))*binary.MaxVarintLen64)
+		b[0] = byte(updateAcksBatchOp)
+		n := 1
+		n += binary.PutUvarint(b[n:], uint64(len(acks)))
+		for _, ack := range acks {
+			n += binary.PutUvarint(b[n:], ack.Consumer)
+			n += binary.PutUvarint(b[n:], ack.Stream)
+		}
+		o.propose(b[:n])
+	} else if o.store != nil {
+		for _, ack := range acks {
+			o.store.UpdateAcks(ack.Consumer, ack.Stream)
+		}
+	}
+	// Update activity.
+	o.lat = time.Now()
+}
+
+// pullRequestState is what we replicate for pending requests with max bytes or a priority group,
+// so that a new leader can continue to serve them within their limits.
+type pullRequestState struct {
+	Reply     string         `json:"reply"`
+	Batch     int            `json:"batch"`
+	MaxBytes  int            `json:"max_bytes,omitempty"`
+	Expires   time.Time      `json:"expires,omitempty"`
+	Heartbeat time.Duration  `json:"idle_heartbeat,omitempty"`
+	NoWait    bool           `json:"no_wait,omitempty"`
+	Group     *PriorityGroup `json:"group,omitempty"`
+}
+
+// Communicate to the cluster an addition of a pending request, or its remaining limits.
 // Lock should be held.
-func (o *consumer) addClusterPendingRequest(reply string) {
+func (o *consumer) addClusterPendingRequest(wr *waitingRequest) {
 	if o.node == nil || !o.pendingRequestsOk() {
 		return
 	}
-	b := make([]byte, len(reply)+1)
+	if wr.b > 0 || wr.pg != nil {
+		prs := &pullRequestState{wr.reply, wr.n, wr.b, wr.expires, wr.hb, wr.noWait, wr.pg}
+		b, _ := json.Marshal(prs)
+		o.propose(append([]byte{byte(addPendingRequestState)}, b...))
+		return
+	}
+	b := make([]byte, len(wr.reply)+1)
 	b[0] = byte(addPendingRequest)
-	copy(b[1:], reply)
+	copy(b[1:], wr.reply)
 	o.propose(b)
 }
 
@@ -1703,6 +2055,7 @@ func (o *consumer) checkAndSetPendingRequestsOk() {
 }
 
 // On leadership change make sure we alert the pending requests that they are no longer valid.
+// Requests with max bytes or a priority group are picked back up with their remaining limits.
 func (o *consumer) checkPendingRequests() {
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -1710,10 +2063,62 @@ func (o *consumer) checkPendingRequests() {
 		return
 	}
 	hdr := []byte("NATS/1.0 409 Leadership Change\r\n\r\n")
-	for reply := range o.prm {
-		o.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+	now := time.Now()
+	var restored bool
+	for reply, prs := range o.prm {
+		if prs == nil || o.waiting == nil || (!prs.Expires.IsZero() && now.After(prs.Expires)) {
+			o.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+			continue
+		}
+		wr := wrPool.Get().(*waitingRequest)
+		wr.acc, wr.interest, wr.reply, wr.n, wr.d, wr.noWait, wr.expires, wr.hb = o.acc, reply, reply, prs.Batch, 0, prs.NoWait, prs.Expires, prs.Heartbeat
+		wr.b, wr.pg, wr.received, wr.hbt = prs.MaxBytes, prs.Group, now, time.Time{}
+		if wr.hb > 0 {
+			wr.hbt = now.Add(wr.hb)
+		}
+		if err := o.waiting.add(wr); err != nil {
+			wr.recycle()
+			o.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+			continue
+		}
+		o.addClusterPendingRequest(wr)
+		restored = true
 	}
 	o.prm = nil
+	if restored {
+		o.signalNewMessages()
+	}
+}
+
+// Communicate to the cluster the client pinned for a priority group, or that the pin was released.
+// Lock should be held.
+func (o *consumer) updateClusterPinned(group, id string) {
+	if o.node == nil {
+		return
+	}
+	b := make([]byte, 0, 2+len(group)+len(id))
+	b = append(b, byte(updatePinnedOp), byte(len(group)))
+	b = append(b, group...)
+	b = append(b, id...)
+	o.propose(b)
+}
+
+// Apply a replicated pin for a priority group.
+// Lock should be held.
+func (o *consumer) applyPinned(buf []byte) error {
+	if len(buf) < 1 || len(buf) < 1+int(buf[0]) {
+		return errCorruptState
+	}
+	group, id := string(buf[1:1+buf[0]]), string(buf[1+buf[0]:])
+	if id == _EMPTY_ {
+		delete(o.pinned, group)
+		return nil
+	}
+	if o.pinned == nil {
+		o.pinned = make(map[string]*pinnedClient)
+	}
+	o.pinned[group] = &pinnedClient{id: id, last: time.Now()}
+	return nil
 }
 
 // Process a NAK.
@@ -1731,7 +2136,7 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 			return
 		}
 	}
-	// Check to see if we have delays attached.
+	// Check to see if we have delays or a reason attached.
 	if len(nak) > len(AckNak) {
 		arg := bytes.TrimSpace(nak[len(AckNak):])
 		if len(arg) > 0 {
@@ -1741,6 +2146,7 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 				var nd ConsumerNakOptions
 				if err = json.Unmarshal(arg, &nd); err == nil {
 					d = nd.Delay
+					o.setNakReason(sseq, nd.Reason)
 				}
 			} else {
 				d, err = time.ParseDuration(string(arg))
@@ -1778,9 +2184,20 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 }
 
 // Process a TERM
-func (o *consumer) processTerm(sseq, dseq, dc uint64) {
+func (o *consumer) processTerm(sseq, dseq, dc uint64, reason string) {
+	// Dead letter first, since the ack will remove the message from a work queue stream.
+	// If dead lettered the ack happens once the message has been stored.
+	var dl bool
+	o.mu.Lock()
+	if _, ok := o.pending[sseq]; ok {
+		dl = o.deadLetter(sseq, dseq, dc, deadLetterTerminated, reason)
+	}
+	o.mu.Unlock()
+
 	// Treat like an ack to suppress redelivery.
-	o.processAckMsg(sseq, dseq, dc, false)
+	if !dl {
+		o.processAckMsg(sseq, dseq, dc, false)
+	}
 
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -1797,6 +2214,7 @@ func (o *consumer) processTerm(sseq, dseq, dc uint64) {
 		ConsumerSeq: dseq,
 		StreamSeq:   sseq,
 		Deliveries:  dc,
+		Reason:      reason,
 		Domain:      o.srv.getOpts().JetStreamDomain,
 	}
 
@@ -1847,6 +2265,12 @@ func (o *consumer) readStoredState(slseq uint64) error {
 		return nil
 	}
 	state, err := o.store.State()
+	if err == nil && state != nil {
+		o.pauseUntil = time.Time{}
+		if state.PauseUntil != nil {
+			o.pauseUntil = *state.PauseUntil
+		}
+	}
 	if err == nil && state != nil && (state.Delivered.Consumer != 0 || state.Delivered.Stream != 0) {
 		o.applyState(state)
 		if len(o.rdc) > 0 {
@@ -2017,6 +2441,16 @@ func (o *consumer) infoWithSnap(snap bool) *ConsumerInfo {
 		PushBound:      o.isPushMode() && o.active,
 		Cluster:        ci,
 	}
+	if o.isPaused() {
+		info.Paused, info.PauseRemaining = true, time.Until(o.pauseUntil)
+	}
+	for _, group := range o.cfg.PriorityGroups {
+		pgs := PriorityGroupState{Group: group}
+		if pin := o.pinned[group]; pin != nil {
+			pgs.PinnedClientID = pin.id
+		}
+		info.PriorityGroups = append(info.PriorityGroups, pgs)
+	}
 	// Adjust active based on non-zero etc. Also make UTC here.
 	if !o.ldt.IsZero() {
 		ldt := o.ldt.UTC() // This copies as well.
@@ -2040,50 +2474,92 @@ func (o *consumer) infoWithSnap(snap bool) *ConsumerInfo {
 	return info
 }
 
-// Will signal us that new messages are available. Will break out of waiting.
-func (o *consumer) signalNewMessages() {
-	// Kick our new message channel
-	select {
-	case o.mch <- struct{}{}:
-	default:
-	}
+// isPaused returns true if delivery has been paused.
+// Lock should be held.
+func (o *consumer) isPaused() bool {
+	return !o.pauseUntil.IsZero() && time.Now().Before(o.pauseUntil)
 }
 
-// shouldSample lets us know if we are sampling metrics on acks.
-func (o *consumer) shouldSample() bool {
-	switch {
-	case o.sfreq <= 0:
-		return false
-	case o.sfreq >= 100:
-		return true
+// pause will stop delivery until the given time, a zero or past time will resume delivery.
+// Ack state is unaffected. The change is replicated to our peers and an advisory is sent.
+// Lock should be held.
+func (o *consumer) pause(until time.Time) {
+	if !until.IsZero() && !time.Now().Before(until) {
+		until = time.Time{}
+	}
+	o.applyPause(until)
+	if o.node != nil {
+		var ts int64
+		if !until.IsZero() {
+			ts = until.UnixNano()
+		}
+		var b [1 + binary.MaxVarintLen64]byte
+		b[0] = byte(updatePauseOp)
+		n := 1 + binary.PutVarint(b[1:], ts)
+		o.propose(b[:n])
 	}
+	o.setPauseTimer()
+	o.sendPauseAdvisoryLocked()
+	if until.IsZero() {
+		o.signalNewMessages()
+	}
+}
 
-	// TODO(ripienaar) this is a tad slow so we need to rethink here, however this will only
-	// hit for those with sampling enabled and its not the default
-	return rand.Int31n(100) <= o.sfreq
+// applyPause records the pause deadline, including in our store so it survives restarts and leader changes.
+// Lock should be held.
+func (o *consumer) applyPause(until time.Time) {
+	o.pauseUntil = until
+	if o.store == nil {
+		return
+	}
+	state, err := o.store.State()
+	if err != nil || state == nil {
+		return
+	}
+	if until.IsZero() {
+		state.PauseUntil = nil
+	} else {
+		pu := until.UTC()
+		state.PauseUntil = &pu
+	}
+	o.store.Update(state)
 }
 
-func (o *consumer) sampleAck(sseq, dseq, dc uint64) {
-	if !o.shouldSample() {
+// setPauseTimer will make sure we resume delivery when our pause expires.
+// Lock should be held.
+func (o *consumer) setPauseTimer() {
+	stopAndClearTimer(&o.pauseTmr)
+	if o.pauseUntil.IsZero() || !o.isLeader() {
 		return
 	}
+	o.pauseTmr = time.AfterFunc(time.Until(o.pauseUntil), o.checkPauseExpired)
+}
 
-	now := time.Now().UTC()
-	unow := now.UnixNano()
+// checkPauseExpired is called from our pause timer to resume delivery.
+func (o *consumer) checkPauseExpired() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.pauseUntil.IsZero() || o.isPaused() || o.mset == nil || !o.isLeader() {
+		return
+	}
+	o.pause(time.Time{})
+}
 
-	e := JSConsumerAckMetric{
+// Lock should be held.
+func (o *consumer) sendPauseAdvisoryLocked() {
+	e := JSConsumerPauseAdvisory{
 		TypedEvent: TypedEvent{
-			Type: JSConsumerAckMetricType,
+			Type: JSConsumerPauseAdvisoryType,
 			ID:   nuid.Next(),
-			Time: now,
+			Time: time.Now().UTC(),
 		},
-		Stream:      o.stream,
-		Consumer:    o.name,
-		ConsumerSeq: dseq,
-		StreamSeq:   sseq,
-		Delay:       unow - o.pending[sseq].Timestamp,
-		Deliveries:  dc,
-		Domain:      o.srv.getOpts().JetStreamDomain,
+		Stream:   o.stream,
+		Consumer: o.name,
+		Paused:   !o.pauseUntil.IsZero(),
+		Domain:   o.srv.getOpts().JetStreamDomain,
+	}
+	if e.Paused {
+		e.PauseUntil = o.pauseUntil.UTC()
 	}
 
 	j, err := json.Marshal(e)
@@ -2091,30 +2567,182 @@ func (o *consumer) sampleAck(sseq, dseq, dc uint64) {
 		return
 	}
 
-	o.sendAdvisory(o.ackEventT, j)
+	subj := JSAdvisoryConsumerPausePre + "." + o.stream + "." + o.name
+	o.sendAdvisory(subj, j)
 }
 
-func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
-	o.mu.Lock()
-	var sagap uint64
-	var needSignal bool
+// reset will move delivery to the given stream sequence, dropping all pending and redelivery state.
+// The consumer sequence keeps going up so acks for messages delivered before the reset are ignored.
+// The change is replicated to our peers and an advisory is sent. Returns the sequence we will deliver next.
+// Lock should be held.
+func (o *consumer) reset(sseq uint64) uint64 {
+	if o.mset == nil || o.mset.store == nil {
+		return 0
+	}
+	var state StreamState
+	o.mset.store.FastState(&state)
+	if sseq < state.FirstSeq {
+		sseq = state.FirstSeq
+	} else if sseq > state.LastSeq {
+		sseq = state.LastSeq + 1
+	}
+	if sseq == 0 {
+		sseq = 1
+	}
+	o.applyReset(sseq, o.dseq)
+	if o.node != nil {
+		var b [1 + 2*binary.MaxVarintLen64]byte
+		b[0] = byte(resetSeqOp)
+		n := 1
+		n += binary.PutUvarint(b[n:], sseq)
+		n += binary.PutUvarint(b[n:], o.dseq)
+		o.propose(b[:n])
+	}
+	o.sendResetAdvisoryLocked()
+	o.signalNewMessages()
+	return sseq
+}
 
-	switch o.cfg.AckPolicy {
-	case AckExplicit:
-		if p, ok := o.pending[sseq]; ok {
-			if doSample {
-				o.sampleAck(sseq, dseq, dc)
-			}
-			if o.maxp > 0 && len(o.pending) >= o.maxp {
-				needSignal = true
-			}
-			delete(o.pending, sseq)
-			// Use the original deliver sequence from our pending record.
-			dseq = p.Sequence
-		}
-		if len(o.pending) == 0 {
-			o.adflr, o.asflr = o.dseq-1, o.sseq-1
-		} else if dseq == o.adflr+1 {
+// applyReset moves our starting sequences and clears all pending and redelivery state, including in our store.
+// Lock should be held.
+func (o *consumer) applyReset(sseq, dseq uint64) {
+	o.sseq, o.dseq = sseq, dseq
+	o.asflr = sseq - 1
+	o.adflr = o.dseq - 1
+	o.lss = nil
+	o.pending, o.rdc, o.nakr = nil, nil, nil
+	o.rdq, o.rdqi = nil, nil
+	o.sched, o.rtq = nil, nil
+	stopAndClearTimer(&o.schedTmr)
+	stopAndClearTimer(&o.ptmr)
+	if o.part != nil {
+		o.part.reset()
+	}
+
+	// Recalculate our pending from the new starting sequence.
+	o.sgap, o.lsgap = 0, 0
+	if o.mset != nil && o.mset.store != nil {
+		var ss SimpleState
+		if len(o.subjf) > 0 {
+			ss = o.filteredState(sseq)
+		} else {
+			ss = o.mset.store.FilteredState(sseq, _EMPTY_)
+		}
+		o.sgap, o.lsgap = ss.Msgs, ss.Last
+	}
+
+	if o.store == nil {
+		return
+	}
+	state := &ConsumerState{
+		Delivered: SequencePair{Consumer: o.dseq - 1, Stream: sseq - 1},
+		AckFloor:  SequencePair{Consumer: o.dseq - 1, Stream: sseq - 1},
+	}
+	if !o.pauseUntil.IsZero() {
+		pu := o.pauseUntil.UTC()
+		state.PauseUntil = &pu
+	}
+	o.store.Update(state)
+}
+
+// Lock should be held.
+func (o *consumer) sendResetAdvisoryLocked() {
+	e := JSConsumerResetAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerResetAdvisoryType,
+			ID:   nuid.Next(),
+			Time: time.Now().UTC(),
+		},
+		Stream:   o.stream,
+		Consumer: o.name,
+		Seq:      o.sseq,
+		Domain:   o.srv.getOpts().JetStreamDomain,
+	}
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	subj := JSAdvisoryConsumerResetPre + "." + o.stream + "." + o.name
+	o.sendAdvisory(subj, j)
+}
+
+// Will signal us that new messages are available. Will break out of waiting.
+func (o *consumer) signalNewMessages() {
+	// Kick our new message channel
+	select {
+	case o.mch <- struct{}{}:
+	default:
+	}
+}
+
+// shouldSample lets us know if we are sampling metrics on acks.
+func (o *consumer) shouldSample() bool {
+	switch {
+	case o.sfreq <= 0:
+		return false
+	case o.sfreq >= 100:
+		return true
+	}
+
+	// TODO(ripienaar) this is a tad slow so we need to rethink here, however this will only
+	// hit for those with sampling enabled and its not the default
+	return rand.Int31n(100) <= o.sfreq
+}
+
+func (o *consumer) sampleAck(sseq, dseq, dc uint64) {
+	if !o.shouldSample() {
+		return
+	}
+
+	now := time.Now().UTC()
+	unow := now.UnixNano()
+
+	e := JSConsumerAckMetric{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerAckMetricType,
+			ID:   nuid.Next(),
+			Time: now,
+		},
+		Stream:      o.stream,
+		Consumer:    o.name,
+		ConsumerSeq: dseq,
+		StreamSeq:   sseq,
+		Delay:       unow - o.pending[sseq].Timestamp,
+		Deliveries:  dc,
+		Domain:      o.srv.getOpts().JetStreamDomain,
+	}
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	o.sendAdvisory(o.ackEventT, j)
+}
+
+func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
+	o.mu.Lock()
+	var sagap uint64
+	var needSignal bool
+
+	switch o.cfg.AckPolicy {
+	case AckExplicit:
+		if p, ok := o.pending[sseq]; ok {
+			if doSample {
+				o.sampleAck(sseq, dseq, dc)
+			}
+			if o.maxp > 0 && len(o.pending) >= o.maxp {
+				needSignal = true
+			}
+			delete(o.pending, sseq)
+			// Use the original deliver sequence from our pending record.
+			dseq = p.Sequence
+		}
+		if len(o.pending) == 0 {
+			o.adflr, o.asflr = o.dseq-1, o.sseq-1
+		} else if dseq == o.adflr+1 {
 			o.adflr, o.asflr = dseq, sseq
 			for ss := sseq + 1; ss < o.sseq; ss++ {
 				if p, ok := o.pending[ss]; ok {
@@ -2125,8 +2753,13 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 				}
 			}
 		}
+		// Do not move past any scheduled or partitioned messages we are holding back.
+		if first := o.firstHeldBack(); first > 0 && first <= o.asflr {
+			o.asflr = first - 1
+		}
 		// We do these regardless.
 		delete(o.rdc, sseq)
+		delete(o.nakr, sseq)
 		o.removeFromRedeliverQueue(sseq)
 	case AckAll:
 		// no-op
@@ -2142,8 +2775,13 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 		for seq := sseq; seq > sseq-sagap; seq-- {
 			delete(o.pending, seq)
 			delete(o.rdc, seq)
+			delete(o.nakr, seq)
 			o.removeFromRedeliverQueue(seq)
 		}
+		// Do not move past any scheduled or partitioned messages we are holding back.
+		if first := o.firstHeldBack(); first > 0 && first <= o.asflr {
+			o.asflr = first - 1
+		}
 	case AckNone:
 		// FIXME(dlc) - This is error but do we care?
 		o.mu.Unlock()
@@ -2177,11 +2815,169 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 	}
 }
 
+// seqRange is an inclusive range of stream sequences.
+type seqRange struct {
+	first, last uint64
+}
+
+// Maximum number of ranges we will accept in a single batched ack.
+const maxAckRanges = 4096
+
+var errBadAckRanges = errors.New("invalid ack ranges")
+
+// parseAckRanges parses a comma separated list of stream sequences and inclusive ranges, e.g. "100-250,260".
+func parseAckRanges(b []byte) ([]seqRange, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, errBadAckRanges
+	}
+	var ranges []seqRange
+	for _, tok := range bytes.Split(b, []byte(",")) {
+		if len(ranges) >= maxAckRanges {
+			return nil, errBadAckRanges
+		}
+		var first, last uint64
+		var err error
+		if i := bytes.IndexByte(tok, '-'); i >= 0 {
+			if first, err = strconv.ParseUint(string(bytes.TrimSpace(tok[:i])), 10, 64); err != nil {
+				return nil, errBadAckRanges
+			}
+			if last, err = strconv.ParseUint(string(bytes.TrimSpace(tok[i+1:])), 10, 64); err != nil {
+				return nil, errBadAckRanges
+			}
+		} else {
+			if first, err = strconv.ParseUint(string(bytes.TrimSpace(tok)), 10, 64); err != nil {
+				return nil, errBadAckRanges
+			}
+			last = first
+		}
+		if first == 0 || last < first {
+			return nil, errBadAckRanges
+		}
+		ranges = append(ranges, seqRange{first, last})
+	}
+	return ranges, nil
+}
+
+// processAckBatch acknowledges all pending messages whose stream sequences are in the given ranges.
+// The acks are applied in one pass and sent to the store or our peers as a single update.
+func (o *consumer) processAckBatch(ranges []seqRange) {
+	o.mu.Lock()
+	if o.cfg.AckPolicy == AckNone || len(o.pending) == 0 {
+		o.mu.Unlock()
+		return
+	}
+
+	// Collect what is pending in the ranges, walking whichever is smaller.
+	var scan bool
+	var total uint64
+	for _, r := range ranges {
+		n := r.last - r.first + 1
+		if n == 0 || n > uint64(len(o.pending))-total {
+			scan = true
+			break
+		}
+		total += n
+	}
+	var acks []SequencePair
+	if scan {
+		for seq, p := range o.pending {
+			for _, r := range ranges {
+				if seq >= r.first && seq <= r.last {
+					acks = append(acks, SequencePair{p.Sequence, seq})
+					break
+				}
+			}
+		}
+	} else {
+		for _, r := range ranges {
+			for seq := r.first; seq <= r.last; seq++ {
+				if p, ok := o.pending[seq]; ok {
+					acks = append(acks, SequencePair{p.Sequence, seq})
+				}
+			}
+		}
+	}
+	if len(acks) == 0 {
+		o.mu.Unlock()
+		return
+	}
+	sort.Slice(acks, func(i, j int) bool { return acks[i].Stream < acks[j].Stream })
+	// Remove any duplicates from overlapping ranges.
+	if !scan {
+		n := 1
+		for i := 1; i < len(acks); i++ {
+			if acks[i].Stream != acks[n-1].Stream {
+				acks[n] = acks[i]
+				n++
+			}
+		}
+		acks = acks[:n]
+	}
+
+	// For AckAll the highest sequence acknowledges everything below it.
+	if o.cfg.AckPolicy == AckAll {
+		last := acks[len(acks)-1]
+		o.mu.Unlock()
+		o.processAckMsg(last.Stream, last.Consumer, 1, true)
+		return
+	}
+
+	needSignal := o.maxp > 0 && len(o.pending) >= o.maxp
+	for _, ack := range acks {
+		sseq := ack.Stream
+		o.sampleAck(sseq, ack.Consumer, o.rdc[sseq]+1)
+		delete(o.pending, sseq)
+		delete(o.rdc, sseq)
+		delete(o.nakr, sseq)
+		o.removeFromRedeliverQueue(sseq)
+	}
+
+	// Move our ack floor up to the first message still pending.
+	if len(o.pending) == 0 {
+		o.adflr, o.asflr = o.dseq-1, o.sseq-1
+	} else {
+		var first uint64
+		for seq := range o.pending {
+			if first == 0 || seq < first {
+				first = seq
+			}
+		}
+		if p := o.pending[first]; first-1 > o.asflr && p.Sequence > 0 {
+			o.adflr, o.asflr = p.Sequence-1, first-1
+		}
+	}
+	// Do not move past any scheduled or partitioned messages we are holding back.
+	if first := o.firstHeldBack(); first > 0 && first <= o.asflr {
+		o.asflr = first - 1
+	}
+
+	// Update underlying store.
+	o.updateAcksBatch(acks)
+
+	mset := o.mset
+	clustered := o.node != nil
+	o.mu.Unlock()
+
+	// Let the owning stream know if we are interest or workqueue retention based.
+	// If this consumer is clustered this will be handled by processReplicatedAcks
+	// after the acks have propagated.
+	if !clustered && mset != nil && mset.cfg.Retention != LimitsPolicy {
+		for _, ack := range acks {
+			mset.ackMsg(o, ack.Stream)
+		}
+	}
+
+	if needSignal {
+		o.signalNewMessages()
+	}
+}
+
 // Determine if this is a truly filtered consumer. Modern clients will place filtered subjects
 // even if the stream only has a single non-wildcard subject designation.
 // Read lock should be held.
 func (o *consumer) isFiltered() bool {
-	if o.cfg.FilterSubject == _EMPTY_ {
+	if len(o.subjf) == 0 {
 		return false
 	}
 	// If we are here we want to check if the filtered subject is
@@ -2190,10 +2986,10 @@ func (o *consumer) isFiltered() bool {
 	if mset == nil {
 		return true
 	}
-	if len(mset.cfg.Subjects) > 1 {
+	if len(mset.cfg.Subjects) > 1 || len(o.subjf) > 1 {
 		return true
 	}
-	return o.cfg.FilterSubject != mset.cfg.Subjects[0]
+	return o.subjf[0] != mset.cfg.Subjects[0]
 }
 
 // Check if we need an ack for this store seq.
@@ -2205,18 +3001,19 @@ func (o *consumer) needAck(sseq uint64) bool {
 	o.mu.RLock()
 
 	// Check first if we are filtered, and if so check if this is even applicable to us.
-	if o.isFiltered() && o.mset != nil {
+	if filtered, hfiltered := o.isFiltered(), len(o.cfg.HeaderFilter) > 0; (filtered || hfiltered) && o.mset != nil {
 		var svp StoreMsg
 		sm, err := o.mset.store.LoadMsg(sseq, &svp)
-		if err != nil || !o.isFilteredMatch(sm.subj) {
+		if err != nil || (filtered && !o.isFilteredMatch(sm.subj)) || (hfiltered && !o.isHeaderFilterMatch(sm.hdr)) {
 			o.mu.RUnlock()
 			return false
 		}
 	}
 
+	var sched *msgTimers
 	if o.isLeader() {
 		asflr, osseq = o.asflr, o.sseq
-		pending = o.pending
+		pending, sched = o.pending, o.sched
 	} else {
 		if o.store == nil {
 			o.mu.RUnlock()
@@ -2245,6 +3042,10 @@ func (o *consumer) needAck(sseq uint64) bool {
 				} else {
 					_, needAck = pending[sseq]
 				}
+				// Scheduled messages we are holding back still need to be delivered.
+				if !needAck && sched != nil {
+					_, needAck = sched.get(sseq)
+				}
 			}
 		}
 	}
@@ -2253,36 +3054,43 @@ func (o *consumer) needAck(sseq uint64) bool {
 }
 
 // Helper for the next message requests.
-func nextReqFromMsg(msg []byte) (time.Time, int, bool, time.Duration, time.Time, error) {
+func nextReqFromMsg(msg []byte) (time.Time, int, int, bool, time.Duration, time.Time, *PriorityGroup, error) {
 	req := bytes.TrimSpace(msg)
 
 	switch {
 	case len(req) == 0:
-		return time.Time{}, 1, false, 0, time.Time{}, nil
+		return time.Time{}, 1, 0, false, 0, time.Time{}, nil, nil
 
 	case req[0] == '{':
 		var cr JSApiConsumerGetNextRequest
 		if err := json.Unmarshal(req, &cr); err != nil {
-			return time.Time{}, -1, false, 0, time.Time{}, err
+			return time.Time{}, -1, 0, false, 0, time.Time{}, nil, err
+		}
+		if cr.MaxBytes < 0 {
+			return time.Time{}, -1, 0, false, 0, time.Time{}, nil, errors.New("max bytes can not be negative")
 		}
 		var hbt time.Time
 		if cr.Heartbeat > 0 {
 			if cr.Heartbeat*2 > cr.Expires {
-				return time.Time{}, 1, false, 0, time.Time{}, errors.New("heartbeat value too large")
+				return time.Time{}, 1, 0, false, 0, time.Time{}, nil, errors.New("heartbeat value too large")
 			}
 			hbt = time.Now().Add(cr.Heartbeat)
 		}
+		var pg *PriorityGroup
+		if cr.Group != _EMPTY_ {
+			pg = &cr.PriorityGroup
+		}
 		if cr.Expires == time.Duration(0) {
-			return time.Time{}, cr.Batch, cr.NoWait, cr.Heartbeat, hbt, nil
+			return time.Time{}, cr.Batch, cr.MaxBytes, cr.NoWait, cr.Heartbeat, hbt, pg, nil
 		}
-		return time.Now().Add(cr.Expires), cr.Batch, cr.NoWait, cr.Heartbeat, hbt, nil
+		return time.Now().Add(cr.Expires), cr.Batch, cr.MaxBytes, cr.NoWait, cr.Heartbeat, hbt, pg, nil
 	default:
 		if n, err := strconv.Atoi(string(req)); err == nil {
-			return time.Time{}, n, false, 0, time.Time{}, nil
+			return time.Time{}, n, 0, false, 0, time.Time{}, nil, nil
 		}
 	}
 
-	return time.Time{}, 1, false, 0, time.Time{}, nil
+	return time.Time{}, 1, 0, false, 0, time.Time{}, nil, nil
 }
 
 // Represents a request that is on the internal waiting queue
@@ -2292,11 +3100,13 @@ type waitingRequest struct {
 	reply    string
 	n        int // For batching
 	d        int
+	b        int // For max bytes, remaining
 	expires  time.Time
 	received time.Time
 	hb       time.Duration
 	hbt      time.Time
 	noWait   bool
+	pg       *PriorityGroup
 }
 
 // sync.Pool for waiting requests.
@@ -2318,7 +3128,7 @@ func (wr *waitingRequest) recycleIfDone() bool {
 // Force a recycle.
 func (wr *waitingRequest) recycle() {
 	if wr != nil {
-		wr.acc, wr.interest, wr.reply = nil, _EMPTY_, _EMPTY_
+		wr.acc, wr.interest, wr.reply, wr.pg = nil, _EMPTY_, _EMPTY_, nil
 		wrPool.Put(wr)
 	}
 }
@@ -2404,6 +3214,25 @@ func (wq *waitQueue) pop() *waitingRequest {
 	return wr
 }
 
+// popAt is like pop but for the request at index i, which may be behind the head.
+// Returns true if an interior entry was removed and the queue needs to be compacted.
+func (wq *waitQueue) popAt(i int) (*waitingRequest, bool) {
+	if i == wq.rp {
+		return wq.pop(), false
+	}
+	wr := wq.reqs[i]
+	if wr == nil {
+		return nil, false
+	}
+	wr.d++
+	wr.n--
+	if wr.n <= 0 {
+		wq.reqs[i] = nil
+		return wr, true
+	}
+	return wr, false
+}
+
 // Removes the current read pointer (head FIFO) entry.
 func (wq *waitQueue) removeCurrent() {
 	if wq.rp < 0 {
@@ -2429,59 +3258,528 @@ func (wq *waitQueue) compact() {
 			i++
 		}
 	}
-	// Reset here.
-	wq.rp, wq.wp, wq.reqs = 0, i, nreqs
+	// Reset here.
+	wq.rp, wq.wp, wq.reqs = 0, i, nreqs
+}
+
+// Return the replies for our pending requests.
+// No-op if push consumer or invalid etc.
+func (o *consumer) pendingRequestReplies() []string {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.waiting == nil {
+		return nil
+	}
+	wq, m := o.waiting, make(map[string]struct{})
+	for rp := o.waiting.rp; o.waiting.rp >= 0 && rp != wq.wp; rp = (rp + 1) % cap(wq.reqs) {
+		if wr := wq.reqs[rp]; wr != nil {
+			m[wr.reply] = struct{}{}
+		}
+	}
+	var replies []string
+	for reply := range m {
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+// Return next waiting request that can take a message of size sz, from owner if not empty. This will check for
+// expirations, interest, max bytes and priority groups, but not noWait. That will be handled by processWaiting.
+// Lock should be held.
+func (o *consumer) nextWaiting(sz int, owner string) *waitingRequest {
+	if o.waiting == nil || o.waiting.isEmpty() {
+		return nil
+	}
+	now, wq := time.Now(), o.waiting
+	o.expirePinned(now)
+
+	// Signals interior deletes, which we will compact before returning.
+	var hid bool
+	remove := func(wr *waitingRequest, i int, status string) {
+		hdr := []byte(fmt.Sprintf("NATS/1.0 %s\r\n\r\n", status))
+		o.outq.send(newJSPubMsg(wr.reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+		if i == wq.rp {
+			wq.removeCurrent()
+		} else {
+			wq.reqs[i], hid = nil, true
+		}
+		if o.node != nil {
+			o.removeClusterPendingRequest(wr.reply)
+		}
+		wr.recycle()
+	}
+
+	// Walk by count since a full queue has the read and write pointers at the same place.
+	var next *waitingRequest
+	for rp, n := wq.rp, wq.len(); n > 0; rp, n = (rp+1)%cap(wq.reqs), n-1 {
+		wr := wq.reqs[rp]
+		if wr == nil {
+			continue
+		}
+		if (!wr.expires.IsZero() && now.After(wr.expires)) || !o.hasWaitingInterest(wr) {
+			// No longer valid.
+			remove(wr, rp, "408 Request Timeout")
+			continue
+		}
+		// Partitions and priority groups may pass over requests that can not be served right now.
+		if owner != _EMPTY_ && wr.interest != owner {
+			continue
+		}
+		if !o.isPriorityEligible(wr, now) {
+			continue
+		}
+		if wr.b > 0 {
+			if sz > wr.b {
+				// Let them know we have hit their max bytes limit.
+				remove(wr, rp, "409 Message Size Exceeds MaxBytes")
+				continue
+			}
+			// Once used up, this will be the last message for this request.
+			if wr.b -= sz; wr.b == 0 {
+				wr.n = 1
+			}
+		}
+		var compact bool
+		next, compact = wq.popAt(rp)
+		hid = hid || compact
+		break
+	}
+	if hid {
+		wq.compact()
+	}
+	return next
+}
+
+// Check that the waiting request still has interest.
+// Lock should be held.
+func (o *consumer) hasWaitingInterest(wr *waitingRequest) bool {
+	rr := wr.acc.sl.Match(wr.interest)
+	if len(rr.psubs)+len(rr.qsubs) > 0 {
+		return true
+	}
+	if o.srv.gateway.enabled {
+		return o.srv.hasGatewayInterest(wr.acc.Name, wr.interest) || time.Since(wr.received) < defaultGatewayRecentSubExpiration
+	}
+	return false
+}
+
+// Default time a pinned client can go without pulling before another client takes over its priority group.
+const defaultPinnedTTL = 2 * time.Minute
+
+// pinnedClient tracks the client that currently holds the pin for a priority group.
+type pinnedClient struct {
+	id   string
+	last time.Time
+}
+
+// Lock should be held.
+func (o *consumer) pinnedTTL() time.Duration {
+	if o.cfg.PinnedTTL > 0 {
+		return o.cfg.PinnedTTL
+	}
+	return defaultPinnedTTL
+}
+
+// isValidPriorityGroup checks a priority group name, which is short and limited to a simple character set.
+func isValidPriorityGroup(group string) bool {
+	if len(group) == 0 || len(group) > 16 {
+		return false
+	}
+	for _, c := range group {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '/', c == '=':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Lock should be held.
+func (o *consumer) hasPriorityGroup(group string) bool {
+	for _, g := range o.cfg.PriorityGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
+}
+
+// isPriorityEligible returns whether the waiting request can be served now under our priority policy.
+// For pinned clients a request will claim the pin for its group if no one holds it.
+// Lock should be held.
+func (o *consumer) isPriorityEligible(wr *waitingRequest, now time.Time) bool {
+	pg := wr.pg
+	if pg == nil {
+		return true
+	}
+	switch o.cfg.PriorityPolicy {
+	case PriorityOverflow:
+		if pg.MinPending <= 0 && pg.MinAckPending <= 0 {
+			return true
+		}
+		if pg.MinPending > 0 && o.adjustedPending()+uint64(len(o.rdq)) >= uint64(pg.MinPending) {
+			return true
+		}
+		return pg.MinAckPending > 0 && int64(len(o.pending)) >= pg.MinAckPending
+	case PriorityPinnedClient:
+		pin := o.pinned[pg.Group]
+		if pin == nil {
+			if o.pinned == nil {
+				o.pinned = make(map[string]*pinnedClient)
+			}
+			pin = &pinnedClient{id: nuid.Next()}
+			o.pinned[pg.Group] = pin
+			pg.Id = pin.id
+			o.updateClusterPinned(pg.Group, pin.id)
+		}
+		if pg.Id != pin.id {
+			return false
+		}
+		pin.last = now
+		return true
+	}
+	return true
+}
+
+// expirePinned releases the pin for any group whose pinned client has not pulled within the pinned TTL.
+// Lock should be held.
+func (o *consumer) expirePinned(now time.Time) {
+	if len(o.pinned) == 0 {
+		return
+	}
+	wq := o.waiting
+	for rp, n := wq.rp, wq.len(); n > 0; rp, n = (rp+1)%cap(wq.reqs), n-1 {
+		// A pinned client that is waiting is still active.
+		if wr := wq.reqs[rp]; wr != nil && wr.pg != nil {
+			if pin := o.pinned[wr.pg.Group]; pin != nil && pin.id == wr.pg.Id {
+				pin.last = now
+			}
+		}
+	}
+	ttl := o.pinnedTTL()
+	for group, pin := range o.pinned {
+		if now.Sub(pin.last) >= ttl {
+			delete(o.pinned, group)
+			o.updateClusterPinned(group, _EMPTY_)
+		}
+	}
+}
+
+// Default time a partitioned pull client can go without pulling before its partitions move to others.
+const defaultPartitionTimeout = 30 * time.Second
+
+// Maximum number of messages we will hold back for partitions whose clients are not waiting.
+const maxPartitionHeld = 64 * 1024
+
+// partitioner tracks the active pull clients of a partitioned consumer, which client owns each
+// partition and the messages held back for partitions whose client is busy.
+type partitioner struct {
+	tr      *transform
+	ttl     time.Duration
+	members map[string]time.Time
+	owners  []string
+	held    map[int][]heldMsg
+	nheld   int
+}
+
+// heldMsg is a message held back for a partition, along with its delivery count.
+type heldMsg struct {
+	seq uint64
+	dc  uint64
+}
+
+func newPartitioner(cfg *PartitionConfig) (*partitioner, error) {
+	if cfg.Partitions < 1 {
+		return nil, errors.New("number of partitions must be at least 1")
+	}
+	if len(cfg.Wildcards) == 0 {
+		return nil, errors.New("at least one wildcard is required for the key")
+	}
+	valid, _, npwcs, hasFwc := subjectInfo(cfg.Subject)
+	if !valid {
+		return nil, errors.New("subject is not valid")
+	}
+	keys := make([]string, 0, len(cfg.Wildcards))
+	for _, wc := range cfg.Wildcards {
+		if wc < 1 || wc > npwcs {
+			return nil, fmt.Errorf("wildcard %d is not in the subject", wc)
+		}
+		keys = append(keys, strconv.Itoa(wc))
+	}
+	// The partition is the first token, followed by all wildcards since every one needs to be mapped.
+	dtoks := []string{fmt.Sprintf("{{partition(%d,%s)}}", cfg.Partitions, strings.Join(keys, ","))}
+	for i := 1; i <= npwcs; i++ {
+		dtoks = append(dtoks, fmt.Sprintf("{{wildcard(%d)}}", i))
+	}
+	if hasFwc {
+		dtoks = append(dtoks, fwcs)
+	}
+	tr, err := newTransform(cfg.Subject, strings.Join(dtoks, tsep))
+	if err != nil {
+		return nil, err
+	}
+	ttl := cfg.Timeout
+	if ttl <= 0 {
+		ttl = defaultPartitionTimeout
+	}
+	return &partitioner{tr: tr, ttl: ttl, owners: make([]string, cfg.Partitions)}, nil
+}
+
+// partition returns the partition for a subject. Subjects that do not match go to the first partition.
+func (p *partitioner) partition(subj string) int {
+	dest, err := p.tr.match(subj)
+	if err != nil {
+		return 0
+	}
+	if i := strings.IndexByte(dest, btsep); i > 0 {
+		dest = dest[:i]
+	}
+	n, _ := strconv.Atoi(dest)
+	return n
+}
+
+// ownerOf returns the client that owns the partition for the subject, and whether that
+// partition has messages held back, which need to go first.
+func (p *partitioner) ownerOf(subj string) (string, bool) {
+	part := p.partition(subj)
+	return p.owners[part], len(p.held[part]) > 0
+}
+
+// hold will hold back a message for its partition. Returns false if we are holding too many already.
+func (p *partitioner) hold(subj string, seq, dc uint64) bool {
+	if p.nheld >= maxPartitionHeld {
+		return false
+	}
+	if p.held == nil {
+		p.held = make(map[int][]heldMsg)
+	}
+	part := p.partition(subj)
+	p.held[part] = append(p.held[part], heldMsg{seq, dc})
+	p.nheld++
+	return true
+}
+
+// pop removes the first message held back for the partition.
+func (p *partitioner) pop(part int) {
+	if hms := p.held[part]; len(hms) > 1 {
+		p.held[part] = hms[1:]
+	} else {
+		delete(p.held, part)
+	}
+	p.nheld--
+}
+
+// first returns the lowest sequence we are holding back, or 0 if none.
+func (p *partitioner) first() uint64 {
+	var first uint64
+	for _, hms := range p.held {
+		if seq := hms[0].seq; first == 0 || seq < first {
+			first = seq
+		}
+	}
+	return first
+}
+
+// join records activity for a pull client, rebalancing if it is new.
+func (p *partitioner) join(member string, now time.Time) {
+	if p.members == nil {
+		p.members = make(map[string]time.Time)
+	}
+	_, ok := p.members[member]
+	p.members[member] = now
+	if !ok {
+		p.rebalance()
+	}
+}
+
+// rebalance assigns each partition to a member. Uses rendezvous hashing so that
+// only the partitions of members that come and go will move.
+func (p *partitioner) rebalance() {
+	for part := range p.owners {
+		var owner string
+		var best uint64
+		for member := range p.members {
+			h := fnv.New64a()
+			h.Write([]byte(strconv.Itoa(part)))
+			h.Write([]byte(member))
+			// FNV does not spread similar keys well on its own, so finish with a mix.
+			w := h.Sum64()
+			w ^= w >> 33
+			w *= 0xff51afd7ed558ccd
+			w ^= w >> 33
+			if owner == _EMPTY_ || w > best || (w == best && member < owner) {
+				owner, best = member, w
+			}
+		}
+		p.owners[part] = owner
+	}
+}
+
+// nextExpiration returns when the first member will expire, or zero time if we have no members.
+func (p *partitioner) nextExpiration() time.Time {
+	var next time.Time
+	for _, last := range p.members {
+		if exp := last.Add(p.ttl); next.IsZero() || exp.Before(next) {
+			next = exp
+		}
+	}
+	return next
+}
+
+// reset clears all members and held messages, e.g. when we are no longer leader.
+func (p *partitioner) reset() {
+	p.members, p.held, p.nheld = nil, nil, 0
+	for i := range p.owners {
+		p.owners[i] = _EMPTY_
+	}
+}
+
+// expirePartitionMembers removes pull clients that have not pulled within the partition timeout
+// and moves their partitions to the remaining ones.
+// Lock should be held.
+func (o *consumer) expirePartitionMembers(now time.Time) {
+	p := o.part
+	if len(p.members) == 0 {
+		return
+	}
+	// A client that is waiting is still active.
+	wq := o.waiting
+	for rp, n := wq.rp, wq.len(); n > 0; rp, n = (rp+1)%cap(wq.reqs), n-1 {
+		if wr := wq.reqs[rp]; wr != nil {
+			if _, ok := p.members[wr.interest]; ok {
+				p.members[wr.interest] = now
+			}
+		}
+	}
+	var changed bool
+	for member, last := range p.members {
+		if now.Sub(last) >= p.ttl {
+			delete(p.members, member)
+			changed = true
+		}
+	}
+	if changed {
+		p.rebalance()
+	}
+}
+
+// nextHeldMsg returns the first message we held back for a partition whose client is now waiting,
+// along with the request it should be delivered to.
+// Lock should be held.
+func (o *consumer) nextHeldMsg() (*jsPubMsg, uint64, *waitingRequest) {
+	p := o.part
+	if p.nheld == 0 || o.waiting.isEmpty() {
+		return nil, 0, nil
+	}
+	waiting := make(map[string]struct{})
+	wq := o.waiting
+	for rp, n := wq.rp, wq.len(); n > 0; rp, n = (rp+1)%cap(wq.reqs), n-1 {
+		if wr := wq.reqs[rp]; wr != nil {
+			waiting[wr.interest] = struct{}{}
+		}
+	}
+	for {
+		// Find the lowest held sequence whose owner is waiting.
+		part, seq := -1, uint64(0)
+		for pi, hms := range p.held {
+			if _, ok := waiting[p.owners[pi]]; ok && (seq == 0 || hms[0].seq < seq) {
+				part, seq = pi, hms[0].seq
+			}
+		}
+		if part < 0 {
+			return nil, 0, nil
+		}
+		hm := p.held[part][0]
+		pmsg := getJSPubMsgFromPool()
+		if sm, err := o.mset.store.LoadMsg(hm.seq, &pmsg.StoreMsg); sm == nil || err != nil {
+			// No longer in the stream.
+			pmsg.returnToPool()
+			p.pop(part)
+			o.updateHeld(hm.seq, false)
+			continue
+		}
+		wr := o.nextWaiting(len(pmsg.subj)+len(pmsg.hdr)+len(pmsg.msg), p.owners[part])
+		if wr == nil {
+			pmsg.returnToPool()
+			return nil, 0, nil
+		}
+		p.pop(part)
+		o.updateHeld(hm.seq, false)
+		return pmsg, hm.dc, wr
+	}
+}
+
+// restoreHeld will hold back again the messages our store tracked as held for partitions or schedules.
+// Scheduled messages that are not yet due are in sched, and any that became due while we were not
+// leader are delivered right away. Messages that are pending will be redelivered as usual, and any we
+// can no longer hold will be retried.
+// Lock should be held.
+func (o *consumer) restoreHeld(sched map[uint64]int64) {
+	if o.store == nil {
+		return
+	}
+	state, err := o.store.State()
+	if err != nil || state == nil {
+		return
+	}
+	now := time.Now().UnixNano()
+	var sm StoreMsg
+	for _, seq := range state.Held {
+		// Anything at or past our starting sequence will be seen again.
+		if _, ok := o.pending[seq]; ok || seq <= o.asflr || seq >= o.sseq {
+			o.updateHeld(seq, false)
+			continue
+		}
+		if _, err := o.mset.store.LoadMsg(seq, &sm); err != nil {
+			o.updateHeld(seq, false)
+			continue
+		}
+		if due, ok := sched[seq]; ok || o.part == nil {
+			if !ok {
+				due = now
+			}
+			o.addScheduled(seq, due, now)
+			continue
+		}
+		if !o.part.hold(sm.subj, seq, 1) {
+			o.updateHeld(seq, false)
+			o.returnMsg(seq, 1)
+		}
+	}
 }
 
-// Return the replies for our pending requests.
-// No-op if push consumer or invalid etc.
-func (o *consumer) pendingRequestReplies() []string {
-	o.mu.RLock()
-	defer o.mu.RUnlock()
-	if o.waiting == nil {
-		return nil
+// firstHeldBack returns the lowest sequence we are holding back for scheduling, partitions or
+// retries, or 0 if none.
+// Lock should be held.
+func (o *consumer) firstHeldBack() uint64 {
+	first := o.firstScheduled()
+	if len(o.rtq) > 0 && (first == 0 || o.rtq[0] < first) {
+		first = o.rtq[0]
 	}
-	wq, m := o.waiting, make(map[string]struct{})
-	for rp := o.waiting.rp; o.waiting.rp >= 0 && rp != wq.wp; rp = (rp + 1) % cap(wq.reqs) {
-		if wr := wq.reqs[rp]; wr != nil {
-			m[wr.reply] = struct{}{}
+	if o.part != nil {
+		if pf := o.part.first(); pf > 0 && (first == 0 || pf < first) {
+			first = pf
 		}
 	}
-	var replies []string
-	for reply := range m {
-		replies = append(replies, reply)
-	}
-	return replies
+	return first
 }
 
-// Return next waiting request. This will check for expirations but not noWait or interest.
-// That will be handled by processWaiting.
+// nextPinnedExpiration returns when the first pin will expire, if we have waiting requests that could take over.
 // Lock should be held.
-func (o *consumer) nextWaiting() *waitingRequest {
-	if o.waiting == nil || o.waiting.isEmpty() {
-		return nil
+func (o *consumer) nextPinnedExpiration() time.Time {
+	var next time.Time
+	if o.waiting.isEmpty() {
+		return next
 	}
-	for wr := o.waiting.peek(); !o.waiting.isEmpty(); wr = o.waiting.peek() {
-		if wr == nil || wr.expires.IsZero() || time.Now().Before(wr.expires) {
-			rr := wr.acc.sl.Match(wr.interest)
-			if len(rr.psubs)+len(rr.qsubs) > 0 {
-				return o.waiting.pop()
-			} else if o.srv.gateway.enabled {
-				if o.srv.hasGatewayInterest(wr.acc.Name, wr.interest) || time.Since(wr.received) < defaultGatewayRecentSubExpiration {
-					return o.waiting.pop()
-				}
-			}
+	ttl := o.pinnedTTL()
+	for _, pin := range o.pinned {
+		if exp := pin.last.Add(ttl); next.IsZero() || exp.Before(next) {
+			next = exp
 		}
-		hdr := []byte("NATS/1.0 408 Request Timeout\r\n\r\n")
-		o.outq.send(newJSPubMsg(wr.reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
-		// Remove the current one, no longer valid.
-		o.waiting.removeCurrent()
-		if o.node != nil {
-			o.removeClusterPendingRequest(wr.reply)
-		}
-		wr.recycle()
 	}
-	return nil
+	return next
 }
 
 // processNextMsgReq will process a request for the next message available. A nil message payload means deliver
@@ -2515,7 +3813,7 @@ func (o *consumer) processNextMsgRequest(reply string, msg []byte) {
 	}
 
 	// Check payload here to see if they sent in batch size or a formal request.
-	expires, batchSize, noWait, hb, hbt, err := nextReqFromMsg(msg)
+	expires, batchSize, maxBytes, noWait, hb, hbt, pg, err := nextReqFromMsg(msg)
 	if err != nil {
 		sendErr(400, fmt.Sprintf("Bad Request - %v", err))
 		return
@@ -2532,6 +3830,32 @@ func (o *consumer) processNextMsgRequest(reply string, msg []byte) {
 		return
 	}
 
+	if maxBytes > 0 && o.cfg.MaxRequestMaxBytes > 0 && maxBytes > o.cfg.MaxRequestMaxBytes {
+		sendErr(409, fmt.Sprintf("Exceeded MaxRequestMaxBytes of %v", o.cfg.MaxRequestMaxBytes))
+		return
+	}
+
+	// If we have priority groups the request needs to select one of them.
+	if len(o.cfg.PriorityGroups) > 0 || pg != nil {
+		if pg == nil || !o.hasPriorityGroup(pg.Group) {
+			sendErr(400, "Bad Request - Invalid Priority Group")
+			return
+		}
+		if (pg.MinPending > 0 || pg.MinAckPending > 0) && o.cfg.PriorityPolicy != PriorityOverflow {
+			sendErr(400, "Bad Request - Not An Overflow Priority Policy")
+			return
+		}
+		// Pinned clients need to present the current pin, or none to wait for their turn.
+		if pg.Id != _EMPTY_ && o.cfg.PriorityPolicy == PriorityPinnedClient {
+			pin := o.pinned[pg.Group]
+			if pin == nil || pin.id != pg.Id {
+				sendErr(423, "Nats-Pin-Id Mismatch")
+				return
+			}
+			pin.last = time.Now()
+		}
+	}
+
 	// If we have the max number of requests already pending try to expire.
 	if o.waiting.isFull() {
 		// Try to expire some of the requests.
@@ -2574,16 +3898,20 @@ func (o *consumer) processNextMsgRequest(reply string, msg []byte) {
 	// In case we have to queue up this request.
 	wr := wrPool.Get().(*waitingRequest)
 	wr.acc, wr.interest, wr.reply, wr.n, wr.d, wr.noWait, wr.expires, wr.hb, wr.hbt = acc, interest, reply, batchSize, 0, noWait, expires, hb, hbt
+	wr.b, wr.pg = maxBytes, pg
 	wr.received = time.Now()
 
 	if err := o.waiting.add(wr); err != nil {
 		sendErr(409, "Exceeded MaxWaiting")
 		return
 	}
+	if o.part != nil {
+		o.part.join(wr.interest, wr.received)
+	}
 	o.signalNewMessages()
 	// If we are clustered update our followers about this request.
 	if o.node != nil {
-		o.addClusterPendingRequest(wr.reply)
+		o.addClusterPendingRequest(wr)
 	}
 }
 
@@ -2621,19 +3949,254 @@ func (o *consumer) notifyDeliveryExceeded(sseq, dc uint64) {
 	o.sendAdvisory(o.deliveryExcEventT, j)
 }
 
+// setNakReason records the reason given with a NAK so it can be included if the message is dead lettered.
+// Lock should be held.
+func (o *consumer) setNakReason(sseq uint64, reason string) {
+	if reason == _EMPTY_ || o.cfg.DeadLetter == nil {
+		return
+	}
+	if o.nakr == nil {
+		o.nakr = make(map[uint64]string)
+	}
+	o.nakr[sseq] = reason
+}
+
+// Headers from the original publish that could alter how the dead lettered copy is stored.
+var deadLetterStripHeaders = []string{
+	JSMsgId, JSExpectedStream, JSExpectedLastSeq, JSExpectedLastSubjSeq, JSExpectedLastMsgId,
+	JSMsgRollup, JSMessageTTL, JSScheduleAt, JSScheduleDelay, JSBatchId, JSBatchSeq, JSBatchCommit,
+}
+
+// deadLetter copies the message at sseq to our dead letter subject if one is configured,
+// with headers describing where it was stored and why it was dead lettered.
+// The copy is published with a reply, and if dseq is set the message will be acked once
+// the dead letter stream has stored it. Returns true if the copy was published.
+// Lock should be held.
+func (o *consumer) deadLetter(sseq, dseq, dc uint64, reason, term string) bool {
+	dl := o.cfg.DeadLetter
+	if dl == nil || o.mset == nil || o.mset.store == nil {
+		return false
+	}
+	nakr := o.nakr[sseq]
+	delete(o.nakr, sseq)
+
+	sm, err := o.mset.store.LoadMsg(sseq, nil)
+	if sm == nil || err != nil {
+		return false
+	}
+	hdr := copyBytes(sm.hdr)
+	for _, key := range deadLetterStripHeaders {
+		hdr = removeHeaderIfPresent(hdr, key)
+	}
+	if dl.Stream != _EMPTY_ {
+		hdr = genHeader(hdr, JSExpectedStream, dl.Stream)
+	}
+	hdr = genHeader(hdr, JSStream, o.stream)
+	hdr = genHeader(hdr, JSConsumer, o.name)
+	hdr = genHeader(hdr, JSSubject, sm.subj)
+	hdr = genHeader(hdr, JSSequence, strconv.FormatUint(sseq, 10))
+	hdr = genHeader(hdr, JSTimeStamp, time.Unix(0, sm.ts).UTC().Format(time.RFC3339Nano))
+	hdr = genHeader(hdr, JSNumDelivered, strconv.FormatUint(dc, 10))
+	hdr = genHeader(hdr, JSDeadLetterReason, reason)
+	if nakr != _EMPTY_ {
+		hdr = genHeader(hdr, JSLastNakReason, nakr)
+	}
+	if term != _EMPTY_ {
+		hdr = genHeader(hdr, JSTermReason, term)
+	}
+	reply := fmt.Sprintf(o.dlReplyT, sseq, dseq, dc)
+	o.outq.send(newJSPubMsg(dl.Subject, _EMPTY_, reply, hdr, copyBytes(sm.msg), nil, 0))
+	return true
+}
+
+// processDeadLetterAck handles the publish ack for a dead lettered message.
+// The original message is only acked once the dead lettered copy has been stored, otherwise
+// it stays pending. A terminated message will then be redelivered, and one that exceeded
+// its max deliveries will be dead lettered again after AckWait.
+func (o *consumer) processDeadLetterAck(_ *subscription, c *client, _ *Account, subject, _ string, rmsg []byte) {
+	_, msg := c.msgParts(rmsg)
+	tokens := strings.Split(subject, tsep)
+	if len(tokens) < 3 {
+		return
+	}
+	tokens = tokens[len(tokens)-3:]
+	sseq, dseq, dc := uint64(parseAckReplyNum(tokens[0])), uint64(parseAckReplyNum(tokens[1])), uint64(parseAckReplyNum(tokens[2]))
+
+	var resp JSPubAckResponse
+	if err := json.Unmarshal(msg, &resp); err != nil || resp.Error != nil {
+		if err == nil {
+			err = resp.Error
+		}
+		o.srv.Warnf("JetStream consumer '%s > %s > %s' failed to dead letter message %d: %v",
+			o.acc.Name, o.stream, o.name, sseq, err)
+		return
+	}
+	if dseq > 0 {
+		o.processAckMsg(sseq, dseq, dc, false)
+	}
+}
+
 // Check to see if the candidate subject matches a filter if its present.
 // Lock should be held.
 func (o *consumer) isFilteredMatch(subj string) bool {
 	// No filter is automatic match.
-	if o.cfg.FilterSubject == _EMPTY_ {
+	if len(o.subjf) == 0 {
 		return true
 	}
+	if len(o.subjf) > 1 {
+		for _, filter := range o.subjf {
+			if subjectIsSubsetMatch(subj, filter) {
+				return true
+			}
+		}
+		return false
+	}
 	if !o.filterWC {
-		return subj == o.cfg.FilterSubject
+		return subj == o.subjf[0]
 	}
 	// If we are here we have a wildcard filter subject.
 	// TODO(dlc) at speed might be better to just do a sublist with L2 and/or possibly L1.
-	return subjectIsSubsetMatch(subj, o.cfg.FilterSubject)
+	return subjectIsSubsetMatch(subj, o.subjf[0])
+}
+
+// filterPos tracks the next matching sequence for one of multiple filters.
+// Messages are only ever appended, so a match found at or after start stays
+// the next one for any sequence between start and that match.
+type filterPos struct {
+	start uint64 // Sequence the last search started from.
+	next  uint64 // Next matching sequence, 0 if there was none.
+	last  uint64 // Last sequence in the stream when there was no match.
+}
+
+// nextSeq returns the next sequence at or after seq that matches filter, or 0 if none.
+// Only searches the store when the last known position can not be used.
+// Lock should be held.
+func (fp *filterPos) nextSeq(store StreamStore, filter string, seq uint64) (uint64, error) {
+	if fp.start == 0 || seq < fp.start {
+		fp.start, fp.next, fp.last = seq, 0, 0
+	} else if fp.next >= seq {
+		return fp.next, nil
+	} else if fp.next == 0 && fp.last >= seq {
+		// Nothing matched up to last, so only need to check newer messages.
+		seq = fp.last + 1
+	} else {
+		fp.start, fp.last = seq, 0
+	}
+	var smv StoreMsg
+	_, sseq, err := store.LoadNextMsg(filter, subjectHasWildcard(filter), seq, &smv)
+	if err == ErrStoreEOF {
+		fp.next, fp.last = 0, sseq
+		return 0, nil
+	} else if err != nil {
+		fp.start = 0
+		return 0, err
+	}
+	fp.next, fp.last = sseq, 0
+	return sseq, nil
+}
+
+// loadNextMsg will load the next message at or after seq that matches any of our filters.
+// Lock should be held.
+func (o *consumer) loadNextMsg(seq uint64, smp *StoreMsg) (*StoreMsg, uint64, error) {
+	store := o.mset.store
+	switch len(o.subjf) {
+	case 0:
+		return store.LoadNextMsg(_EMPTY_, false, seq, smp)
+	case 1:
+		return store.LoadNextMsg(o.subjf[0], o.filterWC, seq, smp)
+	}
+	// Multiple filters, find the lowest matching sequence amongst all of them.
+	for {
+		var nseq, skip uint64
+		var ni int
+		for i, filter := range o.subjf {
+			sseq, err := o.fpos[i].nextSeq(store, filter, seq)
+			if err != nil {
+				return nil, 0, err
+			}
+			if sseq == 0 {
+				if last := o.fpos[i].last; last > skip {
+					skip = last
+				}
+			} else if nseq == 0 || sseq < nseq {
+				nseq, ni = sseq, i
+			}
+		}
+		if nseq == 0 {
+			return nil, skip, ErrStoreEOF
+		}
+		sm, err := store.LoadMsg(nseq, smp)
+		if err == ErrStoreMsgNotFound || err == ErrStoreEOF || err == errDeletedMsg || (err == nil && !o.isFilteredMatch(sm.subj)) {
+			// Removed since we found it, search again for this filter.
+			o.fpos[ni].start = 0
+			continue
+		}
+		return sm, nseq, err
+	}
+}
+
+// filteredState returns the combined state of the messages at or after seq that match our filters.
+// Lock should be held.
+func (o *consumer) filteredState(seq uint64) SimpleState {
+	store := o.mset.store
+	if len(o.subjf) == 1 {
+		return store.FilteredState(seq, o.subjf[0])
+	}
+	// Filters that overlap are counted per subject so each message is only counted once.
+	if o.subjfOverlap {
+		var ss SimpleState
+		for subj, fss := range o.subjectsState() {
+			if fss.Last < seq {
+				continue
+			}
+			if fss.First < seq {
+				fss = store.FilteredState(seq, subj)
+				if fss.Msgs == 0 {
+					continue
+				}
+			}
+			ss.Msgs += fss.Msgs
+			if ss.First == 0 || fss.First < ss.First {
+				ss.First = fss.First
+			}
+			if fss.Last > ss.Last {
+				ss.Last = fss.Last
+			}
+		}
+		return ss
+	}
+	// Otherwise filters do not overlap and can be summed.
+	var ss SimpleState
+	for _, filter := range o.subjf {
+		fss := store.FilteredState(seq, filter)
+		if fss.Msgs == 0 {
+			continue
+		}
+		ss.Msgs += fss.Msgs
+		if ss.First == 0 || fss.First < ss.First {
+			ss.First = fss.First
+		}
+		if fss.Last > ss.Last {
+			ss.Last = fss.Last
+		}
+	}
+	return ss
+}
+
+// subjectsState returns the per subject state for all subjects that match our filters.
+// Lock should be held.
+func (o *consumer) subjectsState() map[string]SimpleState {
+	store := o.mset.store
+	if len(o.subjf) == 1 {
+		return store.SubjectsState(o.subjf[0])
+	}
+	mss := make(map[string]SimpleState)
+	for _, filter := range o.subjf {
+		for subj, ss := range store.SubjectsState(filter) {
+			mss[subj] = ss
+		}
+	}
+	return mss
 }
 
 var (
@@ -2665,7 +4228,17 @@ func (o *consumer) getNextMsg() (*jsPubMsg, uint64, error) {
 			if o.maxdc > 0 && dc > o.maxdc {
 				// Only send once
 				if dc == o.maxdc+1 {
-					o.notifyDeliveryExceeded(seq, dc-1)
+					o.notifyDeliveryExceeded(seq, o.maxdc)
+				}
+				// With explicit acks we keep this pending until the dead lettered copy has been stored.
+				// If it was not stored, we will be back here after AckWait to try again.
+				if p := o.pending[seq]; p != nil && o.cfg.AckPolicy == AckExplicit {
+					if o.deadLetter(seq, p.Sequence, o.maxdc, deadLetterMaxDeliveries, _EMPTY_) {
+						p.Timestamp = time.Now().UnixNano()
+						continue
+					}
+				} else if dc == o.maxdc+1 {
+					o.deadLetter(seq, 0, o.maxdc, deadLetterMaxDeliveries, _EMPTY_)
 				}
 				// Make sure to remove from pending.
 				delete(o.pending, seq)
@@ -2692,23 +4265,65 @@ func (o *consumer) getNextMsg() (*jsPubMsg, uint64, error) {
 		return nil, 0, errMaxAckPending
 	}
 
-	// Grab next message applicable to us.
-	pmsg := getJSPubMsgFromPool()
-	sm, sseq, err := o.mset.store.LoadNextMsg(o.cfg.FilterSubject, o.filterWC, seq, &pmsg.StoreMsg)
-
-	if sseq >= o.sseq {
-		o.sseq = sseq + 1
-		if err == ErrStoreEOF {
-			o.updateSkipped()
+	// Retry any messages we could not deliver before.
+	for len(o.rtq) > 0 {
+		sseq := o.rtq[0]
+		if o.rtq = o.rtq[1:]; len(o.rtq) == 0 {
+			o.rtq = nil
+		}
+		pmsg := getJSPubMsgFromPool()
+		if sm, err := o.mset.store.LoadMsg(sseq, &pmsg.StoreMsg); sm != nil && err == nil {
+			return pmsg, 1, nil
 		}
+		pmsg.returnToPool()
 	}
 
-	if sm == nil {
+	// Check for any scheduled messages we held back that are now due.
+	for sseq := o.getNextScheduled(); sseq > 0; sseq = o.getNextScheduled() {
+		pmsg := getJSPubMsgFromPool()
+		if sm, err := o.mset.store.LoadMsg(sseq, &pmsg.StoreMsg); sm != nil && err == nil {
+			return pmsg, 1, nil
+		}
 		pmsg.returnToPool()
-		return nil, 0, err
 	}
 
-	return pmsg, dc, err
+	// Grab next message applicable to us.
+	pmsg := getJSPubMsgFromPool()
+	var skipped []uint64
+	for {
+		sm, sseq, err := o.loadNextMsg(seq, &pmsg.StoreMsg)
+
+		if sseq >= o.sseq {
+			o.sseq = sseq + 1
+			if err == ErrStoreEOF {
+				o.updateSkipped()
+			}
+		}
+
+		if sm == nil {
+			pmsg.returnToPool()
+			o.ackSkipped(skipped)
+			return nil, 0, err
+		}
+
+		// Skip messages that do not match our header filter, these count as acknowledged.
+		if len(o.cfg.HeaderFilter) > 0 && !o.isHeaderFilterMatch(sm.hdr) {
+			o.sgap--
+			skipped = append(skipped, sseq)
+		} else if !o.deferScheduled(sm) {
+			// Hold back scheduled messages until they are due.
+			o.ackSkipped(skipped)
+			return pmsg, dc, err
+		}
+		// If we are working through a skip list let the next pass pick up where we left off.
+		if o.hasSkipListPending() {
+			pmsg.returnToPool()
+			o.ackSkipped(skipped)
+			o.signalNewMessages()
+			return nil, 0, ErrStoreMsgNotFound
+		}
+		seq = sseq + 1
+	}
 }
 
 // forceExpireFirstWaiting will force expire the first waiting.
@@ -2808,6 +4423,18 @@ func (o *consumer) processWaiting() (int, int, int, time.Time) {
 		o.waiting.compact()
 	}
 
+	// Wake up when a pin or partition member expires so a waiting client can take over.
+	o.expirePinned(now)
+	if pexp := o.nextPinnedExpiration(); !pexp.IsZero() && (fexp.IsZero() || pexp.Before(fexp)) {
+		fexp = pexp
+	}
+	if o.part != nil {
+		o.expirePartitionMembers(now)
+		if pexp := o.part.nextExpiration(); !pexp.IsZero() && (fexp.IsZero() || pexp.Before(fexp)) {
+			fexp = pexp
+		}
+	}
+
 	return expired, o.waiting.len(), brp, fexp
 }
 
@@ -2865,6 +4492,7 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 	for {
 		var (
 			pmsg  *jsPubMsg
+			wr    *waitingRequest
 			dc    uint64
 			dsubj string
 			err   error
@@ -2888,8 +4516,20 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 			goto waitForMsgs
 		}
 
+		// If we have been paused hold off on delivering anything.
+		if o.isPaused() {
+			goto waitForMsgs
+		}
+
+		// Partitioned consumers first look for messages held back for clients that are now waiting.
+		if o.part != nil {
+			pmsg, dc, wr = o.nextHeldMsg()
+		}
+
 		// Grab our next msg.
-		pmsg, dc, err = o.getNextMsg()
+		if pmsg == nil {
+			pmsg, dc, err = o.getNextMsg()
+		}
 
 		// On error either wait or return.
 		if err != nil || pmsg == nil {
@@ -2901,18 +4541,51 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 			}
 		}
 
+		// Partitioned consumers can only deliver to the client that owns the message's partition,
+		// otherwise we hold the message back and move on to the next one.
+		if o.part != nil && wr == nil {
+			if _, ok := o.pending[pmsg.seq]; ok && dc == 1 {
+				// Delivered before we became leader, will be redelivered if needed.
+				pmsg.returnToPool()
+				o.mu.Unlock()
+				continue
+			}
+			if owner, held := o.part.ownerOf(pmsg.subj); !held {
+				wr = o.nextWaiting(len(pmsg.subj)+len(pmsg.hdr)+len(pmsg.msg), owner)
+			}
+			if wr == nil && o.part.hold(pmsg.subj, pmsg.seq, dc) {
+				o.updateHeld(pmsg.seq, true)
+				pmsg.returnToPool()
+				o.mu.Unlock()
+				continue
+			}
+		} else if o.isPullMode() && wr == nil {
+			wr = o.nextWaiting(len(pmsg.subj)+len(pmsg.hdr)+len(pmsg.msg), _EMPTY_)
+		}
+
 		if o.isPushMode() {
 			dsubj = o.dsubj
-		} else if wr := o.nextWaiting(); wr != nil {
+		} else if wr != nil {
 			dsubj = wr.reply
+			// Let pinned clients know their pin.
+			if wr.pg != nil && o.cfg.PriorityPolicy == PriorityPinnedClient {
+				pmsg.hdr = genHeader(pmsg.hdr, JSPullRequestPinId, wr.pg.Id)
+				pmsg.buf = pmsg.buf[:0]
+			}
 			if done := wr.recycleIfDone(); done && o.node != nil {
 				o.removeClusterPendingRequest(dsubj)
-			} else if !done && wr.hb > 0 {
-				wr.hbt = time.Now().Add(wr.hb)
+			} else if !done {
+				if wr.hb > 0 {
+					wr.hbt = time.Now().Add(wr.hb)
+				}
+				// Keep our followers up to date on what is left for requests with limits.
+				if o.node != nil && (wr.b > 0 || wr.pg != nil) {
+					o.addClusterPendingRequest(wr)
+				}
 			}
 		} else {
 			// We will redo this one.
-			o.sseq--
+			o.returnMsg(pmsg.seq, dc)
 			pmsg.returnToPool()
 			goto waitForMsgs
 		}
@@ -2935,10 +4608,19 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 		lts = pmsg.ts
 
 		// If we have a rate limit set make sure we check that here.
-		if o.rlimit != nil {
+		// This is shared by all pull requests for pull based consumers.
+		if o.rlimit != nil || o.mlimit != nil {
 			now, sm := time.Now(), &pmsg.StoreMsg
-			r := o.rlimit.ReserveN(now, len(sm.msg)+len(sm.hdr)+len(sm.subj)+len(dsubj)+len(o.ackReplyT))
-			delay := r.DelayFrom(now)
+			var delay time.Duration
+			if o.rlimit != nil {
+				r := o.rlimit.ReserveN(now, len(sm.msg)+len(sm.hdr)+len(sm.subj)+len(dsubj)+len(o.ackReplyT))
+				delay = r.DelayFrom(now)
+			}
+			if o.mlimit != nil {
+				if d := o.mlimit.ReserveN(now, 1).DelayFrom(now); d > delay {
+					delay = d
+				}
+			}
 			if delay > 0 {
 				o.mu.Unlock()
 				select {
@@ -3270,6 +4952,36 @@ func (o *consumer) addToRedeliverQueue(seqs ...uint64) {
 	}
 }
 
+// returnMsg puts back a message we loaded but could not deliver so it is picked up again on the next pass.
+// Lock should be held.
+func (o *consumer) returnMsg(seq, dc uint64) {
+	switch {
+	case dc > 1:
+		// Undo the redelivery count and put back at the head of the redeliver queue.
+		if o.rdc[seq] > 1 {
+			o.rdc[seq]--
+		} else {
+			delete(o.rdc, seq)
+		}
+		o.rdq = append([]uint64{seq}, o.rdq...)
+		if o.rdqi == nil {
+			o.rdqi = make(map[uint64]struct{})
+		}
+		o.rdqi[seq] = struct{}{}
+	case seq+1 == o.sseq:
+		o.sseq = seq
+	default:
+		// Was held back or skipped ahead, so retry it before moving on.
+		i := sort.Search(len(o.rtq), func(i int) bool { return o.rtq[i] >= seq })
+		if i < len(o.rtq) && o.rtq[i] == seq {
+			return
+		}
+		o.rtq = append(o.rtq, 0)
+		copy(o.rtq[i+1:], o.rtq[i:])
+		o.rtq[i] = seq
+	}
+}
+
 // Lock should be held.
 func (o *consumer) hasRedeliveries() bool {
 	return len(o.rdq) > 0
@@ -3320,6 +5032,119 @@ func (o *consumer) removeFromRedeliverQueue(seq uint64) bool {
 	return false
 }
 
+// isHeaderFilterMatch returns true if the message headers match all of our header predicates.
+// Lock should be held.
+func (o *consumer) isHeaderFilterMatch(hdr []byte) bool {
+	for _, hp := range o.cfg.HeaderFilter {
+		v := getHeader(hp.Header, hdr)
+		switch {
+		case v == nil:
+			return false
+		case hp.Value != _EMPTY_ && string(v) != hp.Value:
+			return false
+		case hp.Prefix != _EMPTY_ && !bytes.HasPrefix(v, []byte(hp.Prefix)):
+			return false
+		}
+	}
+	return true
+}
+
+// ackSkipped lets the stream know about messages we skipped due to our header filter,
+// as if they were acknowledged, so interest and work queue streams can remove them.
+// Lock should be held.
+func (o *consumer) ackSkipped(seqs []uint64) {
+	mset := o.mset
+	if len(seqs) == 0 || mset == nil || mset.cfg.Retention == LimitsPolicy || o.cfg.AckPolicy == AckNone {
+		return
+	}
+	// Replicated consumers will let the stream know once the acks have propagated.
+	if o.node != nil {
+		acks := make([]SequencePair, 0, len(seqs))
+		for _, seq := range seqs {
+			acks = append(acks, SequencePair{Stream: seq})
+		}
+		o.updateAcksBatch(acks)
+		return
+	}
+	// We can not grab the stream lock while holding ours, so queue these up.
+	// We no longer need these, so the stream can check interest without us.
+	for _, seq := range seqs {
+		mset.ackq.push(seq)
+	}
+}
+
+// deferScheduled will check if a message is scheduled for a future time,
+// and if so will hold it back until it becomes due.
+// Lock should be held.
+func (o *consumer) deferScheduled(sm *StoreMsg) bool {
+	if len(sm.hdr) == 0 {
+		return false
+	}
+	due, err := getMessageSchedule(sm.hdr, sm.ts)
+	if err != nil || due == 0 {
+		return false
+	}
+	now := time.Now().UnixNano()
+	if due <= now {
+		return false
+	}
+	o.addScheduled(sm.seq, due, now)
+	o.updateHeld(sm.seq, true)
+	return true
+}
+
+// Lock should be held.
+func (o *consumer) addScheduled(seq uint64, due, now int64) {
+	if o.sched == nil {
+		o.sched = newMsgTimers()
+	}
+	o.sched.track(seq, due)
+	if o.sched.next() == due {
+		o.setScheduledTimer(now)
+	}
+}
+
+// Will kick our delivery loop when the next scheduled message becomes due.
+// Lock should be held.
+func (o *consumer) setScheduledTimer(now int64) {
+	next := time.Duration(o.sched.next() - now)
+	if o.schedTmr == nil {
+		o.schedTmr = time.AfterFunc(next, o.signalNewMessages)
+	} else {
+		o.schedTmr.Reset(next)
+	}
+}
+
+// getNextScheduled returns the held back sequence that became due first, or 0 if none are due.
+// Lock should be held.
+func (o *consumer) getNextScheduled() uint64 {
+	if o.sched == nil {
+		return 0
+	}
+	now := time.Now().UnixNano()
+	seq := o.sched.popExpired(now)
+	if seq > 0 {
+		o.updateHeld(seq, false)
+	}
+	if o.sched.len() == 0 {
+		o.sched = nil
+		stopAndClearTimer(&o.schedTmr)
+	} else if seq > 0 && o.sched.next() > now {
+		o.setScheduledTimer(now)
+	}
+	return seq
+}
+
+// firstScheduled returns the lowest sequence being held back, or 0 if none.
+// Our ack floor can not move past this.
+// Lock should be held.
+func (o *consumer) firstScheduled() uint64 {
+	if o.sched == nil {
+		return 0
+	}
+	return o.sched.first()
+}
+
 // Checks the pending messages.
 func (o *consumer) checkPending() {
 	o.mu.Lock()
@@ -3357,6 +5182,7 @@ func (o *consumer) checkPending() {
 		if seq < fseq {
 			delete(o.pending, seq)
 			delete(o.rdc, seq)
+			delete(o.nakr, seq)
 			o.removeFromRedeliverQueue(seq)
 			shouldUpdateState = true
 			continue
@@ -3529,12 +5355,12 @@ func (o *consumer) selectStartingSeqNo() {
 			} else if o.cfg.DeliverPolicy == DeliverLast {
 				o.sseq = state.LastSeq
 				// If we are partitioned here this will be properly set when we become leader.
-				if o.cfg.FilterSubject != _EMPTY_ {
-					ss := o.mset.store.FilteredState(1, o.cfg.FilterSubject)
+				if len(o.subjf) > 0 {
+					ss := o.filteredState(1)
 					o.sseq = ss.Last
 				}
 			} else if o.cfg.DeliverPolicy == DeliverLastPerSubject {
-				if mss := o.mset.store.SubjectsState(o.cfg.FilterSubject); len(mss) > 0 {
+				if mss := o.subjectsState(); len(mss) > 0 {
 					o.lss = &lastSeqSkipList{
 						resume: state.LastSeq,
 						seqs:   createLastSeqSkipList(mss),
@@ -3729,11 +5555,15 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 	o.mset = nil
 	o.active = false
 	o.unsubscribe(o.ackSub)
+	o.unsubscribe(o.ackBatchSub)
 	o.unsubscribe(o.reqSub)
 	o.unsubscribe(o.fcSub)
+	o.unsubscribe(o.dlSub)
 	o.ackSub = nil
+	o.ackBatchSub = nil
 	o.reqSub = nil
 	o.fcSub = nil
+	o.dlSub = nil
 	if o.infoSub != nil {
 		o.srv.sysUnsubscribe(o.infoSub)
 		o.infoSub = nil
@@ -3745,6 +5575,8 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 	stopAndClearTimer(&o.ptmr)
 	stopAndClearTimer(&o.dtmr)
 	stopAndClearTimer(&o.gwdtmr)
+	stopAndClearTimer(&o.schedTmr)
+	stopAndClearTimer(&o.pauseTmr)
 	delivery := o.cfg.DeliverSubject
 	o.waiting = nil
 	// Break us out of the readLoop.
@@ -3855,6 +5687,48 @@ func validFilteredSubject(filteredSubject string, subjects []string) bool {
 	return false
 }
 
+// filterSubjects returns the configured subject filters, if any.
+func (cfg *ConsumerConfig) filterSubjects() []string {
+	if len(cfg.FilterSubjects) > 0 {
+		return cfg.FilterSubjects
+	}
+	if cfg.FilterSubject != _EMPTY_ {
+		return []string{cfg.FilterSubject}
+	}
+	return nil
+}
+
+// reduceFilterSubjects removes any filter that is covered by another filter.
+// Filters that only partially overlap can not be reduced, which is reported so
+// that messages matching more than one of them are not counted twice.
+func reduceFilterSubjects(filters []string) (reduced []string, overlap bool) {
+	reduced = make([]string, 0, len(filters))
+	for i, filter := range filters {
+		var covered bool
+		for j, other := range filters {
+			if i == j || !subjectIsSubsetMatch(filter, other) {
+				continue
+			}
+			// For duplicates keep the first one.
+			if filter != other || j < i {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			reduced = append(reduced, filter)
+		}
+	}
+	for i, filter := range reduced {
+		for _, other := range reduced[i+1:] {
+			if SubjectsCollide(filter, other) {
+				return reduced, true
+			}
+		}
+	}
+	return reduced, false
+}
+
 // setInActiveDeleteThreshold sets the delete threshold for how long to wait
 // before deleting an inactive ephemeral consumer.
 func (o *consumer) setInActiveDeleteThreshold(dthresh time.Duration) error {
@@ -3914,12 +5788,12 @@ func (o *consumer) setInitialPendingAndStart() {
 	}
 
 	// !filtered means we want all messages.
-	filtered, dp := o.cfg.FilterSubject != _EMPTY_, o.cfg.DeliverPolicy
+	filtered, dp := len(o.subjf) > 0, o.cfg.DeliverPolicy
 	if filtered {
 		// Check to see if we directly match the configured stream.
 		// Many clients will always send a filtered subject.
 		cfg := &mset.cfg
-		if len(cfg.Subjects) == 1 && cfg.Subjects[0] == o.cfg.FilterSubject {
+		if len(cfg.Subjects) == 1 && len(o.subjf) == 1 && cfg.Subjects[0] == o.subjf[0] {
 			filtered = false
 		}
 	}
@@ -3934,11 +5808,11 @@ func (o *consumer) setInitialPendingAndStart() {
 	} else {
 		// Here we are filtered.
 		if dp == DeliverLastPerSubject && o.hasSkipListPending() && o.sseq < o.lss.resume {
-			ss := mset.store.FilteredState(o.lss.resume+1, o.cfg.FilterSubject)
+			ss := o.filteredState(o.lss.resume + 1)
 			o.sseq = o.lss.seqs[0]
 			o.sgap = ss.Msgs + uint64(len(o.lss.seqs))
 			o.lsgap = ss.Last
-		} else if ss := mset.store.FilteredState(o.sseq, o.cfg.FilterSubject); ss.Msgs > 0 {
+		} else if ss := o.filteredState(o.sseq); ss.Msgs > 0 {
 			o.sgap = ss.Msgs
 			o.lsgap = ss.Last
 			// See if we should update our starting sequence.
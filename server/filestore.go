@@ -16,6 +16,7 @@ package server
 import (
 	"archive/tar"
 	"bytes"
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha256"
@@ -56,6 +57,12 @@ type FileStoreConfig struct {
 	SyncInterval time.Duration
 	// AsyncFlush allows async flush to batch write operations.
 	AsyncFlush bool
+	// Cipher is the cipher to use when encrypting new assets.
+	Cipher StoreCipher
+	// Archive is where sealed blocks are moved when the stream has a tier policy.
+	Archive BlockArchive
+	// ArchivePrefix is prepended to the keys of our blocks in the archive.
+	ArchivePrefix string
 }
 
 // FileStreamInfo allows us to remember created time.
@@ -84,9 +91,18 @@ type fileStore struct {
 	scb     StorageUpdateHandler
 	ageChk  *time.Timer
 	syncTmr *time.Timer
+	ttls    *msgTimers
+	ttlChk  *time.Timer
+	ttlNext int64
+	ttlw    bool
+	scheds  *msgTimers
+	schedw  bool
+	tierChk *time.Timer
+	acache  *archiveCache
 	cfg     FileStreamInfo
 	fcfg    FileStoreConfig
 	prf     keyGen
+	oldprf  keyGen
 	aek     cipher.AEAD
 	lmb     *msgBlock
 	blks    []*msgBlock
@@ -94,6 +110,7 @@ type fileStore struct {
 	hh      hash.Hash64
 	qch     chan struct{}
 	cfs     []*consumerFileStore
+	mcs     int
 	sips    int
 	closed  bool
 	fip     bool
@@ -108,7 +125,8 @@ type msgBlock struct {
 	mu      sync.RWMutex
 	fs      *fileStore
 	aek     cipher.AEAD
-	bek     *chacha20.Cipher
+	bek     cipher.Stream
+	sc      StoreCipher
 	seed    []byte
 	nonce   []byte
 	mfn     string
@@ -127,6 +145,7 @@ type msgBlock struct {
 	lwts    int64
 	llts    int64
 	lrts    int64
+	lwfts   int64
 	llseq   uint64
 	hh      hash.Hash64
 	cache   *cache
@@ -141,6 +160,10 @@ type msgBlock struct {
 	qch     chan struct{}
 	lchk    [8]byte
 	closed  bool
+	cmp     StoreCompression // Compression of the block on disk.
+	cbytes  uint64           // Compressed bytes on disk.
+	arch    bool             // Block contents have been moved to the archive.
+	afn     string
 }
 
 // Write through caching layer that is also used on loading messages.
@@ -180,12 +203,18 @@ const (
 	indexScan = "%d.idx"
 	// used to load per subject meta information.
 	fssScan = "%d.fss"
+	// Version of the per subject meta information.
+	fssVersion = uint8(2)
 	// to look for orphans
 	fssScanAll = "*.fss"
 	// used to store our block encryption key.
 	keyScan = "%d.key"
 	// to look for orphans
 	keyScanAll = "*.key"
+	// used to store the per-message TTL index.
+	ttlIdxFile = "ttl.idx"
+	// used to store the message schedule index.
+	schedIdxFile = "sched.idx"
 	// This is where we keep state on consumers.
 	consumerDir = "obs"
 	// Index file for a consumer.
@@ -212,9 +241,10 @@ const (
 	JetStreamMetaFileSum = "meta.sum"
 	JetStreamMetaFileKey = "meta.key"
 
-	// AEK key sizes
+	// AEK key sizes, AES uses a smaller nonce.
 	metaKeySize = 72
 	blkKeySize  = 72
+	aesKeySize  = 60
 
 	// Default stream block size.
 	defaultLargeBlockSize = 16 * 1024 * 1024 // 16MB
@@ -237,13 +267,19 @@ const (
 	rlBadThresh = 32 * 1024 * 1024
 	// Time threshold to write index info.
 	wiThresh = int64(2 * time.Second)
+	// Size of the header for compressed message blocks.
+	cmpHdrSize = 16
+	// Magic for compressed message blocks.
+	cmpMagic = uint8(23)
 )
 
 func newFileStore(fcfg FileStoreConfig, cfg StreamConfig) (*fileStore, error) {
-	return newFileStoreWithCreated(fcfg, cfg, time.Now().UTC(), nil)
+	return newFileStoreWithCreated(fcfg, cfg, time.Now().UTC(), nil, nil)
 }
 
-func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf keyGen) (*fileStore, error) {
+// The oldprf is our previous master key, if any. Asset keys still wrapped
+// with it will be re-wrapped with prf as they are recovered.
+func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf, oldprf keyGen) (*fileStore, error) {
 	if cfg.Name == _EMPTY_ {
 		return nil, fmt.Errorf("name required")
 	}
@@ -280,11 +316,20 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	os.Remove(tmpfile.Name())
 
 	fs := &fileStore{
-		fcfg: fcfg,
-		cfg:  FileStreamInfo{Created: created, StreamConfig: cfg},
-		psmc: make(map[string]uint64),
-		prf:  prf,
-		qch:  make(chan struct{}),
+		fcfg:   fcfg,
+		cfg:    FileStreamInfo{Created: created, StreamConfig: cfg},
+		psmc:   make(map[string]uint64),
+		prf:    prf,
+		oldprf: oldprf,
+		qch:    make(chan struct{}),
+	}
+	if cfg.Tier != nil {
+		if fcfg.Archive == nil {
+			return nil, errNoArchive
+		}
+		fs.acache = newArchiveCache(cfg.Tier.CacheBlocks)
+	} else {
+		fs.acache = newArchiveCache(0)
 	}
 
 	// Set flush in place to AsyncFlush which by default is false.
@@ -327,10 +372,19 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	// This can happen on snapshot restores or conversions.
 	if fs.prf != nil {
 		keyFile := filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFileKey)
-		if _, err := os.Stat(keyFile); err != nil && os.IsNotExist(err) {
+		if ekey, err := ioutil.ReadFile(keyFile); err != nil && os.IsNotExist(err) {
 			if err := fs.writeStreamMeta(); err != nil {
 				return nil, err
 			}
+		} else if err == nil && fs.aek == nil {
+			// Recover our meta key, converting from our previous master key if needed.
+			sc, seed, _, err := fs.recoverKey(keyFile, fs.cfg.Name, ekey)
+			if err != nil {
+				return nil, err
+			}
+			if fs.aek, err = genEncryptionKey(sc, seed); err != nil {
+				return nil, err
+			}
 		}
 	}
 
@@ -349,6 +403,9 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 	if cfg.Storage != FileStorage {
 		return fmt.Errorf("fileStore requires file storage type in config")
 	}
+	if cfg.Tier != nil && fs.fcfg.Archive == nil {
+		return errNoArchive
+	}
 
 	fs.mu.Lock()
 	new_cfg := FileStreamInfo{Created: fs.cfg.Created, StreamConfig: *cfg}
@@ -372,6 +429,25 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 		fs.ageChk.Stop()
 		fs.ageChk = nil
 	}
+
+	// Tier timers. Blocks already archived will stay there.
+	if fs.cfg.Tier != nil {
+		fs.acache.setMax(fs.cfg.Tier.CacheBlocks)
+		fs.startTierChk()
+	} else {
+		fs.acache.setMax(0)
+		fs.cancelTierChk()
+	}
+
+	// If we now allow message schedules make sure we know about any already stored.
+	// Anything we may have persisted before could be out of date, so rebuild from our messages.
+	if fs.cfg.AllowMsgSchedules && !old_cfg.AllowMsgSchedules {
+		os.Remove(filepath.Join(fs.fcfg.StoreDir, msgDir, schedIdxFile))
+		fs.recoverMsgTimers(false, true)
+	} else if !fs.cfg.AllowMsgSchedules && old_cfg.AllowMsgSchedules {
+		fs.scheds, fs.schedw = nil, true
+		fs.writeSchedIndex()
+	}
 	fs.mu.Unlock()
 
 	if cfg.MaxAge != 0 {
@@ -406,7 +482,7 @@ func dynBlkSize(retention RetentionPolicy, maxBytes int64) uint64 {
 }
 
 // Generate an asset encryption key from the context and server PRF.
-func (fs *fileStore) genEncryptionKeys(context string) (aek cipher.AEAD, bek *chacha20.Cipher, seed, encrypted []byte, err error) {
+func (fs *fileStore) genEncryptionKeys(context string) (aek cipher.AEAD, bek cipher.Stream, seed, encrypted []byte, err error) {
 	if fs.prf == nil {
 		return nil, nil, nil, nil, errNoEncryption
 	}
@@ -415,7 +491,8 @@ func (fs *fileStore) genEncryptionKeys(context string) (aek cipher.AEAD, bek *ch
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
-	kek, err := chacha20poly1305.NewX(rb)
+	sc := fs.fcfg.Cipher
+	kek, err := genEncryptionKey(sc, rb)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
@@ -424,15 +501,17 @@ func (fs *fileStore) genEncryptionKeys(context string) (aek cipher.AEAD, bek *ch
 	if n, err := rand.Read(seed); err != nil || n != 32 {
 		return nil, nil, nil, nil, err
 	}
-	aek, err = chacha20poly1305.NewX(seed)
+	aek, err = genEncryptionKey(sc, seed)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
 	// Generate our nonce. Use same buffer to hold encrypted seed.
 	nonce := make([]byte, kek.NonceSize(), kek.NonceSize()+len(seed)+kek.Overhead())
-	mrand.Read(nonce)
-	bek, err = chacha20.NewUnauthenticatedCipher(seed[:], nonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, nil, nil, err
+	}
+	bek, err = genBlockEncryptionKey(sc, seed[:], nonce)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
@@ -440,6 +519,233 @@ func (fs *fileStore) genEncryptionKeys(context string) (aek cipher.AEAD, bek *ch
 	return aek, bek, seed, kek.Seal(nonce, nonce, seed, nil), nil
 }
 
+// Return the AEAD for the given cipher and key.
+func genEncryptionKey(sc StoreCipher, key []byte) (cipher.AEAD, error) {
+	switch sc {
+	case ChaCha:
+		return chacha20poly1305.NewX(key)
+	case AES:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	}
+	return nil, errUnknownCipher
+}
+
+// Return the stream cipher used to encrypt message block data.
+// This is not authenticated, the records in the block carry their own checksums.
+func genBlockEncryptionKey(sc StoreCipher, seed, nonce []byte) (cipher.Stream, error) {
+	switch sc {
+	case ChaCha:
+		bek, err := chacha20.NewUnauthenticatedCipher(seed, nonce)
+		if err != nil {
+			return nil, err
+		}
+		return bek, nil
+	case AES:
+		block, err := aes.NewCipher(seed)
+		if err != nil {
+			return nil, err
+		}
+		// The nonce followed by a zeroed counter is our IV.
+		iv := make([]byte, aes.BlockSize)
+		copy(iv, nonce)
+		return cipher.NewCTR(block, iv), nil
+	}
+	return nil, errUnknownCipher
+}
+
+// Determine the cipher used for an encrypted key from its size.
+func cipherForKeySize(sz int) (StoreCipher, error) {
+	switch sz {
+	case blkKeySize:
+		return ChaCha, nil
+	case aesKeySize:
+		return AES, nil
+	}
+	return ChaCha, errBadKeySize
+}
+
+// Wrap an asset seed with the key encryption key derived from prf and context.
+// The nonce is kept as is since message blocks also use it for their data.
+func wrapKey(prf keyGen, sc StoreCipher, context string, seed, nonce []byte) ([]byte, error) {
+	rb, err := prf([]byte(context))
+	if err != nil {
+		return nil, err
+	}
+	kek, err := genEncryptionKey(sc, rb)
+	if err != nil {
+		return nil, err
+	}
+	ekey := make([]byte, 0, len(nonce)+len(seed)+kek.Overhead())
+	ekey = append(ekey, nonce...)
+	return kek.Seal(ekey, nonce, seed, nil), nil
+}
+
+// Unwrap an encrypted key with the key encryption key derived from prf and context.
+func unwrapKey(prf keyGen, sc StoreCipher, context string, ekey []byte) (seed, nonce []byte, err error) {
+	rb, err := prf([]byte(context))
+	if err != nil {
+		return nil, nil, err
+	}
+	kek, err := genEncryptionKey(sc, rb)
+	if err != nil {
+		return nil, nil, err
+	}
+	ns := kek.NonceSize()
+	if len(ekey) < ns {
+		return nil, nil, errBadKeySize
+	}
+	if seed, err = kek.Open(nil, ekey[:ns], ekey[ns:], nil); err != nil {
+		return nil, nil, err
+	}
+	return seed, ekey[:ns], nil
+}
+
+// Recover the seed and nonce from an encrypted key. If the key was still wrapped with
+// our previous master key we re-wrap it with our current one and write it back out.
+func (fs *fileStore) recoverKey(keyFile, context string, ekey []byte) (sc StoreCipher, seed, nonce []byte, err error) {
+	if sc, err = cipherForKeySize(len(ekey)); err != nil {
+		return sc, nil, nil, err
+	}
+	if seed, nonce, err = unwrapKey(fs.prf, sc, context, ekey); err == nil || fs.oldprf == nil {
+		return sc, seed, nonce, err
+	}
+	if seed, nonce, err = unwrapKey(fs.oldprf, sc, context, ekey); err != nil {
+		return sc, nil, nil, err
+	}
+	if ekey, err = wrapKey(fs.prf, sc, context, seed, nonce); err != nil {
+		return sc, nil, nil, err
+	}
+	return sc, seed, nonce, writeKeyFile(keyFile, ekey)
+}
+
+// Write out an encrypted key. We write to a temporary file and rename
+// so we never leave a partially written key behind.
+func writeKeyFile(keyFile string, ekey []byte) error {
+	tmp := keyFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, ekey, defaultFilePerms); err != nil {
+		return err
+	}
+	return os.Rename(tmp, keyFile)
+}
+
+// Rotate our master key. The encrypted keys for our stream meta, message blocks and
+// consumers are re-wrapped with key encryption keys derived from prf. The asset keys
+// themselves do not change so no data needs to be rewritten. Both keys are tracked until
+// everything has been converted. If we fail part way through, whatever is left will be
+// converted on recovery as long as the previous key is still configured.
+func (fs *fileStore) rotateEncryptionKey(prf keyGen) error {
+	if prf == nil {
+		return errNoEncryption
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.prf == nil {
+		return errNoEncryption
+	}
+	fs.oldprf, fs.prf = fs.prf, prf
+
+	rewrap := func(keyFile, context string) error {
+		ekey, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		_, _, _, err = fs.recoverKey(keyFile, context, ekey)
+		return err
+	}
+
+	if err := rewrap(filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFileKey), fs.cfg.Name); err != nil {
+		return err
+	}
+	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
+	for _, mb := range fs.blks {
+		mb.mu.Lock()
+		err := rewrap(filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index)), fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index))
+		mb.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	for _, o := range fs.cfs {
+		o.mu.Lock()
+		o.prf = prf
+		odir, name := o.odir, o.name
+		o.mu.Unlock()
+		if odir == _EMPTY_ {
+			continue
+		}
+		if err := rewrap(filepath.Join(odir, JetStreamMetaFileKey), fs.cfg.Name+tsep+name); err != nil {
+			return err
+		}
+	}
+	fs.oldprf = nil
+
+	return nil
+}
+
+// Rotate the master key for a stream that is not loaded. The encrypted keys found in
+// the stream directory that are still wrapped with oldprf are re-wrapped with prf.
+func rotateStreamKeyFiles(sdir, name string, prf, oldprf keyGen) error {
+	if prf == nil {
+		return errNoEncryption
+	}
+	rewrap := func(keyFile, context string) error {
+		ekey, err := ioutil.ReadFile(keyFile)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		sc, err := cipherForKeySize(len(ekey))
+		if err != nil {
+			return err
+		}
+		if _, _, err = unwrapKey(prf, sc, context, ekey); err == nil || oldprf == nil {
+			return err
+		}
+		seed, nonce, err := unwrapKey(oldprf, sc, context, ekey)
+		if err != nil {
+			return err
+		}
+		if ekey, err = wrapKey(prf, sc, context, seed, nonce); err != nil {
+			return err
+		}
+		return writeKeyFile(keyFile, ekey)
+	}
+
+	if err := rewrap(filepath.Join(sdir, JetStreamMetaFileKey), name); err != nil {
+		return err
+	}
+	fis, _ := ioutil.ReadDir(filepath.Join(sdir, msgDir))
+	for _, fi := range fis {
+		var index uint64
+		if n, err := fmt.Sscanf(fi.Name(), keyScan, &index); err != nil || n != 1 {
+			continue
+		}
+		if err := rewrap(filepath.Join(sdir, msgDir, fi.Name()), fmt.Sprintf("%s:%d", name, index)); err != nil {
+			return err
+		}
+	}
+	fis, _ = ioutil.ReadDir(filepath.Join(sdir, consumerDir))
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		if err := rewrap(filepath.Join(sdir, consumerDir, fi.Name(), JetStreamMetaFileKey), name+tsep+fi.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Write out meta and the checksum.
 // Lock should be held.
 func (fs *fileStore) writeStreamMeta() error {
@@ -469,7 +775,9 @@ func (fs *fileStore) writeStreamMeta() error {
 	// Encrypt if needed.
 	if fs.aek != nil {
 		nonce := make([]byte, fs.aek.NonceSize(), fs.aek.NonceSize()+len(b)+fs.aek.Overhead())
-		mrand.Read(nonce)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
 		b = fs.aek.Seal(nonce, nonce, b, nil)
 	}
 
@@ -550,7 +858,11 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) (*msgBlock, e
 	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire}
 
 	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
-	mb.mfn = filepath.Join(mdir, fi.Name())
+	mb.mfn = filepath.Join(mdir, fmt.Sprintf(blkScan, index))
+	// Check if this block has been moved to our archive.
+	if afn := filepath.Join(mdir, fmt.Sprintf(arcScan, index)); fi.Name() == filepath.Base(afn) {
+		mb.arch, mb.afn = true, afn
+	}
 	mb.ifn = filepath.Join(mdir, fmt.Sprintf(indexScan, index))
 	mb.sfn = filepath.Join(mdir, fmt.Sprintf(fssScan, index))
 
@@ -563,7 +875,8 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) (*msgBlock, e
 
 	// Check if encryption is enabled.
 	if fs.prf != nil {
-		ekey, err := ioutil.ReadFile(filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index)))
+		keyFile := filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index))
+		ekey, err := ioutil.ReadFile(keyFile)
 		if err != nil {
 			// We do not seem to have keys even though we should. Could be a plaintext conversion.
 			// Create the keys and we will double check below.
@@ -572,28 +885,16 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) (*msgBlock, e
 			}
 			createdKeys = true
 		} else {
-			if len(ekey) != blkKeySize {
-				return nil, errBadKeySize
-			}
-			// Recover key encryption key.
-			rb, err := fs.prf([]byte(fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index)))
-			if err != nil {
-				return nil, err
-			}
-			kek, err := chacha20poly1305.NewX(rb)
-			if err != nil {
-				return nil, err
-			}
-			ns := kek.NonceSize()
-			seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
+			// Recover our keys, converting from our previous master key if needed.
+			sc, seed, nonce, err := fs.recoverKey(keyFile, fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index), ekey)
 			if err != nil {
 				return nil, err
 			}
-			mb.seed, mb.nonce = seed, ekey[:ns]
-			if mb.aek, err = chacha20poly1305.NewX(seed); err != nil {
+			mb.sc, mb.seed, mb.nonce, mb.kfn = sc, seed, nonce, keyFile
+			if mb.aek, err = genEncryptionKey(sc, seed); err != nil {
 				return nil, err
 			}
-			if mb.bek, err = chacha20.NewUnauthenticatedCipher(seed, ekey[:ns]); err != nil {
+			if mb.bek, err = genBlockEncryptionKey(sc, seed, nonce); err != nil {
 				return nil, err
 			}
 		}
@@ -601,18 +902,26 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) (*msgBlock, e
 
 	// If we created keys here, let's check the data and if it is plaintext convert here.
 	if createdKeys {
+		// We will need to rewrite the block so bring it back if archived.
+		if err := mb.restoreLocked(); err != nil {
+			return nil, err
+		}
 		buf, err := mb.loadBlock(nil)
 		if err != nil {
 			return nil, err
 		}
-		if err := mb.indexCacheBuf(buf); err != nil {
+		raw, _, err := decompressBlockBuf(buf)
+		if err != nil {
+			return nil, err
+		}
+		if err := mb.indexCacheBuf(raw); err != nil {
 			// This likely indicates this was already encrypted or corrupt.
 			mb.cache = nil
 			return nil, err
 		}
 		// Undo cache from above for later.
 		mb.cache = nil
-		wbek, err := chacha20.NewUnauthenticatedCipher(mb.seed, mb.nonce)
+		wbek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
 		if err != nil {
 			return nil, err
 		}
@@ -633,21 +942,47 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) (*msgBlock, e
 
 	// Open up the message file, but we will try to recover from the index file.
 	// We will check that the last checksums match.
-	file, err := os.Open(mb.mfn)
-	if err != nil {
-		return nil, err
+	// For archived blocks we have what we need in the marker file.
+	var size int64
+	var lchk [8]byte
+	var chdr [cmpHdrSize]byte
+	if mb.arch {
+		var err error
+		if size, lchk, chdr, err = readArchiveMarker(mb.afn); err != nil {
+			return nil, err
+		}
+	} else {
+		file, err := os.Open(mb.mfn)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		if fi, err := file.Stat(); fi != nil {
+			size = fi.Size()
+		} else {
+			return nil, err
+		}
+		// Grab last checksum from main block file.
+		file.ReadAt(lchk[:], size-8)
+		if n, _ := file.ReadAt(chdr[:], 0); n != cmpHdrSize {
+			chdr = [cmpHdrSize]byte{}
+		}
+		file.Close()
 	}
-	defer file.Close()
+	mb.rbytes = uint64(size)
 
-	if fi, err := file.Stat(); fi != nil {
-		mb.rbytes = uint64(fi.Size())
-	} else {
-		return nil, err
+	// Check if this block has been compressed.
+	if size >= cmpHdrSize {
+		if mb.bek != nil {
+			if rbek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce); err == nil {
+				rbek.XORKeyStream(chdr[:], chdr[:])
+			}
+		}
+		if alg, rsz, ok := compressedBlockHeader(chdr[:]); ok {
+			mb.cmp, mb.cbytes, mb.rbytes = alg, uint64(size), rsz
+		}
 	}
-	// Grab last checksum from main block file.
-	var lchk [8]byte
-	file.ReadAt(lchk[:], fi.Size()-8)
-	file.Close()
 
 	// Read our index file. Use this as source of truth if possible.
 	if err := mb.readIndexInfo(); err == nil {
@@ -671,6 +1006,11 @@ func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint64) (*msgBlock, e
 
 	// Rewrite this to make sure we are sync'd.
 	mb.writeIndexInfo()
+	if fs.tms {
+		mb.mu.Lock()
+		mb.writePerSubjectInfo()
+		mb.mu.Unlock()
+	}
 	mb.closeFDs()
 	fs.blks = append(fs.blks, mb)
 	fs.lmb = mb
@@ -742,13 +1082,22 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	// Check if we need to decrypt.
 	if mb.bek != nil && len(buf) > 0 {
 		// Recreate to reset counter.
-		mb.bek, err = chacha20.NewUnauthenticatedCipher(mb.seed, mb.nonce)
+		mb.bek, err = genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
 		if err != nil {
 			return nil, err
 		}
 		mb.bek.XORKeyStream(buf, buf)
 	}
 
+	// Check if we need to decompress.
+	cbytes := uint64(len(buf))
+	if buf, mb.cmp, err = decompressBlockBuf(buf); err != nil {
+		return nil, err
+	}
+	if mb.cbytes = 0; mb.cmp != NoCompression {
+		mb.cbytes = cbytes
+	}
+
 	mb.rbytes = uint64(len(buf))
 
 	addToDmap := func(seq uint64) {
@@ -764,6 +1113,10 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	var le = binary.LittleEndian
 
 	truncate := func(index uint32) {
+		// Can not truncate a compressed or archived block in place.
+		if mb.cmp != NoCompression || mb.arch {
+			return
+		}
 		var fd *os.File
 		if mb.mfd != nil {
 			fd = mb.mfd
@@ -926,7 +1279,22 @@ func (fs *fileStore) recoverMsgs() error {
 	// These can come in a random order, so account for that.
 	for _, fi := range fis {
 		var index uint64
+		isBlk := false
 		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
+			isBlk = true
+		} else if n, err := fmt.Sscanf(fi.Name(), arcScan, &index); err == nil && n == 1 {
+			// If we still have the block locally we were interrupted moving it to or from
+			// the archive, so prefer our local copy.
+			if _, err := os.Stat(filepath.Join(mdir, fmt.Sprintf(blkScan, index))); err == nil {
+				os.Remove(filepath.Join(mdir, fi.Name()))
+				if fs.fcfg.Archive != nil {
+					fs.fcfg.Archive.Remove(fs.archiveKey(index))
+				}
+			} else {
+				isBlk = true
+			}
+		}
+		if isBlk {
 			if mb, err := fs.recoverMsgBlock(fi, index); err == nil && mb != nil {
 				if fs.state.FirstSeq == 0 || mb.first.seq < fs.state.FirstSeq {
 					fs.state.FirstSeq = mb.first.seq
@@ -962,27 +1330,22 @@ func (fs *fileStore) recoverMsgs() error {
 		return err
 	}
 
-	// We had a bug that would leave fss files around during a snapshot.
-	// Clean them up here if we see them.
-	if fms, err := filepath.Glob(filepath.Join(mdir, fssScanAll)); err == nil && len(fms) > 0 {
-		for _, fn := range fms {
-			os.Remove(fn)
-		}
-	}
-	// Same bug for keyfiles but for these we just need to identify orphans.
-	if kms, err := filepath.Glob(filepath.Join(mdir, keyScanAll)); err == nil && len(kms) > 0 {
-		valid := make(map[uint64]bool)
-		for _, mb := range fs.blks {
-			valid[mb.index] = true
-		}
-		for _, fn := range kms {
-			var index uint64
-			shouldRemove := true
-			if n, err := fmt.Sscanf(filepath.Base(fn), keyScan, &index); err == nil && n == 1 && valid[index] {
-				shouldRemove = false
-			}
-			if shouldRemove {
-				os.Remove(fn)
+	// Per subject info and keyfiles are kept with their blocks, but we need to identify orphans.
+	valid := make(map[uint64]bool)
+	for _, mb := range fs.blks {
+		valid[mb.index] = true
+	}
+	for _, scan := range []struct{ all, format string }{{fssScanAll, fssScan}, {keyScanAll, keyScan}} {
+		if fns, err := filepath.Glob(filepath.Join(mdir, scan.all)); err == nil && len(fns) > 0 {
+			for _, fn := range fns {
+				var index uint64
+				shouldRemove := true
+				if n, err := fmt.Sscanf(filepath.Base(fn), scan.format, &index); err == nil && n == 1 && valid[index] {
+					shouldRemove = false
+				}
+				if shouldRemove {
+					os.Remove(fn)
+				}
 			}
 		}
 	}
@@ -997,6 +1360,14 @@ func (fs *fileStore) recoverMsgs() error {
 		fs.startAgeChk()
 	}
 
+	// Recover any per-message TTLs and message schedules. Expired messages will be removed when our timer fires.
+	if fs.cfg.AllowMsgTTL || fs.cfg.AllowMsgSchedules {
+		fs.recoverMsgTimers(fs.cfg.AllowMsgTTL, fs.cfg.AllowMsgSchedules)
+	}
+
+	// Move any cold blocks to our archive when our timer fires.
+	fs.startTierChk()
+
 	return nil
 }
 
@@ -1538,10 +1909,21 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 	if lmb := fs.lmb; lmb != nil {
 		index = lmb.index + 1
 
+		// This block is now sealed, so compress if needed.
+		if alg := fs.cfg.Compression; alg != NoCompression {
+			defer func() { go lmb.compressBlock(alg) }()
+		}
+
 		// Make sure to write out our index file if needed.
 		if lmb.indexNeedsUpdate() {
 			lmb.writeIndexInfo()
 		}
+		// Same for our per subject info, which will not change much once sealed.
+		if fs.tms {
+			lmb.mu.Lock()
+			lmb.writePerSubjectInfo()
+			lmb.mu.Unlock()
+		}
 
 		// Determine if we can reclaim any resources here.
 		if fs.fip {
@@ -1632,7 +2014,7 @@ func (fs *fileStore) genEncryptionKeysForBlock(mb *msgBlock) error {
 	if err != nil {
 		return err
 	}
-	mb.aek, mb.bek, mb.seed, mb.nonce = key, bek, seed, encrypted[:key.NonceSize()]
+	mb.aek, mb.bek, mb.sc, mb.seed, mb.nonce = key, bek, fs.fcfg.Cipher, seed, encrypted[:key.NonceSize()]
 	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
 	keyFile := filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index))
 	if _, err := os.Stat(keyFile); err != nil && !os.IsNotExist(err) {
@@ -1662,6 +2044,9 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 				asl = true
 			}
 		}
+		if asl && fs.cfg.DiscardNewPer {
+			return ErrMaxMsgsPerSubject
+		}
 		if fs.cfg.MaxMsgs > 0 && fs.state.Msgs >= uint64(fs.cfg.MaxMsgs) {
 			if !asl {
 				return ErrMaxMsgs
@@ -1721,6 +2106,23 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 		fs.startAgeChk()
 	}
 
+	// Track any per-message TTL.
+	if fs.cfg.AllowMsgTTL && len(hdr) > 0 {
+		if ttl, err := getMessageTTL(hdr); err == nil && ttl > 0 {
+			fs.trackMsgTTL(seq, ts+int64(ttl))
+		}
+	}
+	// Track any message schedule.
+	if fs.cfg.AllowMsgSchedules && len(hdr) > 0 {
+		if due, err := getMessageSchedule(hdr, ts); err == nil && due > 0 {
+			if fs.scheds == nil {
+				fs.scheds = newMsgTimers()
+			}
+			fs.scheds.track(seq, due)
+			fs.schedw = true
+		}
+	}
+
 	return nil
 }
 
@@ -1991,6 +2393,14 @@ func (fs *fileStore) removeMsg(seq uint64, secure, needFSLock bool) (bool, error
 	fs.removePerSubject(sm.subj)
 	mb.removeSeqPerSubject(sm.subj, seq, &smv)
 
+	// Remove from any per-message TTL tracking.
+	if fs.ttls != nil && fs.ttls.untrack(seq) {
+		fs.ttlw = true
+	}
+	if fs.scheds != nil && fs.scheds.untrack(seq) {
+		fs.schedw = true
+	}
+
 	var shouldWriteIndex, firstSeqNeedsUpdate bool
 
 	if secure {
@@ -2100,6 +2510,10 @@ func (fs *fileStore) removeMsg(seq uint64, secure, needFSLock bool) (bool, error
 // writing new messages. We will silently bail on any issues with the underlying block and let someone else detect.
 // Write lock needs to be held.
 func (mb *msgBlock) compact() {
+	// We will rewrite the block so bring it back if archived.
+	if err := mb.restoreLocked(); err != nil {
+		return
+	}
 	if mb.cacheNotLoaded() {
 		if err := mb.loadMsgsWithLock(); err != nil {
 			return
@@ -2167,10 +2581,15 @@ func (mb *msgBlock) compact() {
 		index += rl
 	}
 
+	// Keep the block compressed if it was.
+	if mb.cmp != NoCompression && len(nbuf) > 0 {
+		nbuf = compressBlockBuf(nbuf, mb.cmp)
+	}
+
 	// Check for encryption.
 	if mb.bek != nil && len(nbuf) > 0 {
 		// Recreate to reset counter.
-		rbek, err := chacha20.NewUnauthenticatedCipher(mb.seed, mb.nonce)
+		rbek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
 		if err != nil {
 			return
 		}
@@ -2345,6 +2764,10 @@ func (mb *msgBlock) flushLoop(fch, qch chan struct{}) {
 
 // Lock should be held.
 func (mb *msgBlock) eraseMsg(seq uint64, ri, rl int) error {
+	// We will rewrite the block so bring it back if archived.
+	if err := mb.restoreLocked(); err != nil {
+		return err
+	}
 	var le = binary.LittleEndian
 	var hdr [msgHdrSize]byte
 
@@ -2380,6 +2803,14 @@ func (mb *msgBlock) eraseMsg(seq uint64, ri, rl int) error {
 		copy(buf, nbytes)
 	}
 
+	// Compressed blocks need to be rewritten as a whole.
+	if mb.cmp != NoCompression {
+		if mb.cache.off != 0 {
+			return errPartialCache
+		}
+		return mb.writeCompressedLocked(mb.cache.buf, mb.cmp)
+	}
+
 	// Disk
 	if mb.cache.off+mb.cache.wp > ri {
 		mfd, err := os.OpenFile(mb.mfn, os.O_RDWR, defaultFilePerms)
@@ -2676,45 +3107,335 @@ func (fs *fileStore) startAgeChk() {
 }
 
 // Lock should be held.
-func (fs *fileStore) resetAgeChk(delta int64) {
-	fireIn := fs.cfg.MaxAge
-	if delta > 0 {
-		fireIn = time.Duration(delta)
+func (fs *fileStore) resetAgeChk(delta int64) {
+	fireIn := fs.cfg.MaxAge
+	if delta > 0 {
+		fireIn = time.Duration(delta)
+	}
+	if fs.ageChk != nil {
+		fs.ageChk.Reset(fireIn)
+	} else {
+		fs.ageChk = time.AfterFunc(fireIn, fs.expireMsgs)
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelAgeChk() {
+	if fs.ageChk != nil {
+		fs.ageChk.Stop()
+		fs.ageChk = nil
+	}
+}
+
+// Will expire msgs that are too old.
+func (fs *fileStore) expireMsgs() {
+	// We need to delete one by one here and can not optimize for the time being.
+	// Reason is that we need more information to adjust ack pending in consumers.
+	var smv StoreMsg
+	var sm *StoreMsg
+	minAge := time.Now().UnixNano() - int64(fs.cfg.MaxAge)
+	for sm, _ = fs.msgForSeq(0, &smv); sm != nil && sm.ts <= minAge; sm, _ = fs.msgForSeq(0, &smv) {
+		fs.removeMsg(sm.seq, false, true)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if sm == nil {
+		fs.cancelAgeChk()
+	} else {
+		fs.resetAgeChk(sm.ts - minAge)
+	}
+}
+
+// Will track the expiration of a message with a per-message TTL.
+// Lock should be held.
+func (fs *fileStore) trackMsgTTL(seq uint64, exp int64) {
+	if fs.ttls == nil {
+		fs.ttls = newMsgTimers()
+	}
+	fs.ttls.track(seq, exp)
+	fs.ttlw = true
+	if fs.ttlChk == nil || exp < fs.ttlNext {
+		fs.resetTTLChk(exp)
+	}
+}
+
+// Will reset the per-message TTL timer to fire at the expiration time.
+// Lock should be held.
+func (fs *fileStore) resetTTLChk(exp int64) {
+	fs.ttlNext = exp
+	fireIn := time.Duration(exp - time.Now().UnixNano())
+	if fs.ttlChk != nil {
+		fs.ttlChk.Reset(fireIn)
+	} else {
+		fs.ttlChk = time.AfterFunc(fireIn, fs.expireMsgTTLs)
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelTTLChk() {
+	if fs.ttlChk != nil {
+		fs.ttlChk.Stop()
+		fs.ttlChk = nil
+	}
+}
+
+// Will expire msgs whose per-message TTL has passed.
+func (fs *fileStore) expireMsgTTLs() {
+	fs.mu.Lock()
+	if fs.closed || fs.ttls == nil {
+		fs.mu.Unlock()
+		return
+	}
+	// Anything below our first sequence is already gone.
+	fs.ttls.removeBelow(fs.state.FirstSeq)
+	now := time.Now().UnixNano()
+	var seqs []uint64
+	for seq := fs.ttls.popExpired(now); seq > 0; seq = fs.ttls.popExpired(now) {
+		if seq <= fs.state.LastSeq {
+			seqs = append(seqs, seq)
+		}
+		fs.ttlw = true
+	}
+	fs.mu.Unlock()
+
+	// Same as with age expiration we remove these one by one.
+	var retry []uint64
+	for i, seq := range seqs {
+		if _, err := fs.removeMsg(seq, false, true); err == ErrStoreSnapshotInProgress {
+			retry = seqs[i:]
+			break
+		}
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		fs.cancelTTLChk()
+		return
+	}
+	if len(retry) > 0 {
+		// Put these back so we can try again.
+		for _, seq := range retry {
+			fs.ttls.track(seq, now)
+		}
+		fs.resetTTLChk(time.Now().Add(time.Second).UnixNano())
+		return
+	}
+	if next := fs.ttls.next(); next == 0 {
+		fs.cancelTTLChk()
+	} else {
+		fs.resetTTLChk(next)
+	}
+}
+
+// Will write out the per-message TTL index if it has changed.
+// Lock should be held.
+func (fs *fileStore) writeTTLIndex() error {
+	if !fs.ttlw {
+		return nil
+	}
+	fs.ttlw = false
+	return fs.writeMsgTimers(filepath.Join(fs.fcfg.StoreDir, msgDir, ttlIdxFile), fs.ttls)
+}
+
+// Will write out the message schedule index if it has changed.
+// Lock should be held.
+func (fs *fileStore) writeSchedIndex() error {
+	if !fs.schedw {
+		return nil
+	}
+	fs.schedw = false
+	fs.pruneMsgSchedules()
+	return fs.writeMsgTimers(filepath.Join(fs.fcfg.StoreDir, msgDir, schedIdxFile), fs.scheds)
+}
+
+// Will write out an index of message timers, e.g. TTLs or schedules.
+// We record our last sequence so that on recovery we only need to
+// scan messages stored after this.
+// Lock should be held.
+func (fs *fileStore) writeMsgTimers(fn string, mt *msgTimers) error {
+	if mt == nil || mt.len() == 0 {
+		if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	// HEADER: magic version lseq count [seq ts]... checksum
+	buf := make([]byte, hdrLen, hdrLen+2*binary.MaxVarintLen64*(mt.len()+1)+8)
+	buf[0], buf[1] = magic, version
+	var tmp [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(tmp[:], v)
+		buf = append(buf, tmp[:n]...)
+	}
+	putUvarint(fs.state.LastSeq)
+	putUvarint(uint64(mt.len()))
+	mt.iter(func(seq uint64, ts int64) {
+		putUvarint(seq)
+		n := binary.PutVarint(tmp[:], ts)
+		buf = append(buf, tmp[:n]...)
+	})
+	fs.hh.Reset()
+	fs.hh.Write(buf)
+	buf = fs.hh.Sum(buf)
+
+	return ioutil.WriteFile(fn, buf, defaultFilePerms)
+}
+
+// Will recover our per-message TTL and message schedule indexes. We will load
+// any persisted index and then scan messages stored after it was written.
+// Lock should be held.
+func (fs *fileStore) recoverMsgTimers(ttls, scheds bool) {
+	// Returns the timers from the index and the first sequence we need to scan from.
+	load := func(fn string) (*msgTimers, uint64) {
+		mt := newMsgTimers()
+		lseq, err := fs.readMsgTimers(fn, mt)
+		if err != nil {
+			// Could have partially loaded, so rebuild from scratch.
+			return newMsgTimers(), fs.state.FirstSeq
+		}
+		if lseq < fs.state.FirstSeq {
+			return mt, fs.state.FirstSeq
+		}
+		return mt, lseq + 1
+	}
+
+	start := fs.state.LastSeq + 1
+	var ttlStart, schedStart uint64
+	if ttls {
+		fs.ttls, ttlStart = load(filepath.Join(fs.fcfg.StoreDir, msgDir, ttlIdxFile))
+		if ttlStart < start {
+			start = ttlStart
+		}
+	}
+	if scheds {
+		fs.scheds, schedStart = load(filepath.Join(fs.fcfg.StoreDir, msgDir, schedIdxFile))
+		if schedStart < start {
+			start = schedStart
+		}
+	}
+
+	var smv StoreMsg
+	for seq := start; seq <= fs.state.LastSeq && seq > 0; seq++ {
+		mb := fs.selectMsgBlock(seq)
+		if mb == nil {
+			continue
+		}
+		sm, _, err := mb.fetchMsg(seq, &smv)
+		if err != nil || sm == nil || len(sm.hdr) == 0 {
+			continue
+		}
+		if ttls && seq >= ttlStart {
+			if ttl, err := getMessageTTL(sm.hdr); err == nil && ttl > 0 {
+				fs.ttls.track(seq, sm.ts+int64(ttl))
+				fs.ttlw = true
+			}
+		}
+		if scheds && seq >= schedStart {
+			if due, err := getMessageSchedule(sm.hdr, sm.ts); err == nil && due > 0 {
+				fs.scheds.track(seq, due)
+				fs.schedw = true
+			}
+		}
+	}
+
+	if scheds {
+		fs.pruneMsgSchedules()
+		if fs.scheds.len() == 0 {
+			fs.scheds = nil
+		}
+	}
+	if ttls {
+		if fs.ttls.len() == 0 {
+			fs.ttls = nil
+		} else {
+			fs.resetTTLChk(fs.ttls.next())
+		}
+	}
+}
+
+// Will read in an index of message timers and return the last sequence it covers.
+// Lock should be held.
+func (fs *fileStore) readMsgTimers(fn string, mt *msgTimers) (uint64, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return 0, err
 	}
-	if fs.ageChk != nil {
-		fs.ageChk.Reset(fireIn)
-	} else {
-		fs.ageChk = time.AfterFunc(fireIn, fs.expireMsgs)
+	if err := checkHeader(buf); err != nil || len(buf) < hdrLen+8 {
+		os.Remove(fn)
+		return 0, errCorruptState
+	}
+	data, sum := buf[:len(buf)-8], buf[len(buf)-8:]
+	fs.hh.Reset()
+	fs.hh.Write(data)
+	if !bytes.Equal(fs.hh.Sum(nil), sum) {
+		os.Remove(fn)
+		return 0, errCorruptState
 	}
-}
 
-// Lock should be held.
-func (fs *fileStore) cancelAgeChk() {
-	if fs.ageChk != nil {
-		fs.ageChk.Stop()
-		fs.ageChk = nil
+	bi := hdrLen
+	readUvarint := func() uint64 {
+		if bi < 0 {
+			return 0
+		}
+		v, n := binary.Uvarint(data[bi:])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return v
+	}
+	lseq, count := readUvarint(), readUvarint()
+	for i := uint64(0); i < count && bi > 0; i++ {
+		seq := readUvarint()
+		if bi < 0 {
+			break
+		}
+		ts, n := binary.Varint(data[bi:])
+		if n <= 0 {
+			bi = -1
+			break
+		}
+		bi += n
+		mt.track(seq, ts)
 	}
+	if bi < 0 {
+		os.Remove(fn)
+		return 0, errCorruptState
+	}
+	return lseq, nil
 }
 
-// Will expire msgs that are too old.
-func (fs *fileStore) expireMsgs() {
-	// We need to delete one by one here and can not optimize for the time being.
-	// Reason is that we need more information to adjust ack pending in consumers.
-	var smv StoreMsg
-	var sm *StoreMsg
-	minAge := time.Now().UnixNano() - int64(fs.cfg.MaxAge)
-	for sm, _ = fs.msgForSeq(0, &smv); sm != nil && sm.ts <= minAge; sm, _ = fs.msgForSeq(0, &smv) {
-		fs.removeMsg(sm.seq, false, true)
+// Will drop any scheduled messages that are now due or have been removed.
+// Lock should be held.
+func (fs *fileStore) pruneMsgSchedules() {
+	if fs.scheds == nil {
+		return
+	}
+	fs.scheds.removeBelow(fs.state.FirstSeq)
+	for now := time.Now().UnixNano(); fs.scheds.popExpired(now) > 0; {
+		fs.schedw = true
 	}
+}
 
+// MsgSchedules returns the messages scheduled for a future time along with when they are due.
+func (fs *fileStore) MsgSchedules() map[uint64]int64 {
 	fs.mu.Lock()
 	defer fs.mu.Unlock()
-
-	if sm == nil {
-		fs.cancelAgeChk()
-	} else {
-		fs.resetAgeChk(sm.ts - minAge)
+	fs.pruneMsgSchedules()
+	if fs.scheds == nil || fs.scheds.len() == 0 {
+		return nil
 	}
+	sched := make(map[uint64]int64, fs.scheds.len())
+	fs.scheds.iter(func(seq uint64, due int64) {
+		sched[seq] = due
+	})
+	return sched
 }
 
 // Lock should be held.
@@ -2759,6 +3480,16 @@ func (mb *msgBlock) enableForWriting(fip bool) error {
 	if mb.mfd != nil {
 		return nil
 	}
+	// We only append to local blocks.
+	if err := mb.restoreLocked(); err != nil {
+		return err
+	}
+	// We only append to uncompressed blocks.
+	if mb.cmp != NoCompression {
+		if err := mb.decompressOnDiskLocked(); err != nil {
+			return err
+		}
+	}
 	mfd, err := os.OpenFile(mb.mfn, os.O_CREATE|os.O_RDWR, defaultFilePerms)
 	if err != nil {
 		return fmt.Errorf("error opening msg block file [%q]: %v", mb.mfn, err)
@@ -3025,6 +3756,9 @@ func (fs *fileStore) syncBlocks() {
 		// Do actual sync. Hold lock for consistency.
 		mb.mu.Lock()
 		if !mb.closed {
+			if mb.perSubjectInfoNeedsWrite() {
+				mb.writePerSubjectInfo()
+			}
 			if mb.mfd != nil {
 				mb.mfd.Sync()
 			}
@@ -3041,6 +3775,8 @@ func (fs *fileStore) syncBlocks() {
 	}
 
 	fs.mu.Lock()
+	fs.writeTTLIndex()
+	fs.writeSchedIndex()
 	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
 	fs.mu.Unlock()
 }
@@ -3314,9 +4050,171 @@ func (mb *msgBlock) cacheNotLoaded() bool {
 	return !mb.cacheAlreadyLoaded()
 }
 
+// Compressed message blocks lead with a zero record length which is never valid for a raw block.
+// HEADER: 0x00000000 magic algorithm reserved(2) rawlen(8)
+// The compressed data follows and the block ends with the last checksum of the raw block.
+func compressBlockBuf(raw []byte, alg StoreCompression) []byte {
+	var le = binary.LittleEndian
+	var hdr [cmpHdrSize]byte
+	hdr[4], hdr[5] = cmpMagic, byte(alg)
+	le.PutUint64(hdr[8:], uint64(len(raw)))
+
+	buf := make([]byte, cmpHdrSize, cmpHdrSize+s2.MaxEncodedLen(len(raw))+8)
+	copy(buf, hdr[:])
+	switch alg {
+	case S2Compression:
+		buf = append(buf, s2.Encode(nil, raw)...)
+	}
+	if len(raw) >= 8 {
+		buf = append(buf, raw[len(raw)-8:]...)
+	} else {
+		buf = append(buf, make([]byte, 8)...)
+	}
+	return buf
+}
+
+// Will check the header of a block and return the compression used and the raw size if compressed.
+func compressedBlockHeader(buf []byte) (StoreCompression, uint64, bool) {
+	if len(buf) < cmpHdrSize || binary.LittleEndian.Uint32(buf) != 0 || buf[4] != cmpMagic {
+		return NoCompression, 0, false
+	}
+	alg := StoreCompression(buf[5])
+	if alg != S2Compression {
+		return NoCompression, 0, false
+	}
+	return alg, binary.LittleEndian.Uint64(buf[8:]), true
+}
+
+// Will decompress the block contents if needed. If the block is not compressed buf will be returned as is.
+func decompressBlockBuf(buf []byte) ([]byte, StoreCompression, error) {
+	alg, rsz, ok := compressedBlockHeader(buf)
+	if !ok {
+		return buf, NoCompression, nil
+	}
+	if len(buf) < cmpHdrSize+8 {
+		return nil, alg, errCorruptState
+	}
+	data := buf[cmpHdrSize : len(buf)-8]
+	var raw []byte
+	var err error
+	switch alg {
+	case S2Compression:
+		raw, err = s2.Decode(make([]byte, 0, rsz), data)
+	}
+	if err != nil || uint64(len(raw)) != rsz {
+		return nil, alg, errCorruptState
+	}
+	return raw, alg, nil
+}
+
+// Will write out the raw block contents compressed, encrypting if needed.
+// If compression does not save any space the block will be written raw.
+// Lock should be held.
+func (mb *msgBlock) writeCompressedLocked(raw []byte, alg StoreCompression) error {
+	buf := compressBlockBuf(raw, alg)
+	if len(buf) >= len(raw) {
+		buf, alg = copyBytes(raw), NoCompression
+	}
+	rbek := mb.bek
+	if rbek != nil && len(buf) > 0 {
+		var err error
+		if rbek, err = genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce); err != nil {
+			return err
+		}
+		rbek.XORKeyStream(buf, buf)
+	}
+	if err := mb.closeFDsLocked(); err != nil {
+		return err
+	}
+
+	// We will write to a new file and mv/rename it in case of failure.
+	mfn := filepath.Join(filepath.Join(mb.fs.fcfg.StoreDir, msgDir), fmt.Sprintf(newScan, mb.index))
+	defer os.Remove(mfn)
+	if err := ioutil.WriteFile(mfn, buf, defaultFilePerms); err != nil {
+		return err
+	}
+	if err := os.Rename(mfn, mb.mfn); err != nil {
+		return err
+	}
+	if mb.cmp, mb.cbytes = alg, 0; alg != NoCompression {
+		mb.cbytes = uint64(len(buf))
+	} else if rbek != nil {
+		// Any appends need to continue the stream.
+		mb.bek = rbek
+	}
+	return nil
+}
+
+// compressBlock will compress a sealed message block on disk.
+// Any cache for the block is left as is.
+func (mb *msgBlock) compressBlock(alg StoreCompression) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.closed || mb.cmp == alg || mb.arch {
+		return
+	}
+	// Make sure any pending writes are on disk.
+	if ld, err := mb.flushPendingMsgsLocked(); err != nil || ld != nil {
+		if ld != nil && mb.fs != nil {
+			go mb.fs.rebuildState(ld)
+		}
+		return
+	}
+	buf, err := mb.loadBlock(nil)
+	if err != nil || len(buf) == 0 {
+		return
+	}
+	defer recycleMsgBlockBuf(buf)
+
+	if mb.bek != nil {
+		rbek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
+		if err != nil {
+			return
+		}
+		rbek.XORKeyStream(buf, buf)
+	}
+	raw, _, err := decompressBlockBuf(buf)
+	if err != nil {
+		return
+	}
+	// On failure the block is simply left uncompressed.
+	mb.writeCompressedLocked(raw, alg)
+}
+
+// Will rewrite a compressed block uncompressed so it can be appended to.
+// Lock should be held.
+func (mb *msgBlock) decompressOnDiskLocked() error {
+	buf, err := mb.loadBlock(nil)
+	if err != nil {
+		return err
+	}
+	defer recycleMsgBlockBuf(buf)
+
+	if mb.bek != nil && len(buf) > 0 {
+		rbek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
+		if err != nil {
+			return err
+		}
+		rbek.XORKeyStream(buf, buf)
+	}
+	raw, alg, err := decompressBlockBuf(buf)
+	if err != nil {
+		return err
+	}
+	if alg == NoCompression {
+		mb.cmp, mb.cbytes = NoCompression, 0
+		return nil
+	}
+	return mb.writeCompressedLocked(raw, NoCompression)
+}
+
 // Used to load in the block contents.
 // Lock should be held and all conditionals satisfied prior.
 func (mb *msgBlock) loadBlock(buf []byte) ([]byte, error) {
+	if mb.arch {
+		return mb.loadArchivedBlock(buf)
+	}
 	f, err := os.Open(mb.mfn)
 	if err != nil {
 		return nil, err
@@ -3405,13 +4303,21 @@ checkCache:
 
 	// Check if we need to decrypt.
 	if mb.bek != nil && len(buf) > 0 {
-		rbek, err := chacha20.NewUnauthenticatedCipher(mb.seed, mb.nonce)
+		rbek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
 		if err != nil {
 			return err
 		}
 		rbek.XORKeyStream(buf, buf)
 	}
 
+	// Check if we need to decompress.
+	if raw, alg, err := decompressBlockBuf(buf); err != nil {
+		return err
+	} else if alg != NoCompression {
+		recycleMsgBlockBuf(buf)
+		buf = raw
+	}
+
 	if err := mb.indexCacheBuf(buf); err != nil {
 		if err == errCorruptState {
 			fs := mb.fs
@@ -3458,18 +4364,22 @@ func (mb *msgBlock) fetchMsg(seq uint64, sm *StoreMsg) (*StoreMsg, bool, error)
 }
 
 var (
-	errNoCache      = errors.New("no message cache")
-	errBadMsg       = errors.New("malformed or corrupt message")
-	errDeletedMsg   = errors.New("deleted message")
-	errPartialCache = errors.New("partial cache")
-	errNoPending    = errors.New("message block does not have pending data")
-	errNotReadable  = errors.New("storage directory not readable")
-	errCorruptState = errors.New("corrupt state file")
-	errPendingData  = errors.New("pending data still present")
-	errNoEncryption = errors.New("encryption not enabled")
-	errBadKeySize   = errors.New("encryption bad key size")
-	errNoMsgBlk     = errors.New("no message block")
-	errMsgBlkTooBig = errors.New("message block size exceeded int capacity")
+	errNoCache       = errors.New("no message cache")
+	errBadMsg        = errors.New("malformed or corrupt message")
+	errDeletedMsg    = errors.New("deleted message")
+	errPartialCache  = errors.New("partial cache")
+	errNoPending     = errors.New("message block does not have pending data")
+	errNotReadable   = errors.New("storage directory not readable")
+	errCorruptState  = errors.New("corrupt state file")
+	errPendingData   = errors.New("pending data still present")
+	errNoEncryption  = errors.New("encryption not enabled")
+	errBadKeySize    = errors.New("encryption bad key size")
+	errNoMsgBlk      = errors.New("no message block")
+	errMsgBlkTooBig  = errors.New("message block size exceeded int capacity")
+	errUnknownCipher = errors.New("unknown cipher")
+	errNoArchive     = errors.New("no jetstream archive configured")
+	errBadIndexFile  = errors.New("bad index file")
+	errShortIndex    = errors.New("short index file")
 )
 
 // Used for marking messages that have had their checksums checked.
@@ -3766,7 +4676,7 @@ func (fs *fileStore) FastState(state *StreamState) {
 			state.NumDeleted = 0
 		}
 	}
-	state.Consumers = len(fs.cfs)
+	state.Consumers = len(fs.cfs) + fs.mcs
 	state.NumSubjects = len(fs.psmc)
 	fs.mu.RUnlock()
 }
@@ -3775,7 +4685,7 @@ func (fs *fileStore) FastState(state *StreamState) {
 func (fs *fileStore) State() StreamState {
 	fs.mu.RLock()
 	state := fs.state
-	state.Consumers = len(fs.cfs)
+	state.Consumers = len(fs.cfs) + fs.mcs
 	state.NumSubjects = len(fs.psmc)
 	state.Deleted = nil // make sure.
 
@@ -3805,16 +4715,23 @@ func (fs *fileStore) State() StreamState {
 	return state
 }
 
-func (fs *fileStore) Utilization() (total, reported uint64, err error) {
+// Utilization returns the raw bytes of all blocks, the bytes reported to the user,
+// and the bytes used on disk once compressed blocks are taken into account.
+func (fs *fileStore) Utilization() (total, reported, compressed uint64, err error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
 	for _, mb := range fs.blks {
 		mb.mu.RLock()
 		reported += mb.bytes
 		total += mb.rbytes
+		if mb.cmp != NoCompression {
+			compressed += mb.cbytes
+		} else {
+			compressed += mb.rbytes
+		}
 		mb.mu.RUnlock()
 	}
-	return total, reported, nil
+	return total, reported, compressed, nil
 }
 
 func fileStoreMsgSize(subj string, hdr, msg []byte) uint64 {
@@ -3925,9 +4842,20 @@ func (mb *msgBlock) readIndexInfo() error {
 		}
 	}
 
+	if err := mb.decodeIndexInfo(buf); err != nil {
+		// Only remove index files that are bad or were not completely written.
+		if err == errBadIndexFile || err == errShortIndex {
+			os.Remove(mb.ifn)
+		}
+		return err
+	}
+	return nil
+}
+
+// decodeIndexInfo will decode the plaintext index information for the message block.
+func (mb *msgBlock) decodeIndexInfo(buf []byte) error {
 	if err := checkHeader(buf); err != nil {
-		defer os.Remove(mb.ifn)
-		return fmt.Errorf("bad index file")
+		return errBadIndexFile
 	}
 
 	bi := hdrLen
@@ -3968,8 +4896,7 @@ func (mb *msgBlock) readIndexInfo() error {
 
 	// Check if this is a short write index file.
 	if bi < 0 || bi+checksumSize > len(buf) {
-		defer os.Remove(mb.ifn)
-		return fmt.Errorf("short index file")
+		return errShortIndex
 	}
 
 	// Checksum
@@ -4211,6 +5138,10 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 
 	for _, mb := range fs.blks {
 		mb.dirtyClose()
+		// Archived contents are not in our msgs directory.
+		mb.mu.Lock()
+		mb.removeArchivedLocked()
+		mb.mu.Unlock()
 	}
 
 	fs.blks = nil
@@ -4249,6 +5180,12 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 	// Clear any per subject tracking.
 	fs.psmc = make(map[string]uint64)
 
+	// Clear any per-message TTLs and schedules along with their indexes.
+	fs.ttls, fs.ttlw = nil, true
+	fs.writeTTLIndex()
+	fs.scheds, fs.schedw = nil, true
+	fs.writeSchedIndex()
+
 	cb := fs.scb
 	fs.mu.Unlock()
 
@@ -4347,10 +5284,17 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 			nbuf := getMsgBlockBuf(len(buf))
 			nbuf = append(nbuf, buf...)
 			smb.closeFDsLockedNoCheck()
-			// Check for encryption.
-			if smb.bek != nil && len(nbuf) > 0 {
+			if err := smb.restoreLocked(); err != nil {
+				goto SKIP
+			}
+			// Compressed blocks will also handle encryption.
+			if smb.cmp != NoCompression {
+				if err := smb.writeCompressedLocked(nbuf, smb.cmp); err != nil {
+					goto SKIP
+				}
+			} else if smb.bek != nil && len(nbuf) > 0 {
 				// Recreate to reset counter.
-				rbek, err := chacha20.NewUnauthenticatedCipher(smb.seed, smb.nonce)
+				rbek, err := genBlockEncryptionKey(smb.sc, smb.seed, smb.nonce)
 				if err != nil {
 					goto SKIP
 				}
@@ -4420,7 +5364,11 @@ func (fs *fileStore) Truncate(seq uint64) error {
 
 	// Set lmb to nlmb and make sure writeable.
 	fs.lmb = nlmb
-	if err := nlmb.enableForWriting(fs.fip); err != nil {
+	nlmb.mu.Lock()
+	err := nlmb.enableForWriting(fs.fip)
+	nlmb.mu.Unlock()
+	if err != nil {
+		fs.mu.Unlock()
 		return err
 	}
 
@@ -4560,6 +5508,11 @@ func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
 		if mb.kfn != _EMPTY_ {
 			os.Remove(mb.kfn)
 		}
+		if mb.arch {
+			mb.removeArchivedLocked()
+			os.Remove(mb.afn)
+			mb.arch, mb.afn = false, _EMPTY_
+		}
 	}
 }
 
@@ -4649,20 +5602,38 @@ func (mb *msgBlock) generatePerSubjectInfo() error {
 }
 
 // readPerSubjectInfo will attempt to restore the per subject information.
+// The information is only used if it matches the state of the block from our index file,
+// otherwise it is generated from the block and written back out.
 func (mb *msgBlock) readPerSubjectInfo() error {
-	// Remove after processing regardless.
-	defer os.Remove(mb.sfn)
-
 	const (
 		fileHashIndex = 16
 		mbHashIndex   = 8
 		minFileSize   = 24
 	)
 
-	buf, err := ioutil.ReadFile(mb.sfn)
+	regenerate := func() error {
+		if err := mb.generatePerSubjectInfo(); err != nil {
+			return err
+		}
+		// Failing to write is not fatal, we will just generate again next time.
+		mb.mu.Lock()
+		mb.writePerSubjectInfo()
+		mb.mu.Unlock()
+		return nil
+	}
 
-	if err != nil || len(buf) < minFileSize || checkHeader(buf) != nil {
-		return mb.generatePerSubjectInfo()
+	buf, err := ioutil.ReadFile(mb.sfn)
+	if err != nil {
+		return regenerate()
+	}
+	// Check for encryption.
+	if mb.aek != nil && len(buf) > 0 {
+		if buf, err = mb.aek.Open(buf[:0], mb.nonce, buf, nil); err != nil {
+			return regenerate()
+		}
+	}
+	if len(buf) < minFileSize || buf[0] != magic || buf[1] != fssVersion {
+		return regenerate()
 	}
 
 	// Check that we did not have any bit flips.
@@ -4670,21 +5641,20 @@ func (mb *msgBlock) readPerSubjectInfo() error {
 	mb.hh.Write(buf[0 : len(buf)-fileHashIndex])
 	fhash := buf[len(buf)-fileHashIndex : len(buf)-mbHashIndex]
 	if checksum := mb.hh.Sum(nil); !bytes.Equal(checksum, fhash) {
-		return mb.generatePerSubjectInfo()
+		return regenerate()
 	}
 
 	if !bytes.Equal(buf[len(buf)-mbHashIndex:], mb.lchk[:]) {
-		return mb.generatePerSubjectInfo()
+		return regenerate()
 	}
 
-	fss := make(map[string]*SimpleState)
-
+	body := buf[:len(buf)-fileHashIndex]
 	bi := hdrLen
 	readU64 := func() uint64 {
 		if bi < 0 {
 			return 0
 		}
-		num, n := binary.Uvarint(buf[bi:])
+		num, n := binary.Uvarint(body[bi:])
 		if n <= 0 {
 			bi = -1
 			return 0
@@ -4694,31 +5664,51 @@ func (mb *msgBlock) readPerSubjectInfo() error {
 	}
 
 	mb.mu.Lock()
+	// Removals do not change the block itself, so make sure we match the state from our index file.
+	if msgs, fseq := readU64(), readU64(); bi < 0 || msgs != mb.msgs || fseq != mb.first.seq {
+		mb.mu.Unlock()
+		return regenerate()
+	}
+	fss := make(map[string]*SimpleState)
 	for i, numEntries := uint64(0), readU64(); i < numEntries; i++ {
 		lsubj := readU64()
+		if bi < 0 || lsubj > uint64(len(body)-bi) {
+			mb.mu.Unlock()
+			return regenerate()
+		}
 		// Make a copy or use a configured subject (to avoid mem allocation)
-		subj := mb.subjString(buf[bi : bi+int(lsubj)])
+		subj := mb.subjString(body[bi : bi+int(lsubj)])
 		bi += int(lsubj)
 		msgs, first, last := readU64(), readU64(), readU64()
 		fss[subj] = &SimpleState{Msgs: msgs, First: first, Last: last}
 	}
+	if bi < 0 {
+		mb.mu.Unlock()
+		return regenerate()
+	}
 	mb.fss = fss
+	mb.lwfts = time.Now().UnixNano()
 	mb.mu.Unlock()
 	return nil
 }
 
 // writePerSubjectInfo will write out per subject information if we are tracking per subject.
+// HEADER: magic version msgs fseq numEntries
+// Each entry is the subject with its msgs, first and last sequences, followed by our hash
+// and the last checksum of the block.
 // Lock should be held.
 func (mb *msgBlock) writePerSubjectInfo() error {
 	// Raft groups do not have any subjects.
-	if len(mb.fss) == 0 {
+	if len(mb.fss) == 0 || mb.sfn == _EMPTY_ {
 		return nil
 	}
 	var scratch [4 * binary.MaxVarintLen64]byte
 	var b bytes.Buffer
 	b.WriteByte(magic)
-	b.WriteByte(version)
-	n := binary.PutUvarint(scratch[0:], uint64(len(mb.fss)))
+	b.WriteByte(fssVersion)
+	n := binary.PutUvarint(scratch[0:], mb.msgs)
+	n += binary.PutUvarint(scratch[n:], mb.first.seq)
+	n += binary.PutUvarint(scratch[n:], uint64(len(mb.fss)))
 	b.Write(scratch[0:n])
 	for subj, ss := range mb.fss {
 		n := binary.PutUvarint(scratch[0:], uint64(len(subj)))
@@ -4737,7 +5727,22 @@ func (mb *msgBlock) writePerSubjectInfo() error {
 	// Now copy over checksum from the block itself, this allows us to know if we are in sync.
 	b.Write(mb.lchk[:])
 
-	return ioutil.WriteFile(mb.sfn, b.Bytes(), defaultFilePerms)
+	buf := b.Bytes()
+	// Check for encryption.
+	if mb.aek != nil {
+		buf = mb.aek.Seal(buf[:0], mb.nonce, buf, nil)
+	}
+	if err := ioutil.WriteFile(mb.sfn, buf, defaultFilePerms); err != nil {
+		return err
+	}
+	mb.lwfts = time.Now().UnixNano()
+	return nil
+}
+
+// Determine if our per subject information has changed since we last wrote it out.
+// Lock should be held.
+func (mb *msgBlock) perSubjectInfoNeedsWrite() bool {
+	return mb.fss != nil && (mb.lwfts < mb.lwts || mb.lwfts < mb.lrts)
 }
 
 // Close the message block.
@@ -4754,7 +5759,7 @@ func (mb *msgBlock) close(sync bool) {
 	mb.closed = true
 
 	// Check if we are tracking by subject.
-	if mb.fss != nil {
+	if mb.perSubjectInfoNeedsWrite() {
 		mb.writePerSubjectInfo()
 	}
 
@@ -4835,9 +5840,13 @@ func (fs *fileStore) Stop() error {
 
 	fs.checkAndFlushAllBlocks()
 	fs.closeAllMsgBlocks(false)
+	fs.writeTTLIndex()
+	fs.writeSchedIndex()
 
 	fs.cancelSyncTimer()
 	fs.cancelAgeChk()
+	fs.cancelTTLChk()
+	fs.cancelTierChk()
 
 	var _cfs [256]*consumerFileStore
 	cfs := append(_cfs[:0], fs.cfs...)
@@ -4960,7 +5969,7 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 		}
 		// Check for encryption.
 		if mb.bek != nil && len(bbuf) > 0 {
-			rbek, err := chacha20.NewUnauthenticatedCipher(mb.seed, mb.nonce)
+			rbek, err := genBlockEncryptionKey(mb.sc, mb.seed, mb.nonce)
 			if err != nil {
 				mb.mu.Unlock()
 				writeErr(fmt.Sprintf("Could not create encryption key for message block [%d]: %v", mb.index, err))
@@ -4971,6 +5980,10 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 		// Make sure we snapshot the per subject info.
 		mb.writePerSubjectInfo()
 		buf, err = ioutil.ReadFile(mb.sfn)
+		// Check for encryption.
+		if err == nil && mb.aek != nil && len(buf) > 0 {
+			buf, err = mb.aek.Open(buf[:0], mb.nonce, buf, nil)
+		}
 		// If not there that is ok and not fatal.
 		if err == nil && writeFile(msgPre+fmt.Sprintf(fssScan, mb.index), buf) != nil {
 			mb.mu.Unlock()
@@ -5107,6 +6120,13 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	if cfg == nil || name == _EMPTY_ {
 		return nil, fmt.Errorf("bad consumer config")
 	}
+	// Memory based consumers keep no state on disk.
+	if cfg.MemoryStorage {
+		fs.mu.Lock()
+		fs.mcs++
+		fs.mu.Unlock()
+		return newConsumerMemStore(fs, cfg), nil
+	}
 	odir := filepath.Join(fs.fcfg.StoreDir, consumerDir, name)
 	if err := os.MkdirAll(odir, defaultDirPerms); err != nil {
 		return nil, fmt.Errorf("could not create consumer directory - %v", err)
@@ -5129,22 +6149,16 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 
 	// Check for encryption.
 	if o.prf != nil {
-		if ekey, err := ioutil.ReadFile(filepath.Join(odir, JetStreamMetaFileKey)); err == nil {
-			// Recover key encryption key.
-			rb, err := fs.prf([]byte(fs.cfg.Name + tsep + o.name))
-			if err != nil {
-				return nil, err
-			}
-			kek, err := chacha20poly1305.NewX(rb)
-			if err != nil {
-				return nil, err
-			}
-			ns := kek.NonceSize()
-			seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
+		keyFile := filepath.Join(odir, JetStreamMetaFileKey)
+		if ekey, err := ioutil.ReadFile(keyFile); err == nil {
+			// Recover our key, converting from our previous master key if needed.
+			fs.mu.Lock()
+			sc, seed, _, err := fs.recoverKey(keyFile, fs.cfg.Name+tsep+o.name, ekey)
+			fs.mu.Unlock()
 			if err != nil {
 				return nil, err
 			}
-			if o.aek, err = chacha20poly1305.NewX(seed); err != nil {
+			if o.aek, err = genEncryptionKey(sc, seed); err != nil {
 				return nil, err
 			}
 		}
@@ -5190,6 +6204,15 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	return o, nil
 }
 
+// decMemConsumers is called when a memory based consumer is stopped.
+func (fs *fileStore) decMemConsumers() {
+	fs.mu.Lock()
+	if fs.mcs > 0 {
+		fs.mcs--
+	}
+	fs.mu.Unlock()
+}
+
 // Kick flusher for this consumer.
 // Lock should be held.
 func (o *consumerFileStore) kickFlusher() {
@@ -5402,11 +6425,36 @@ func (o *consumerFileStore) UpdateAcks(dseq, sseq uint64) error {
 			}
 		}
 	}
+	// Do not move past any messages held back for partitions.
+	if len(o.state.Held) > 0 && o.state.Held[0] <= o.state.AckFloor.Stream {
+		o.state.AckFloor.Stream = o.state.Held[0] - 1
+	}
 
 	o.kickFlusher()
 	return nil
 }
 
+// UpdateHeld is called when a consumer holds back or releases a message for a partition or schedule.
+func (o *consumerFileStore) UpdateHeld(sseq uint64, held bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	i := sort.Search(len(o.state.Held), func(i int) bool { return o.state.Held[i] >= sseq })
+	found := i < len(o.state.Held) && o.state.Held[i] == sseq
+	if held == found {
+		return nil
+	}
+	if held {
+		o.state.Held = append(o.state.Held, 0)
+		copy(o.state.Held[i+1:], o.state.Held[i:])
+		o.state.Held[i] = sseq
+	} else {
+		o.state.Held = append(o.state.Held[:i], o.state.Held[i+1:]...)
+	}
+	o.kickFlusher()
+	return nil
+}
+
 const seqsHdrSize = 6*binary.MaxVarintLen64 + hdrLen
 
 // Encode our consumer state, version 2.
@@ -5429,6 +6477,19 @@ func encodeConsumerState(state *ConsumerState) []byte {
 	if lr := len(state.Redelivered); lr > 0 {
 		maxSize += lr*(2*binary.MaxVarintLen64) + binary.MaxVarintLen64
 	}
+	// Held entries at or below the ack floor are no longer needed.
+	var held []uint64
+	for _, seq := range state.Held {
+		if seq > state.AckFloor.Stream {
+			held = append(held, seq)
+		}
+	}
+	if state.PauseUntil != nil || len(held) > 0 {
+		maxSize += binary.MaxVarintLen64
+	}
+	if lh := len(held); lh > 0 {
+		maxSize += lh*binary.MaxVarintLen64 + binary.MaxVarintLen64
+	}
 	if maxSize == seqsHdrSize {
 		buf = hdr[:seqsHdrSize]
 	} else {
@@ -5477,6 +6538,21 @@ func encodeConsumerState(state *ConsumerState) []byte {
 		}
 	}
 
+	// Optional, only written when paused or holding messages so older servers will simply ignore it.
+	if state.PauseUntil != nil {
+		n += binary.PutVarint(buf[n:], state.PauseUntil.UnixNano())
+	} else if len(held) > 0 {
+		n += binary.PutVarint(buf[n:], 0)
+	}
+
+	// Optional, held back messages for partitioned consumers.
+	if len(held) > 0 {
+		n += binary.PutUvarint(buf[n:], uint64(len(held)))
+		for _, seq := range held {
+			n += binary.PutUvarint(buf[n:], seq-asflr)
+		}
+	}
+
 	return buf[:n]
 }
 
@@ -5534,6 +6610,8 @@ func (o *consumerFileStore) Update(state *ConsumerState) error {
 	o.state.AckFloor = state.AckFloor
 	o.state.Pending = pending
 	o.state.Redelivered = redelivered
+	o.state.PauseUntil = state.PauseUntil
+	o.state.Held = append([]uint64(nil), state.Held...)
 	o.kickFlusher()
 	o.mu.Unlock()
 
@@ -5548,7 +6626,7 @@ func (o *consumerFileStore) encryptState(buf []byte) []byte {
 	}
 	// TODO(dlc) - Optimize on space usage a bit?
 	nonce := make([]byte, o.aek.NonceSize(), o.aek.NonceSize()+len(buf)+o.aek.Overhead())
-	mrand.Read(nonce)
+	rand.Read(nonce)
 	return o.aek.Seal(nonce, nonce, buf, nil)
 }
 
@@ -5644,7 +6722,9 @@ func (cfs *consumerFileStore) writeConsumerMeta() error {
 	// Encrypt if needed.
 	if cfs.aek != nil {
 		nonce := make([]byte, cfs.aek.NonceSize(), cfs.aek.NonceSize()+len(b)+cfs.aek.Overhead())
-		mrand.Read(nonce)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
 		b = cfs.aek.Seal(nonce, nonce, b, nil)
 	}
 
@@ -5710,7 +6790,7 @@ func (o *consumerFileStore) State() (*ConsumerState, error) {
 	state := &ConsumerState{}
 
 	// See if we have a running state or if we need to read in from disk.
-	if o.state.Delivered.Consumer != 0 || o.state.Delivered.Stream != 0 {
+	if o.state.Delivered.Consumer != 0 || o.state.Delivered.Stream != 0 || o.state.PauseUntil != nil || len(o.state.Held) > 0 {
 		state.Delivered = o.state.Delivered
 		state.AckFloor = o.state.AckFloor
 		if len(o.state.Pending) > 0 {
@@ -5719,6 +6799,10 @@ func (o *consumerFileStore) State() (*ConsumerState, error) {
 		if len(o.state.Redelivered) > 0 {
 			state.Redelivered = o.copyRedelivered()
 		}
+		state.PauseUntil = o.state.PauseUntil
+		if len(o.state.Held) > 0 {
+			state.Held = append([]uint64(nil), o.state.Held...)
+		}
 		return state, nil
 	}
 
@@ -5761,6 +6845,8 @@ func (o *consumerFileStore) State() (*ConsumerState, error) {
 			o.state.Redelivered[seq] = dc
 		}
 	}
+	o.state.PauseUntil = state.PauseUntil
+	o.state.Held = append([]uint64(nil), state.Held...)
 
 	return state, nil
 }
@@ -5866,6 +6952,29 @@ func decodeConsumerState(buf []byte) (*ConsumerState, error) {
 		}
 	}
 
+	// Check if we have been paused.
+	if bi > 0 && bi < len(buf) {
+		if ts := readTimeStamp(); ts > 0 {
+			pu := time.Unix(0, ts).UTC()
+			state.PauseUntil = &pu
+		}
+	}
+
+	// Check if we have held back messages.
+	if bi > 0 && bi < len(buf) {
+		if numHeld := readLen(); numHeld > 0 {
+			state.Held = make([]uint64, 0, numHeld)
+			for i := 0; i < int(numHeld); i++ {
+				if seq := readSeq(); seq > 0 {
+					state.Held = append(state.Held, seq+state.AckFloor.Stream)
+				}
+			}
+		}
+		if bi == -1 {
+			return nil, errCorruptState
+		}
+	}
+
 	return state, nil
 }
 
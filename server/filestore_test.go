@@ -2024,6 +2024,32 @@ func TestFileStoreConsumerEncodeDecodeRedelivered(t *testing.T) {
 	}
 }
 
+func TestFileStoreConsumerEncodeDecodeHeld(t *testing.T) {
+	state := &ConsumerState{}
+
+	state.Delivered.Consumer = 10
+	state.Delivered.Stream = 100
+	state.AckFloor.Consumer = 10
+	state.AckFloor.Stream = 50
+
+	state.Held = []uint64{22, 61, 77}
+	rstate, err := decodeConsumerState(encodeConsumerState(state))
+	require_NoError(t, err)
+	// Only the ones above the ack floor are kept.
+	if !reflect.DeepEqual(rstate.Held, []uint64{61, 77}) || rstate.PauseUntil != nil {
+		t.Fatalf("Unexpected state: %+v", rstate)
+	}
+
+	pu := time.Now().Add(time.Hour).Round(0).UTC()
+	state.PauseUntil = &pu
+	state.Held = []uint64{61}
+	rstate, err = decodeConsumerState(encodeConsumerState(state))
+	require_NoError(t, err)
+	if !reflect.DeepEqual(state, rstate) {
+		t.Fatalf("States do not match: %+v vs %+v", state, rstate)
+	}
+}
+
 func TestFileStoreConsumerEncodeDecodePendingBelowStreamAckFloor(t *testing.T) {
 	state := &ConsumerState{}
 
@@ -3316,7 +3342,7 @@ func TestFileStoreSparseCompaction(t *testing.T) {
 		t.Helper()
 		var ssb, ssa StreamState
 		fs.FastState(&ssb)
-		tb, ub, _ := fs.Utilization()
+		tb, ub, _, _ := fs.Utilization()
 
 		fs.mu.RLock()
 		if len(fs.blks) == 0 {
@@ -3332,7 +3358,7 @@ func TestFileStoreSparseCompaction(t *testing.T) {
 		if !reflect.DeepEqual(ssb, ssa) {
 			t.Fatalf("States do not match; %+v vs %+v", ssb, ssa)
 		}
-		ta, ua, _ := fs.Utilization()
+		ta, ua, _, _ := fs.Utilization()
 		if ub != ua {
 			t.Fatalf("Expected used to be the same, got %d vs %d", ub, ua)
 		}
@@ -3366,7 +3392,7 @@ func TestFileStoreSparseCompaction(t *testing.T) {
 		return h.Sum(nil), nil
 	}
 
-	fs, err = newFileStoreWithCreated(FileStoreConfig{StoreDir: storeDir, BlockSize: 1024 * 1024}, cfg, time.Now(), prf)
+	fs, err = newFileStoreWithCreated(FileStoreConfig{StoreDir: storeDir, BlockSize: 1024 * 1024}, cfg, time.Now(), prf, nil)
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
@@ -3677,7 +3703,7 @@ func TestFileStoreCompactReclaimHeadSpace(t *testing.T) {
 		FileStoreConfig{StoreDir: storeDir, BlockSize: 1024 * 1024},
 		StreamConfig{Name: "TEST", Storage: FileStorage},
 		time.Now(),
-		prf,
+		prf, nil,
 	)
 	require_NoError(t, err)
 	defer fs.Stop()
@@ -3707,7 +3733,7 @@ func TestFileStoreCompactReclaimHeadSpace(t *testing.T) {
 		FileStoreConfig{StoreDir: storeDir, BlockSize: 1024 * 1024},
 		StreamConfig{Name: "TEST", Storage: FileStorage},
 		time.Now(),
-		prf,
+		prf, nil,
 	)
 	require_NoError(t, err)
 	defer fs.Stop()
@@ -3719,3 +3745,1093 @@ func TestFileStoreCompactReclaimHeadSpace(t *testing.T) {
 	_, _, err = fs.StoreMsg(subj, nil, msg)
 	require_NoError(t, err)
 }
+
+func TestFileStoreMessageTTLRecovery(t *testing.T) {
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgTTL: true}
+	fs, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("Hello World")
+	hdr := genHeader(nil, JSMessageTTL, "1s")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg(subj, hdr, msg)
+		fs.StoreMsg(subj, nil, msg)
+	}
+	if state := fs.State(); state.Msgs != 20 {
+		t.Fatalf("Expected 20 msgs, got %d", state.Msgs)
+	}
+	fs.Stop()
+
+	// The index should have been written out.
+	if _, err := os.Stat(filepath.Join(storeDir, msgDir, ttlIdxFile)); err != nil {
+		t.Fatalf("Expected TTL index file: %v", err)
+	}
+
+	checkExpired := func(fs *fileStore) {
+		t.Helper()
+		checkFor(t, 3*time.Second, 50*time.Millisecond, func() error {
+			if state := fs.State(); state.Msgs != 10 {
+				return fmt.Errorf("Expected 10 msgs, got %d", state.Msgs)
+			}
+			return nil
+		})
+		var smv StoreMsg
+		for seq := uint64(2); seq <= 20; seq += 2 {
+			if _, err := fs.LoadMsg(seq, &smv); err != nil {
+				t.Fatalf("Expected msg %d without TTL to remain: %v", seq, err)
+			}
+		}
+	}
+
+	// Recover from the index.
+	fs, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	fs.mu.RLock()
+	nttls := fs.ttls.len()
+	fs.mu.RUnlock()
+	if nttls != 10 {
+		t.Fatalf("Expected 10 TTL entries, got %d", nttls)
+	}
+	fs.Stop()
+
+	// Now remove the index and make sure we rebuild it from the messages.
+	os.Remove(filepath.Join(storeDir, msgDir, ttlIdxFile))
+	fs, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	checkExpired(fs)
+
+	// A purge should clear the index as well.
+	fs.StoreMsg(subj, hdr, msg)
+	fs.mu.Lock()
+	fs.writeTTLIndex()
+	fs.mu.Unlock()
+	if _, err := os.Stat(filepath.Join(storeDir, msgDir, ttlIdxFile)); err != nil {
+		t.Fatalf("Expected TTL index file: %v", err)
+	}
+	if _, err := fs.Purge(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	fs.Stop()
+	if _, err := os.Stat(filepath.Join(storeDir, msgDir, ttlIdxFile)); err == nil {
+		t.Fatalf("Expected TTL index file to be removed on purge")
+	}
+}
+
+func TestFileStoreMessageScheduleRecovery(t *testing.T) {
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, AllowMsgSchedules: true}
+	fs, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("Hello World")
+	hdr := genHeader(nil, JSScheduleDelay, "1h")
+	for i := 0; i < 10; i++ {
+		fs.StoreMsg(subj, hdr, msg)
+		fs.StoreMsg(subj, nil, msg)
+	}
+	// Already due, so should not be tracked.
+	fs.StoreMsg(subj, genHeader(nil, JSScheduleAt, time.Now().Add(-time.Hour).Format(time.RFC3339Nano)), msg)
+	fs.RemoveMsg(1)
+
+	checkScheduled := func(fs *fileStore, n int) {
+		t.Helper()
+		sched := fs.MsgSchedules()
+		if len(sched) != n {
+			t.Fatalf("Expected %d scheduled msgs, got %d", n, len(sched))
+		}
+		for seq := range sched {
+			if seq == 1 || seq == 21 || (seq < 21 && seq%2 == 0) {
+				t.Fatalf("Unexpected scheduled msg %d", seq)
+			}
+		}
+	}
+	checkScheduled(fs, 9)
+	fs.Stop()
+
+	// The index should have been written out.
+	if _, err := os.Stat(filepath.Join(storeDir, msgDir, schedIdxFile)); err != nil {
+		t.Fatalf("Expected schedule index file: %v", err)
+	}
+
+	// Recover from the index, along with anything stored after it was written.
+	fs, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	checkScheduled(fs, 9)
+	fs.mu.Lock()
+	fs.writeSchedIndex()
+	fs.mu.Unlock()
+	fs.StoreMsg(subj, hdr, msg)
+	fs.Stop()
+	fs, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	checkScheduled(fs, 10)
+	fs.Stop()
+
+	// Now remove the index and make sure we rebuild it from the messages.
+	os.Remove(filepath.Join(storeDir, msgDir, schedIdxFile))
+	fs, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer fs.Stop()
+	checkScheduled(fs, 10)
+
+	// A purge should clear them along with the index.
+	if _, err := fs.Purge(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	checkScheduled(fs, 0)
+	fs.Stop()
+	if _, err := os.Stat(filepath.Join(storeDir, msgDir, schedIdxFile)); err == nil {
+		t.Fatalf("Expected schedule index file to be removed on purge")
+	}
+}
+
+func TestFileStoreCompression(t *testing.T) {
+	prf := func(context []byte) ([]byte, error) {
+		h := hmac.New(sha256.New, []byte("dlc22"))
+		if _, err := h.Write(context); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+
+	test := func(t *testing.T, prf func([]byte) ([]byte, error)) {
+		storeDir := createDir(t, JetStreamStoreDir)
+		defer removeDir(t, storeDir)
+
+		fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 4 * 1024}
+		cfg := StreamConfig{Name: "zzz", Storage: FileStorage, Compression: S2Compression}
+		fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+
+		subj, msg := "foo", bytes.Repeat([]byte("Z"), 256)
+		for i := 0; i < 100; i++ {
+			_, _, err := fs.StoreMsg(subj, nil, msg)
+			require_NoError(t, err)
+		}
+
+		checkCompressed := func(fs *fileStore) {
+			t.Helper()
+			checkFor(t, 2*time.Second, 20*time.Millisecond, func() error {
+				fs.mu.RLock()
+				blks := append([]*msgBlock(nil), fs.blks...)
+				fs.mu.RUnlock()
+				if len(blks) < 2 {
+					return fmt.Errorf("Expected multiple blocks, got %d", len(blks))
+				}
+				// All but the last block should be compressed.
+				for _, mb := range blks[:len(blks)-1] {
+					mb.mu.RLock()
+					cmp := mb.cmp
+					mb.mu.RUnlock()
+					if cmp != S2Compression {
+						return fmt.Errorf("Expected block %d to be compressed", mb.index)
+					}
+				}
+				return nil
+			})
+			total, reported, compressed, err := fs.Utilization()
+			require_NoError(t, err)
+			if reported > total || compressed >= total {
+				t.Fatalf("Unexpected utilization, total %d, reported %d, compressed %d", total, reported, compressed)
+			}
+		}
+		checkMsgs := func(fs *fileStore, skip uint64) {
+			t.Helper()
+			var smv StoreMsg
+			for seq := uint64(1); seq <= 100; seq++ {
+				if seq == skip {
+					continue
+				}
+				sm, err := fs.LoadMsg(seq, &smv)
+				if err != nil {
+					t.Fatalf("Error loading seq %d: %v", seq, err)
+				}
+				if sm.subj != subj || !bytes.Equal(sm.msg, msg) {
+					t.Fatalf("Bad msg for seq %d", seq)
+				}
+			}
+		}
+		checkCompressed(fs)
+
+		// Make sure we can load messages from disk.
+		fs.mu.RLock()
+		for _, mb := range fs.blks {
+			mb.mu.Lock()
+			mb.clearCacheAndOffset()
+			mb.mu.Unlock()
+		}
+		fs.mu.RUnlock()
+		checkMsgs(fs, 0)
+
+		// Erasing a message from a compressed block should keep it compressed.
+		removed, err := fs.EraseMsg(2)
+		require_NoError(t, err)
+		require_True(t, removed)
+		checkMsgs(fs, 2)
+
+		// Restart and make sure we recover properly.
+		fs.Stop()
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		if state := fs.State(); state.Msgs != 99 || state.LastSeq != 100 {
+			t.Fatalf("Unexpected state after restart: %+v", state)
+		}
+		checkCompressed(fs)
+		checkMsgs(fs, 2)
+
+		// Now make sure we can recover without our index files.
+		fs.Stop()
+		ifiles, _ := filepath.Glob(filepath.Join(storeDir, msgDir, "*.idx"))
+		for _, fn := range ifiles {
+			os.Remove(fn)
+		}
+		fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+		require_NoError(t, err)
+		defer fs.Stop()
+		if state := fs.State(); state.LastSeq != 100 {
+			t.Fatalf("Unexpected state after rebuild: %+v", state)
+		}
+		checkMsgs(fs, 2)
+
+		// Make sure we can still write.
+		seq, _, err := fs.StoreMsg(subj, nil, msg)
+		require_NoError(t, err)
+		if seq != 101 {
+			t.Fatalf("Expected sequence of 101, got %d", seq)
+		}
+	}
+
+	t.Run("Plain", func(t *testing.T) { test(t, nil) })
+	t.Run("Encrypted", func(t *testing.T) { test(t, prf) })
+}
+
+func TestFileStoreDiscardNewPerSubject(t *testing.T) {
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, MaxMsgsPer: 2, Discard: DiscardNew, DiscardNewPer: true}
+	fs, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 2; i++ {
+		_, _, err := fs.StoreMsg("foo", nil, msg)
+		require_NoError(t, err)
+	}
+	if _, _, err := fs.StoreMsg("foo", nil, msg); err != ErrMaxMsgsPerSubject {
+		t.Fatalf("Expected %v, got %v", ErrMaxMsgsPerSubject, err)
+	}
+	// Other subjects are not affected.
+	_, _, err = fs.StoreMsg("bar", nil, msg)
+	require_NoError(t, err)
+
+	// Make sure this holds after a restart.
+	fs.Stop()
+	fs, err = newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	if _, _, err := fs.StoreMsg("foo", nil, msg); err != ErrMaxMsgsPerSubject {
+		t.Fatalf("Expected %v, got %v", ErrMaxMsgsPerSubject, err)
+	}
+	if state := fs.State(); state.Msgs != 3 || state.LastSeq != 3 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestFileStoreEncryptedAES(t *testing.T) {
+	prf := func(context []byte) ([]byte, error) {
+		h := hmac.New(sha256.New, []byte("dlc22"))
+		if _, err := h.Write(context); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 4 * 1024, Cipher: AES}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("ENCRYPTED PAYLOAD!!")
+	for i := 0; i < 500; i++ {
+		_, _, err := fs.StoreMsg(subj, nil, msg)
+		require_NoError(t, err)
+	}
+	_, err = fs.RemoveMsg(22)
+	require_NoError(t, err)
+
+	o, err := fs.ConsumerStore("o22", &ConsumerConfig{AckPolicy: AckExplicit})
+	require_NoError(t, err)
+	state := &ConsumerState{}
+	state.Delivered.Consumer, state.Delivered.Stream = 10, 10
+	state.AckFloor.Consumer, state.AckFloor.Stream = 5, 5
+	require_NoError(t, o.Update(state))
+
+	// All of our keys should be AES sized.
+	kfs, _ := filepath.Glob(filepath.Join(storeDir, msgDir, "*.key"))
+	if len(kfs) < 2 {
+		t.Fatalf("Expected multiple block keys, got %d", len(kfs))
+	}
+	kfs = append(kfs, filepath.Join(storeDir, JetStreamMetaFileKey), filepath.Join(storeDir, consumerDir, "o22", JetStreamMetaFileKey))
+	for _, fn := range kfs {
+		ekey, err := ioutil.ReadFile(fn)
+		require_NoError(t, err)
+		if len(ekey) != aesKeySize {
+			t.Fatalf("Expected key size of %d for %q, got %d", aesKeySize, fn, len(ekey))
+		}
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(storeDir, msgDir, fmt.Sprintf(blkScan, 1)))
+	require_NoError(t, err)
+	if bytes.Contains(buf, msg) {
+		t.Fatalf("Found plaintext in message block")
+	}
+
+	checkState := func(fs *fileStore) {
+		t.Helper()
+		if state := fs.State(); state.Msgs != 499 || state.LastSeq != 500 {
+			t.Fatalf("Unexpected state: %+v", state)
+		}
+		var smv StoreMsg
+		for _, seq := range []uint64{1, 21, 23, 250, 500} {
+			sm, err := fs.LoadMsg(seq, &smv)
+			require_NoError(t, err)
+			if sm.subj != subj || !bytes.Equal(sm.msg, msg) {
+				t.Fatalf("Bad msg for seq %d", seq)
+			}
+		}
+	}
+	checkState(fs)
+
+	// The cipher of existing assets is determined by their keys, so restarting
+	// with a different configured cipher should still work.
+	fs.Stop()
+	fcfg.Cipher = ChaCha
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+	checkState(fs)
+
+	o, err = fs.ConsumerStore("o22", &ConsumerConfig{AckPolicy: AckExplicit})
+	require_NoError(t, err)
+	rstate, err := o.State()
+	require_NoError(t, err)
+	if rstate.Delivered != state.Delivered || rstate.AckFloor != state.AckFloor {
+		t.Fatalf("Consumer state did not match, %+v vs %+v", rstate, state)
+	}
+
+	// Mixing ciphers across blocks is fine.
+	for i := 0; i < 500; i++ {
+		_, _, err := fs.StoreMsg(subj, nil, msg)
+		require_NoError(t, err)
+	}
+	fs.Stop()
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 999 || state.LastSeq != 1000 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	var smv StoreMsg
+	for _, seq := range []uint64{1, 500, 501, 1000} {
+		_, err := fs.LoadMsg(seq, &smv)
+		require_NoError(t, err)
+	}
+}
+
+func TestFileStoreEncryptionKeyRotation(t *testing.T) {
+	genPRF := func(key string) keyGen {
+		return func(context []byte) ([]byte, error) {
+			h := hmac.New(sha256.New, []byte(key))
+			if _, err := h.Write(context); err != nil {
+				return nil, err
+			}
+			return h.Sum(nil), nil
+		}
+	}
+
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 4 * 1024}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage}
+	fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), genPRF("k1"), nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	subj, msg := "foo", []byte("ENCRYPTED PAYLOAD!!")
+	for i := 0; i < 500; i++ {
+		_, _, err := fs.StoreMsg(subj, nil, msg)
+		require_NoError(t, err)
+	}
+	state := &ConsumerState{}
+	state.Delivered.Consumer, state.Delivered.Stream = 10, 10
+	state.AckFloor.Consumer, state.AckFloor.Stream = 5, 5
+	o, err := fs.ConsumerStore("o22", &ConsumerConfig{AckPolicy: AckExplicit})
+	require_NoError(t, err)
+	require_NoError(t, o.Update(state))
+
+	keys := func() map[string][]byte {
+		t.Helper()
+		kfs, _ := filepath.Glob(filepath.Join(storeDir, msgDir, "*.key"))
+		kfs = append(kfs, filepath.Join(storeDir, JetStreamMetaFileKey), filepath.Join(storeDir, consumerDir, "o22", JetStreamMetaFileKey))
+		m := make(map[string][]byte)
+		for _, fn := range kfs {
+			ekey, err := ioutil.ReadFile(fn)
+			require_NoError(t, err)
+			m[fn] = ekey
+		}
+		return m
+	}
+	reopen := func(prf, oldprf keyGen) (*fileStore, error) {
+		t.Helper()
+		fs.Stop()
+		return newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, oldprf)
+	}
+	checkStore := func(fs *fileStore) {
+		t.Helper()
+		if state := fs.State(); state.Msgs != 500 {
+			t.Fatalf("Unexpected state: %+v", state)
+		}
+		var smv StoreMsg
+		for _, seq := range []uint64{1, 250, 500} {
+			sm, err := fs.LoadMsg(seq, &smv)
+			require_NoError(t, err)
+			if !bytes.Equal(sm.msg, msg) {
+				t.Fatalf("Bad msg for seq %d", seq)
+			}
+		}
+		o, err := fs.ConsumerStore("o22", &ConsumerConfig{AckPolicy: AckExplicit})
+		require_NoError(t, err)
+		rstate, err := o.State()
+		require_NoError(t, err)
+		if rstate.Delivered != state.Delivered || rstate.AckFloor != state.AckFloor {
+			t.Fatalf("Consumer state did not match, %+v vs %+v", rstate, state)
+		}
+	}
+
+	before := keys()
+
+	// Restart with a new key without the previous one should fail.
+	_, err = reopen(genPRF("k2"), nil)
+	require_Error(t, err)
+
+	// With our previous key configured everything will be converted on recovery.
+	fs, err = reopen(genPRF("k2"), genPRF("k1"))
+	require_NoError(t, err)
+	defer fs.Stop()
+	checkStore(fs)
+
+	after := keys()
+	for fn, ekey := range before {
+		if bytes.Equal(ekey, after[fn]) {
+			t.Fatalf("Expected key %q to have been re-wrapped", fn)
+		}
+	}
+
+	// Now we should be able to run without the old key.
+	fs, err = reopen(genPRF("k2"), nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+	checkStore(fs)
+
+	// Rotate online.
+	require_NoError(t, fs.rotateEncryptionKey(genPRF("k3")))
+	if fs.oldprf != nil {
+		t.Fatalf("Expected previous key to be dropped after rotation")
+	}
+	// Make sure we can still write and read.
+	_, _, err = fs.StoreMsg(subj, nil, msg)
+	require_NoError(t, err)
+	_, err = fs.RemoveMsg(501)
+	require_NoError(t, err)
+
+	_, err = reopen(genPRF("k2"), nil)
+	require_Error(t, err)
+	fs, err = reopen(genPRF("k3"), nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+	checkStore(fs)
+
+	// Rotate while not loaded.
+	fs.Stop()
+	before = keys()
+	require_Error(t, rotateStreamKeyFiles(storeDir, cfg.Name, genPRF("k4"), genPRF("k2")))
+	require_NoError(t, rotateStreamKeyFiles(storeDir, cfg.Name, genPRF("k4"), genPRF("k3")))
+	after = keys()
+	for fn, ekey := range before {
+		if bytes.Equal(ekey, after[fn]) {
+			t.Fatalf("Expected key %q to have been re-wrapped", fn)
+		}
+	}
+	fs, err = reopen(genPRF("k4"), nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+	checkStore(fs)
+}
+
+func TestFileStoreVerifyAndRepair(t *testing.T) {
+	root := createDir(t, "js-verify")
+	defer removeDir(t, root)
+	sdir := filepath.Join(root, JetStreamStoreDir, globalAccountName, streamsDir, "zzz")
+
+	subj, msg := "foo", make([]byte, 100)
+	rl := fileStoreMsgSize(subj, nil, msg)
+
+	fcfg := FileStoreConfig{StoreDir: sdir, BlockSize: 10 * rl}
+	fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
+	require_NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, _, err := fs.StoreMsg(subj, nil, msg)
+		require_NoError(t, err)
+	}
+	o, err := fs.ConsumerStore("dlc", &ConsumerConfig{AckPolicy: AckExplicit})
+	require_NoError(t, err)
+	require_NoError(t, o.Update(&ConsumerState{Delivered: SequencePair{Consumer: 30, Stream: 30}, AckFloor: SequencePair{Consumer: 30, Stream: 30}}))
+	fs.Stop()
+
+	report, err := VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	if report.Errors != 0 || len(report.Streams) != 1 {
+		t.Fatalf("Expected a clean report, got %+v", report)
+	}
+	sr := report.Streams[0]
+	if sr.Msgs != 30 || sr.FirstSeq != 1 || sr.LastSeq != 30 || sr.NumBlocks != 3 || sr.NumConsumers != 1 {
+		t.Fatalf("Unexpected stream report: %+v", sr)
+	}
+
+	// Corrupt the payload of the 6th message in the second block, sequence 16.
+	mfn := filepath.Join(sdir, msgDir, fmt.Sprintf(blkScan, 2))
+	buf, err := ioutil.ReadFile(mfn)
+	require_NoError(t, err)
+	buf[5*rl+msgHdrSize+10] ^= 0xff
+	require_NoError(t, ioutil.WriteFile(mfn, buf, defaultFilePerms))
+
+	report, err = VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	sr = report.Streams[0]
+	if report.Errors != 1 || len(sr.Blocks) != 1 {
+		t.Fatalf("Expected one bad block, got %+v", sr)
+	}
+	if br := sr.Blocks[0]; br.Index != 2 || br.IndexFile != jsVerifyIndexStale || br.Offset != 5*rl || br.LostBytes != 5*rl {
+		t.Fatalf("Unexpected block report: %+v", br)
+	}
+	if len(sr.Lost) != 1 || sr.Lost[0] != (JSVerifyRange{First: 16, Last: 20}) {
+		t.Fatalf("Expected lost range of 16-20, got %+v", sr.Lost)
+	}
+	// The consumer is ahead of the good messages but not the stream.
+	if len(sr.Consumers) != 0 {
+		t.Fatalf("Expected no consumer problems, got %+v", sr.Consumers)
+	}
+	// Make sure we can generate JSON.
+	_, err = json.Marshal(report)
+	require_NoError(t, err)
+
+	// Now repair.
+	report, err = VerifyJetStreamStore(root, true)
+	require_NoError(t, err)
+	if sr = report.Streams[0]; len(sr.Repairs) != 2 {
+		t.Fatalf("Expected truncate and rebuild repairs, got %+v", sr.Repairs)
+	}
+
+	report, err = VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	if sr = report.Streams[0]; report.Errors != 0 || sr.Msgs != 25 || sr.LastSeq != 30 {
+		t.Fatalf("Expected a clean report after repair, got %+v", sr)
+	}
+
+	fs, err = newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
+	require_NoError(t, err)
+	defer fs.Stop()
+	if state := fs.State(); state.Msgs != 25 || state.FirstSeq != 1 || state.LastSeq != 30 {
+		t.Fatalf("Unexpected state after repair: %+v", state)
+	}
+	var smv StoreMsg
+	_, err = fs.LoadMsg(16, &smv)
+	require_Error(t, err)
+	_, err = fs.LoadMsg(21, &smv)
+	require_NoError(t, err)
+}
+
+func TestFileStoreVerifyFirstRecordAndEncrypted(t *testing.T) {
+	root := createDir(t, "js-verify")
+	defer removeDir(t, root)
+	sdir := filepath.Join(root, JetStreamStoreDir, globalAccountName, streamsDir, "zzz")
+
+	subj, msg := "foo", make([]byte, 100)
+	rl := fileStoreMsgSize(subj, nil, msg)
+
+	fcfg := FileStoreConfig{StoreDir: sdir, BlockSize: 10 * rl}
+	fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Storage: FileStorage})
+	require_NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, _, err := fs.StoreMsg(subj, nil, msg)
+		require_NoError(t, err)
+	}
+	fs.Stop()
+
+	// Corrupt the first message in the second block, sequence 11.
+	mfn := filepath.Join(sdir, msgDir, fmt.Sprintf(blkScan, 2))
+	buf, err := ioutil.ReadFile(mfn)
+	require_NoError(t, err)
+	buf[msgHdrSize+10] ^= 0xff
+	require_NoError(t, ioutil.WriteFile(mfn, buf, defaultFilePerms))
+
+	// Lost range comes from the index.
+	report, err := VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	if sr := report.Streams[0]; len(sr.Lost) != 1 || sr.Lost[0] != (JSVerifyRange{First: 11, Last: 20}) {
+		t.Fatalf("Expected lost range of 11-20, got %+v", sr.Lost)
+	}
+	// Without the index, the first lost sequence comes from the previous block.
+	require_NoError(t, os.Remove(filepath.Join(sdir, msgDir, fmt.Sprintf(indexScan, 2))))
+	report, err = VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	if sr := report.Streams[0]; len(sr.Lost) != 1 || sr.Lost[0].First != 11 {
+		t.Fatalf("Expected lost range starting at 11, got %+v", sr.Lost)
+	}
+
+	// Encrypted streams can not be checked.
+	prf := func(context []byte) ([]byte, error) {
+		h := hmac.New(sha256.New, []byte("dlc22"))
+		if _, err := h.Write(context); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+	edir := filepath.Join(root, JetStreamStoreDir, globalAccountName, streamsDir, "enc")
+	fs, err = newFileStoreWithCreated(FileStoreConfig{StoreDir: edir}, StreamConfig{Name: "enc", Storage: FileStorage}, time.Now(), prf, nil)
+	require_NoError(t, err)
+	_, _, err = fs.StoreMsg(subj, nil, msg)
+	require_NoError(t, err)
+	fs.Stop()
+
+	report, err = VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	if report.Unchecked != 1 {
+		t.Fatalf("Expected one unchecked stream, got %+v", report)
+	}
+}
+
+func TestFileStoreVerifyArchivedBlocks(t *testing.T) {
+	root := createDir(t, "js-verify")
+	defer removeDir(t, root)
+	sdir := filepath.Join(root, JetStreamStoreDir, globalAccountName, streamsDir, "zzz")
+	adir := createDir(t, "js-archive")
+	defer removeDir(t, adir)
+
+	subj, msg := "foo", make([]byte, 100)
+	rl := fileStoreMsgSize(subj, nil, msg)
+
+	fcfg := FileStoreConfig{StoreDir: sdir, BlockSize: 10 * rl, Archive: &DirArchive{Dir: adir}, ArchivePrefix: "S1/$G/streams/zzz"}
+	cfg := StreamConfig{Name: "zzz", Storage: FileStorage, Tier: &TierPolicy{Age: time.Millisecond}}
+	fs, err := newFileStore(fcfg, cfg)
+	require_NoError(t, err)
+	for i := 0; i < 30; i++ {
+		_, _, err := fs.StoreMsg(subj, nil, msg)
+		require_NoError(t, err)
+	}
+	// Everything but the last block should be archived.
+	time.Sleep(10 * time.Millisecond)
+	fs.tierBlocks()
+	fs.Stop()
+
+	report, err := VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	sr := report.Streams[0]
+	if report.Errors != 0 || sr.NumBlocks != 3 || sr.NumArchived != 2 || sr.Msgs != 30 || sr.FirstSeq != 1 || sr.LastSeq != 30 {
+		t.Fatalf("Unexpected stream report: %+v", sr)
+	}
+
+	// A bad marker should be reported.
+	afn := filepath.Join(sdir, msgDir, fmt.Sprintf(arcScan, 1))
+	marker, err := ioutil.ReadFile(afn)
+	require_NoError(t, err)
+	require_NoError(t, ioutil.WriteFile(afn, marker[:4], defaultFilePerms))
+	report, err = VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	if sr = report.Streams[0]; report.Errors != 1 || len(sr.Blocks) != 1 || sr.Blocks[0].Index != 1 {
+		t.Fatalf("Expected archived block 1 to be reported, got %+v", sr)
+	}
+	require_NoError(t, ioutil.WriteFile(afn, marker, defaultFilePerms))
+
+	// Corrupt a message in our local block, sequence 26, and repair without the archive.
+	mfn := filepath.Join(sdir, msgDir, fmt.Sprintf(blkScan, 3))
+	buf, err := ioutil.ReadFile(mfn)
+	require_NoError(t, err)
+	buf[5*rl+msgHdrSize+10] ^= 0xff
+	require_NoError(t, ioutil.WriteFile(mfn, buf, defaultFilePerms))
+
+	report, err = VerifyJetStreamStore(root, true)
+	require_NoError(t, err)
+	for _, r := range report.Streams[0].Repairs {
+		if strings.HasPrefix(r, "error") {
+			t.Fatalf("Unexpected repair error: %q", r)
+		}
+	}
+	report, err = VerifyJetStreamStore(root, false)
+	require_NoError(t, err)
+	if sr = report.Streams[0]; report.Errors != 0 || sr.NumArchived != 2 || sr.Msgs != 25 {
+		t.Fatalf("Expected a clean report after repair, got %+v", sr)
+	}
+
+	// Archived blocks should still be readable.
+	fs, err = newFileStore(fcfg, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+	var smv StoreMsg
+	_, err = fs.LoadMsg(5, &smv)
+	require_NoError(t, err)
+	_, err = fs.LoadMsg(26, &smv)
+	require_Error(t, err)
+}
+
+func TestFileStoreTieredStorage(t *testing.T) {
+	prf := func(context []byte) ([]byte, error) {
+		h := hmac.New(sha256.New, []byte("dlc22"))
+		if _, err := h.Write(context); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+
+	for _, test := range []struct {
+		name string
+		alg  StoreCompression
+		prf  keyGen
+	}{
+		{"None", NoCompression, nil},
+		{"S2", S2Compression, nil},
+		{"S2-Encrypted", S2Compression, prf},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			storeDir := createDir(t, JetStreamStoreDir)
+			defer removeDir(t, storeDir)
+			adir := createDir(t, "js-archive")
+			defer removeDir(t, adir)
+
+			archive := &DirArchive{Dir: adir}
+			subj, msg := "foo", bytes.Repeat([]byte("Z"), 100)
+			rl := fileStoreMsgSize(subj, nil, msg)
+
+			fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 10 * rl, Archive: archive, ArchivePrefix: "$G/streams/zzz"}
+			cfg := StreamConfig{Name: "zzz", Storage: FileStorage, Compression: test.alg, Tier: &TierPolicy{Age: time.Hour, CacheBlocks: 1}}
+
+			// Need an archive.
+			_, err := newFileStore(FileStoreConfig{StoreDir: storeDir}, cfg)
+			require_Error(t, err, errNoArchive)
+
+			fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), test.prf, nil)
+			require_NoError(t, err)
+			defer fs.Stop()
+
+			for i := 0; i < 30; i++ {
+				_, _, err := fs.StoreMsg(subj, nil, msg)
+				require_NoError(t, err)
+			}
+			// Nothing is old enough yet.
+			fs.tierBlocks()
+			if _, cold, blocks := fs.tierUsage(); cold != 0 || blocks != 0 {
+				t.Fatalf("Expected no cold blocks, got %d bytes in %d blocks", cold, blocks)
+			}
+
+			// Lower our age, everything but the last block should be archived.
+			cfg.Tier.Age = time.Millisecond
+			require_NoError(t, fs.UpdateConfig(&cfg))
+			time.Sleep(10 * time.Millisecond)
+			fs.tierBlocks()
+			// Put it back so nothing else moves while we check.
+			cfg.Tier.Age = time.Hour
+			require_NoError(t, fs.UpdateConfig(&cfg))
+
+			mdir := filepath.Join(storeDir, msgDir)
+			checkArchived := func(index uint64, archived bool) {
+				t.Helper()
+				_, lerr := os.Stat(filepath.Join(mdir, fmt.Sprintf(blkScan, index)))
+				_, merr := os.Stat(filepath.Join(mdir, fmt.Sprintf(arcScan, index)))
+				_, aerr := os.Stat(filepath.Join(adir, "$G", "streams", "zzz", msgDir, fmt.Sprintf(blkScan, index)))
+				if archived && (lerr == nil || merr != nil || aerr != nil) {
+					t.Fatalf("Expected block %d to be archived", index)
+				}
+				if !archived && (lerr != nil || merr == nil || aerr == nil) {
+					t.Fatalf("Expected block %d to be local", index)
+				}
+			}
+			checkArchived(1, true)
+			checkArchived(2, true)
+			checkArchived(3, false)
+
+			hot, cold, blocks := fs.tierUsage()
+			if blocks != 2 || cold == 0 || hot == 0 {
+				t.Fatalf("Unexpected tier usage: hot %d, cold %d, blocks %d", hot, cold, blocks)
+			}
+
+			checkMsgs := func(fs *fileStore) {
+				t.Helper()
+				if state := fs.State(); state.Msgs != 30 || state.FirstSeq != 1 || state.LastSeq != 30 {
+					t.Fatalf("Unexpected state: %+v", state)
+				}
+				var smv StoreMsg
+				for seq := uint64(1); seq <= 30; seq++ {
+					sm, err := fs.LoadMsg(seq, &smv)
+					require_NoError(t, err)
+					if sm.subj != subj || !bytes.Equal(sm.msg, msg) {
+						t.Fatalf("Bad message for seq %d", seq)
+					}
+				}
+				sm, _, err := fs.LoadNextMsg(subj, false, 12, &smv)
+				require_NoError(t, err)
+				if sm.seq != 12 {
+					t.Fatalf("Expected seq 12, got %d", sm.seq)
+				}
+			}
+
+			// Make sure we do not rely on the block caches.
+			fs.mu.RLock()
+			for _, mb := range fs.blks {
+				mb.mu.Lock()
+				mb.clearCache()
+				mb.mu.Unlock()
+			}
+			fs.mu.RUnlock()
+			checkMsgs(fs)
+
+			// We should only hold one archived block.
+			if n := len(fs.acache.blks); n != 1 {
+				t.Fatalf("Expected 1 cached archived block, got %d", n)
+			}
+
+			// Updates to the number of cached blocks should take effect.
+			cfg.Tier.CacheBlocks = 2
+			require_NoError(t, fs.UpdateConfig(&cfg))
+			fs.mu.RLock()
+			for _, mb := range fs.blks {
+				mb.mu.Lock()
+				mb.clearCache()
+				mb.mu.Unlock()
+			}
+			fs.mu.RUnlock()
+			checkMsgs(fs)
+			if n := len(fs.acache.blks); n != 2 {
+				t.Fatalf("Expected 2 cached archived blocks, got %d", n)
+			}
+			cfg.Tier.CacheBlocks = 1
+			require_NoError(t, fs.UpdateConfig(&cfg))
+			if n := len(fs.acache.blks); n != 1 {
+				t.Fatalf("Expected 1 cached archived block, got %d", n)
+			}
+
+			// Recover from the archive.
+			fs.Stop()
+			fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), test.prf, nil)
+			require_NoError(t, err)
+			defer fs.Stop()
+			checkMsgs(fs)
+			if _, _, blocks := fs.tierUsage(); blocks != 2 {
+				t.Fatalf("Expected 2 cold blocks after restart, got %d", blocks)
+			}
+
+			// Erasing a message needs to rewrite the block, so it is brought back.
+			// Encrypted stores do not rewrite on erase.
+			_, err = fs.EraseMsg(5)
+			require_NoError(t, err)
+			checkArchived(1, test.prf != nil)
+			checkArchived(2, true)
+			var smv StoreMsg
+			_, err = fs.LoadMsg(5, &smv)
+			require_Error(t, err)
+			_, err = fs.LoadMsg(6, &smv)
+			require_NoError(t, err)
+
+			// Purge should remove our archived blocks.
+			_, err = fs.Purge()
+			require_NoError(t, err)
+			_, err = os.Stat(filepath.Join(adir, "$G", "streams", "zzz", msgDir, fmt.Sprintf(blkScan, 2)))
+			if !os.IsNotExist(err) {
+				t.Fatalf("Expected archived block to be removed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileStorePerSubjectInfoRecovery(t *testing.T) {
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	msg := []byte("Hello World")
+	rl := fileStoreMsgSize("foo.0", nil, msg)
+	fcfg := FileStoreConfig{StoreDir: storeDir, BlockSize: 10 * rl}
+	cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: FileStorage}
+
+	fs, err := newFileStore(fcfg, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	for i := 0; i < 100; i++ {
+		_, _, err := fs.StoreMsg(fmt.Sprintf("foo.%d", i%7), nil, msg)
+		require_NoError(t, err)
+	}
+
+	// Sealed blocks should have their per subject info written out.
+	mdir := filepath.Join(storeDir, msgDir)
+	sfn := func(index int) string { return filepath.Join(mdir, fmt.Sprintf(fssScan, index)) }
+	for i := 1; i < 10; i++ {
+		if _, err := os.Stat(sfn(i)); err != nil {
+			t.Fatalf("Expected per subject info for sealed block %d: %v", i, err)
+		}
+	}
+	stale, err := ioutil.ReadFile(sfn(1))
+	require_NoError(t, err)
+
+	// Interior delete in the first block.
+	_, err = fs.RemoveMsg(3)
+	require_NoError(t, err)
+
+	expected := fs.SubjectsState(">")
+	efs := fs.FilteredState(1, "foo.2")
+	var smv StoreMsg
+	esm, err := fs.LoadLastMsg("foo.3", &smv)
+	require_NoError(t, err)
+	eseq := esm.seq
+
+	checkState := func(fs *fileStore) {
+		t.Helper()
+		if ss := fs.SubjectsState(">"); !reflect.DeepEqual(ss, expected) {
+			t.Fatalf("Subjects state did not match\n%+v\nvs\n%+v", ss, expected)
+		}
+		if ss := fs.FilteredState(1, "foo.2"); ss != efs {
+			t.Fatalf("Filtered state did not match, %+v vs %+v", ss, efs)
+		}
+		sm, err := fs.LoadLastMsg("foo.3", &smv)
+		require_NoError(t, err)
+		if sm.seq != eseq {
+			t.Fatalf("Expected last seq %d, got %d", eseq, sm.seq)
+		}
+	}
+
+	fs.Stop()
+	good, err := ioutil.ReadFile(sfn(2))
+	require_NoError(t, err)
+
+	// Simulate not having written out the first block's info after the delete.
+	// It still matches the block's contents, but not our index.
+	require_NoError(t, ioutil.WriteFile(sfn(1), stale, defaultFilePerms))
+
+	fs, err = newFileStore(fcfg, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+	checkState(fs)
+
+	// The stale one should have been rebuilt and written back out, the others left as is.
+	buf, err := ioutil.ReadFile(sfn(1))
+	require_NoError(t, err)
+	if bytes.Equal(buf, stale) {
+		t.Fatalf("Expected stale per subject info to be rewritten")
+	}
+	buf, err = ioutil.ReadFile(sfn(2))
+	require_NoError(t, err)
+	if !bytes.Equal(buf, good) {
+		t.Fatalf("Expected valid per subject info to be left alone")
+	}
+
+	// Corrupt one and make sure we rebuild.
+	fs.Stop()
+	buf[10] ^= 0xff
+	require_NoError(t, ioutil.WriteFile(sfn(2), buf, defaultFilePerms))
+	require_NoError(t, os.Remove(sfn(3)))
+
+	fs, err = newFileStore(fcfg, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+	checkState(fs)
+
+	nbuf, err := ioutil.ReadFile(sfn(2))
+	require_NoError(t, err)
+	if bytes.Equal(nbuf, buf) || len(nbuf) != len(good) {
+		t.Fatalf("Expected corrupt per subject info to be rebuilt")
+	}
+	if _, err := os.Stat(sfn(3)); err != nil {
+		t.Fatalf("Expected missing per subject info to be rebuilt: %v", err)
+	}
+}
+
+func TestFileStorePerSubjectInfoEncrypted(t *testing.T) {
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	prf := func(context []byte) ([]byte, error) {
+		h := hmac.New(sha256.New, []byte("dlc22"))
+		if _, err := h.Write(context); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
+	}
+
+	fcfg := FileStoreConfig{StoreDir: storeDir}
+	cfg := StreamConfig{Name: "zzz", Subjects: []string{"secret.>"}, Storage: FileStorage}
+	fs, err := newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	for i := 0; i < 10; i++ {
+		_, _, err := fs.StoreMsg(fmt.Sprintf("secret.subject.%d", i), nil, []byte("ok"))
+		require_NoError(t, err)
+	}
+	fs.Stop()
+
+	buf, err := ioutil.ReadFile(filepath.Join(storeDir, msgDir, fmt.Sprintf(fssScan, 1)))
+	require_NoError(t, err)
+	if bytes.Contains(buf, []byte("secret.subject")) {
+		t.Fatalf("Found plaintext subjects in per subject info")
+	}
+
+	fs, err = newFileStoreWithCreated(fcfg, cfg, time.Now(), prf, nil)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	// Make sure we used what we wrote out.
+	fs.mu.RLock()
+	mb := fs.blks[0]
+	fs.mu.RUnlock()
+	mb.mu.RLock()
+	used := mb.lwfts > 0 && len(mb.fss) == 10
+	mb.mu.RUnlock()
+	if !used {
+		t.Fatalf("Expected per subject info to be recovered")
+	}
+	if ss := fs.SubjectsState("secret.>"); len(ss) != 10 {
+		t.Fatalf("Expected 10 subjects, got %d", len(ss))
+	}
+}
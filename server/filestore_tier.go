@@ -0,0 +1,385 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// BlockArchive is a secondary store for sealed message blocks of file based streams.
+// Keys are relative slash separated paths that are unique per stream and block.
+type BlockArchive interface {
+	// Put stores the block contents under key, replacing anything already there.
+	Put(key string, buf []byte) error
+	// Get returns the block contents stored under key.
+	Get(key string) ([]byte, error)
+	// Remove removes the block stored under key. Removing a missing key is not an error.
+	Remove(key string) error
+}
+
+// DirArchive is a BlockArchive that keeps blocks in a local directory.
+// This can be used with network file systems or object store fuse mounts.
+// The directory should not be shared between servers.
+type DirArchive struct {
+	Dir string
+}
+
+// Put writes the block to a temporary file and moves it into place.
+func (da *DirArchive) Put(key string, buf []byte) error {
+	fn := filepath.Join(da.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(fn), defaultDirPerms); err != nil {
+		return err
+	}
+	tmp := fn + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if _, err = f.Write(buf); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, fn)
+}
+
+// Get reads the block from the archive directory.
+func (da *DirArchive) Get(key string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(da.Dir, filepath.FromSlash(key)))
+}
+
+// Remove removes the block from the archive directory.
+func (da *DirArchive) Remove(key string) error {
+	if err := os.Remove(filepath.Join(da.Dir, filepath.FromSlash(key))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+const (
+	// Marker file for a block that has been moved to the archive.
+	arcScan = "%d.arc"
+	// Default number of archived blocks we keep in memory once fetched.
+	defaultTierCacheBlocks = 4
+	// Maximum interval between checks for blocks to archive.
+	tierCheckInterval = time.Minute
+	// Marker holds the on disk size, the trailing checksum and the compression header of the block.
+	arcMarkerSize = 8 + checksumSize + cmpHdrSize
+)
+
+// Small LRU cache of archived block contents as stored, so possibly compressed and encrypted.
+type archiveCache struct {
+	mu   sync.Mutex
+	max  int
+	blks []archivedBlock // Most recently used first.
+}
+
+type archivedBlock struct {
+	index uint64
+	buf   []byte
+}
+
+func newArchiveCache(max int) *archiveCache {
+	if max <= 0 {
+		max = defaultTierCacheBlocks
+	}
+	return &archiveCache{max: max}
+}
+
+// Will change the number of blocks we keep, dropping the least recently used ones if needed.
+func (ac *archiveCache) setMax(max int) {
+	if max <= 0 {
+		max = defaultTierCacheBlocks
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	ac.max = max
+	if len(ac.blks) > max {
+		ac.blks = ac.blks[:max]
+	}
+}
+
+func (ac *archiveCache) get(index uint64) []byte {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for i, ab := range ac.blks {
+		if ab.index == index {
+			copy(ac.blks[1:i+1], ac.blks[:i])
+			ac.blks[0] = ab
+			return ab.buf
+		}
+	}
+	return nil
+}
+
+func (ac *archiveCache) add(index uint64, buf []byte) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for i, ab := range ac.blks {
+		if ab.index == index {
+			ac.blks = append(ac.blks[:i], ac.blks[i+1:]...)
+			break
+		}
+	}
+	if len(ac.blks) >= ac.max {
+		ac.blks = ac.blks[:ac.max-1]
+	}
+	ac.blks = append(ac.blks, archivedBlock{})
+	copy(ac.blks[1:], ac.blks)
+	ac.blks[0] = archivedBlock{index, buf}
+}
+
+func (ac *archiveCache) remove(index uint64) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	for i, ab := range ac.blks {
+		if ab.index == index {
+			ac.blks = append(ac.blks[:i], ac.blks[i+1:]...)
+			return
+		}
+	}
+}
+
+// Key for a message block in our archive.
+func (fs *fileStore) archiveKey(index uint64) string {
+	return filepath.ToSlash(filepath.Join(fs.fcfg.ArchivePrefix, msgDir, fmt.Sprintf(blkScan, index)))
+}
+
+// Will fetch the stored contents of an archived block, using our cache if possible.
+// The returned buffer should not be modified.
+func (fs *fileStore) fetchArchivedBlock(index uint64) ([]byte, error) {
+	if buf := fs.acache.get(index); buf != nil {
+		return buf, nil
+	}
+	if fs.fcfg.Archive == nil {
+		return nil, errNoArchive
+	}
+	buf, err := fs.fcfg.Archive.Get(fs.archiveKey(index))
+	if err != nil {
+		return nil, err
+	}
+	fs.acache.add(index, buf)
+	return buf, nil
+}
+
+// Lock should be held.
+func (fs *fileStore) startTierChk() {
+	if fs.tierChk != nil || fs.cfg.Tier == nil || fs.fcfg.Archive == nil {
+		return
+	}
+	fs.tierChk = time.AfterFunc(fs.tierInterval(), fs.tierBlocks)
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelTierChk() {
+	if fs.tierChk != nil {
+		fs.tierChk.Stop()
+		fs.tierChk = nil
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) tierInterval() time.Duration {
+	if age := fs.cfg.Tier.Age; age < tierCheckInterval {
+		return age
+	}
+	return tierCheckInterval
+}
+
+// Will move any sealed blocks older than our tier policy's age to the archive.
+func (fs *fileStore) tierBlocks() {
+	fs.mu.RLock()
+	if fs.closed || fs.cfg.Tier == nil || fs.fcfg.Archive == nil {
+		fs.mu.RUnlock()
+		return
+	}
+	minAge := time.Now().UnixNano() - int64(fs.cfg.Tier.Age)
+	var _blks [32]*msgBlock
+	blks := _blks[:0]
+	for _, mb := range fs.blks {
+		if mb != fs.lmb {
+			blks = append(blks, mb)
+		}
+	}
+	fs.mu.RUnlock()
+
+	for _, mb := range blks {
+		mb.mu.Lock()
+		if !mb.arch && !mb.closed && mb.msgs > 0 && mb.last.ts <= minAge {
+			// On failure the block will simply stay local and we will try again.
+			mb.archiveLocked()
+		}
+		mb.mu.Unlock()
+	}
+
+	fs.mu.Lock()
+	if fs.tierChk != nil {
+		fs.tierChk.Reset(fs.tierInterval())
+	}
+	fs.mu.Unlock()
+}
+
+// Returns the bytes on disk for blocks held locally and in our archive.
+func (fs *fileStore) tierUsage() (hot, cold uint64, coldBlocks int) {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		sz := mb.rbytes
+		if mb.cmp != NoCompression {
+			sz = mb.cbytes
+		}
+		if mb.arch {
+			cold += sz
+			coldBlocks++
+		} else {
+			hot += sz
+		}
+		mb.mu.RUnlock()
+	}
+	return hot, cold, coldBlocks
+}
+
+// Will move our block contents to the archive and leave a marker in its place.
+// Lock should be held.
+func (mb *msgBlock) archiveLocked() error {
+	fs := mb.fs
+	if fs == nil || fs.fcfg.Archive == nil {
+		return errNoArchive
+	}
+	if ld, err := mb.flushPendingMsgsLocked(); err != nil || ld != nil {
+		if ld != nil {
+			go fs.rebuildState(ld)
+		}
+		return errPendingData
+	}
+	if err := mb.closeFDsLocked(); err != nil {
+		return err
+	}
+	// Make sure our index is current since we will trust it on recovery.
+	if mb.lwits < mb.lwts || mb.lwits < mb.lrts {
+		if err := mb.writeIndexInfoLocked(); err != nil {
+			return err
+		}
+	}
+	buf, err := ioutil.ReadFile(mb.mfn)
+	if err != nil {
+		return err
+	}
+	if len(buf) < checksumSize {
+		return errCorruptState
+	}
+	if err := fs.fcfg.Archive.Put(fs.archiveKey(mb.index), buf); err != nil {
+		return err
+	}
+
+	var marker [arcMarkerSize]byte
+	binary.LittleEndian.PutUint64(marker[0:], uint64(len(buf)))
+	copy(marker[8:], buf[len(buf)-checksumSize:])
+	if len(buf) >= cmpHdrSize {
+		copy(marker[8+checksumSize:], buf)
+	}
+	afn := filepath.Join(filepath.Dir(mb.mfn), fmt.Sprintf(arcScan, mb.index))
+	if err := ioutil.WriteFile(afn, marker[:], defaultFilePerms); err != nil {
+		fs.fcfg.Archive.Remove(fs.archiveKey(mb.index))
+		return err
+	}
+	if err := os.Remove(mb.mfn); err != nil {
+		os.Remove(afn)
+		fs.fcfg.Archive.Remove(fs.archiveKey(mb.index))
+		return err
+	}
+	mb.arch, mb.afn = true, afn
+	return nil
+}
+
+// Will bring an archived block back to local storage.
+// This is needed before any changes to the underlying block file.
+// Lock should be held.
+func (mb *msgBlock) restoreLocked() error {
+	if !mb.arch {
+		return nil
+	}
+	fs := mb.fs
+	buf, err := fs.fetchArchivedBlock(mb.index)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(mb.mfn, buf, defaultFilePerms); err != nil {
+		return err
+	}
+	os.Remove(mb.afn)
+	mb.removeArchivedLocked()
+	mb.arch, mb.afn = false, _EMPTY_
+	return nil
+}
+
+// Will remove our block contents from the archive, if any.
+// Lock should be held.
+func (mb *msgBlock) removeArchivedLocked() {
+	if !mb.arch || mb.fs == nil {
+		return
+	}
+	fs := mb.fs
+	fs.acache.remove(mb.index)
+	if fs.fcfg.Archive != nil {
+		fs.fcfg.Archive.Remove(fs.archiveKey(mb.index))
+	}
+}
+
+// Will load the stored contents of an archived block.
+// Lock should be held.
+func (mb *msgBlock) loadArchivedBlock(buf []byte) ([]byte, error) {
+	abuf, err := mb.fs.fetchArchivedBlock(mb.index)
+	if err != nil {
+		return nil, err
+	}
+	sz := len(abuf)
+	if buf == nil {
+		buf = getMsgBlockBuf(sz)
+	}
+	if sz > cap(buf) {
+		buf = make([]byte, sz)
+	}
+	buf = buf[:sz]
+	// Callers may decrypt in place, so always copy.
+	copy(buf, abuf)
+	return buf, nil
+}
+
+// Read the marker of an archived block.
+func readArchiveMarker(afn string) (size int64, lchk [checksumSize]byte, chdr [cmpHdrSize]byte, err error) {
+	buf, err := ioutil.ReadFile(afn)
+	if err != nil {
+		return 0, lchk, chdr, err
+	}
+	if len(buf) != arcMarkerSize {
+		return 0, lchk, chdr, errCorruptState
+	}
+	size = int64(binary.LittleEndian.Uint64(buf))
+	copy(lchk[:], buf[8:])
+	copy(chdr[:], buf[8+checksumSize:])
+	return size, lchk, chdr, nil
+}
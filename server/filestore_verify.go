@@ -0,0 +1,519 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/minio/highwayhash"
+)
+
+// JSVerifyReport is the result of an offline check of a JetStream store directory.
+// Streams that could not be checked, e.g. encrypted ones, are counted as unchecked.
+type JSVerifyReport struct {
+	StoreDir  string            `json:"store_dir"`
+	Repair    bool              `json:"repair"`
+	Streams   []*JSVerifyStream `json:"streams"`
+	Errors    int               `json:"errors"`
+	Unchecked int               `json:"unchecked"`
+}
+
+// JSVerifyStream is the result of checking a single stream.
+// Only blocks and consumers with problems are listed.
+type JSVerifyStream struct {
+	Account      string              `json:"account"`
+	Name         string              `json:"name"`
+	Skipped      string              `json:"skipped,omitempty"`
+	Msgs         uint64              `json:"messages"`
+	Bytes        uint64              `json:"bytes"`
+	FirstSeq     uint64              `json:"first_seq"`
+	LastSeq      uint64              `json:"last_seq"`
+	NumBlocks    int                 `json:"num_blocks"`
+	NumArchived  int                 `json:"num_archived,omitempty"`
+	NumConsumers int                 `json:"num_consumers"`
+	Lost         []JSVerifyRange     `json:"lost,omitempty"`
+	LostBytes    uint64              `json:"lost_bytes,omitempty"`
+	Blocks       []*JSVerifyBlock    `json:"blocks,omitempty"`
+	Consumers    []*JSVerifyConsumer `json:"consumers,omitempty"`
+	Errors       []string            `json:"errors,omitempty"`
+	Repairs      []string            `json:"repairs,omitempty"`
+}
+
+// JSVerifyBlock is a message block with problems.
+type JSVerifyBlock struct {
+	Index     uint64         `json:"index"`
+	IndexFile string         `json:"index_file"`
+	Error     string         `json:"error,omitempty"`
+	Offset    uint64         `json:"offset,omitempty"`
+	Lost      *JSVerifyRange `json:"lost,omitempty"`
+	LostBytes uint64         `json:"lost_bytes,omitempty"`
+}
+
+// JSVerifyConsumer is a consumer with problems.
+type JSVerifyConsumer struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// JSVerifyRange is an inclusive range of stream sequences.
+// A Last of zero means the end of the range could not be determined.
+type JSVerifyRange struct {
+	First uint64 `json:"first"`
+	Last  uint64 `json:"last"`
+}
+
+// Status of a message block's index file.
+const (
+	jsVerifyIndexOK      = "ok"
+	jsVerifyIndexMissing = "missing"
+	jsVerifyIndexCorrupt = "corrupt"
+	jsVerifyIndexStale   = "stale"
+)
+
+// VerifyJetStreamStore will walk every stream and consumer in a JetStream store directory
+// and check message records, index files and consumer state. The server must not be running
+// against storeDir. If repair is true, corrupt message blocks are truncated at the last good
+// record and bad index files are rebuilt in place.
+func VerifyJetStreamStore(storeDir string, repair bool) (*JSVerifyReport, error) {
+	// Allow the top level store directory or the jetstream directory itself.
+	if fi, err := os.Stat(filepath.Join(storeDir, JetStreamStoreDir)); err == nil && fi.IsDir() {
+		storeDir = filepath.Join(storeDir, JetStreamStoreDir)
+	}
+	afis, err := ioutil.ReadDir(storeDir)
+	if err != nil {
+		return nil, err
+	}
+	report := &JSVerifyReport{StoreDir: storeDir, Repair: repair, Streams: []*JSVerifyStream{}}
+	for _, afi := range afis {
+		if !afi.IsDir() {
+			continue
+		}
+		sfis, err := ioutil.ReadDir(filepath.Join(storeDir, afi.Name(), streamsDir))
+		if err != nil {
+			continue
+		}
+		for _, sfi := range sfis {
+			if !sfi.IsDir() {
+				continue
+			}
+			sr := verifyStreamStore(afi.Name(), filepath.Join(storeDir, afi.Name(), streamsDir, sfi.Name()), repair)
+			report.Errors += len(sr.Errors) + len(sr.Blocks) + len(sr.Consumers)
+			if sr.Skipped != _EMPTY_ {
+				report.Unchecked++
+			}
+			report.Streams = append(report.Streams, sr)
+		}
+	}
+	return report, nil
+}
+
+// Read and validate the stream meta file for a stream directory.
+func readStreamMeta(sdir, name string) (*FileStreamInfo, error) {
+	buf, err := ioutil.ReadFile(filepath.Join(sdir, JetStreamMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	sum, err := ioutil.ReadFile(filepath.Join(sdir, JetStreamMetaFileSum))
+	if err != nil {
+		return nil, err
+	}
+	key := sha256.Sum256([]byte(name))
+	hh, _ := highwayhash.New64(key[:])
+	hh.Write(buf)
+	if checksum := hex.EncodeToString(hh.Sum(nil)); checksum != string(sum) {
+		return nil, fmt.Errorf("meta file checksum mismatch")
+	}
+	var cfg FileStreamInfo
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+func verifyStreamStore(acc, sdir string, repair bool) *JSVerifyStream {
+	name := filepath.Base(sdir)
+	sr := &JSVerifyStream{Account: acc, Name: name}
+
+	// We can not check encrypted streams offline.
+	if _, err := os.Stat(filepath.Join(sdir, JetStreamMetaFileKey)); err == nil {
+		sr.Skipped = "encrypted"
+		return sr
+	}
+
+	cfg, err := readStreamMeta(sdir, name)
+	if err != nil {
+		sr.Errors = append(sr.Errors, fmt.Sprintf("stream meta: %v", err))
+	}
+
+	mdir := filepath.Join(sdir, msgDir)
+	fis, err := ioutil.ReadDir(mdir)
+	if err != nil {
+		sr.Errors = append(sr.Errors, fmt.Sprintf("message directory: %v", err))
+		return sr
+	}
+	// Blocks moved to an archive only leave a marker behind. Recovery prefers a local
+	// copy if we have both, so we do the same.
+	var indexes []uint64
+	archived := make(map[uint64]bool)
+	for _, fi := range fis {
+		var index uint64
+		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
+			if _, ok := archived[index]; !ok {
+				indexes = append(indexes, index)
+			}
+			archived[index] = false
+		} else if n, err := fmt.Sscanf(fi.Name(), arcScan, &index); err == nil && n == 1 {
+			if _, ok := archived[index]; !ok {
+				indexes = append(indexes, index)
+				archived[index] = true
+			}
+		}
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+	sr.NumBlocks = len(indexes)
+
+	var truncate []*JSVerifyBlock
+	var rebuild []uint64
+	var lost []*JSVerifyBlock
+
+	for _, index := range indexes {
+		var br *JSVerifyBlock
+		var scan *msgBlockScan
+		if archived[index] {
+			sr.NumArchived++
+			br, scan = verifyArchivedBlock(mdir, index)
+		} else {
+			br, scan = verifyMsgBlock(mdir, name, index, sr.LastSeq)
+		}
+		if scan != nil {
+			sr.Msgs += scan.msgs
+			sr.Bytes += scan.bytes
+			if scan.msgs > 0 && (sr.FirstSeq == 0 || scan.first < sr.FirstSeq) {
+				sr.FirstSeq = scan.first
+			}
+			if scan.last > sr.LastSeq {
+				sr.LastSeq = scan.last
+			}
+			// Fill in the end of any lost range from a previous block.
+			for _, lb := range lost {
+				if scan.first > 0 && lb.Lost.Last == 0 && scan.first > lb.Lost.First {
+					lb.Lost.Last = scan.first - 1
+				}
+			}
+			lost = lost[:0]
+		}
+		if br == nil {
+			continue
+		}
+		sr.Blocks = append(sr.Blocks, br)
+		if br.Lost != nil && br.Lost.Last == 0 {
+			lost = append(lost, br)
+		}
+		// The contents of archived blocks are not local, so we can not repair them here.
+		if archived[index] {
+			continue
+		}
+		if br.Error != _EMPTY_ && scan != nil && scan.truncatable {
+			truncate = append(truncate, br)
+		}
+		rebuild = append(rebuild, index)
+	}
+	for _, br := range sr.Blocks {
+		if br.Lost != nil {
+			sr.Lost = append(sr.Lost, *br.Lost)
+		}
+		sr.LostBytes += br.LostBytes
+	}
+
+	// Now check our consumers.
+	odir := filepath.Join(sdir, consumerDir)
+	if ofis, err := ioutil.ReadDir(odir); err == nil {
+		for _, ofi := range ofis {
+			if !ofi.IsDir() {
+				continue
+			}
+			sr.NumConsumers++
+			if err := verifyConsumerStore(filepath.Join(odir, ofi.Name()), name, sr.LastSeq); err != nil {
+				sr.Consumers = append(sr.Consumers, &JSVerifyConsumer{Name: ofi.Name(), Error: err.Error()})
+			}
+		}
+	}
+
+	if !repair || len(rebuild) == 0 {
+		return sr
+	}
+	if cfg == nil {
+		sr.Repairs = append(sr.Repairs, "not repaired, stream meta is not readable")
+		return sr
+	}
+
+	// Truncate any bad blocks at the last good record.
+	for _, br := range truncate {
+		mfn := filepath.Join(mdir, fmt.Sprintf(blkScan, br.Index))
+		if err := os.Truncate(mfn, int64(br.Offset)); err != nil {
+			sr.Repairs = append(sr.Repairs, fmt.Sprintf("error truncating block %d: %v", br.Index, err))
+			continue
+		}
+		sr.Repairs = append(sr.Repairs, fmt.Sprintf("truncated block %d at offset %d", br.Index, br.Offset))
+	}
+	// Remove index files that need to be rebuilt and let recovery rebuild them.
+	for _, index := range rebuild {
+		os.Remove(filepath.Join(mdir, fmt.Sprintf(indexScan, index)))
+		os.Remove(filepath.Join(mdir, fmt.Sprintf(fssScan, index)))
+	}
+	// Make sure recovery does not remove anything based on limits. We have no archive here,
+	// but archived blocks with a good index can be recovered from their markers.
+	scfg := cfg.StreamConfig
+	scfg.MaxAge, scfg.MaxMsgs, scfg.MaxBytes, scfg.MaxMsgsPer, scfg.AllowMsgTTL = 0, -1, -1, -1, false
+	scfg.Tier = nil
+	fs, err := newFileStoreWithCreated(FileStoreConfig{StoreDir: sdir}, scfg, cfg.Created, nil, nil)
+	if err != nil {
+		sr.Repairs = append(sr.Repairs, fmt.Sprintf("error rebuilding indexes: %v", err))
+		return sr
+	}
+	fs.Stop()
+	for _, index := range rebuild {
+		sr.Repairs = append(sr.Repairs, fmt.Sprintf("rebuilt index for block %d", index))
+	}
+	return sr
+}
+
+// Result of scanning the records of a message block.
+type msgBlockScan struct {
+	msgs        uint64
+	bytes       uint64
+	first       uint64
+	last        uint64
+	good        uint32
+	truncatable bool
+	err         error
+}
+
+// Check a single message block and its index file. The last sequence of the blocks before
+// this one is used to determine what was lost if we can not read any records.
+// Will return a non-nil block result if the block has problems.
+func verifyMsgBlock(mdir, name string, index, plast uint64) (*JSVerifyBlock, *msgBlockScan) {
+	br := &JSVerifyBlock{Index: index, IndexFile: jsVerifyIndexOK}
+
+	buf, err := ioutil.ReadFile(filepath.Join(mdir, fmt.Sprintf(blkScan, index)))
+	if err != nil {
+		br.Error = err.Error()
+		return br, nil
+	}
+	raw, cmp, err := decompressBlockBuf(buf)
+	if err != nil {
+		br.Error = err.Error()
+		return br, nil
+	}
+
+	// Use the index file, if valid, for the delete map and first sequence.
+	mb := &msgBlock{index: index}
+	hasIndex := false
+	if ibuf, err := ioutil.ReadFile(filepath.Join(mdir, fmt.Sprintf(indexScan, index))); err != nil {
+		br.IndexFile = jsVerifyIndexMissing
+	} else if err := mb.decodeIndexInfo(ibuf); err != nil {
+		br.IndexFile = jsVerifyIndexCorrupt
+		mb = &msgBlock{index: index}
+	} else {
+		hasIndex = true
+	}
+
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", name, index)))
+	hh, _ := highwayhash.New64(key[:])
+	scan := scanMsgBlock(raw, hh, mb.first.seq, mb.dmap)
+	scan.truncatable = cmp == NoCompression
+
+	if scan.err != nil {
+		br.Error, br.Offset = scan.err.Error(), uint64(scan.good)
+		br.LostBytes = uint64(len(raw)) - uint64(scan.good)
+		br.Lost = &JSVerifyRange{First: scan.last + 1}
+		// Nothing readable, so go by our index or the previous block.
+		if scan.last == 0 {
+			if br.Lost.First = plast + 1; hasIndex && mb.first.seq > 0 {
+				br.Lost.First = mb.first.seq
+			}
+		}
+		if hasIndex && mb.last.seq > scan.last {
+			br.Lost.Last = mb.last.seq
+		}
+		if br.IndexFile == jsVerifyIndexOK {
+			br.IndexFile = jsVerifyIndexStale
+		}
+	} else if hasIndex {
+		// This is the same check recovery uses to trust the index file,
+		// but we also make sure the counts match what is in the block.
+		var lchk []byte
+		if cmp == NoCompression && len(raw) >= checksumSize {
+			lchk = raw[len(raw)-checksumSize:]
+		}
+		if mb.msgs != scan.msgs || mb.last.seq != scan.last || (lchk != nil && !bytes.Equal(lchk, mb.lchk[:])) {
+			br.IndexFile = jsVerifyIndexStale
+		}
+	}
+
+	if br.Error == _EMPTY_ && br.IndexFile == jsVerifyIndexOK {
+		return nil, scan
+	}
+	return br, scan
+}
+
+// Check an archived block's marker against its index file. Its contents are only in the
+// archive, so the index is what recovery trusts and what we report from.
+// Will return a non-nil block result if the block has problems.
+func verifyArchivedBlock(mdir string, index uint64) (*JSVerifyBlock, *msgBlockScan) {
+	br := &JSVerifyBlock{Index: index, IndexFile: jsVerifyIndexOK}
+
+	_, lchk, _, err := readArchiveMarker(filepath.Join(mdir, fmt.Sprintf(arcScan, index)))
+	if err != nil {
+		br.Error = fmt.Sprintf("archive marker: %v", err)
+	}
+	mb := &msgBlock{index: index}
+	if ibuf, err := ioutil.ReadFile(filepath.Join(mdir, fmt.Sprintf(indexScan, index))); err != nil {
+		br.IndexFile = jsVerifyIndexMissing
+	} else if err := mb.decodeIndexInfo(ibuf); err != nil {
+		br.IndexFile = jsVerifyIndexCorrupt
+	} else if br.Error == _EMPTY_ && lchk != mb.lchk {
+		br.IndexFile = jsVerifyIndexStale
+	}
+	if br.IndexFile != jsVerifyIndexOK {
+		// Recovery would need to rebuild from the archive.
+		if br.Error == _EMPTY_ {
+			br.Error = "archived block needs its archive to rebuild the index"
+		}
+		return br, nil
+	}
+
+	scan := &msgBlockScan{msgs: mb.msgs, bytes: mb.bytes, first: mb.first.seq, last: mb.last.seq}
+	if br.Error == _EMPTY_ {
+		return nil, scan
+	}
+	return br, scan
+}
+
+// Scan the records of a message block validating each checksum.
+// This follows rebuildStateLocked but will not modify anything.
+func scanMsgBlock(buf []byte, hh hash.Hash64, fseq uint64, dmap map[uint64]struct{}) *msgBlockScan {
+	var le = binary.LittleEndian
+	scan := &msgBlockScan{first: fseq}
+	firstNeedsSet := true
+
+	for index, lbuf := uint32(0), uint32(len(buf)); index < lbuf; {
+		if index+msgHdrSize > lbuf {
+			scan.err = fmt.Errorf("short record header")
+			return scan
+		}
+		hdr := buf[index : index+msgHdrSize]
+		rl, slen := le.Uint32(hdr[0:]), le.Uint16(hdr[20:])
+
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit
+		dlen := int(rl) - msgHdrSize
+		if dlen < 0 || int(slen) > dlen || dlen > int(rl) || rl > rlBadThresh || index+rl > lbuf {
+			scan.err = errBadMsg
+			return scan
+		}
+
+		seq := le.Uint64(hdr[4:])
+		// Erased or deleted at the head.
+		if seq == 0 || seq&ebit != 0 || seq < fseq {
+			scan.last = seq &^ ebit
+			index += rl
+			scan.good = index
+			continue
+		}
+		if firstNeedsSet && seq > scan.first {
+			firstNeedsSet, scan.first = false, seq
+		}
+		_, deleted := dmap[seq]
+
+		data := buf[index+msgHdrSize : index+rl]
+		if !deleted {
+			hh.Reset()
+			hh.Write(hdr[4:20])
+			hh.Write(data[:slen])
+			if hasHeaders {
+				hh.Write(data[slen+4 : dlen-8])
+			} else {
+				hh.Write(data[slen : dlen-8])
+			}
+			if !bytes.Equal(hh.Sum(nil), data[len(data)-8:]) {
+				scan.err = fmt.Errorf("checksum mismatch for sequence %d", seq)
+				return scan
+			}
+			if firstNeedsSet {
+				firstNeedsSet, scan.first = false, seq
+			}
+			scan.msgs++
+			scan.bytes += uint64(rl)
+		}
+		scan.last = seq
+		index += rl
+		scan.good = index
+	}
+	return scan
+}
+
+// Check a consumer's meta and state files.
+func verifyConsumerStore(odir, stream string, lseq uint64) error {
+	name := filepath.Base(odir)
+	if _, err := os.Stat(filepath.Join(odir, JetStreamMetaFileKey)); err == nil {
+		return nil
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(odir, JetStreamMetaFile))
+	if err != nil {
+		return fmt.Errorf("consumer meta: %v", err)
+	}
+	sum, err := ioutil.ReadFile(filepath.Join(odir, JetStreamMetaFileSum))
+	if err != nil {
+		return fmt.Errorf("consumer meta: %v", err)
+	}
+	key := sha256.Sum256([]byte(stream + "/" + name))
+	hh, _ := highwayhash.New64(key[:])
+	hh.Write(buf)
+	if checksum := hex.EncodeToString(hh.Sum(nil)); checksum != string(sum) {
+		return fmt.Errorf("consumer meta: checksum mismatch")
+	}
+	var cfg FileConsumerInfo
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return fmt.Errorf("consumer meta: %v", err)
+	}
+	sbuf, err := ioutil.ReadFile(filepath.Join(odir, consumerState))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("consumer state: %v", err)
+	}
+	if len(sbuf) == 0 {
+		return nil
+	}
+	state, err := decodeConsumerState(sbuf)
+	if err != nil {
+		return fmt.Errorf("consumer state: %v", err)
+	}
+	if state.AckFloor.Stream > lseq {
+		return fmt.Errorf("consumer state: ack floor %d is past the stream's last sequence %d", state.AckFloor.Stream, lseq)
+	}
+	return nil
+}
@@ -35,7 +35,6 @@ import (
 	"github.com/nats-io/nats-server/v2/server/sysmem"
 	"github.com/nats-io/nkeys"
 	"github.com/nats-io/nuid"
-	"golang.org/x/crypto/chacha20poly1305"
 )
 
 // JetStreamConfig determines this server's configuration.
@@ -107,6 +106,7 @@ type jetStream struct {
 	standAlone    bool
 	disabled      bool
 	oos           bool
+	keyRotation   *JetStreamKeyRotation
 }
 
 type remoteUsage struct {
@@ -194,7 +194,11 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 		return err
 	}
 
-	if ek := s.getOpts().JetStreamKey; ek != _EMPTY_ {
+	// Resolve our encryption key, which may come from a key provider.
+	if err := s.setJetStreamKey(); err != nil {
+		return err
+	}
+	if ek, _ := s.jsEncryptionKeys(); ek != _EMPTY_ {
 		s.Warnf("JetStream Encryption is Beta")
 	}
 
@@ -204,10 +208,10 @@ func (s *Server) EnableJetStream(config *JetStreamConfig) error {
 // Function signature to generate a key encryption key.
 type keyGen func(context []byte) ([]byte, error)
 
-// Return a key generation function or nil if encryption not enabled.
+// Return a key generation function for the given master key or nil if encryption not enabled.
 // keyGen defined in filestore.go - keyGen func(iv, context []byte) []byte
-func (s *Server) jsKeyGen(info string) keyGen {
-	if ek := s.getOpts().JetStreamKey; ek != _EMPTY_ {
+func (s *Server) jsKeyGen(ek, info string) keyGen {
+	if ek != _EMPTY_ {
 		return func(context []byte) ([]byte, error) {
 			h := hmac.New(sha256.New, []byte(ek))
 			if _, err := h.Write([]byte(info)); err != nil {
@@ -222,33 +226,123 @@ func (s *Server) jsKeyGen(info string) keyGen {
 	return nil
 }
 
+// JetStreamKeyRotation reports on the last rotation of the JetStream encryption key.
+// Once completed, the previous key is no longer needed and can be removed.
+type JetStreamKeyRotation struct {
+	Started   time.Time  `json:"started"`
+	Completed *time.Time `json:"completed,omitempty"`
+	Streams   int        `json:"streams"`
+	Errors    int        `json:"errors,omitempty"`
+}
+
+// Rotate the encryption key for all file based streams to our currently configured key.
+// Streams on disk that are not loaded are rotated using our previous key, if configured.
+// Called on a config reload.
+func (s *Server) rotateJetStreamKey() {
+	js := s.getJetStream()
+	if js == nil {
+		return
+	}
+	ek, oldek := s.jsEncryptionKeys()
+	kr := &JetStreamKeyRotation{Started: time.Now().UTC()}
+
+	var streams []*stream
+	js.mu.RLock()
+	sdir := js.config.StoreDir
+	for _, jsa := range js.accounts {
+		jsa.mu.RLock()
+		for _, mset := range jsa.streams {
+			streams = append(streams, mset)
+		}
+		jsa.mu.RUnlock()
+	}
+	js.mu.RUnlock()
+
+	loaded := make(map[string]struct{}, len(streams))
+	for _, mset := range streams {
+		mset.mu.RLock()
+		fs, ok := mset.store.(*fileStore)
+		acc, name := mset.acc.Name, mset.cfg.Name
+		mset.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		loaded[filepath.Join(acc, streamsDir, name)] = struct{}{}
+		kr.Streams++
+		if err := fs.rotateEncryptionKey(s.jsKeyGen(ek, acc)); err != nil {
+			kr.Errors++
+			s.Warnf("Error rotating encryption key for stream '%s > %s': %v", acc, name, err)
+		}
+	}
+
+	// Now any encrypted streams we have on disk that are not loaded.
+	if oldek != _EMPTY_ {
+		adirs, _ := ioutil.ReadDir(sdir)
+		for _, adir := range adirs {
+			if !adir.IsDir() {
+				continue
+			}
+			acc := adir.Name()
+			fis, _ := ioutil.ReadDir(filepath.Join(sdir, acc, streamsDir))
+			for _, fi := range fis {
+				if _, ok := loaded[filepath.Join(acc, streamsDir, fi.Name())]; ok || !fi.IsDir() {
+					continue
+				}
+				dir := filepath.Join(sdir, acc, streamsDir, fi.Name())
+				if _, err := os.Stat(filepath.Join(dir, JetStreamMetaFileKey)); err != nil {
+					continue
+				}
+				kr.Streams++
+				if err := rotateStreamKeyFiles(dir, fi.Name(), s.jsKeyGen(ek, acc), s.jsKeyGen(oldek, acc)); err != nil {
+					kr.Errors++
+					s.Warnf("Error rotating encryption key for stream '%s > %s': %v", acc, fi.Name(), err)
+				}
+			}
+		}
+	}
+
+	if kr.Errors == 0 {
+		now := time.Now().UTC()
+		kr.Completed = &now
+		s.Noticef("JetStream encryption key rotation complete for %d streams, previous key is no longer needed", kr.Streams)
+	} else {
+		s.Warnf("JetStream encryption key rotation failed for %d of %d streams, previous key is still needed", kr.Errors, kr.Streams)
+	}
+	js.mu.Lock()
+	js.keyRotation = kr
+	js.mu.Unlock()
+}
+
 // Decode the encrypted metafile.
+// If our current key can not open it we will try our previous key if one is configured.
 func (s *Server) decryptMeta(ekey, buf []byte, acc, context string) ([]byte, error) {
-	if len(ekey) != metaKeySize {
+	sc, err := cipherForKeySize(len(ekey))
+	if err != nil {
 		return nil, errors.New("bad encryption key")
 	}
-	prf := s.jsKeyGen(acc)
+	ek, oldek := s.jsEncryptionKeys()
+	prf := s.jsKeyGen(ek, acc)
 	if prf == nil {
 		return nil, errNoEncryption
 	}
-	rb, err := prf([]byte(context))
+	seed, nonce, err := unwrapKey(prf, sc, context, ekey)
 	if err != nil {
-		return nil, err
-	}
-	kek, err := chacha20poly1305.NewX(rb)
-	if err != nil {
-		return nil, err
+		oldprf := s.jsKeyGen(oldek, acc)
+		if oldprf == nil {
+			return nil, err
+		}
+		if seed, nonce, err = unwrapKey(oldprf, sc, context, ekey); err != nil {
+			return nil, err
+		}
 	}
-	ns := kek.NonceSize()
-	seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
+	aek, err := genEncryptionKey(sc, seed)
 	if err != nil {
 		return nil, err
 	}
-	aek, err := chacha20poly1305.NewX(seed[:])
-	if err != nil {
-		return nil, err
+	ns := len(nonce)
+	if len(buf) < ns {
+		return nil, errBadKeySize
 	}
-	ns = kek.NonceSize()
 	plain, err := aek.Open(nil, buf[:ns], buf[ns:], nil)
 	if err != nil {
 		return nil, err
@@ -363,6 +457,9 @@ func (s *Server) enableJetStream(cfg JetStreamConfig) error {
 	if cfg.Domain != _EMPTY_ {
 		s.Noticef("  Domain:          %s", cfg.Domain)
 	}
+	if ek, _ := s.jsEncryptionKeys(); ek != _EMPTY_ {
+		s.Noticef("  Encryption:      %s", s.getOpts().JetStreamCipher)
+	}
 	s.Noticef("-------------------------------------------")
 
 	// Setup our internal subscriptions.
@@ -1126,7 +1223,7 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 		// Check if we are encrypted.
 		if key, err := ioutil.ReadFile(filepath.Join(mdir, JetStreamMetaFileKey)); err == nil {
 			s.Debugf("  Stream metafile is encrypted, reading encrypted keyfile")
-			if len(key) != metaKeySize {
+			if _, err := cipherForKeySize(len(key)); err != nil {
 				s.Warnf("  Bad stream encryption key length of %d", len(key))
 				continue
 			}
@@ -2460,6 +2557,9 @@ func (s *Server) resourcesExeededError() {
 
 // For validating options.
 func validateJetStreamOptions(o *Options) error {
+	if o.JetStreamKey != _EMPTY_ && o.JetStreamKeyProvider != nil {
+		return fmt.Errorf("jetstream encryption key and key provider can not both be configured")
+	}
 	// in non operator mode, the account names need to be configured
 	if len(o.JsAccDefaultDomain) > 0 {
 		if len(o.TrustedOperators) == 0 {
@@ -2514,6 +2614,10 @@ func validateJetStreamOptions(o *Options) error {
 			return fmt.Errorf("invalid domain name: may not contain ., * or >")
 		}
 	}
+	// Archived blocks are kept per server, so we need a stable name.
+	if o.JetStreamArchive != nil && o.ServerName == _EMPTY_ {
+		return fmt.Errorf("jetstream archive requires `server_name` to be set")
+	}
 	// If not clustered no checks needed past here.
 	if !o.JetStream || o.Cluster.Port == 0 {
 		return nil
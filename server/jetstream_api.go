@@ -75,6 +75,11 @@ const (
 	JSApiStreamUpdate  = "$JS.API.STREAM.UPDATE.*"
 	JSApiStreamUpdateT = "$JS.API.STREAM.UPDATE.%s"
 
+	// JSApiStreamPromote is the endpoint to promote a mirror to a standalone stream.
+	// Will return JSON response.
+	JSApiStreamPromote  = "$JS.API.STREAM.PROMOTE.*"
+	JSApiStreamPromoteT = "$JS.API.STREAM.PROMOTE.%s"
+
 	// JSApiStreams is the endpoint to list all stream names for this account.
 	// Will return JSON response.
 	JSApiStreams = "$JS.API.STREAM.NAMES"
@@ -118,6 +123,13 @@ const (
 	JSApiMsgGet  = "$JS.API.STREAM.MSG.GET.*"
 	JSApiMsgGetT = "$JS.API.STREAM.MSG.GET.%s"
 
+	// JSDirectMsgGet is the template for direct requests for a message by its stream sequence number or
+	// last by subject. These are answered by any replica of the stream, and optionally its mirrors, outside
+	// of the JetStream API layer. The message is returned as is with its metadata in headers.
+	// If the message can not be found the response will have a 404 status header.
+	JSDirectMsgGet  = "$JS.API.DIRECT.GET.*"
+	JSDirectMsgGetT = "$JS.API.DIRECT.GET.%s"
+
 	// JSApiConsumerCreate is the endpoint to create ephemeral consumers for streams.
 	// Will return JSON response.
 	JSApiConsumerCreate  = "$JS.API.CONSUMER.CREATE.*"
@@ -171,6 +183,16 @@ const (
 	JSApiConsumerLeaderStepDown  = "$JS.API.CONSUMER.LEADER.STEPDOWN.*.*"
 	JSApiConsumerLeaderStepDownT = "$JS.API.CONSUMER.LEADER.STEPDOWN.%s.%s"
 
+	// JSApiConsumerPause is the endpoint to pause or resume delivery on a consumer.
+	// Will return JSON response.
+	JSApiConsumerPause  = "$JS.API.CONSUMER.PAUSE.*.*"
+	JSApiConsumerPauseT = "$JS.API.CONSUMER.PAUSE.%s.%s"
+
+	// JSApiConsumerReset is the endpoint to move a consumer to a new starting stream sequence or time.
+	// Will return JSON response.
+	JSApiConsumerReset  = "$JS.API.CONSUMER.RESET.*.*"
+	JSApiConsumerResetT = "$JS.API.CONSUMER.RESET.%s.%s"
+
 	// JSApiLeaderStepDown is the endpoint to have our metaleader stepdown.
 	// Only works from system account.
 	// Will return JSON response.
@@ -186,6 +208,10 @@ const (
 	jsAckT   = "$JS.ACK.%s.%s"
 	jsAckPre = "$JS.ACK."
 
+	// jsDeadLetterAckT is the template for the publish acks coming back to a consumer
+	// from the stream that stored a dead lettered message.
+	jsDeadLetterAckT = "$JS.DLACK.%s.%s"
+
 	// jsFlowControl is for flow control subjects.
 	jsFlowControlPre = "$JS.FC."
 	// jsFlowControl is for FC responses.
@@ -221,6 +247,12 @@ const (
 	// JSAdvisoryConsumerDeletedPre notification that a template deleted.
 	JSAdvisoryConsumerDeletedPre = "$JS.EVENT.ADVISORY.CONSUMER.DELETED"
 
+	// JSAdvisoryConsumerPausePre notification that a consumer was paused or resumed.
+	JSAdvisoryConsumerPausePre = "$JS.EVENT.ADVISORY.CONSUMER.PAUSE"
+
+	// JSAdvisoryConsumerResetPre notification that a consumer was reset to a new starting sequence.
+	JSAdvisoryConsumerResetPre = "$JS.EVENT.ADVISORY.CONSUMER.RESET"
+
 	// JSAdvisoryStreamSnapshotCreatePre notification that a snapshot was created.
 	JSAdvisoryStreamSnapshotCreatePre = "$JS.EVENT.ADVISORY.STREAM.SNAPSHOT_CREATE"
 
@@ -288,6 +320,9 @@ func generateJSMappingTable(domain string) map[string]string {
 // JSMaxDescription is the maximum description length for streams and consumers.
 const JSMaxDescriptionLen = 4 * 1024
 
+// JSMaxMetadataLen is the maximum total size of metadata keys and values for streams and consumers.
+const JSMaxMetadataLen = 128 * 1024
+
 // JSMaxNameLen is the maximum name lengths for streams, consumers and templates.
 const JSMaxNameLen = 256
 
@@ -387,7 +422,8 @@ const JSApiStreamNamesResponseType = "io.nats.jetstream.api.v1.stream_names_resp
 type JSApiStreamListRequest struct {
 	ApiPagedRequest
 	// These are filters that can be applied to the list.
-	Subject string `json:"subject,omitempty"`
+	Subject  string            `json:"subject,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
 }
 
 // JSApiStreamListResponse list of detailed stream information.
@@ -431,6 +467,20 @@ type JSApiStreamUpdateResponse struct {
 
 const JSApiStreamUpdateResponseType = "io.nats.jetstream.api.v1.stream_update_response"
 
+// JSApiStreamPromoteRequest is optional request information to the promote API.
+// Subjects will be assigned to the promoted stream, if empty the stream name is used.
+type JSApiStreamPromoteRequest struct {
+	Subjects []string `json:"subjects,omitempty"`
+}
+
+// JSApiStreamPromoteResponse for promoting a mirror to a standalone stream.
+type JSApiStreamPromoteResponse struct {
+	ApiResponse
+	*StreamInfo
+}
+
+const JSApiStreamPromoteResponseType = "io.nats.jetstream.api.v1.stream_promote_response"
+
 // JSApiMsgDeleteRequest delete message request.
 type JSApiMsgDeleteRequest struct {
 	Seq     uint64 `json:"seq"`
@@ -514,6 +564,38 @@ type JSApiConsumerLeaderStepDownResponse struct {
 
 const JSApiConsumerLeaderStepDownResponseType = "io.nats.jetstream.api.v1.consumer_leader_stepdown_response"
 
+// JSApiConsumerPauseRequest will pause delivery until the given time.
+// A missing or past time will resume delivery.
+type JSApiConsumerPauseRequest struct {
+	PauseUntil time.Time `json:"pause_until,omitempty"`
+}
+
+// JSApiConsumerPauseResponse is the response to a consumer pause request.
+type JSApiConsumerPauseResponse struct {
+	ApiResponse
+	Paused         bool          `json:"paused"`
+	PauseUntil     time.Time     `json:"pause_until,omitempty"`
+	PauseRemaining time.Duration `json:"pause_remaining,omitempty"`
+}
+
+const JSApiConsumerPauseResponseType = "io.nats.jetstream.api.v1.consumer_pause_response"
+
+// JSApiConsumerResetRequest will move a consumer to a new stream sequence, or the first
+// message at or after a time. All pending and redelivery state is dropped.
+type JSApiConsumerResetRequest struct {
+	Seq       uint64     `json:"seq,omitempty"`
+	StartTime *time.Time `json:"start_time,omitempty"`
+}
+
+// JSApiConsumerResetResponse is the response to a consumer reset request.
+type JSApiConsumerResetResponse struct {
+	ApiResponse
+	*ConsumerInfo
+	ResetSeq uint64 `json:"reset_seq,omitempty"`
+}
+
+const JSApiConsumerResetResponseType = "io.nats.jetstream.api.v1.consumer_reset_response"
+
 // JSApiLeaderStepdownRequest allows placement control over the meta leader placement.
 type JSApiLeaderStepdownRequest struct {
 	Placement *Placement `json:"placement,omitempty"`
@@ -603,8 +685,18 @@ const JSApiConsumerListResponseType = "io.nats.jetstream.api.v1.consumer_list_re
 type JSApiConsumerGetNextRequest struct {
 	Expires   time.Duration `json:"expires,omitempty"`
 	Batch     int           `json:"batch,omitempty"`
+	MaxBytes  int           `json:"max_bytes,omitempty"`
 	NoWait    bool          `json:"no_wait,omitempty"`
 	Heartbeat time.Duration `json:"idle_heartbeat,omitempty"`
+	PriorityGroup
+}
+
+// PriorityGroup selects the priority group for a pull request on consumers that have them.
+type PriorityGroup struct {
+	Group         string `json:"group,omitempty"`
+	MinPending    int64  `json:"min_pending,omitempty"`
+	MinAckPending int64  `json:"min_ack_pending,omitempty"`
+	Id            string `json:"id,omitempty"`
 }
 
 // JSApiStreamTemplateCreateResponse for creating templates.
@@ -742,6 +834,7 @@ func (s *Server) setJetStreamExportSubs() error {
 		{JSApiTemplateDelete, s.jsTemplateDeleteRequest},
 		{JSApiStreamCreate, s.jsStreamCreateRequest},
 		{JSApiStreamUpdate, s.jsStreamUpdateRequest},
+		{JSApiStreamPromote, s.jsStreamPromoteRequest},
 		{JSApiStreams, s.jsStreamNamesRequest},
 		{JSApiStreamList, s.jsStreamListRequest},
 		{JSApiStreamInfo, s.jsStreamInfoRequest},
@@ -752,6 +845,8 @@ func (s *Server) setJetStreamExportSubs() error {
 		{JSApiStreamRemovePeer, s.jsStreamRemovePeerRequest},
 		{JSApiStreamLeaderStepDown, s.jsStreamLeaderStepDownRequest},
 		{JSApiConsumerLeaderStepDown, s.jsConsumerLeaderStepDownRequest},
+		{JSApiConsumerPause, s.jsConsumerPauseRequest},
+		{JSApiConsumerReset, s.jsConsumerResetRequest},
 		{JSApiMsgDelete, s.jsMsgDeleteRequest},
 		{JSApiMsgGet, s.jsMsgGetRequest},
 		{JSApiConsumerCreate, s.jsConsumerCreateRequest},
@@ -1591,6 +1686,96 @@ func (s *Server) jsStreamNamesRequest(sub *subscription, c *client, _ *Account,
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
+// Request to promote a mirror to a standalone stream.
+func (s *Server) jsStreamPromoteRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamPromoteResponse{ApiResponse: ApiResponse{Type: JSApiStreamPromoteResponseType}}
+
+	// Determine if we should proceed here when we are in clustered mode.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if js.isLeaderless() {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Make sure we are meta leader.
+		if !s.JetStreamIsLeader() {
+			return
+		}
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	var req JSApiStreamPromoteRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = NewJSInvalidJSONError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	streamName := streamNameFromSubject(subject)
+
+	if s.JetStreamIsClustered() {
+		s.jsClusteredStreamPromoteRequest(ci, acc, streamName, subject, reply, rmsg, &req)
+		return
+	}
+
+	mset, err := acc.lookupStream(streamName)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError(Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	ocfg := mset.config()
+	cfg, apiErr := promotedStreamConfig(&ocfg, req.Subjects, &s.getOpts().JetStreamLimits)
+	if apiErr != nil {
+		resp.Error = apiErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	jsa := mset.jsa
+	jsa.mu.RLock()
+	overlap := jsa.subjectsOverlap(cfg.Subjects)
+	jsa.mu.RUnlock()
+	if overlap {
+		resp.Error = NewJSStreamSubjectOverlapError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if err := mset.promote(cfg); err != nil {
+		resp.Error = NewJSStreamUpdateError(err, Unless(err))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	resp.StreamInfo = &StreamInfo{Created: mset.createdTime(), State: mset.state(), Config: mset.config()}
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
 // Request for the list of all detailed stream info.
 // TODO(dlc) - combine with above long term
 func (s *Server) jsStreamListRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
@@ -1635,6 +1820,7 @@ func (s *Server) jsStreamListRequest(sub *subscription, c *client, _ *Account, s
 
 	var offset int
 	var filter string
+	var metadata map[string]string
 
 	if !isEmptyRequest(msg) {
 		var req JSApiStreamListRequest
@@ -1647,13 +1833,14 @@ func (s *Server) jsStreamListRequest(sub *subscription, c *client, _ *Account, s
 		if req.Subject != _EMPTY_ {
 			filter = req.Subject
 		}
+		metadata = req.Metadata
 	}
 
 	// Clustered mode will invoke a scatter and gather.
 	if s.JetStreamIsClustered() {
 		// Need to copy these off before sending.. don't move this inside startGoRoutine!!!
 		msg = copyBytes(msg)
-		s.startGoRoutine(func() { s.jsClusteredStreamListRequest(acc, ci, filter, offset, subject, reply, msg) })
+		s.startGoRoutine(func() { s.jsClusteredStreamListRequest(acc, ci, filter, metadata, offset, subject, reply, msg) })
 		return
 	}
 
@@ -1665,6 +1852,15 @@ func (s *Server) jsStreamListRequest(sub *subscription, c *client, _ *Account, s
 	} else {
 		msets = acc.filteredStreams(filter)
 	}
+	if len(metadata) > 0 {
+		var fmsets []*stream
+		for _, mset := range msets {
+			if metadataMatches(mset.config().Metadata, metadata) {
+				fmsets = append(fmsets, mset)
+			}
+		}
+		msets = fmsets
+	}
 
 	sort.Slice(msets, func(i, j int) bool {
 		return strings.Compare(msets[i].cfg.Name, msets[j].cfg.Name) < 0
@@ -1819,11 +2015,13 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 	js, _ := s.getJetStreamCluster()
 
 	resp.StreamInfo = &StreamInfo{
-		Created: mset.createdTime(),
-		State:   mset.stateWithDetail(details),
-		Config:  config,
-		Domain:  s.getOpts().JetStreamDomain,
-		Cluster: js.clusterInfo(mset.raftGroup()),
+		Created:     mset.createdTime(),
+		State:       mset.stateWithDetail(details),
+		Config:      config,
+		Domain:      s.getOpts().JetStreamDomain,
+		Cluster:     js.clusterInfo(mset.raftGroup()),
+		Compression: mset.compressionInfo(),
+		Tier:        mset.tierInfo(),
 	}
 	if clusterWideConsCount > 0 {
 		resp.StreamInfo.State.Consumers = clusterWideConsCount
@@ -2047,6 +2245,193 @@ func (s *Server) jsConsumerLeaderStepDownRequest(sub *subscription, c *client, _
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
+// jsConsumerLeaderCheck determines if we should handle a request for a consumer, which in
+// clustered mode is only the case for the consumer leader. Returns an error when we should
+// respond without handling the request.
+func (s *Server) jsConsumerLeaderCheck(acc *Account, stream, consumer string) (bool, *ApiError) {
+	if !s.JetStreamIsClustered() {
+		return true, nil
+	}
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return false, nil
+	}
+	if js.isLeaderless() {
+		return false, NewJSClusterNotAvailError()
+	}
+
+	js.mu.RLock()
+	isLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, stream)
+	var ca *consumerAssignment
+	if sa != nil && sa.consumers != nil {
+		ca = sa.consumers[consumer]
+	}
+	js.mu.RUnlock()
+
+	if sa == nil || ca == nil {
+		// Only the meta leader will respond for unknown assets.
+		if !isLeader {
+			return false, nil
+		}
+		if sa == nil {
+			return false, NewJSStreamNotFoundError()
+		}
+		return false, NewJSConsumerNotFoundError()
+	}
+	// Check to see if we are a member of the group and if the group has no leader.
+	if js.isGroupLeaderless(ca.Group) {
+		return false, NewJSClusterNotAvailError()
+	}
+	return acc.JetStreamIsConsumerLeader(stream, consumer), nil
+}
+
+// Request to pause or resume delivery on a consumer.
+func (s *Server) jsConsumerPauseRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiConsumerPauseResponse{ApiResponse: ApiResponse{Type: JSApiConsumerPauseResponseType}}
+
+	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+
+	// In clustered mode the consumer leader will handle this and replicate to its peers.
+	if handle, apiErr := s.jsConsumerLeaderCheck(acc, stream, consumer); apiErr != nil {
+		resp.Error = apiErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	} else if !handle {
+		return
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	var req JSApiConsumerPauseRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = NewJSInvalidJSONError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	o := mset.lookupConsumer(consumer)
+	if o == nil {
+		resp.Error = NewJSConsumerNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	o.mu.Lock()
+	o.pause(req.PauseUntil)
+	if resp.Paused = o.isPaused(); resp.Paused {
+		resp.PauseUntil = o.pauseUntil.UTC()
+		resp.PauseRemaining = time.Until(o.pauseUntil)
+	}
+	o.mu.Unlock()
+
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Request to reset a consumer to a new starting sequence or time.
+func (s *Server) jsConsumerResetRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiConsumerResetResponse{ApiResponse: ApiResponse{Type: JSApiConsumerResetResponseType}}
+
+	stream := streamNameFromSubject(subject)
+	consumer := consumerNameFromSubject(subject)
+
+	// In clustered mode the consumer leader will handle this and replicate to its peers.
+	if handle, apiErr := s.jsConsumerLeaderCheck(acc, stream, consumer); apiErr != nil {
+		resp.Error = apiErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	} else if !handle {
+		return
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+
+	var req JSApiConsumerResetRequest
+	if isEmptyRequest(msg) {
+		resp.Error = NewJSBadRequestError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if err := json.Unmarshal(msg, &req); err != nil {
+		resp.Error = NewJSInvalidJSONError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if req.Seq > 0 && req.StartTime != nil {
+		resp.Error = NewJSConsumerResetInvalidError(errors.New("sequence and start time are mutually exclusive"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	if req.Seq == 0 && req.StartTime == nil {
+		resp.Error = NewJSConsumerResetInvalidError(errors.New("a sequence or start time is required"))
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	o := mset.lookupConsumer(consumer)
+	if o == nil {
+		resp.Error = NewJSConsumerNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	sseq := req.Seq
+	if req.StartTime != nil {
+		sseq = mset.store.GetSeqFromTime(*req.StartTime)
+	}
+
+	o.mu.Lock()
+	resp.ResetSeq = o.reset(sseq)
+	o.mu.Unlock()
+	resp.ConsumerInfo = o.info()
+
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
 // Request to remove a peer from a clustered stream.
 func (s *Server) jsStreamRemovePeerRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	if c == nil || !s.JetStreamEnabled() {
@@ -86,6 +86,20 @@ const (
 	// For updating information on pending pull requests.
 	addPendingRequest
 	removePendingRequest
+	// Pause or resume consumer delivery.
+	updatePauseOp
+	// Reset a consumer to a new starting sequence.
+	resetSeqOp
+	// Batch of acks for a consumer.
+	updateAcksBatchOp
+	// Atomic batch of stream msgs.
+	batchMsgOp
+	// Pending pull request with max bytes or a priority group.
+	addPendingRequestState
+	// Pinned client for a priority group.
+	updatePinnedOp
+	// Message held back or released for a partition.
+	updateHeldOp
 )
 
 // raftGroups are controlled by the metagroup controller.
@@ -1170,7 +1184,7 @@ func (js *jetStream) processAddPeer(peer string) {
 					// Ephemerals are R=1, so only auto-remap durables, or R>1.
 					if ca.Config.Durable != _EMPTY_ || len(ca.Group.Peers) > 1 {
 						cca := ca.copyGroup()
-						cca.Group.Peers = csa.Group.Peers
+						cca.Group.Peers = consumerPeers(ca.Config, csa.Group.Peers, ca.Group.Peers)
 						cc.meta.Propose(encodeAddConsumerAssignment(cca))
 					}
 				}
@@ -1254,7 +1268,7 @@ func (js *jetStream) removePeerFromStreamLocked(sa *streamAssignment, peer strin
 		// Ephemerals are R=1, so only auto-remap durables, or R>1.
 		if ca.Config.Durable != _EMPTY_ {
 			cca := ca.copyGroup()
-			cca.Group.Peers, cca.Group.Preferred = rg.Peers, _EMPTY_
+			cca.Group.Peers, cca.Group.Preferred = consumerPeers(ca.Config, rg.Peers, ca.Group.Peers), _EMPTY_
 			cc.meta.Propose(encodeAddConsumerAssignment(cca))
 		} else if ca.Group.isMember(peer) {
 			// These are ephemerals. Check to see if we deleted this peer.
@@ -1674,10 +1688,10 @@ func (js *jetStream) monitorStream(mset *stream, sa *streamAssignment, sendSnaps
 			// These are not currently assigned so we will need to do so here.
 			if consumers := mset.getPublicConsumers(); len(consumers) > 0 {
 				for _, o := range consumers {
-					rg := cc.createGroupForConsumer(sa)
+					name, cfg := o.String(), o.config()
+					rg := cc.createGroupForConsumer(&cfg, sa)
 					// Pick a preferred leader.
 					rg.setPreferred()
-					name, cfg := o.String(), o.config()
 					// Place our initial state here as well for assignment distribution.
 					ca := &consumerAssignment{
 						Group:   rg,
@@ -1853,6 +1867,37 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 					s.Debugf("Apply stream entries for '%s > %s' got error processing message: %v",
 						mset.account(), mset.name(), err)
 				}
+			case batchMsgOp:
+				if mset == nil {
+					continue
+				}
+				s := js.srv
+
+				msgs, lseq, ts, err := decodeStreamBatch(buf[1:])
+				if err != nil {
+					if node := mset.raftNode(); node != nil {
+						s.Errorf("JetStream cluster could not decode stream batch for '%s > %s' [%s]",
+							mset.account(), mset.name(), node.Group())
+					}
+					panic(err.Error())
+				}
+
+				// We can skip if we know this is less than what we already have.
+				if last := mset.lastSeq(); lseq < last || (lseq == 0 && last != 0) {
+					s.Debugf("Apply stream entries for '%s > %s' skipping batch with sequence %d with last of %d",
+						mset.account(), mset.name(), lseq, last)
+					continue
+				}
+
+				// The whole batch is stored or none of it is.
+				if err := mset.processJetStreamBatch(msgs, lseq, ts); err != nil {
+					// Only return in place if we are going to reset stream or we are out of space.
+					if isClusterResetErr(err) || isOutOfSpaceErr(err) {
+						return err
+					}
+					s.Debugf("Apply stream entries for '%s > %s' got error processing batch: %v",
+						mset.account(), mset.name(), err)
+				}
 			case deleteMsgOp:
 				md, err := decodeMsgDelete(buf[1:])
 				if err != nil {
@@ -2336,6 +2381,8 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, osa, sa *streamAss
 	storage := sa.Config.Storage
 	hasResponded := sa.responded
 	sa.responded = true
+	// Updates can not change the mirror, so this can only come from the promote API.
+	promoted := osa.Config.Mirror != nil && sa.Config.Mirror == nil
 	js.mu.Unlock()
 
 	mset, err := acc.lookupStream(sa.Config.Name)
@@ -2358,7 +2405,12 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, osa, sa *streamAss
 			js.mu.Unlock()
 		}
 		mset.setStreamAssignment(sa)
-		if err = mset.update(sa.Config); err != nil {
+		if promoted {
+			err = mset.promote(sa.Config)
+		} else {
+			err = mset.update(sa.Config)
+		}
+		if err != nil {
 			s.Warnf("JetStream cluster error updating stream %q for account %q: %v", sa.Config.Name, acc.Name, err)
 			mset.setStreamAssignment(osa)
 		}
@@ -2415,6 +2467,9 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, osa, sa *streamAss
 
 	// Send our response.
 	var resp = JSApiStreamUpdateResponse{ApiResponse: ApiResponse{Type: JSApiStreamUpdateResponseType}}
+	if promoted {
+		resp.Type = JSApiStreamPromoteResponseType
+	}
 	resp.StreamInfo = &StreamInfo{
 		Created: mset.createdTime(),
 		State:   mset.state(),
@@ -2464,7 +2519,13 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 		if err == nil && mset != nil {
 			osa := mset.streamAssignment()
 			mset.setStreamAssignment(sa)
-			if err = mset.update(sa.Config); err != nil {
+			// We may have missed a promotion of our mirror.
+			if mset.isMirror() && sa.Config.Mirror == nil {
+				err = mset.promote(sa.Config)
+			} else {
+				err = mset.update(sa.Config)
+			}
+			if err != nil {
 				s.Warnf("JetStream cluster error updating stream %q for account %q: %v", sa.Config.Name, acc.Name, err)
 				mset.setStreamAssignment(osa)
 			}
@@ -2562,8 +2623,8 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 						js.mu.RUnlock()
 
 						for _, o := range consumers {
-							rg := cc.createGroupForConsumer(sa)
 							name, cfg := o.String(), o.config()
+							rg := cc.createGroupForConsumer(&cfg, sa)
 							// Place our initial state here as well for assignment distribution.
 							ca := &consumerAssignment{
 								Group:   rg,
@@ -2841,7 +2902,11 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment, state
 
 	if !alreadyRunning {
 		// Process the raft group and make sure its running if needed.
-		js.createRaftGroup(acc.GetName(), rg, mset.config().Storage)
+		storage := mset.config().Storage
+		if ca.Config.MemoryStorage {
+			storage = MemoryStorage
+		}
+		js.createRaftGroup(acc.GetName(), rg, storage)
 	}
 
 	// Check if we already have this consumer running.
@@ -3262,6 +3327,17 @@ func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLea
 					panic(err.Error())
 				}
 				o.processReplicatedAck(dseq, sseq)
+			case updateAcksBatchOp:
+				acks, err := decodeAckBatchUpdate(buf[1:])
+				if err != nil {
+					if mset, node := o.streamAndNode(); mset != nil && node != nil {
+						s := js.srv
+						s.Errorf("JetStream cluster could not decode consumer ack batch update for '%s > %s > %s' [%s]",
+							mset.account(), mset.name(), o, node.Group())
+					}
+					panic(err.Error())
+				}
+				o.processReplicatedAcks(acks)
 			case updateSkipOp:
 				o.mu.Lock()
 				if !o.isLeader() {
@@ -3273,9 +3349,43 @@ func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLea
 				if !o.isLeader() {
 					o.mu.Lock()
 					if o.prm == nil {
-						o.prm = make(map[string]struct{})
+						o.prm = make(map[string]*pullRequestState)
+					}
+					o.prm[string(buf[1:])] = nil
+					o.mu.Unlock()
+				}
+			case addPendingRequestState:
+				if !o.isLeader() {
+					var prs pullRequestState
+					if err := json.Unmarshal(buf[1:], &prs); err != nil {
+						panic(err.Error())
+					}
+					o.mu.Lock()
+					if o.prm == nil {
+						o.prm = make(map[string]*pullRequestState)
+					}
+					o.prm[prs.Reply] = &prs
+					o.mu.Unlock()
+				}
+			case updatePinnedOp:
+				o.mu.Lock()
+				if !o.isLeader() {
+					if err := o.applyPinned(buf[1:]); err != nil {
+						o.mu.Unlock()
+						panic(err.Error())
+					}
+				}
+				o.mu.Unlock()
+			case updateHeldOp:
+				if !o.isLeader() {
+					sseq, n := binary.Uvarint(buf[1:])
+					if n <= 0 || len(buf) != 2+n {
+						panic(errCorruptState.Error())
+					}
+					o.mu.Lock()
+					if o.store != nil {
+						o.store.UpdateHeld(sseq, buf[1+n] == 1)
 					}
-					o.prm[string(buf[1:])] = struct{}{}
 					o.mu.Unlock()
 				}
 			case removePendingRequest:
@@ -3286,6 +3396,34 @@ func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLea
 					}
 					o.mu.Unlock()
 				}
+			case updatePauseOp:
+				ts, n := binary.Varint(buf[1:])
+				if n <= 0 {
+					panic("JetStream Cluster could not decode consumer pause update")
+				}
+				var until time.Time
+				if ts > 0 {
+					until = time.Unix(0, ts)
+				}
+				o.mu.Lock()
+				if !o.isLeader() {
+					o.applyPause(until)
+				}
+				o.mu.Unlock()
+			case resetSeqOp:
+				sseq, n := binary.Uvarint(buf[1:])
+				if n <= 0 {
+					panic("JetStream Cluster could not decode consumer reset")
+				}
+				dseq, m := binary.Uvarint(buf[1+n:])
+				if m <= 0 {
+					panic("JetStream Cluster could not decode consumer reset")
+				}
+				o.mu.Lock()
+				if !o.isLeader() {
+					o.applyReset(sseq, dseq)
+				}
+				o.mu.Unlock()
 			default:
 				panic(fmt.Sprintf("JetStream Cluster Unknown group entry op type! %v", entryOp(buf[0])))
 			}
@@ -3314,7 +3452,7 @@ func (o *consumer) processReplicatedAck(dseq, sseq uint64) {
 		} else {
 			// We are a follower so only have the store state, so read that in.
 			state, err := o.store.State()
-			if err != nil {
+			if err != nil || state == nil {
 				o.mu.Unlock()
 				return
 			}
@@ -3333,6 +3471,26 @@ func (o *consumer) processReplicatedAck(dseq, sseq uint64) {
 	}
 }
 
+// processReplicatedAcks applies a batch of explicit acks to our store and lets the stream know if needed.
+func (o *consumer) processReplicatedAcks(acks []SequencePair) {
+	o.mu.Lock()
+	// Update activity.
+	o.lat = time.Now()
+	// Do actual ack updates to store.
+	for _, ack := range acks {
+		o.store.UpdateAcks(ack.Consumer, ack.Stream)
+	}
+	mset := o.mset
+	o.mu.Unlock()
+
+	if mset == nil || mset.cfg.Retention == LimitsPolicy {
+		return
+	}
+	for _, ack := range acks {
+		mset.ackMsg(o, ack.Stream)
+	}
+}
+
 var errBadAckUpdate = errors.New("jetstream cluster bad replicated ack update")
 var errBadDeliveredUpdate = errors.New("jetstream cluster bad replicated delivered update")
 
@@ -3348,6 +3506,28 @@ func decodeAckUpdate(buf []byte) (dseq, sseq uint64, err error) {
 	return dseq, sseq, nil
 }
 
+func decodeAckBatchUpdate(buf []byte) ([]SequencePair, error) {
+	num, bi := binary.Uvarint(buf)
+	if bi <= 0 || num > uint64(len(buf)) {
+		return nil, errBadAckUpdate
+	}
+	acks := make([]SequencePair, 0, num)
+	for i := uint64(0); i < num; i++ {
+		dseq, n := binary.Uvarint(buf[bi:])
+		if n <= 0 {
+			return nil, errBadAckUpdate
+		}
+		bi += n
+		sseq, n := binary.Uvarint(buf[bi:])
+		if n <= 0 {
+			return nil, errBadAckUpdate
+		}
+		bi += n
+		acks = append(acks, SequencePair{dseq, sseq})
+	}
+	return acks, nil
+}
+
 func decodeDeliveredUpdate(buf []byte) (dseq, sseq, dc uint64, ts int64, err error) {
 	var bi, n int
 	if dseq, n = binary.Uvarint(buf); n < 0 {
@@ -4121,13 +4301,6 @@ func (s *Server) jsClusteredStreamUpdateRequest(ci *ClientInfo, acc *Account, su
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
 		return
 	}
-	// Check for mirrot changes which are not allowed.
-	if !reflect.DeepEqual(newCfg.Mirror, osa.Config.Mirror) {
-		resp.Error = NewJSStreamMirrorNotUpdatableError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
-		return
-	}
-
 	// Check for subject collisions here.
 	for _, sa := range cc.streams[acc.Name] {
 		if sa == osa {
@@ -4183,7 +4356,7 @@ func (s *Server) jsClusteredStreamUpdateRequest(ci *ClientInfo, acc *Account, su
 					cca.Group.Preferred = _EMPTY_
 				}
 				// Assign new peers.
-				cca.Group.Peers = rg.Peers
+				cca.Group.Peers = consumerPeers(ca.Config, rg.Peers, ca.Group.Peers)
 				// We can not propose here before the stream itself so we collect them.
 				consumers = append(consumers, cca)
 			}
@@ -4199,6 +4372,72 @@ func (s *Server) jsClusteredStreamUpdateRequest(ci *ClientInfo, acc *Account, su
 	}
 }
 
+func (s *Server) jsClusteredStreamPromoteRequest(ci *ClientInfo, acc *Account, stream, subject, reply string, rmsg []byte, req *JSApiStreamPromoteRequest) {
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	var resp = JSApiStreamPromoteResponse{ApiResponse: ApiResponse{Type: JSApiStreamPromoteResponseType}}
+
+	osa := js.streamAssignment(acc.Name, stream)
+	if osa == nil {
+		resp.Error = NewJSStreamNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	pcfg, apiErr := promotedStreamConfig(osa.Config, req.Subjects, &s.getOpts().JetStreamLimits)
+	if apiErr != nil {
+		resp.Error = apiErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+	// Promoting is an update, so it is subject to the same checks and account limits.
+	var cfg *StreamConfig
+	if jsa := js.accounts[acc.Name]; jsa != nil {
+		js.mu.Unlock()
+		// Check against the configuration without the mirror, since removing it is allowed here.
+		ocfg := *osa.Config
+		ocfg.Mirror = nil
+		ncfg, err := jsa.configUpdateCheck(&ocfg, pcfg, &s.getOpts().JetStreamLimits)
+		js.mu.Lock()
+		if err != nil {
+			resp.Error = NewJSStreamUpdateError(err, Unless(err))
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+			return
+		}
+		cfg = ncfg
+	} else {
+		resp.Error = NewJSNotEnabledForAccountError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Check for subject collisions here.
+	for _, sa := range cc.streams[acc.Name] {
+		if sa == osa {
+			continue
+		}
+		for _, subj := range sa.Config.Subjects {
+			for _, tsubj := range cfg.Subjects {
+				if SubjectsCollide(tsubj, subj) {
+					resp.Error = NewJSStreamSubjectOverlapError()
+					s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
+					return
+				}
+			}
+		}
+	}
+
+	// The cut-over is ordered through the meta layer, each peer stops mirroring when it applies this update.
+	sa := &streamAssignment{Group: osa.Group, Sync: osa.Sync, Config: cfg, Subject: subject, Reply: reply, Client: ci}
+	cc.meta.Propose(encodeUpdateStreamAssignment(sa))
+}
+
 func (s *Server) jsClusteredStreamDeleteRequest(ci *ClientInfo, acc *Account, stream, subject, reply string, rmsg []byte) {
 	js, cc := s.getJetStreamCluster()
 	if js == nil || cc == nil {
@@ -4328,7 +4567,7 @@ func (s *Server) allPeersOffline(rg *raftGroup) bool {
 
 // This will do a scatter and gather operation for all streams for this account. This is only called from metadata leader.
 // This will be running in a separate Go routine.
-func (s *Server) jsClusteredStreamListRequest(acc *Account, ci *ClientInfo, filter string, offset int, subject, reply string, rmsg []byte) {
+func (s *Server) jsClusteredStreamListRequest(acc *Account, ci *ClientInfo, filter string, metadata map[string]string, offset int, subject, reply string, rmsg []byte) {
 	defer s.grWG.Done()
 
 	js, cc := s.getJetStreamCluster()
@@ -4343,6 +4582,9 @@ func (s *Server) jsClusteredStreamListRequest(acc *Account, ci *ClientInfo, filt
 		if IsNatsErr(sa.err, JSClusterNotAssignedErr) {
 			continue
 		}
+		if len(metadata) > 0 && !metadataMatches(sa.Config.Metadata, metadata) {
+			continue
+		}
 
 		if filter != _EMPTY_ {
 			// These could not have subjects auto-filled in since they are raw and unprocessed.
@@ -4761,13 +5003,51 @@ func decodeStreamAssignment(buf []byte) (*streamAssignment, error) {
 	return &sa, err
 }
 
-// createGroupForConsumer will create a new group with same peer set as the stream.
-func (cc *jetStreamCluster) createGroupForConsumer(sa *streamAssignment) *raftGroup {
-	peers := sa.Group.Peers
+// createGroupForConsumer will create a new group with same peer set as the stream,
+// or a subset of it if the consumer has asked for fewer replicas.
+func (cc *jetStreamCluster) createGroupForConsumer(cfg *ConsumerConfig, sa *streamAssignment) *raftGroup {
+	peers := consumerPeers(cfg, sa.Group.Peers, nil)
 	if len(peers) == 0 {
 		return nil
 	}
-	return &raftGroup{Name: groupNameForConsumer(peers, sa.Config.Storage), Storage: sa.Config.Storage, Peers: peers}
+	storage := sa.Config.Storage
+	if cfg.MemoryStorage {
+		storage = MemoryStorage
+	}
+	return &raftGroup{Name: groupNameForConsumer(peers, storage), Storage: storage, Peers: peers}
+}
+
+// consumerPeers selects the peers for a consumer from the stream's peers. Consumers that have
+// asked for fewer replicas than the stream keep the current peers that are still stream peers,
+// and fill in the rest randomly.
+func consumerPeers(cfg *ConsumerConfig, speers, current []string) []string {
+	if cfg == nil || cfg.Replicas <= 0 || cfg.Replicas >= len(speers) {
+		return speers
+	}
+	peers := make([]string, 0, cfg.Replicas)
+	for _, p := range current {
+		if len(peers) < cfg.Replicas && isMemberOf(p, speers) {
+			peers = append(peers, p)
+		}
+	}
+	for _, pi := range rand.Perm(len(speers)) {
+		if len(peers) >= cfg.Replicas {
+			break
+		}
+		if p := speers[pi]; !isMemberOf(p, peers) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+func isMemberOf(peer string, peers []string) bool {
+	for _, p := range peers {
+		if p == peer {
+			return true
+		}
+	}
+	return false
 }
 
 // jsClusteredConsumerRequest is first point of entry to create a consumer with R > 1.
@@ -4808,7 +5088,7 @@ func (s *Server) jsClusteredConsumerRequest(ci *ClientInfo, acc *Account, subjec
 
 	// Also short circuit if DeliverLastPerSubject is set with no FilterSubject.
 	if cfg.DeliverPolicy == DeliverLastPerSubject {
-		if cfg.FilterSubject == _EMPTY_ {
+		if cfg.FilterSubject == _EMPTY_ && len(cfg.FilterSubjects) == 0 {
 			resp.Error = NewJSConsumerInvalidPolicyError(fmt.Errorf("consumer delivery policy is deliver last per subject, but FilterSubject is not set"))
 			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
 			return
@@ -4846,7 +5126,7 @@ func (s *Server) jsClusteredConsumerRequest(ci *ClientInfo, acc *Account, subjec
 
 	// If this is new consumer.
 	if ca == nil {
-		rg := cc.createGroupForConsumer(sa)
+		rg := cc.createGroupForConsumer(cfg, sa)
 		if rg == nil {
 			resp.Error = NewJSInsufficientResourcesError()
 			s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
@@ -4857,8 +5137,9 @@ func (s *Server) jsClusteredConsumerRequest(ci *ClientInfo, acc *Account, subjec
 
 		// We need to set the ephemeral here before replicating.
 		if !isDurableConsumer(cfg) {
-			// We chose to have ephemerals be R=1 unless stream is interest or workqueue.
-			if sa.Config.Retention == LimitsPolicy {
+			// We chose to have ephemerals be R=1 unless stream is interest or workqueue,
+			// or replicas were asked for explicitly.
+			if sa.Config.Retention == LimitsPolicy && cfg.Replicas == 0 {
 				rg.Peers = []string{rg.Preferred}
 				rg.Name = groupNameForConsumer(rg.Peers, rg.Storage)
 			}
@@ -5037,6 +5318,60 @@ func encodeStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int
 	return buf[:wi]
 }
 
+// Encode all messages of an atomic batch as a single entry.
+// Each message is encoded as a stream msg, with lseq and ts those of the batch.
+func encodeStreamBatch(msgs []*inMsg, lseq uint64, ts int64) []byte {
+	var le = binary.LittleEndian
+	ems := make([][]byte, 0, len(msgs))
+	elen := 1 + 4
+	for _, im := range msgs {
+		em := encodeStreamMsg(im.subj, im.rply, im.hdr, im.msg, lseq, ts)[1:]
+		ems = append(ems, em)
+		elen += 4 + len(em)
+	}
+	buf := make([]byte, 5, elen)
+	buf[0] = byte(batchMsgOp)
+	le.PutUint32(buf[1:], uint32(len(ems)))
+	for _, em := range ems {
+		var lb [4]byte
+		le.PutUint32(lb[:], uint32(len(em)))
+		buf = append(buf, lb[:]...)
+		buf = append(buf, em...)
+	}
+	return buf
+}
+
+func decodeStreamBatch(buf []byte) (msgs []*inMsg, lseq uint64, ts int64, err error) {
+	var le = binary.LittleEndian
+	if len(buf) < 4 {
+		return nil, 0, 0, errBadStreamMsg
+	}
+	n := int(le.Uint32(buf))
+	buf = buf[4:]
+	if n == 0 || n > streamMaxBatchSize {
+		return nil, 0, 0, errBadStreamMsg
+	}
+	msgs = make([]*inMsg, 0, n)
+	for i := 0; i < n; i++ {
+		if len(buf) < 4 {
+			return nil, 0, 0, errBadStreamMsg
+		}
+		ml := int(le.Uint32(buf))
+		buf = buf[4:]
+		if len(buf) < ml {
+			return nil, 0, 0, errBadStreamMsg
+		}
+		subject, reply, hdr, msg, mlseq, mts, err := decodeStreamMsg(buf[:ml])
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		buf = buf[ml:]
+		lseq, ts = mlseq, mts
+		msgs = append(msgs, &inMsg{subject, reply, hdr, msg})
+	}
+	return msgs, lseq, ts, nil
+}
+
 // StreamSnapshot is used for snapshotting and out of band catch up in clustered mode.
 type streamSnapshot struct {
 	Msgs     uint64   `json:"messages"`
@@ -5206,6 +5541,49 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 	return err
 }
 
+// processClusteredBatch will propose all of the messages of an atomic batch to the
+// underlying raft group as a single entry. The batch is checked against the stream
+// state when applied so that it is stored on all replicas or none.
+func (mset *stream) processClusteredBatch(msgs []*inMsg) {
+	if len(msgs) == 0 {
+		return
+	}
+	reply := msgs[len(msgs)-1].rply
+
+	mset.mu.RLock()
+	apiErr := mset.checkBatch(msgs)
+	s, node, lseq := mset.srv, mset.node, mset.lseq
+	mset.mu.RUnlock()
+
+	if apiErr != nil {
+		mset.sendBatchError(reply, apiErr)
+		return
+	}
+	if node == nil {
+		mset.sendBatchError(reply, &ApiError{Code: 503, Description: errNotLeader.Error()})
+		return
+	}
+
+	mset.clMu.Lock()
+	if mset.clseq == 0 || mset.clseq < lseq {
+		mset.clseq = mset.lastSeq()
+	}
+	esm := encodeStreamBatch(msgs, mset.clseq, time.Now().UnixNano())
+	// Do proposal.
+	err := node.Propose(esm)
+	if err == nil {
+		mset.clseq += uint64(len(msgs))
+	}
+	mset.clMu.Unlock()
+
+	if err != nil {
+		mset.sendBatchError(reply, &ApiError{Code: 503, Description: err.Error()})
+		if isOutOfSpaceErr(err) {
+			s.handleOutOfSpace(mset)
+		}
+	}
+}
+
 // For requesting messages post raft snapshot to catch up streams post server restart.
 // Any deleted msgs etc will be handled inline on catchup.
 type streamSyncRequest struct {
@@ -5299,12 +5677,17 @@ func (mset *stream) hasCatchupPeers() bool {
 func (mset *stream) setCatchingUp() {
 	mset.mu.Lock()
 	mset.catchup = true
+	// Do not answer direct gets while we are behind.
+	mset.unsubscribeToDirect()
 	mset.mu.Unlock()
 }
 
 func (mset *stream) clearCatchingUp() {
 	mset.mu.Lock()
 	mset.catchup = false
+	if err := mset.subscribeToDirect(); err != nil {
+		mset.srv.Warnf("JetStream failed to subscribe to direct gets for '%s > %s': %v", mset.acc.Name, mset.cfg.Name, err)
+	}
 	mset.mu.Unlock()
 }
 
@@ -5639,12 +6022,14 @@ func (mset *stream) handleClusterStreamInfoRequest(sub *subscription, c *client,
 	}
 
 	si := &StreamInfo{
-		Created: mset.createdTime(),
-		State:   mset.state(),
-		Config:  config,
-		Cluster: js.clusterInfo(mset.raftGroup()),
-		Sources: mset.sourcesInfo(),
-		Mirror:  mset.mirrorInfo(),
+		Created:     mset.createdTime(),
+		State:       mset.state(),
+		Config:      config,
+		Cluster:     js.clusterInfo(mset.raftGroup()),
+		Sources:     mset.sourcesInfo(),
+		Mirror:      mset.mirrorInfo(),
+		Compression: mset.compressionInfo(),
+		Tier:        mset.tierInfo(),
 	}
 
 	// Check for out of band catchups.
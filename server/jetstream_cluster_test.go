@@ -4678,7 +4678,7 @@ func TestJetStreamClusterSuperClusterCrossClusterConsumerInterest(t *testing.T)
 
 func TestJetStreamNextReqFromMsg(t *testing.T) {
 	bef := time.Now()
-	expires, _, _, _, _, err := nextReqFromMsg([]byte(`{"expires":5000000000}`)) // nanoseconds
+	expires, _, _, _, _, _, _, err := nextReqFromMsg([]byte(`{"expires":5000000000}`)) // nanoseconds
 	require_NoError(t, err)
 	now := time.Now()
 	if expires.Before(bef.Add(5*time.Second)) || expires.After(now.Add(5*time.Second)) {
@@ -10280,6 +10280,97 @@ func TestJetStreamClusterPullConsumerLeaderChange(t *testing.T) {
 	checkSubsPending(t, sub, 1)
 }
 
+func TestJetStreamClusterPullConsumerLimitsLeaderChange(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Replicas: 3,
+		Subjects: []string{"foo"},
+	})
+	require_NoError(t, err)
+
+	ccReq := &CreateConsumerRequest{
+		Stream: "TEST",
+		Config: ConsumerConfig{
+			Durable:        "dlc",
+			AckPolicy:      AckExplicit,
+			PriorityGroups: []string{"A"},
+			PriorityPolicy: PriorityPinnedClient,
+			PinnedTTL:      time.Minute,
+		},
+	}
+	req, err := json.Marshal(ccReq)
+	require_NoError(t, err)
+	resp, err := nc.Request(fmt.Sprintf(JSApiDurableCreateT, "TEST", "dlc"), req, time.Second)
+	require_NoError(t, err)
+	var ccResp JSApiConsumerCreateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &ccResp))
+	if ccResp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", ccResp.Error)
+	}
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc")
+	sub, err := nc.SubscribeSync("reply")
+	require_NoError(t, err)
+	defer sub.Unsubscribe()
+
+	// Get pinned.
+	_, err = js.Publish("foo", []byte("HELLO"))
+	require_NoError(t, err)
+	require_NoError(t, nc.PublishRequest(rsubj, "reply", []byte(`{"batch":1,"group":"A","expires":5000000000}`)))
+	m, err := sub.NextMsg(time.Second)
+	require_NoError(t, err)
+	pin := m.Header.Get(JSPullRequestPinId)
+	if pin == _EMPTY_ {
+		t.Fatalf("Expected a pin, got %+v", m.Header)
+	}
+	m.Respond(nil)
+
+	// Queue up a request with max bytes that will take two messages.
+	preq := fmt.Sprintf(`{"batch":10,"max_bytes":%d,"group":"A","id":%q,"expires":10000000000}`, 2*(len("foo")+len("HELLO")), pin)
+	require_NoError(t, nc.PublishRequest(rsubj, "reply", []byte(preq)))
+	// Make sure request is recorded and replicated.
+	time.Sleep(100 * time.Millisecond)
+	checkSubsPending(t, sub, 0)
+
+	// The request and the pin should survive a leader change.
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+	time.Sleep(100 * time.Millisecond)
+	checkSubsPending(t, sub, 0)
+
+	for i := 0; i < 3; i++ {
+		_, err = js.Publish("foo", []byte("HELLO"))
+		require_NoError(t, err)
+	}
+	for i := 0; i < 2; i++ {
+		m, err = sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		if string(m.Data) != "HELLO" || m.Header.Get(JSPullRequestPinId) != pin {
+			t.Fatalf("Expected pinned message, got %q with %+v", m.Data, m.Header)
+		}
+	}
+	// Max bytes was reached so nothing else for this request.
+	if m, err := sub.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no more messages, got %q with %+v", m.Data, m.Header)
+	}
+
+	// Another client can not take over the pin.
+	other, err := nc.SubscribeSync(nats.NewInbox())
+	require_NoError(t, err)
+	defer other.Unsubscribe()
+	require_NoError(t, nc.PublishRequest(rsubj, other.Subject, []byte(`{"batch":1,"group":"A","expires":1000000000}`)))
+	if m, err := other.NextMsg(250 * time.Millisecond); err == nil {
+		t.Fatalf("Expected no message for other client, got %q with %+v", m.Data, m.Header)
+	}
+}
+
 func TestJetStreamClusterEphemeralPullConsumerServerShutdown(t *testing.T) {
 	c := createJetStreamClusterExplicit(t, "JSC", 3)
 	defer c.shutdown()
@@ -11656,6 +11747,812 @@ func TestJetStreamClusterMemoryConsumerCompactVsSnapshot(t *testing.T) {
 
 }
 
+func TestJetStreamClusterRePublish(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	addStream(t, nc, &StreamConfig{
+		Name:      "TEST",
+		Subjects:  []string{"foo"},
+		Storage:   FileStorage,
+		Replicas:  3,
+		RePublish: &RePublish{Destination: "rp.>", Source: ">"},
+	})
+
+	sub, err := nc.SubscribeSync("rp.foo")
+	require_NoError(t, err)
+	require_NoError(t, nc.Flush())
+
+	toSend := 10
+	for i := 0; i < toSend; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	// Only the leader should republish.
+	checkSubsPending(t, sub, toSend)
+	time.Sleep(100 * time.Millisecond)
+	if n, _, _ := sub.Pending(); n != toSend {
+		t.Fatalf("Expected %d republished msgs, got %d", toSend, n)
+	}
+	for i := 1; i <= toSend; i++ {
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		require_Equal(t, m.Header.Get(JSSequence), strconv.Itoa(i))
+	}
+}
+
+func TestJetStreamClusterDirectGet(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	addStream(t, nc, &StreamConfig{
+		Name:        "TEST",
+		Subjects:    []string{"foo"},
+		Storage:     FileStorage,
+		Replicas:    3,
+		AllowDirect: true,
+	})
+
+	for i := 1; i <= 10; i++ {
+		_, err := js.Publish("foo", []byte(strconv.Itoa(i)))
+		require_NoError(t, err)
+	}
+
+	// Make sure all replicas have the messages.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 10 {
+				return fmt.Errorf("Expected 10 msgs, got %d", state.Msgs)
+			}
+		}
+		return nil
+	})
+
+	// Every replica should be able to answer, so stop the leader from doing so.
+	sl := c.streamLeader("$G", "TEST")
+	mset, err := sl.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	mset.mu.Lock()
+	mset.unsubscribeToDirect()
+	mset.mu.Unlock()
+
+	getSubj := fmt.Sprintf(JSDirectMsgGetT, "TEST")
+	for i := 1; i <= 10; i++ {
+		m, err := nc.Request(getSubj, []byte(fmt.Sprintf(`{"seq":%d}`, i)), time.Second)
+		require_NoError(t, err)
+		require_Equal(t, string(m.Data), strconv.Itoa(i))
+		require_Equal(t, m.Header.Get(JSSequence), strconv.Itoa(i))
+	}
+	m, err := nc.Request(getSubj, []byte(`{"last_by_subj":"foo"}`), time.Second)
+	require_NoError(t, err)
+	require_Equal(t, string(m.Data), "10")
+}
+
+func TestJetStreamClusterAtomicBatchPublish(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	addStream(t, nc, &StreamConfig{
+		Name:               "TEST",
+		Subjects:           []string{"foo"},
+		Storage:            FileStorage,
+		Replicas:           3,
+		AllowAtomicPublish: true,
+	})
+
+	batchMsg := func(id string, seq int, commit bool, hdrs ...string) *nats.Msg {
+		m := nats.NewMsg("foo")
+		m.Header.Set(JSBatchId, id)
+		m.Header.Set(JSBatchSeq, strconv.Itoa(seq))
+		if commit {
+			m.Header.Set(JSBatchCommit, "1")
+		}
+		for i := 0; i+1 < len(hdrs); i += 2 {
+			m.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		m.Data = []byte(strconv.Itoa(seq))
+		return m
+	}
+	commit := func(m *nats.Msg) *JSPubAckResponse {
+		t.Helper()
+		rmsg, err := nc.RequestMsg(m, 2*time.Second)
+		require_NoError(t, err)
+		var resp JSPubAckResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+	checkMsgs := func(n uint64) {
+		t.Helper()
+		checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+			for _, s := range c.servers {
+				mset, err := s.GlobalAccount().lookupStream("TEST")
+				if err != nil {
+					return err
+				}
+				if state := mset.state(); state.Msgs != n {
+					return fmt.Errorf("Expected %d msgs, got %d", n, state.Msgs)
+				}
+			}
+			return nil
+		})
+	}
+
+	for i := 1; i < 5; i++ {
+		require_NoError(t, nc.PublishMsg(batchMsg("A", i, false)))
+	}
+	resp := commit(batchMsg("A", 5, true))
+	if resp.Error != nil || resp.PubAck.Sequence != 5 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkMsgs(5)
+
+	// A batch that fails when applied should store nothing on any replica.
+	require_NoError(t, nc.PublishMsg(batchMsg("B", 1, false, JSExpectedLastSeq, "2")))
+	require_NoError(t, nc.PublishMsg(batchMsg("B", 2, false)))
+	resp = commit(batchMsg("B", 3, true))
+	if resp.Error == nil || resp.Error.ErrCode != ApiErrors[JSStreamWrongLastSequenceErrF].ErrCode {
+		t.Fatalf("Expected wrong last sequence error, got %+v", resp.Error)
+	}
+	checkMsgs(5)
+
+	// Make sure normal publishes continue in order.
+	pa, err := js.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, pa.Sequence == 6)
+	checkMsgs(6)
+
+	// Per subject limits that reject new messages apply to the whole batch on all replicas.
+	cfg := StreamConfig{
+		Name:               "TEST",
+		Subjects:           []string{"foo"},
+		Storage:            FileStorage,
+		Replicas:           3,
+		Discard:            DiscardNew,
+		MaxMsgsPer:         7,
+		DiscardNewPer:      true,
+		AllowAtomicPublish: true,
+	}
+	req, _ := json.Marshal(cfg)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamUpdateT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var ur JSApiStreamUpdateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &ur))
+	if ur.Error != nil {
+		t.Fatalf("Unexpected error: %+v", ur.Error)
+	}
+	require_NoError(t, nc.PublishMsg(batchMsg("C", 1, false)))
+	resp = commit(batchMsg("C", 2, true))
+	if resp.Error == nil || resp.Error.ErrCode != ApiErrors[JSStreamMaxMsgsPerSubjectErr].ErrCode {
+		t.Fatalf("Expected max messages per subject error, got %+v", resp.Error)
+	}
+	checkMsgs(6)
+	pa, err = js.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+	require_True(t, pa.Sequence == 7)
+	checkMsgs(7)
+}
+
+func TestJetStreamClusterMessageSchedules(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	addStream(t, nc, &StreamConfig{
+		Name:              "TEST",
+		Subjects:          []string{"foo"},
+		Storage:           FileStorage,
+		Replicas:          3,
+		AllowMsgSchedules: true,
+	})
+
+	start := time.Now()
+	m := nats.NewMsg("foo")
+	m.Header.Set(JSScheduleDelay, "2s")
+	m.Data = []byte("A")
+	_, err := js.PublishMsg(m)
+	require_NoError(t, err)
+	_, err = js.Publish("foo", []byte("B"))
+	require_NoError(t, err)
+
+	// All replicas should know about the message being held back.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if sched := mset.store.MsgSchedules(); len(sched) != 1 {
+				return fmt.Errorf("Expected 1 scheduled message on %s, got %d", s, len(sched))
+			}
+		}
+		return nil
+	})
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+
+	fetch := func(expected string, wait time.Duration) {
+		t.Helper()
+		msgs, err := sub.Fetch(1, nats.MaxWait(wait))
+		require_NoError(t, err)
+		if data := string(msgs[0].Data); data != expected {
+			t.Fatalf("Expected %q, got %q", expected, data)
+		}
+		msgs[0].AckSync()
+	}
+	fetch("B", time.Second)
+
+	// Now have the consumer leader change and make sure the new leader delivers the held back message.
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	fetch("A", 3*time.Second)
+	if time.Since(start) < 2*time.Second {
+		t.Fatalf("Scheduled message was delivered early")
+	}
+
+	// Now have a scheduled message become due while there is no leader at all.
+	m = nats.NewMsg("foo")
+	m.Header.Set(JSScheduleDelay, "1s")
+	m.Data = []byte("C")
+	_, err = js.PublishMsg(m)
+	require_NoError(t, err)
+	_, err = sub.Fetch(1, nats.MaxWait(250*time.Millisecond))
+	require_Error(t, err)
+
+	// All replicas should know the consumer is holding it back.
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("No consumer on %s", s)
+			}
+			state, err := o.store.State()
+			if err != nil {
+				return err
+			}
+			if len(state.Held) != 1 {
+				return fmt.Errorf("Expected 1 held message on %s, got %v", s, state.Held)
+			}
+		}
+		return nil
+	})
+	nc.Close()
+
+	c.stopAll()
+	time.Sleep(time.Second)
+	c.restartAllSamePorts()
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	nc, js = jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+	sub, err = js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	fetch("C", 2*time.Second)
+}
+
+func TestJetStreamClusterStreamListMetadataFilter(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc := natsConnect(t, c.randomServer().ClientURL())
+	defer nc.Close()
+
+	addStream(t, nc, &StreamConfig{Name: "A", Storage: FileStorage, Replicas: 3, Metadata: map[string]string{"team": "core"}})
+	addStream(t, nc, &StreamConfig{Name: "B", Storage: FileStorage, Replicas: 3, Metadata: map[string]string{"team": "edge"}})
+	addStream(t, nc, &StreamConfig{Name: "C", Storage: FileStorage, Replicas: 3})
+
+	list := func(md map[string]string) []string {
+		t.Helper()
+		req, err := json.Marshal(&JSApiStreamListRequest{Metadata: md})
+		require_NoError(t, err)
+		rmsg, err := nc.Request(JSApiStreamList, req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamListResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		if resp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", resp.Error)
+		}
+		var names []string
+		for _, si := range resp.Streams {
+			names = append(names, si.Config.Name)
+		}
+		return names
+	}
+
+	if names := list(map[string]string{"team": "core"}); !reflect.DeepEqual(names, []string{"A"}) {
+		t.Fatalf("Unexpected streams: %v", names)
+	}
+
+	// Update the metadata and make sure it is replicated to all servers.
+	req, err := json.Marshal(&StreamConfig{Name: "C", Replicas: 3, Storage: FileStorage, Metadata: map[string]string{"team": "core"}})
+	require_NoError(t, err)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamUpdateT, "C"), req, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamUpdateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+
+	if names := list(map[string]string{"team": "core"}); !reflect.DeepEqual(names, []string{"A", "C"}) {
+		t.Fatalf("Unexpected streams: %v", names)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("C")
+			if err != nil {
+				return err
+			}
+			if md := mset.config().Metadata; md["team"] != "core" {
+				return fmt.Errorf("Unexpected metadata on %s: %+v", s, md)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterMirrorPromote(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "ORIGINAL", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "MIRROR", Mirror: &nats.StreamSource{Name: "ORIGINAL"}, Replicas: 3})
+	require_NoError(t, err)
+
+	for i := 0; i < 20; i++ {
+		js.Publish("foo", []byte("OK"))
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		si, err := js.StreamInfo("MIRROR")
+		require_NoError(t, err)
+		if si.State.LastSeq != 20 {
+			return fmt.Errorf("Expected last seq of 20, got %d", si.State.LastSeq)
+		}
+		return nil
+	})
+
+	req, err := json.Marshal(&JSApiStreamPromoteRequest{Subjects: []string{"bar"}})
+	require_NoError(t, err)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamPromoteT, "MIRROR"), req, 2*time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamPromoteResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	if resp.Type != JSApiStreamPromoteResponseType {
+		t.Fatalf("Unexpected response type: %q", resp.Type)
+	}
+	if resp.Config.Mirror != nil || resp.State.LastSeq != 20 {
+		t.Fatalf("Unexpected response: %+v", resp.StreamInfo)
+	}
+
+	js.Publish("foo", []byte("OK"))
+	pa, err := js.Publish("bar", []byte("NEW"))
+	require_NoError(t, err)
+	if pa.Stream != "MIRROR" || pa.Sequence != 21 {
+		t.Fatalf("Unexpected pub ack: %+v", pa)
+	}
+
+	// All peers should agree on the cut-over and have no mirror.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("MIRROR")
+			if err != nil {
+				return err
+			}
+			if mset.isMirror() {
+				return fmt.Errorf("Stream on %s is still a mirror", s)
+			}
+			if state := mset.state(); state.Msgs != 21 || state.LastSeq != 21 {
+				return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+			}
+		}
+		return nil
+	})
+
+	// Make sure the new config survives a leader change.
+	_, err = nc.Request(fmt.Sprintf(JSApiStreamLeaderStepDownT, "MIRROR"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnStreamLeader("$G", "MIRROR")
+	pa, err = js.Publish("bar", []byte("NEW"))
+	require_NoError(t, err)
+	if pa.Sequence != 22 {
+		t.Fatalf("Unexpected pub ack: %+v", pa)
+	}
+}
+
+func TestJetStreamClusterConsumerPause(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	for i := 0; i < 5; i++ {
+		js.Publish("foo", []byte("OK"))
+	}
+
+	pause := func(until time.Time) *JSApiConsumerPauseResponse {
+		t.Helper()
+		var data []byte
+		if !until.IsZero() {
+			data, err = json.Marshal(&JSApiConsumerPauseRequest{PauseUntil: until})
+			require_NoError(t, err)
+		}
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", "dlc"), data, 2*time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerPauseResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		if resp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", resp.Error)
+		}
+		return &resp
+	}
+
+	if resp := pause(time.Now().Add(time.Hour)); !resp.Paused {
+		t.Fatalf("Expected to be paused, got %+v", resp)
+	}
+
+	// All peers should know about the pause.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("No consumer on %s", s)
+			}
+			o.mu.RLock()
+			paused := o.isPaused()
+			o.mu.RUnlock()
+			if !paused {
+				return fmt.Errorf("Consumer on %s not paused", s)
+			}
+		}
+		return nil
+	})
+
+	// Change the consumer leader and make sure we are still paused.
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiConsumerInfoT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	var ci JSApiConsumerInfoResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &ci))
+	if ci.ConsumerInfo == nil || !ci.Paused || ci.NumPending != 5 {
+		t.Fatalf("Expected paused consumer info, got %+v", ci.ConsumerInfo)
+	}
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc")
+	m, err := nc.Request(rsubj, []byte(`{"batch":1,"expires":250000000}`), time.Second)
+	require_NoError(t, err)
+	if len(m.Data) > 0 {
+		t.Fatalf("Expected no message while paused, got %q", m.Data)
+	}
+
+	// Now resume.
+	if resp := pause(time.Time{}); resp.Paused {
+		t.Fatalf("Expected to be resumed, got %+v", resp)
+	}
+	m, err = nc.Request(rsubj, nil, time.Second)
+	require_NoError(t, err)
+	if string(m.Data) != "OK" {
+		t.Fatalf("Unexpected message: %q", m.Data)
+	}
+}
+
+func TestJetStreamClusterConsumerReset(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	for i := 1; i <= 10; i++ {
+		js.Publish("foo", []byte(strconv.Itoa(i)))
+	}
+
+	// Ack some and leave some pending.
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(6)
+	require_NoError(t, err)
+	for _, m := range msgs[:4] {
+		m.AckSync()
+	}
+
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiConsumerResetT, "TEST", "dlc"), []byte(`{"seq":2}`), 2*time.Second)
+	require_NoError(t, err)
+	var resp JSApiConsumerResetResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil || resp.ResetSeq != 2 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+
+	// All peers should have the reset state.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("No consumer on %s", s)
+			}
+			state := o.readStoreState()
+			if state == nil || state.Delivered.Stream != 1 || state.AckFloor.Stream != 1 || len(state.Pending) != 0 {
+				return fmt.Errorf("Consumer on %s not reset: %+v", s, state)
+			}
+		}
+		return nil
+	})
+
+	// Change the consumer leader and make sure we pick up from the reset.
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	if ci.NumAckPending != 0 || ci.NumPending != 9 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+	msgs, err = sub.Fetch(1)
+	require_NoError(t, err)
+	if string(msgs[0].Data) != "2" {
+		t.Fatalf("Unexpected message: %q", msgs[0].Data)
+	}
+}
+
+func TestJetStreamClusterConsumerAckBatch(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3, Retention: nats.WorkQueuePolicy})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	for i := 0; i < 100; i++ {
+		js.Publish("foo", []byte("OK"))
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(100)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 100)
+
+	_, err = nc.Request("$JS.ACK.TEST.dlc", []byte("+ACK 1-80,90"), 2*time.Second)
+	require_NoError(t, err)
+
+	// All peers should have applied the acks to the consumer and the stream.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			if state := mset.state(); state.Msgs != 19 {
+				return fmt.Errorf("Expected 19 messages on %s, got %d", s, state.Msgs)
+			}
+			o := mset.lookupConsumer("dlc")
+			if o == nil {
+				return fmt.Errorf("No consumer on %s", s)
+			}
+			state := o.readStoreState()
+			if state == nil || state.AckFloor.Stream != 80 || len(state.Pending) != 19 {
+				return fmt.Errorf("Unexpected state on %s: %+v", s, state)
+			}
+		}
+		return nil
+	})
+
+	// Change the consumer leader and make sure the new one has the same view.
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	if ci.NumAckPending != 19 || ci.AckFloor.Stream != 80 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+}
+
+func TestJetStreamClusterConsumerReplicasAndStorage(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "WQ", Subjects: []string{"bar"}, Replicas: 3, Retention: nats.WorkQueuePolicy})
+	require_NoError(t, err)
+
+	create := func(stream string, cfg *ConsumerConfig) *JSApiConsumerCreateResponse {
+		t.Helper()
+		req, err := json.Marshal(&CreateConsumerRequest{Stream: stream, Config: *cfg})
+		require_NoError(t, err)
+		subj := fmt.Sprintf(JSApiDurableCreateT, stream, cfg.Durable)
+		rmsg, err := nc.Request(subj, req, 2*time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerCreateResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+
+	if resp := create("TEST", &ConsumerConfig{Durable: "bad", AckPolicy: AckExplicit, Replicas: 5}); resp.Error == nil ||
+		resp.Error.ErrCode != ApiErrors[JSConsumerReplicasExceedsStream].ErrCode {
+		t.Fatalf("Expected replicas exceeds stream error, got %+v", resp.Error)
+	}
+	if resp := create("WQ", &ConsumerConfig{Durable: "bad", AckPolicy: AckExplicit, Replicas: 1}); resp.Error == nil ||
+		resp.Error.ErrCode != ApiErrors[JSConsumerReplicasShouldMatchStream].ErrCode {
+		t.Fatalf("Expected replicas should match stream error, got %+v", resp.Error)
+	}
+
+	checkGroup := func(name string, replicas int, storage StorageType) {
+		t.Helper()
+		sl := c.streamLeader("$G", "TEST")
+		js := sl.getJetStream()
+		js.mu.RLock()
+		ca := js.consumerAssignment("$G", "TEST", name)
+		var rg raftGroup
+		if ca != nil {
+			rg = *ca.Group
+		}
+		js.mu.RUnlock()
+		if ca == nil {
+			t.Fatalf("No assignment for %q", name)
+		}
+		if len(rg.Peers) != replicas || rg.Storage != storage {
+			t.Fatalf("Expected %d %v peers for %q, got %d %v", replicas, storage, name, len(rg.Peers), rg.Storage)
+		}
+		// The servers running the consumer should use the right store.
+		var running int
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			require_NoError(t, err)
+			if o := mset.lookupConsumer(name); o != nil {
+				running++
+				if o.store.Type() != storage {
+					t.Fatalf("Expected %v store for %q on %s, got %v", storage, name, s, o.store.Type())
+				}
+			}
+		}
+		if running != replicas {
+			t.Fatalf("Expected %q to run on %d servers, got %d", name, replicas, running)
+		}
+	}
+
+	resp := create("TEST", &ConsumerConfig{Durable: "r1", AckPolicy: AckExplicit, Replicas: 1, MemoryStorage: true})
+	require_True(t, resp.Error == nil)
+	c.waitOnConsumerLeader("$G", "TEST", "r1")
+	checkGroup("r1", 1, MemoryStorage)
+
+	resp = create("TEST", &ConsumerConfig{Durable: "r2", AckPolicy: AckExplicit, Replicas: 2})
+	require_True(t, resp.Error == nil)
+	c.waitOnConsumerLeader("$G", "TEST", "r2")
+	checkGroup("r2", 2, FileStorage)
+
+	resp = create("TEST", &ConsumerConfig{Durable: "r3", AckPolicy: AckExplicit})
+	require_True(t, resp.Error == nil)
+	c.waitOnConsumerLeader("$G", "TEST", "r3")
+	checkGroup("r3", 3, FileStorage)
+
+	// Make sure the in memory consumer works.
+	for i := 0; i < 10; i++ {
+		js.Publish("foo", []byte("OK"))
+	}
+	sub, err := js.PullSubscribe("foo", "r1")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(10)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 10)
+	for _, m := range msgs {
+		m.AckSync()
+	}
+	ci, err := js.ConsumerInfo("TEST", "r1")
+	require_NoError(t, err)
+	if ci.AckFloor.Stream != 10 || ci.Cluster == nil || len(ci.Cluster.Replicas) != 0 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+
+	// Replicated in memory consumers should keep their state on all peers.
+	resp = create("TEST", &ConsumerConfig{Durable: "m3", AckPolicy: AckExplicit, MemoryStorage: true})
+	require_True(t, resp.Error == nil)
+	c.waitOnConsumerLeader("$G", "TEST", "m3")
+	checkGroup("m3", 3, MemoryStorage)
+
+	sub, err = js.PullSubscribe("foo", "m3")
+	require_NoError(t, err)
+	msgs, err = sub.Fetch(5)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 5)
+	for _, m := range msgs {
+		m.AckSync()
+	}
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			require_NoError(t, err)
+			o := mset.lookupConsumer("m3")
+			if o == nil {
+				return fmt.Errorf("No consumer on %s", s)
+			}
+			state, err := o.store.State()
+			if err != nil || state == nil || state.AckFloor.Stream != 5 || state.Delivered.Stream != 5 {
+				return fmt.Errorf("Unexpected state on %s: %+v %v", s, state, err)
+			}
+		}
+		return nil
+	})
+
+	// A new leader should pick up where we left off.
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "m3"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "m3")
+	msgs, err = sub.Fetch(10, nats.MaxWait(time.Second))
+	require_NoError(t, err)
+	if len(msgs) != 5 {
+		t.Fatalf("Expected 5 messages, got %d", len(msgs))
+	}
+	for _, m := range msgs {
+		if meta, _ := m.Metadata(); meta.Sequence.Stream <= 5 || meta.NumDelivered != 1 {
+			t.Fatalf("Unexpected redelivery: %+v", meta)
+		}
+	}
+}
+
 // Support functions
 
 // Used to setup superclusters for tests.
@@ -8,6 +8,24 @@ const (
 	// JSAccountResourcesExceededErr resource limits exceeded for account
 	JSAccountResourcesExceededErr ErrorIdentifier = 10002
 
+	// JSAtomicPublishDisabledErr atomic publish is disabled
+	JSAtomicPublishDisabledErr ErrorIdentifier = 10124
+
+	// JSAtomicPublishDuplicateMsgIdErr atomic publish batch contains a duplicate message id
+	JSAtomicPublishDuplicateMsgIdErr ErrorIdentifier = 10128
+
+	// JSAtomicPublishIncompleteBatchErr atomic publish batch is incomplete
+	JSAtomicPublishIncompleteBatchErr ErrorIdentifier = 10125
+
+	// JSAtomicPublishTooLargeBatchErrF atomic publish batch is too large: {size}
+	JSAtomicPublishTooLargeBatchErrF ErrorIdentifier = 10126
+
+	// JSAtomicPublishTooManyBytesErrF atomic publish batch exceeds the byte limit of {limit}
+	JSAtomicPublishTooManyBytesErrF ErrorIdentifier = 10145
+
+	// JSAtomicPublishUnsupportedHeaderBatchErrF atomic publish unsupported header used: {header}
+	JSAtomicPublishUnsupportedHeaderBatchErrF ErrorIdentifier = 10127
+
 	// JSBadRequestErr bad request
 	JSBadRequestErr ErrorIdentifier = 10003
 
@@ -53,6 +71,9 @@ const (
 	// JSConsumerCreateErrF General consumer creation failure string ({err})
 	JSConsumerCreateErrF ErrorIdentifier = 10012
 
+	// JSConsumerDeadLetterInvalidErrF consumer dead letter configuration invalid: {err}
+	JSConsumerDeadLetterInvalidErrF ErrorIdentifier = 10136
+
 	// JSConsumerDeliverCycleErr consumer deliver subject forms a cycle
 	JSConsumerDeliverCycleErr ErrorIdentifier = 10081
 
@@ -92,12 +113,21 @@ const (
 	// JSConsumerFilterNotSubsetErr consumer filter subject is not a valid subset of the interest subjects
 	JSConsumerFilterNotSubsetErr ErrorIdentifier = 10093
 
+	// JSConsumerFilterSubjectsOverlapErr consumer filter subjects can not partially overlap
+	JSConsumerFilterSubjectsOverlapErr ErrorIdentifier = 10135
+
 	// JSConsumerHBRequiresPushErr consumer idle heartbeat requires a push based consumer
 	JSConsumerHBRequiresPushErr ErrorIdentifier = 10088
 
+	// JSConsumerHeaderFilterInvalidErrF consumer header filter invalid: {err}
+	JSConsumerHeaderFilterInvalidErrF ErrorIdentifier = 10142
+
 	// JSConsumerInvalidDeliverSubject invalid push consumer deliver subject
 	JSConsumerInvalidDeliverSubject ErrorIdentifier = 10112
 
+	// JSConsumerInvalidGroupNameErr consumer priority group names must match A-Z, a-z, 0-9, -_/= and may not exceed 16 characters
+	JSConsumerInvalidGroupNameErr ErrorIdentifier = 10138
+
 	// JSConsumerInvalidPolicyErrF Generic delivery policy error ({err})
 	JSConsumerInvalidPolicyErrF ErrorIdentifier = 10094
 
@@ -122,6 +152,12 @@ const (
 	// JSConsumerMaxWaitingNegativeErr consumer max waiting needs to be positive
 	JSConsumerMaxWaitingNegativeErr ErrorIdentifier = 10087
 
+	// JSConsumerMetadataLengthErrF consumer metadata exceeds maximum size of {limit}
+	JSConsumerMetadataLengthErrF ErrorIdentifier = 10132
+
+	// JSConsumerMultipleFiltersNotAllowed consumer can not have both filter subject and filter subjects
+	JSConsumerMultipleFiltersNotAllowed ErrorIdentifier = 10134
+
 	// JSConsumerNameExistErr consumer name already in use
 	JSConsumerNameExistErr ErrorIdentifier = 10013
 
@@ -137,6 +173,12 @@ const (
 	// JSConsumerOnMappedErr consumer direct on a mapped consumer
 	JSConsumerOnMappedErr ErrorIdentifier = 10092
 
+	// JSConsumerPartitionInvalidErrF consumer partition configuration invalid: {err}
+	JSConsumerPartitionInvalidErrF ErrorIdentifier = 10140
+
+	// JSConsumerPriorityPolicyWithoutGroup consumer priority policy requires at least one priority group
+	JSConsumerPriorityPolicyWithoutGroup ErrorIdentifier = 10137
+
 	// JSConsumerPullNotDurableErr consumer in pull mode requires a durable name
 	JSConsumerPullNotDurableErr ErrorIdentifier = 10085
 
@@ -149,9 +191,21 @@ const (
 	// JSConsumerPushMaxWaitingErr consumer in push mode can not set max waiting
 	JSConsumerPushMaxWaitingErr ErrorIdentifier = 10080
 
+	// JSConsumerPushWithPriorityGroupErr consumer priority groups can not be used with push consumers
+	JSConsumerPushWithPriorityGroupErr ErrorIdentifier = 10139
+
 	// JSConsumerReplacementWithDifferentNameErr consumer replacement durable config not the same
 	JSConsumerReplacementWithDifferentNameErr ErrorIdentifier = 10106
 
+	// JSConsumerReplicasExceedsStream consumer config replica count exceeds parent stream
+	JSConsumerReplicasExceedsStream ErrorIdentifier = 10143
+
+	// JSConsumerReplicasShouldMatchStream consumer config replicas must match interest retention stream's replicas
+	JSConsumerReplicasShouldMatchStream ErrorIdentifier = 10144
+
+	// JSConsumerResetInvalidErrF consumer reset request invalid: {err}
+	JSConsumerResetInvalidErrF ErrorIdentifier = 10141
+
 	// JSConsumerSmallHeartbeatErr consumer idle heartbeat needs to be >= 100ms
 	JSConsumerSmallHeartbeatErr ErrorIdentifier = 10083
 
@@ -188,6 +242,18 @@ const (
 	// JSMemoryResourcesExceededErr insufficient memory resources available
 	JSMemoryResourcesExceededErr ErrorIdentifier = 10028
 
+	// JSMessageScheduleDisabledErr message schedules are disabled
+	JSMessageScheduleDisabledErr ErrorIdentifier = 10129
+
+	// JSMessageScheduleInvalidErr invalid message schedule
+	JSMessageScheduleInvalidErr ErrorIdentifier = 10130
+
+	// JSMessageTTLDisabledErr per-message TTL is disabled
+	JSMessageTTLDisabledErr ErrorIdentifier = 10122
+
+	// JSMessageTTLInvalidErr invalid per-message TTL
+	JSMessageTTLInvalidErr ErrorIdentifier = 10123
+
 	// JSMirrorConsumerSetupFailedErrF Generic mirror consumer setup failure string ({err})
 	JSMirrorConsumerSetupFailedErrF ErrorIdentifier = 10029
 
@@ -287,6 +353,9 @@ const (
 	// JSStreamMaxBytesRequired account requires a stream config to have max bytes set
 	JSStreamMaxBytesRequired ErrorIdentifier = 10113
 
+	// JSStreamMaxMsgsPerSubjectErr maximum messages per subject exceeded
+	JSStreamMaxMsgsPerSubjectErr ErrorIdentifier = 10131
+
 	// JSStreamMessageExceedsMaximumErr message size exceeds maximum allowed
 	JSStreamMessageExceedsMaximumErr ErrorIdentifier = 10054
 
@@ -308,6 +377,9 @@ const (
 	// JSStreamNotMatchErr expected stream does not match
 	JSStreamNotMatchErr ErrorIdentifier = 10060
 
+	// JSStreamNotMirrorErr stream is not a mirror
+	JSStreamNotMirrorErr ErrorIdentifier = 10133
+
 	// JSStreamOfflineErr stream is offline
 	JSStreamOfflineErr ErrorIdentifier = 10118
 
@@ -369,6 +441,12 @@ const (
 var (
 	ApiErrors = map[ErrorIdentifier]*ApiError{
 		JSAccountResourcesExceededErr:              {Code: 400, ErrCode: 10002, Description: "resource limits exceeded for account"},
+		JSAtomicPublishDisabledErr:                 {Code: 400, ErrCode: 10124, Description: "atomic publish is disabled"},
+		JSAtomicPublishDuplicateMsgIdErr:           {Code: 400, ErrCode: 10128, Description: "atomic publish batch contains a duplicate message id"},
+		JSAtomicPublishIncompleteBatchErr:          {Code: 400, ErrCode: 10125, Description: "atomic publish batch is incomplete"},
+		JSAtomicPublishTooLargeBatchErrF:           {Code: 400, ErrCode: 10126, Description: "atomic publish batch is too large: {size}"},
+		JSAtomicPublishTooManyBytesErrF:            {Code: 400, ErrCode: 10145, Description: "atomic publish batch exceeds the byte limit of {limit}"},
+		JSAtomicPublishUnsupportedHeaderBatchErrF:  {Code: 400, ErrCode: 10127, Description: "atomic publish unsupported header used: {header}"},
 		JSBadRequestErr:                            {Code: 400, ErrCode: 10003, Description: "bad request"},
 		JSClusterIncompleteErr:                     {Code: 503, ErrCode: 10004, Description: "incomplete results"},
 		JSClusterNoPeersErr:                        {Code: 400, ErrCode: 10005, Description: "no suitable peers for placement"},
@@ -384,6 +462,7 @@ var (
 		JSConsumerBadDurableNameErr:                {Code: 400, ErrCode: 10103, Description: "durable name can not contain '.', '*', '>'"},
 		JSConsumerConfigRequiredErr:                {Code: 400, ErrCode: 10078, Description: "consumer config required"},
 		JSConsumerCreateErrF:                       {Code: 500, ErrCode: 10012, Description: "{err}"},
+		JSConsumerDeadLetterInvalidErrF:            {Code: 400, ErrCode: 10136, Description: "consumer dead letter configuration invalid: {err}"},
 		JSConsumerDeliverCycleErr:                  {Code: 400, ErrCode: 10081, Description: "consumer deliver subject forms a cycle"},
 		JSConsumerDeliverToWildcardsErr:            {Code: 400, ErrCode: 10079, Description: "consumer deliver subject has wildcards"},
 		JSConsumerDescriptionTooLongErrF:           {Code: 400, ErrCode: 10107, Description: "consumer description is too long, maximum allowed is {max}"},
@@ -397,8 +476,11 @@ var (
 		JSConsumerExistingActiveErr:                {Code: 400, ErrCode: 10105, Description: "consumer already exists and is still active"},
 		JSConsumerFCRequiresPushErr:                {Code: 400, ErrCode: 10089, Description: "consumer flow control requires a push based consumer"},
 		JSConsumerFilterNotSubsetErr:               {Code: 400, ErrCode: 10093, Description: "consumer filter subject is not a valid subset of the interest subjects"},
+		JSConsumerFilterSubjectsOverlapErr:         {Code: 400, ErrCode: 10135, Description: "consumer filter subjects can not partially overlap"},
 		JSConsumerHBRequiresPushErr:                {Code: 400, ErrCode: 10088, Description: "consumer idle heartbeat requires a push based consumer"},
+		JSConsumerHeaderFilterInvalidErrF:          {Code: 400, ErrCode: 10142, Description: "consumer header filter invalid: {err}"},
 		JSConsumerInvalidDeliverSubject:            {Code: 400, ErrCode: 10112, Description: "invalid push consumer deliver subject"},
+		JSConsumerInvalidGroupNameErr:              {Code: 400, ErrCode: 10138, Description: "consumer priority group names must match A-Z, a-z, 0-9, -_/= and may not exceed 16 characters"},
 		JSConsumerInvalidPolicyErrF:                {Code: 400, ErrCode: 10094, Description: "{err}"},
 		JSConsumerInvalidSamplingErrF:              {Code: 400, ErrCode: 10095, Description: "failed to parse consumer sampling configuration: {err}"},
 		JSConsumerMaxDeliverBackoffErr:             {Code: 400, ErrCode: 10116, Description: "max deliver is required to be > length of backoff values"},
@@ -407,16 +489,24 @@ var (
 		JSConsumerMaxRequestBatchNegativeErr:       {Code: 400, ErrCode: 10114, Description: "consumer max request batch needs to be > 0"},
 		JSConsumerMaxRequestExpiresToSmall:         {Code: 400, ErrCode: 10115, Description: "consumer max request expires needs to be >= 1ms"},
 		JSConsumerMaxWaitingNegativeErr:            {Code: 400, ErrCode: 10087, Description: "consumer max waiting needs to be positive"},
+		JSConsumerMetadataLengthErrF:               {Code: 400, ErrCode: 10132, Description: "consumer metadata exceeds maximum size of {limit}"},
+		JSConsumerMultipleFiltersNotAllowed:        {Code: 400, ErrCode: 10134, Description: "consumer can not have both filter subject and filter subjects"},
 		JSConsumerNameExistErr:                     {Code: 400, ErrCode: 10013, Description: "consumer name already in use"},
 		JSConsumerNameTooLongErrF:                  {Code: 400, ErrCode: 10102, Description: "consumer name is too long, maximum allowed is {max}"},
 		JSConsumerNotFoundErr:                      {Code: 404, ErrCode: 10014, Description: "consumer not found"},
 		JSConsumerOfflineErr:                       {Code: 500, ErrCode: 10119, Description: "consumer is offline"},
 		JSConsumerOnMappedErr:                      {Code: 400, ErrCode: 10092, Description: "consumer direct on a mapped consumer"},
+		JSConsumerPartitionInvalidErrF:             {Code: 400, ErrCode: 10140, Description: "consumer partition configuration invalid: {err}"},
+		JSConsumerPriorityPolicyWithoutGroup:       {Code: 400, ErrCode: 10137, Description: "consumer priority policy requires at least one priority group"},
 		JSConsumerPullNotDurableErr:                {Code: 400, ErrCode: 10085, Description: "consumer in pull mode requires a durable name"},
 		JSConsumerPullRequiresAckErr:               {Code: 400, ErrCode: 10084, Description: "consumer in pull mode requires ack policy"},
 		JSConsumerPullWithRateLimitErr:             {Code: 400, ErrCode: 10086, Description: "consumer in pull mode can not have rate limit set"},
 		JSConsumerPushMaxWaitingErr:                {Code: 400, ErrCode: 10080, Description: "consumer in push mode can not set max waiting"},
+		JSConsumerPushWithPriorityGroupErr:         {Code: 400, ErrCode: 10139, Description: "consumer priority groups can not be used with push consumers"},
 		JSConsumerReplacementWithDifferentNameErr:  {Code: 400, ErrCode: 10106, Description: "consumer replacement durable config not the same"},
+		JSConsumerReplicasExceedsStream:            {Code: 400, ErrCode: 10143, Description: "consumer config replica count exceeds parent stream"},
+		JSConsumerReplicasShouldMatchStream:        {Code: 400, ErrCode: 10144, Description: "consumer config replicas must match interest retention stream's replicas"},
+		JSConsumerResetInvalidErrF:                 {Code: 400, ErrCode: 10141, Description: "consumer reset request invalid: {err}"},
 		JSConsumerSmallHeartbeatErr:                {Code: 400, ErrCode: 10083, Description: "consumer idle heartbeat needs to be >= 100ms"},
 		JSConsumerStoreFailedErrF:                  {Code: 500, ErrCode: 10104, Description: "error creating store for consumer: {err}"},
 		JSConsumerWQConsumerNotDeliverAllErr:       {Code: 400, ErrCode: 10101, Description: "consumer must be deliver all on workqueue stream"},
@@ -429,6 +519,10 @@ var (
 		JSMaximumConsumersLimitErr:                 {Code: 400, ErrCode: 10026, Description: "maximum consumers limit reached"},
 		JSMaximumStreamsLimitErr:                   {Code: 400, ErrCode: 10027, Description: "maximum number of streams reached"},
 		JSMemoryResourcesExceededErr:               {Code: 500, ErrCode: 10028, Description: "insufficient memory resources available"},
+		JSMessageScheduleDisabledErr:               {Code: 400, ErrCode: 10129, Description: "message schedules are disabled"},
+		JSMessageScheduleInvalidErr:                {Code: 400, ErrCode: 10130, Description: "invalid message schedule"},
+		JSMessageTTLDisabledErr:                    {Code: 400, ErrCode: 10122, Description: "per-message TTL is disabled"},
+		JSMessageTTLInvalidErr:                     {Code: 400, ErrCode: 10123, Description: "invalid per-message TTL"},
 		JSMirrorConsumerSetupFailedErrF:            {Code: 500, ErrCode: 10029, Description: "{err}"},
 		JSMirrorMaxMessageSizeTooBigErr:            {Code: 400, ErrCode: 10030, Description: "stream mirror must have max message size >= source"},
 		JSMirrorWithSourcesErr:                     {Code: 400, ErrCode: 10031, Description: "stream mirrors can not also contain other sources"},
@@ -462,6 +556,7 @@ var (
 		JSStreamInvalidExternalDeliverySubjErrF:    {Code: 400, ErrCode: 10024, Description: "stream external delivery prefix {prefix} must not contain wildcards"},
 		JSStreamLimitsErrF:                         {Code: 500, ErrCode: 10053, Description: "{err}"},
 		JSStreamMaxBytesRequired:                   {Code: 400, ErrCode: 10113, Description: "account requires a stream config to have max bytes set"},
+		JSStreamMaxMsgsPerSubjectErr:               {Code: 400, ErrCode: 10131, Description: "maximum messages per subject exceeded"},
 		JSStreamMessageExceedsMaximumErr:           {Code: 400, ErrCode: 10054, Description: "message size exceeds maximum allowed"},
 		JSStreamMirrorNotUpdatableErr:              {Code: 400, ErrCode: 10055, Description: "Mirror configuration can not be updated"},
 		JSStreamMismatchErr:                        {Code: 400, ErrCode: 10056, Description: "stream name in subject does not match request"},
@@ -469,6 +564,7 @@ var (
 		JSStreamNameExistErr:                       {Code: 400, ErrCode: 10058, Description: "stream name already in use"},
 		JSStreamNotFoundErr:                        {Code: 404, ErrCode: 10059, Description: "stream not found"},
 		JSStreamNotMatchErr:                        {Code: 400, ErrCode: 10060, Description: "expected stream does not match"},
+		JSStreamNotMirrorErr:                       {Code: 400, ErrCode: 10133, Description: "stream is not a mirror"},
 		JSStreamOfflineErr:                         {Code: 500, ErrCode: 10118, Description: "stream is offline"},
 		JSStreamPurgeFailedF:                       {Code: 500, ErrCode: 10110, Description: "{err}"},
 		JSStreamReplicasNotSupportedErr:            {Code: 500, ErrCode: 10074, Description: "replicas > 1 not supported in non-clustered mode"},
@@ -523,6 +619,84 @@ func NewJSAccountResourcesExceededError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSAccountResourcesExceededErr]
 }
 
+// NewJSAtomicPublishDisabledError creates a new JSAtomicPublishDisabledErr error: "atomic publish is disabled"
+func NewJSAtomicPublishDisabledError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishDisabledErr]
+}
+
+// NewJSAtomicPublishDuplicateMsgIdError creates a new JSAtomicPublishDuplicateMsgIdErr error: "atomic publish batch contains a duplicate message id"
+func NewJSAtomicPublishDuplicateMsgIdError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishDuplicateMsgIdErr]
+}
+
+// NewJSAtomicPublishIncompleteBatchError creates a new JSAtomicPublishIncompleteBatchErr error: "atomic publish batch is incomplete"
+func NewJSAtomicPublishIncompleteBatchError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAtomicPublishIncompleteBatchErr]
+}
+
+// NewJSAtomicPublishTooLargeBatchError creates a new JSAtomicPublishTooLargeBatchErrF error: "atomic publish batch is too large: {size}"
+func NewJSAtomicPublishTooLargeBatchError(size interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSAtomicPublishTooLargeBatchErrF]
+	args := e.toReplacerArgs([]interface{}{"{size}", size})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSAtomicPublishTooManyBytesError creates a new JSAtomicPublishTooManyBytesErrF error: "atomic publish batch exceeds the byte limit of {limit}"
+func NewJSAtomicPublishTooManyBytesError(limit interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSAtomicPublishTooManyBytesErrF]
+	args := e.toReplacerArgs([]interface{}{"{limit}", limit})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSAtomicPublishUnsupportedHeaderBatchError creates a new JSAtomicPublishUnsupportedHeaderBatchErrF error: "atomic publish unsupported header used: {header}"
+func NewJSAtomicPublishUnsupportedHeaderBatchError(header interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSAtomicPublishUnsupportedHeaderBatchErrF]
+	args := e.toReplacerArgs([]interface{}{"{header}", header})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSBadRequestError creates a new JSBadRequestErr error: "bad request"
 func NewJSBadRequestError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -679,6 +853,22 @@ func NewJSConsumerCreateError(err error, opts ...ErrorOption) *ApiError {
 	}
 }
 
+// NewJSConsumerDeadLetterInvalidError creates a new JSConsumerDeadLetterInvalidErrF error: "consumer dead letter configuration invalid: {err}"
+func NewJSConsumerDeadLetterInvalidError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSConsumerDeadLetterInvalidErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSConsumerDeliverCycleError creates a new JSConsumerDeliverCycleErr error: "consumer deliver subject forms a cycle"
 func NewJSConsumerDeliverCycleError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -815,6 +1005,16 @@ func NewJSConsumerFilterNotSubsetError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerFilterNotSubsetErr]
 }
 
+// NewJSConsumerFilterSubjectsOverlapError creates a new JSConsumerFilterSubjectsOverlapErr error: "consumer filter subjects can not partially overlap"
+func NewJSConsumerFilterSubjectsOverlapError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerFilterSubjectsOverlapErr]
+}
+
 // NewJSConsumerHBRequiresPushError creates a new JSConsumerHBRequiresPushErr error: "consumer idle heartbeat requires a push based consumer"
 func NewJSConsumerHBRequiresPushError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -825,6 +1025,22 @@ func NewJSConsumerHBRequiresPushError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerHBRequiresPushErr]
 }
 
+// NewJSConsumerHeaderFilterInvalidError creates a new JSConsumerHeaderFilterInvalidErrF error: "consumer header filter invalid: {err}"
+func NewJSConsumerHeaderFilterInvalidError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSConsumerHeaderFilterInvalidErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSConsumerInvalidDeliverSubjectError creates a new JSConsumerInvalidDeliverSubject error: "invalid push consumer deliver subject"
 func NewJSConsumerInvalidDeliverSubjectError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -835,6 +1051,16 @@ func NewJSConsumerInvalidDeliverSubjectError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerInvalidDeliverSubject]
 }
 
+// NewJSConsumerInvalidGroupNameError creates a new JSConsumerInvalidGroupNameErr error: "consumer priority group names must match A-Z, a-z, 0-9, -_/= and may not exceed 16 characters"
+func NewJSConsumerInvalidGroupNameError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerInvalidGroupNameErr]
+}
+
 // NewJSConsumerInvalidPolicyError creates a new JSConsumerInvalidPolicyErrF error: "{err}"
 func NewJSConsumerInvalidPolicyError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -927,6 +1153,32 @@ func NewJSConsumerMaxWaitingNegativeError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerMaxWaitingNegativeErr]
 }
 
+// NewJSConsumerMetadataLengthError creates a new JSConsumerMetadataLengthErrF error: "consumer metadata exceeds maximum size of {limit}"
+func NewJSConsumerMetadataLengthError(limit interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSConsumerMetadataLengthErrF]
+	args := e.toReplacerArgs([]interface{}{"{limit}", limit})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSConsumerMultipleFiltersNotAllowedError creates a new JSConsumerMultipleFiltersNotAllowed error: "consumer can not have both filter subject and filter subjects"
+func NewJSConsumerMultipleFiltersNotAllowedError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerMultipleFiltersNotAllowed]
+}
+
 // NewJSConsumerNameExistError creates a new JSConsumerNameExistErr error: "consumer name already in use"
 func NewJSConsumerNameExistError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -983,6 +1235,32 @@ func NewJSConsumerOnMappedError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerOnMappedErr]
 }
 
+// NewJSConsumerPartitionInvalidError creates a new JSConsumerPartitionInvalidErrF error: "consumer partition configuration invalid: {err}"
+func NewJSConsumerPartitionInvalidError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSConsumerPartitionInvalidErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
+// NewJSConsumerPriorityPolicyWithoutGroupError creates a new JSConsumerPriorityPolicyWithoutGroup error: "consumer priority policy requires at least one priority group"
+func NewJSConsumerPriorityPolicyWithoutGroupError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerPriorityPolicyWithoutGroup]
+}
+
 // NewJSConsumerPullNotDurableError creates a new JSConsumerPullNotDurableErr error: "consumer in pull mode requires a durable name"
 func NewJSConsumerPullNotDurableError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1023,6 +1301,16 @@ func NewJSConsumerPushMaxWaitingError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerPushMaxWaitingErr]
 }
 
+// NewJSConsumerPushWithPriorityGroupError creates a new JSConsumerPushWithPriorityGroupErr error: "consumer priority groups can not be used with push consumers"
+func NewJSConsumerPushWithPriorityGroupError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerPushWithPriorityGroupErr]
+}
+
 // NewJSConsumerReplacementWithDifferentNameError creates a new JSConsumerReplacementWithDifferentNameErr error: "consumer replacement durable config not the same"
 func NewJSConsumerReplacementWithDifferentNameError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1033,6 +1321,42 @@ func NewJSConsumerReplacementWithDifferentNameError(opts ...ErrorOption) *ApiErr
 	return ApiErrors[JSConsumerReplacementWithDifferentNameErr]
 }
 
+// NewJSConsumerReplicasExceedsStreamError creates a new JSConsumerReplicasExceedsStream error: "consumer config replica count exceeds parent stream"
+func NewJSConsumerReplicasExceedsStreamError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerReplicasExceedsStream]
+}
+
+// NewJSConsumerReplicasShouldMatchStreamError creates a new JSConsumerReplicasShouldMatchStream error: "consumer config replicas must match interest retention stream's replicas"
+func NewJSConsumerReplicasShouldMatchStreamError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerReplicasShouldMatchStream]
+}
+
+// NewJSConsumerResetInvalidError creates a new JSConsumerResetInvalidErrF error: "consumer reset request invalid: {err}"
+func NewJSConsumerResetInvalidError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSConsumerResetInvalidErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSConsumerSmallHeartbeatError creates a new JSConsumerSmallHeartbeatErr error: "consumer idle heartbeat needs to be >= 100ms"
 func NewJSConsumerSmallHeartbeatError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1159,6 +1483,46 @@ func NewJSMemoryResourcesExceededError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSMemoryResourcesExceededErr]
 }
 
+// NewJSMessageScheduleDisabledError creates a new JSMessageScheduleDisabledErr error: "message schedules are disabled"
+func NewJSMessageScheduleDisabledError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMessageScheduleDisabledErr]
+}
+
+// NewJSMessageScheduleInvalidError creates a new JSMessageScheduleInvalidErr error: "invalid message schedule"
+func NewJSMessageScheduleInvalidError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMessageScheduleInvalidErr]
+}
+
+// NewJSMessageTTLDisabledError creates a new JSMessageTTLDisabledErr error: "per-message TTL is disabled"
+func NewJSMessageTTLDisabledError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMessageTTLDisabledErr]
+}
+
+// NewJSMessageTTLInvalidError creates a new JSMessageTTLInvalidErr error: "invalid per-message TTL"
+func NewJSMessageTTLInvalidError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSMessageTTLInvalidErr]
+}
+
 // NewJSMirrorConsumerSetupFailedError creates a new JSMirrorConsumerSetupFailedErrF error: "{err}"
 func NewJSMirrorConsumerSetupFailedError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1573,6 +1937,16 @@ func NewJSStreamMaxBytesRequiredError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSStreamMaxBytesRequired]
 }
 
+// NewJSStreamMaxMsgsPerSubjectError creates a new JSStreamMaxMsgsPerSubjectErr error: "maximum messages per subject exceeded"
+func NewJSStreamMaxMsgsPerSubjectError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSStreamMaxMsgsPerSubjectErr]
+}
+
 // NewJSStreamMessageExceedsMaximumError creates a new JSStreamMessageExceedsMaximumErr error: "message size exceeds maximum allowed"
 func NewJSStreamMessageExceedsMaximumError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1649,6 +2023,16 @@ func NewJSStreamNotMatchError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSStreamNotMatchErr]
 }
 
+// NewJSStreamNotMirrorError creates a new JSStreamNotMirrorErr error: "stream is not a mirror"
+func NewJSStreamNotMirrorError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSStreamNotMirrorErr]
+}
+
 // NewJSStreamOfflineError creates a new JSStreamOfflineErr error: "stream is offline"
 func NewJSStreamOfflineError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -0,0 +1,142 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// KeyProvider supplies the master key used to encrypt JetStream file based assets.
+// If configured it is consulted in place of a static key when JetStream is enabled
+// and when the configuration is reloaded.
+type KeyProvider interface {
+	// Key returns the master key. Surrounding whitespace is ignored.
+	Key() (string, error)
+}
+
+// FileKeyProvider reads the key from a file.
+// The file must not be accessible by group or others.
+type FileKeyProvider struct {
+	Path string
+}
+
+// Key returns the contents of the key file.
+func (kp *FileKeyProvider) Key() (string, error) {
+	fi, err := os.Stat(kp.Path)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+		return _EMPTY_, fmt.Errorf("key file %q permissions %#o are too open, must not be accessible by group or others", kp.Path, fi.Mode().Perm())
+	}
+	buf, err := ioutil.ReadFile(kp.Path)
+	if err != nil {
+		return _EMPTY_, err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// EnvKeyProvider reads the key from an environment variable.
+type EnvKeyProvider struct {
+	Name string
+}
+
+// Key returns the value of the environment variable.
+func (kp *EnvKeyProvider) Key() (string, error) {
+	key, ok := os.LookupEnv(kp.Name)
+	if !ok {
+		return _EMPTY_, fmt.Errorf("environment variable %q not set", kp.Name)
+	}
+	return strings.TrimSpace(key), nil
+}
+
+// Default time we will wait for a key helper command.
+const defaultKeyProviderTimeout = 10 * time.Second
+
+// ExecKeyProvider runs a helper command and uses its standard output as the key.
+type ExecKeyProvider struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+// Key runs the helper command and returns its output.
+func (kp *ExecKeyProvider) Key() (string, error) {
+	timeout := kp.Timeout
+	if timeout <= 0 {
+		timeout = defaultKeyProviderTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, kp.Command, kp.Args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return _EMPTY_, fmt.Errorf("key command %q timed out after %v", kp.Command, timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != _EMPTY_ {
+			return _EMPTY_, fmt.Errorf("key command %q failed: %v: %s", kp.Command, err, msg)
+		}
+		return _EMPTY_, fmt.Errorf("key command %q failed: %v", kp.Command, err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// Resolve our JetStream encryption key from the options, consulting the key provider if one
+// is configured. We want to fail here if the provider is not available vs silently starting
+// without encryption.
+func resolveJetStreamKey(opts *Options) (string, error) {
+	kp := opts.JetStreamKeyProvider
+	if kp == nil {
+		return opts.JetStreamKey, nil
+	}
+	key, err := kp.Key()
+	if err != nil {
+		return _EMPTY_, fmt.Errorf("jetstream encryption key provider: %v", err)
+	}
+	if key == _EMPTY_ {
+		return _EMPTY_, fmt.Errorf("jetstream encryption key provider returned an empty key")
+	}
+	return key, nil
+}
+
+// Will resolve and set our JetStream encryption key.
+func (s *Server) setJetStreamKey() error {
+	opts := s.getOpts()
+	key, err := resolveJetStreamKey(opts)
+	if err != nil {
+		return err
+	}
+	s.optsMu.Lock()
+	s.jsKey = key
+	s.optsMu.Unlock()
+	return nil
+}
+
+// Return our resolved JetStream encryption key and our previous one, if configured.
+func (s *Server) jsEncryptionKeys() (string, string) {
+	s.optsMu.RLock()
+	defer s.optsMu.RUnlock()
+	return s.jsKey, s.opts.JetStreamOldKey
+}
@@ -3626,11 +3626,12 @@ func TestJetStreamConsumerRateLimit(t *testing.T) {
 
 	// 100Mbit
 	rateLimit := uint64(100 * 1024 * 1024)
-	// Make sure if you set a rate with a pull based consumer it errors.
-	_, err = mset.addConsumer(&ConsumerConfig{Durable: "to", AckPolicy: AckExplicit, RateLimit: rateLimit})
-	if err == nil {
-		t.Fatalf("Expected an error, got none")
+	// Pull based consumers can have a rate limit as well.
+	po, err := mset.addConsumer(&ConsumerConfig{Durable: "to", AckPolicy: AckExplicit, RateLimit: rateLimit})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
+	po.delete()
 
 	// Now create one and measure the rate delivered.
 	o, err := mset.addConsumer(&ConsumerConfig{
@@ -16817,3 +16818,2854 @@ func TestJetStreamConsumerStreamUpdate(t *testing.T) {
 		test(t, s, 1)
 	})
 }
+
+func TestJetStreamSubjectTransform(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+
+	// Check config errors.
+	for _, cfg := range []*StreamConfig{
+		{Name: "BAD", Subjects: []string{"orders.*.*"}, SubjectTransform: &SubjectTransformConfig{Source: "orders.*.*"}},
+		{Name: "BAD", Subjects: []string{"orders.*.*"}, SubjectTransform: &SubjectTransformConfig{Source: "orders.*.*", Destination: "orders.x"}},
+		{Name: "BAD", Subjects: []string{"orders.*"}, SubjectTransform: &SubjectTransformConfig{Source: "orders.*", Destination: "$JS.API.{{wildcard(1)}}"}},
+		{Name: "BAD", Mirror: &StreamSource{Name: "TEST"}, SubjectTransform: &SubjectTransformConfig{Destination: "foo.>"}},
+		{Name: "BAD", Sources: []*StreamSource{{Name: "TEST", SubjectTransform: &SubjectTransformConfig{Source: "foo", Destination: "bar.*"}}}},
+	} {
+		_, err := acc.addStream(cfg)
+		require_Error(t, err)
+	}
+
+	mset, err := acc.addStream(&StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"orders.*.*", "other"},
+		SubjectTransform: &SubjectTransformConfig{
+			Source:      "orders.*.*",
+			Destination: "orders.{{wildcard(2)}}.{{wildcard(1)}}",
+		},
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err = js.Publish("orders.eu.22", []byte("OK"))
+	require_NoError(t, err)
+	// Does not match the transform source so should be stored as is.
+	_, err = js.Publish("other", []byte("OK"))
+	require_NoError(t, err)
+
+	checkSubj := func(seq uint64, expected string) {
+		t.Helper()
+		sm, err := mset.store.LoadMsg(seq, nil)
+		require_NoError(t, err)
+		require_Equal(t, sm.subj, expected)
+	}
+	checkSubj(1, "orders.22.eu")
+	checkSubj(2, "other")
+
+	// Consumers can filter on the transformed subjects.
+	_, err = mset.addConsumer(&ConsumerConfig{Durable: "dlc", FilterSubject: "orders.22.*", AckPolicy: AckExplicit})
+	require_NoError(t, err)
+
+	// Update the transform.
+	cfg := mset.config()
+	cfg.SubjectTransform = &SubjectTransformConfig{Source: "orders.*.*", Destination: "all.{{partition(3,1,2)}}.orders.{{wildcard(1)}}.{{wildcard(2)}}"}
+	require_NoError(t, mset.update(&cfg))
+
+	_, err = js.Publish("orders.eu.22", []byte("OK"))
+	require_NoError(t, err)
+	sm, err := mset.store.LoadMsg(3, nil)
+	require_NoError(t, err)
+	if !subjectIsSubsetMatch(sm.subj, "all.*.orders.eu.22") {
+		t.Fatalf("Unexpected subject: %q", sm.subj)
+	}
+}
+
+func TestJetStreamSourceSubjectTransform(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+
+	for _, region := range []string{"EU", "US"} {
+		_, err := acc.addStream(&StreamConfig{Name: region, Subjects: []string{fmt.Sprintf("orders.%s.*", strings.ToLower(region))}})
+		require_NoError(t, err)
+	}
+
+	source := func(region string) *StreamSource {
+		return &StreamSource{
+			Name: region,
+			SubjectTransform: &SubjectTransformConfig{
+				Source:      fmt.Sprintf("orders.%s.*", strings.ToLower(region)),
+				Destination: "agg.orders.{{wildcard(1)}}",
+			},
+		}
+	}
+	agg, err := acc.addStream(&StreamConfig{Name: "AGG", Sources: []*StreamSource{source("EU"), source("US")}})
+	require_NoError(t, err)
+
+	mirror, err := acc.addStream(&StreamConfig{
+		Name:   "M",
+		Mirror: &StreamSource{Name: "EU", SubjectTransform: &SubjectTransformConfig{Source: "orders.eu.*", Destination: "eu.{{wildcard(1)}}"}},
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err = js.Publish("orders.eu.1", []byte("OK"))
+	require_NoError(t, err)
+	_, err = js.Publish("orders.us.2", []byte("OK"))
+	require_NoError(t, err)
+
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		if state := agg.state(); state.Msgs != 2 {
+			return fmt.Errorf("Expected 2 msgs, got %d", state.Msgs)
+		}
+		if state := mirror.state(); state.Msgs != 1 {
+			return fmt.Errorf("Expected 1 msg in mirror, got %d", state.Msgs)
+		}
+		return nil
+	})
+
+	var subjs []string
+	for seq := uint64(1); seq <= 2; seq++ {
+		sm, err := agg.store.LoadMsg(seq, nil)
+		require_NoError(t, err)
+		subjs = append(subjs, sm.subj)
+	}
+	sort.Strings(subjs)
+	require_Equal(t, strings.Join(subjs, ","), "agg.orders.1,agg.orders.2")
+
+	sm, err := mirror.store.LoadMsg(1, nil)
+	require_NoError(t, err)
+	require_Equal(t, sm.subj, "eu.1")
+
+	// Filtering on the transformed subjects should be allowed.
+	_, err = agg.addConsumer(&ConsumerConfig{Durable: "dlc", FilterSubject: "agg.orders.1", AckPolicy: AckExplicit})
+	require_NoError(t, err)
+}
+
+func TestJetStreamRePublish(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+
+	// Check for cycles and bad destinations.
+	for _, rp := range []*RePublish{
+		{Source: "foo"},
+		{Source: ">", Destination: "bar.>"},
+		{Source: "foo", Destination: "$JS.API.foo"},
+		{Source: "bar.*", Destination: "rp.bar"},
+	} {
+		_, err := acc.addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar.*"}, RePublish: rp})
+		require_Error(t, err)
+	}
+
+	mset, err := acc.addStream(&StreamConfig{
+		Name:      "TEST",
+		Subjects:  []string{"foo", "bar.*"},
+		RePublish: &RePublish{Source: ">", Destination: "rp.>"},
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync("rp.>")
+	require_NoError(t, err)
+
+	_, err = js.Publish("foo", []byte("HELLO"))
+	require_NoError(t, err)
+	_, err = js.Publish("bar.22", []byte("WORLD"))
+	require_NoError(t, err)
+	m := nats.NewMsg("foo")
+	m.Header.Set("X-Custom", "ok")
+	m.Data = []byte("AGAIN")
+	_, err = js.PublishMsg(m)
+	require_NoError(t, err)
+
+	checkMsg := func(subj, data string, seq, lseq uint64) *nats.Msg {
+		t.Helper()
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		require_Equal(t, m.Subject, "rp."+subj)
+		require_Equal(t, string(m.Data), data)
+		require_Equal(t, m.Header.Get(JSStream), "TEST")
+		require_Equal(t, m.Header.Get(JSSubject), subj)
+		require_Equal(t, m.Header.Get(JSSequence), strconv.FormatUint(seq, 10))
+		require_Equal(t, m.Header.Get(JSLastSequence), strconv.FormatUint(lseq, 10))
+		if m.Header.Get(JSTimeStamp) == _EMPTY_ {
+			t.Fatalf("Expected a timestamp header")
+		}
+		return m
+	}
+	checkMsg("foo", "HELLO", 1, 0)
+	checkMsg("bar.22", "WORLD", 2, 0)
+	m = checkMsg("foo", "AGAIN", 3, 1)
+	require_Equal(t, m.Header.Get("X-Custom"), "ok")
+
+	// Now update to only republish headers for the bar subjects.
+	cfg := mset.config()
+	cfg.RePublish = &RePublish{Source: "bar.*", Destination: "rp.hdrs.{{wildcard(1)}}", HeadersOnly: true}
+	require_NoError(t, mset.update(&cfg))
+
+	_, err = js.Publish("foo", []byte("SKIP"))
+	require_NoError(t, err)
+	_, err = js.Publish("bar.22", []byte("HDRS"))
+	require_NoError(t, err)
+
+	m, err = sub.NextMsg(time.Second)
+	require_NoError(t, err)
+	require_Equal(t, m.Subject, "rp.hdrs.22")
+	require_Len(t, len(m.Data), 0)
+	require_Equal(t, m.Header.Get(JSSequence), "5")
+	require_Equal(t, m.Header.Get(JSLastSequence), "2")
+	require_Equal(t, m.Header.Get(JSMsgSize), "4")
+
+	if m, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Fatalf("Did not expect another msg, got %q", m.Subject)
+	}
+}
+
+func TestJetStreamDirectGet(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+	_, err := acc.addStream(&StreamConfig{
+		Name:        "TEST",
+		Subjects:    []string{"foo", "bar"},
+		Storage:     MemoryStorage,
+		AllowDirect: true,
+	})
+	require_NoError(t, err)
+
+	for _, subj := range []string{"foo", "bar", "foo"} {
+		msg := nats.NewMsg(subj)
+		msg.Header.Set("X-Test", "OK")
+		msg.Data = []byte("HELLO " + subj)
+		_, err := js.PublishMsg(msg)
+		require_NoError(t, err)
+	}
+
+	getSubj := fmt.Sprintf(JSDirectMsgGetT, "TEST")
+	get := func(req string) *nats.Msg {
+		t.Helper()
+		m, err := nc.Request(getSubj, []byte(req), time.Second)
+		require_NoError(t, err)
+		return m
+	}
+
+	m := get(`{"seq":2}`)
+	require_Equal(t, string(m.Data), "HELLO bar")
+	require_Equal(t, m.Header.Get(JSStream), "TEST")
+	require_Equal(t, m.Header.Get(JSSubject), "bar")
+	require_Equal(t, m.Header.Get(JSSequence), "2")
+	require_Equal(t, m.Header.Get("X-Test"), "OK")
+	if m.Header.Get(JSTimeStamp) == _EMPTY_ {
+		t.Fatalf("Expected a timestamp header")
+	}
+
+	m = get(`{"last_by_subj":"foo"}`)
+	require_Equal(t, string(m.Data), "HELLO foo")
+	require_Equal(t, m.Header.Get(JSSequence), "3")
+
+	m = get(`{"seq":22}`)
+	require_Len(t, len(m.Data), 0)
+	require_Equal(t, m.Header.Get("Status"), "404")
+
+	m = get(`{"seq":1,"last_by_subj":"foo"}`)
+	require_Equal(t, m.Header.Get("Status"), "408")
+
+	// Mirrors can answer for the stream they mirror.
+	_, err = acc.addStream(&StreamConfig{
+		Name:         "M",
+		Storage:      MemoryStorage,
+		Mirror:       &StreamSource{Name: "TEST"},
+		MirrorDirect: true,
+	})
+	require_NoError(t, err)
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		mset, err := acc.lookupStream("M")
+		require_NoError(t, err)
+		if state := mset.state(); state.Msgs != 3 {
+			return fmt.Errorf("Expected 3 msgs, got %d", state.Msgs)
+		}
+		return nil
+	})
+
+	// Once we turn off direct gets for the origin only the mirror answers.
+	mset, err := acc.lookupStream("TEST")
+	require_NoError(t, err)
+	cfg := mset.config()
+	cfg.AllowDirect = false
+	require_NoError(t, mset.update(&cfg))
+
+	m = get(`{"seq":1}`)
+	require_Equal(t, string(m.Data), "HELLO foo")
+	require_Equal(t, m.Header.Get(JSStream), "M")
+
+	// Mirror direct requires a mirror.
+	_, err = acc.addStream(&StreamConfig{Name: "BAD", Subjects: []string{"baz"}, MirrorDirect: true})
+	require_Error(t, err)
+}
+
+func TestJetStreamMessageTTL(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+	mset, err := acc.addStream(&StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Storage:  FileStorage,
+	})
+	require_NoError(t, err)
+
+	pubTTL := func(ttl string) error {
+		t.Helper()
+		msg := nats.NewMsg("foo")
+		msg.Header.Set(JSMessageTTL, ttl)
+		msg.Data = []byte("OK")
+		_, err := js.PublishMsg(msg)
+		return err
+	}
+
+	// Not enabled by default.
+	err = pubTTL("1s")
+	require_Error(t, err)
+	if !strings.Contains(err.Error(), NewJSMessageTTLDisabledError().Description) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cfg := mset.config()
+	cfg.AllowMsgTTL = true
+	require_NoError(t, mset.update(&cfg))
+
+	err = pubTTL("bad")
+	require_Error(t, err)
+	if !strings.Contains(err.Error(), NewJSMessageTTLInvalidError().Description) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	require_NoError(t, pubTTL("100ms"))
+	_, err = js.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := mset.state(); state.Msgs != 1 || state.FirstSeq != 2 {
+			return fmt.Errorf("Expected only msg 2 to remain, got %+v", state)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamAtomicBatchPublish(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, _ := jsClientConnect(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+	mset, err := acc.addStream(&StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo.*"},
+		Storage:  FileStorage,
+	})
+	require_NoError(t, err)
+
+	batchMsg := func(id string, seq int, commit bool, hdrs ...string) *nats.Msg {
+		m := nats.NewMsg(fmt.Sprintf("foo.%d", seq))
+		m.Header.Set(JSBatchId, id)
+		m.Header.Set(JSBatchSeq, strconv.Itoa(seq))
+		if commit {
+			m.Header.Set(JSBatchCommit, "1")
+		}
+		for i := 0; i+1 < len(hdrs); i += 2 {
+			m.Header.Set(hdrs[i], hdrs[i+1])
+		}
+		m.Data = []byte("OK")
+		return m
+	}
+	commit := func(m *nats.Msg) *JSPubAckResponse {
+		t.Helper()
+		rmsg, err := nc.RequestMsg(m, time.Second)
+		require_NoError(t, err)
+		var resp JSPubAckResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+	expectErr := func(resp *JSPubAckResponse, code ErrorIdentifier) {
+		t.Helper()
+		if resp.Error == nil || resp.Error.ErrCode != ApiErrors[code].ErrCode {
+			t.Fatalf("Expected error %d, got %+v", ApiErrors[code].ErrCode, resp.Error)
+		}
+	}
+	expectMsgs := func(n uint64) {
+		t.Helper()
+		if state := mset.state(); state.Msgs != n {
+			t.Fatalf("Expected %d msgs, got %d", n, state.Msgs)
+		}
+	}
+
+	// Not enabled by default.
+	expectErr(commit(batchMsg("A", 1, true)), JSAtomicPublishDisabledErr)
+	expectMsgs(0)
+
+	cfg := mset.config()
+	cfg.AllowAtomicPublish = true
+	require_NoError(t, mset.update(&cfg))
+
+	// Only the commit should receive an ack.
+	require_NoError(t, nc.PublishMsg(batchMsg("A", 1, false)))
+	require_NoError(t, nc.PublishMsg(batchMsg("A", 2, false)))
+	expectMsgs(0)
+	resp := commit(batchMsg("A", 3, true))
+	if resp.Error != nil || resp.PubAck.Sequence != 3 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	expectMsgs(3)
+
+	// Gaps will fail the batch.
+	require_NoError(t, nc.PublishMsg(batchMsg("B", 1, false)))
+	expectErr(commit(batchMsg("B", 3, true)), JSAtomicPublishIncompleteBatchErr)
+	expectMsgs(3)
+
+	// Failed expectations on the first message mean nothing is stored.
+	require_NoError(t, nc.PublishMsg(batchMsg("C", 1, false, JSExpectedLastSeq, "2")))
+	require_NoError(t, nc.PublishMsg(batchMsg("C", 2, false)))
+	expectErr(commit(batchMsg("C", 3, true)), JSStreamWrongLastSequenceErrF)
+	expectMsgs(3)
+
+	// Expectations are only allowed on the first message.
+	require_NoError(t, nc.PublishMsg(batchMsg("D", 1, false)))
+	expectErr(commit(batchMsg("D", 2, true, JSExpectedLastSeq, "3")), JSAtomicPublishUnsupportedHeaderBatchErrF)
+	expectMsgs(3)
+
+	// Duplicate message ids.
+	require_NoError(t, nc.PublishMsg(batchMsg("E", 1, false, JSMsgId, "1")))
+	expectErr(commit(batchMsg("E", 2, true, JSMsgId, "1")), JSAtomicPublishDuplicateMsgIdErr)
+	expectMsgs(3)
+
+	// Discard new limits apply to the whole batch.
+	cfg.MaxMsgs, cfg.Discard = 5, DiscardNew
+	require_NoError(t, mset.update(&cfg))
+	for i := 1; i <= 2; i++ {
+		require_NoError(t, nc.PublishMsg(batchMsg("F", i, false)))
+	}
+	expectErr(commit(batchMsg("F", 3, true)), JSStreamStoreFailedF)
+	expectMsgs(3)
+
+	resp = commit(batchMsg("G", 1, true, JSExpectedLastSeq, "3"))
+	if resp.Error != nil || resp.PubAck.Sequence != 4 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	expectMsgs(4)
+
+	// A batch that fails part way through storing should be removed.
+	// Our check of max bytes does not account for the store overhead, so
+	// leave enough room for the payloads but not for the stored messages.
+	hdrLen := func(m *nats.Msg) int {
+		n := len("NATS/1.0\r\n\r\n")
+		for k, v := range m.Header {
+			n += len(k) + len(": \r\n") + len(v[0])
+		}
+		return n
+	}
+	hmsgs := []*nats.Msg{batchMsg("H", 1, false), batchMsg("H", 2, false), batchMsg("H", 3, true)}
+	room := 0
+	for _, m := range hmsgs {
+		room += hdrLen(m) + len(m.Data)
+	}
+	cfg.MaxMsgs, cfg.MaxBytes = -1, int64(mset.state().Bytes)+int64(room)
+	require_NoError(t, mset.update(&cfg))
+	require_NoError(t, nc.PublishMsg(hmsgs[0]))
+	require_NoError(t, nc.PublishMsg(hmsgs[1]))
+	expectErr(commit(hmsgs[2]), JSStreamStoreFailedF)
+	expectMsgs(4)
+	if state := mset.state(); state.LastSeq != 6 {
+		t.Fatalf("Expected last sequence of 6, got %d", state.LastSeq)
+	}
+
+	// Batches are limited in size as well.
+	big := make([]byte, streamMaxBatchBytes/8-1024)
+	for i := 1; i <= 8; i++ {
+		m := batchMsg("I", i, false)
+		m.Data = big
+		require_NoError(t, nc.PublishMsg(m))
+	}
+	m := batchMsg("I", 9, true)
+	m.Data = big
+	expectErr(commit(m), JSAtomicPublishTooManyBytesErrF)
+	expectMsgs(4)
+	mset.mu.RLock()
+	staged := mset.batchBytes
+	mset.mu.RUnlock()
+	if staged != 0 {
+		t.Fatalf("Expected no staged bytes, got %d", staged)
+	}
+}
+
+func TestJetStreamStreamCompression(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+
+	// Only supported for file storage.
+	_, err := acc.addStream(&StreamConfig{
+		Name:        "MEM",
+		Storage:     MemoryStorage,
+		Compression: S2Compression,
+	})
+	require_Error(t, err)
+
+	// Keep the blocks small so we seal a few.
+	_, err = acc.addStream(&StreamConfig{
+		Name:        "TEST",
+		Subjects:    []string{"foo"},
+		Storage:     FileStorage,
+		MaxBytes:    128 * 1024,
+		Compression: S2Compression,
+	})
+	require_NoError(t, err)
+
+	msg := bytes.Repeat([]byte("Z"), 1024)
+	for i := 0; i < 80; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), nil, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamInfoResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		if resp.StreamInfo == nil {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		if resp.Config.Compression != S2Compression {
+			t.Fatalf("Expected compression to be set in config, got %v", resp.Config.Compression)
+		}
+		ci := resp.Compression
+		if ci == nil || ci.Algorithm != S2Compression {
+			return fmt.Errorf("Expected compression info, got %+v", ci)
+		}
+		if ci.RawBytes < resp.State.Bytes || ci.CompressedBytes >= ci.RawBytes {
+			return fmt.Errorf("Unexpected compression info: %+v", ci)
+		}
+		return nil
+	})
+
+	// Messages should be readable from compressed blocks.
+	sub, err := js.SubscribeSync("foo")
+	require_NoError(t, err)
+	for i := 0; i < 80; i++ {
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		if !bytes.Equal(m.Data, msg) {
+			t.Fatalf("Unexpected message data")
+		}
+	}
+}
+
+func TestJetStreamMessageSchedules(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+	mset, err := acc.addStream(&StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Storage:  FileStorage,
+	})
+	require_NoError(t, err)
+
+	pubSchedule := func(hdr, value, data string) error {
+		t.Helper()
+		msg := nats.NewMsg("foo")
+		msg.Header.Set(hdr, value)
+		msg.Data = []byte(data)
+		_, err := js.PublishMsg(msg)
+		return err
+	}
+
+	// Not enabled by default.
+	err = pubSchedule(JSScheduleDelay, "1s", "A")
+	require_Error(t, err)
+	if !strings.Contains(err.Error(), NewJSMessageScheduleDisabledError().Description) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	cfg := mset.config()
+	cfg.AllowMsgSchedules = true
+	require_NoError(t, mset.update(&cfg))
+
+	err = pubSchedule(JSScheduleAt, "tomorrow", "A")
+	require_Error(t, err)
+	if !strings.Contains(err.Error(), NewJSMessageScheduleInvalidError().Description) {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	start := time.Now()
+	require_NoError(t, pubSchedule(JSScheduleDelay, "2s", "A"))
+	require_NoError(t, pubSchedule(JSScheduleAt, start.Add(500*time.Millisecond).Format(time.RFC3339Nano), "B"))
+	_, err = js.Publish("foo", []byte("C"))
+	require_NoError(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+
+	fetch := func(expected string, wait time.Duration) {
+		t.Helper()
+		msgs, err := sub.Fetch(1, nats.MaxWait(wait))
+		require_NoError(t, err)
+		if data := string(msgs[0].Data); data != expected {
+			t.Fatalf("Expected %q, got %q", expected, data)
+		}
+		msgs[0].Ack()
+	}
+
+	// The unscheduled message should be delivered first.
+	fetch("C", time.Second)
+	fetch("B", 2*time.Second)
+	if time.Since(start) < 500*time.Millisecond {
+		t.Fatalf("Scheduled message was delivered early")
+	}
+
+	// Our ack floor should not move past the message we are holding back.
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+	checkFor(t, time.Second, 20*time.Millisecond, func() error {
+		if info := o.info(); info.AckFloor.Stream != 0 || info.NumAckPending != 0 {
+			return fmt.Errorf("Unexpected ack floor or pending: %+v %d", info.AckFloor, info.NumAckPending)
+		}
+		return nil
+	})
+
+	// Make sure we pick the held back message back up after a restart.
+	nc.Close()
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err = js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+
+	fetch("A", 3*time.Second)
+	if time.Since(start) < 2*time.Second {
+		t.Fatalf("Scheduled message was delivered early")
+	}
+}
+
+func TestJetStreamDiscardNewPerSubject(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+
+	// Requires the discard new policy and a per subject limit.
+	_, err := acc.addStream(&StreamConfig{
+		Name:          "TEST",
+		Subjects:      []string{"kv.>"},
+		Storage:       FileStorage,
+		MaxMsgsPer:    1,
+		DiscardNewPer: true,
+	})
+	require_Error(t, err)
+	_, err = acc.addStream(&StreamConfig{
+		Name:          "TEST",
+		Subjects:      []string{"kv.>"},
+		Storage:       FileStorage,
+		Discard:       DiscardNew,
+		DiscardNewPer: true,
+	})
+	require_Error(t, err)
+
+	mset, err := acc.addStream(&StreamConfig{
+		Name:          "TEST",
+		Subjects:      []string{"kv.>"},
+		Storage:       FileStorage,
+		MaxMsgsPer:    1,
+		Discard:       DiscardNew,
+		DiscardNewPer: true,
+	})
+	require_NoError(t, err)
+
+	_, err = js.Publish("kv.a", []byte("1"))
+	require_NoError(t, err)
+	_, err = js.Publish("kv.b", []byte("1"))
+	require_NoError(t, err)
+
+	// A second write to the same key should be rejected.
+	rmsg, err := nc.Request("kv.a", []byte("2"), time.Second)
+	require_NoError(t, err)
+	var resp JSPubAckResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error == nil || resp.Error.ErrCode != ApiErrors[JSStreamMaxMsgsPerSubjectErr].ErrCode {
+		t.Fatalf("Expected max msgs per subject error, got %+v", resp.Error)
+	}
+
+	// The original should remain.
+	if state := mset.state(); state.Msgs != 2 || state.LastSeq != 2 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	var smv StoreMsg
+	sm, err := mset.store.LoadLastMsg("kv.a", &smv)
+	require_NoError(t, err)
+	if string(sm.msg) != "1" {
+		t.Fatalf("Expected original value, got %q", sm.msg)
+	}
+}
+
+func TestJetStreamStreamAndConsumerMetadata(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc := clientConnectToServer(t, s)
+	defer nc.Close()
+
+	addStream := func(api string, cfg *StreamConfig) *JSApiStreamCreateResponse {
+		t.Helper()
+		req, err := json.Marshal(cfg)
+		require_NoError(t, err)
+		rmsg, err := nc.Request(fmt.Sprintf(api, cfg.Name), req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamCreateResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+	listStreams := func(md map[string]string) []string {
+		t.Helper()
+		req, err := json.Marshal(&JSApiStreamListRequest{Metadata: md})
+		require_NoError(t, err)
+		rmsg, err := nc.Request(JSApiStreamList, req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamListResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		if resp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", resp.Error)
+		}
+		var names []string
+		for _, si := range resp.Streams {
+			names = append(names, si.Config.Name)
+		}
+		return names
+	}
+
+	for _, cfg := range []*StreamConfig{
+		{Name: "A", Storage: FileStorage, Metadata: map[string]string{"team": "core", "schema": "1"}},
+		{Name: "B", Storage: FileStorage, Metadata: map[string]string{"team": "core", "schema": "2"}},
+		{Name: "C", Storage: FileStorage, Metadata: map[string]string{"team": "edge"}},
+		{Name: "D", Storage: FileStorage},
+	} {
+		if resp := addStream(JSApiStreamCreateT, cfg); resp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", resp.Error)
+		}
+	}
+
+	// Metadata that is too large should be rejected.
+	big := &StreamConfig{Name: "BIG", Storage: FileStorage, Metadata: map[string]string{"k": strings.Repeat("x", JSMaxMetadataLen)}}
+	if resp := addStream(JSApiStreamCreateT, big); resp.Error == nil {
+		t.Fatalf("Expected an error for oversized metadata")
+	}
+
+	if names := listStreams(nil); len(names) != 4 {
+		t.Fatalf("Expected 4 streams, got %v", names)
+	}
+	if names := listStreams(map[string]string{"team": "core"}); !reflect.DeepEqual(names, []string{"A", "B"}) {
+		t.Fatalf("Unexpected streams: %v", names)
+	}
+	if names := listStreams(map[string]string{"team": "core", "schema": "2"}); !reflect.DeepEqual(names, []string{"B"}) {
+		t.Fatalf("Unexpected streams: %v", names)
+	}
+	if names := listStreams(map[string]string{"team": "none"}); len(names) != 0 {
+		t.Fatalf("Expected no streams, got %v", names)
+	}
+
+	// Metadata can be updated in place.
+	resp := addStream(JSApiStreamUpdateT, &StreamConfig{Name: "D", Storage: FileStorage, Metadata: map[string]string{"team": "edge"}})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	if !reflect.DeepEqual(resp.Config.Metadata, map[string]string{"team": "edge"}) {
+		t.Fatalf("Unexpected metadata: %+v", resp.Config.Metadata)
+	}
+	if names := listStreams(map[string]string{"team": "edge"}); !reflect.DeepEqual(names, []string{"C", "D"}) {
+		t.Fatalf("Unexpected streams: %v", names)
+	}
+
+	addConsumer := func(cfg ConsumerConfig) *JSApiConsumerCreateResponse {
+		t.Helper()
+		req, err := json.Marshal(&CreateConsumerRequest{Stream: "A", Config: cfg})
+		require_NoError(t, err)
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiDurableCreateT, "A", cfg.Durable), req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerCreateResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+
+	ccfg := ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit, Metadata: map[string]string{"owner": "derek"}}
+	cresp := addConsumer(ccfg)
+	if cresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", cresp.Error)
+	}
+	if !reflect.DeepEqual(cresp.Config.Metadata, ccfg.Metadata) {
+		t.Fatalf("Unexpected metadata: %+v", cresp.Config.Metadata)
+	}
+
+	ccfg.Metadata = map[string]string{"owner": "ivan", "cost_center": "42"}
+	if cresp = addConsumer(ccfg); cresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", cresp.Error)
+	}
+
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiConsumerInfoT, "A", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	var iresp JSApiConsumerInfoResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &iresp))
+	if iresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", iresp.Error)
+	}
+	if !reflect.DeepEqual(iresp.Config.Metadata, ccfg.Metadata) {
+		t.Fatalf("Unexpected metadata: %+v", iresp.Config.Metadata)
+	}
+
+	ccfg.Metadata = map[string]string{"k": strings.Repeat("x", JSMaxMetadataLen)}
+	cresp = addConsumer(ccfg)
+	if cresp.Error == nil || cresp.Error.ErrCode != ApiErrors[JSConsumerMetadataLengthErrF].ErrCode {
+		t.Fatalf("Expected metadata length error, got %+v", cresp.Error)
+	}
+
+	// Make sure metadata survives a restart.
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().lookupStream("A")
+	require_NoError(t, err)
+	if md := mset.config().Metadata; md["schema"] != "1" {
+		t.Fatalf("Unexpected metadata after restart: %+v", md)
+	}
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+	if md := o.config().Metadata; md["cost_center"] != "42" {
+		t.Fatalf("Unexpected metadata after restart: %+v", md)
+	}
+}
+
+func TestJetStreamMirrorPromote(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "ORIGINAL", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "MIRROR", Mirror: &nats.StreamSource{Name: "ORIGINAL"}})
+	require_NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		js.Publish("foo", []byte("OK"))
+	}
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		si, err := js.StreamInfo("MIRROR")
+		require_NoError(t, err)
+		if si.State.LastSeq != 10 {
+			return fmt.Errorf("Expected last seq of 10, got %d", si.State.LastSeq)
+		}
+		return nil
+	})
+
+	promote := func(stream string, req *JSApiStreamPromoteRequest) *JSApiStreamPromoteResponse {
+		t.Helper()
+		var data []byte
+		if req != nil {
+			data, err = json.Marshal(req)
+			require_NoError(t, err)
+		}
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamPromoteT, stream), data, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamPromoteResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+
+	// Can only promote mirrors.
+	resp := promote("ORIGINAL", nil)
+	if resp.Error == nil || resp.Error.ErrCode != ApiErrors[JSStreamNotMirrorErr].ErrCode {
+		t.Fatalf("Expected not a mirror error, got %+v", resp.Error)
+	}
+	// A plain update can not remove the mirror.
+	ureq, err := json.Marshal(&StreamConfig{Name: "MIRROR", Subjects: []string{"bar"}, Storage: FileStorage})
+	require_NoError(t, err)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamUpdateT, "MIRROR"), ureq, time.Second)
+	require_NoError(t, err)
+	var uresp JSApiStreamUpdateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &uresp))
+	if uresp.Error == nil || uresp.Error.ErrCode != ApiErrors[JSStreamMirrorNotUpdatableErr].ErrCode {
+		t.Fatalf("Expected mirror not updatable error, got %+v", uresp.Error)
+	}
+	// Subjects can not overlap with other streams.
+	resp = promote("MIRROR", &JSApiStreamPromoteRequest{Subjects: []string{"foo"}})
+	if resp.Error == nil || resp.Error.ErrCode != ApiErrors[JSStreamSubjectOverlapErr].ErrCode {
+		t.Fatalf("Expected subject overlap error, got %+v", resp.Error)
+	}
+
+	resp = promote("MIRROR", &JSApiStreamPromoteRequest{Subjects: []string{"bar"}})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	if resp.Type != JSApiStreamPromoteResponseType {
+		t.Fatalf("Unexpected response type: %q", resp.Type)
+	}
+	if resp.Config.Mirror != nil || !reflect.DeepEqual(resp.Config.Subjects, []string{"bar"}) {
+		t.Fatalf("Unexpected config: %+v", resp.Config)
+	}
+	if state := resp.State; state.Msgs != 10 || state.FirstSeq != 1 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+
+	// Messages to the original should no longer be mirrored.
+	js.Publish("foo", []byte("OK"))
+	// New messages are accepted and continue the sequence.
+	pa, err := js.Publish("bar", []byte("NEW"))
+	require_NoError(t, err)
+	if pa.Stream != "MIRROR" || pa.Sequence != 11 {
+		t.Fatalf("Unexpected pub ack: %+v", pa)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	si, err := js.StreamInfo("MIRROR")
+	require_NoError(t, err)
+	if si.State.Msgs != 11 || si.State.LastSeq != 11 {
+		t.Fatalf("Unexpected state: %+v", si.State)
+	}
+	if si.Mirror != nil {
+		t.Fatalf("Expected no mirror info, got %+v", si.Mirror)
+	}
+
+	// Can not promote twice.
+	resp = promote("MIRROR", nil)
+	if resp.Error == nil || resp.Error.ErrCode != ApiErrors[JSStreamNotMirrorErr].ErrCode {
+		t.Fatalf("Expected not a mirror error, got %+v", resp.Error)
+	}
+}
+
+func TestJetStreamConsumerMultipleFilterSubjects(t *testing.T) {
+	cases := []struct {
+		name    string
+		mconfig *StreamConfig
+	}{
+		{"MemoryStore", &StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}, Storage: MemoryStorage}},
+		{"FileStore", &StreamConfig{Name: "ORDERS", Subjects: []string{"orders.>"}, Storage: FileStorage}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := RunBasicJetStreamServer()
+			if config := s.JetStreamConfig(); config != nil {
+				defer removeDir(t, config.StoreDir)
+			}
+			defer s.Shutdown()
+
+			mset, err := s.GlobalAccount().addStream(c.mconfig)
+			require_NoError(t, err)
+			defer mset.delete()
+
+			nc, js := jsClientConnect(t, s)
+			defer nc.Close()
+
+			for i := 0; i < 3; i++ {
+				js.Publish("orders.created", []byte("C"))
+				js.Publish("orders.updated", []byte("U"))
+				js.Publish("orders.cancelled", []byte("X"))
+			}
+
+			// Can not combine with a single filter and must be within the stream.
+			_, err = mset.addConsumer(&ConsumerConfig{
+				Durable:        "bad",
+				AckPolicy:      AckExplicit,
+				FilterSubject:  "orders.created",
+				FilterSubjects: []string{"orders.cancelled"},
+			})
+			require_Error(t, err, NewJSConsumerMultipleFiltersNotAllowedError())
+			_, err = mset.addConsumer(&ConsumerConfig{
+				Durable:        "bad",
+				AckPolicy:      AckExplicit,
+				FilterSubjects: []string{"orders.created", "foo"},
+			})
+			require_Error(t, err, NewJSConsumerFilterNotSubsetError())
+
+			o, err := mset.addConsumer(&ConsumerConfig{
+				Durable:        "dlc",
+				AckPolicy:      AckExplicit,
+				FilterSubjects: []string{"orders.created", "orders.cancelled"},
+			})
+			require_NoError(t, err)
+			defer o.delete()
+
+			if ci := o.info(); ci.NumPending != 6 {
+				t.Fatalf("Expected 6 pending, got %d", ci.NumPending)
+			}
+
+			rsubj := fmt.Sprintf(JSApiRequestNextT, "ORDERS", "dlc")
+			for _, expected := range []string{"C", "X", "C", "X", "C", "X"} {
+				m, err := nc.Request(rsubj, nil, time.Second)
+				require_NoError(t, err)
+				if string(m.Data) != expected {
+					t.Fatalf("Expected %q, got %q on %q", expected, m.Data, m.Subject)
+				}
+				m.Respond(nil)
+			}
+			if ci := o.info(); ci.NumPending != 0 {
+				t.Fatalf("Expected no pending, got %d", ci.NumPending)
+			}
+
+			// New messages should be accounted for as well.
+			js.Publish("orders.updated", []byte("U"))
+			js.Publish("orders.created", []byte("C"))
+			checkFor(t, time.Second, 15*time.Millisecond, func() error {
+				if ci := o.info(); ci.NumPending != 1 {
+					return fmt.Errorf("Expected 1 pending, got %d", ci.NumPending)
+				}
+				return nil
+			})
+
+			// Overlapping filters should not count messages twice.
+			o2, err := mset.addConsumer(&ConsumerConfig{
+				Durable:        "ivan",
+				AckPolicy:      AckExplicit,
+				FilterSubjects: []string{"orders.*", "orders.created", "orders.created"},
+			})
+			require_NoError(t, err)
+			defer o2.delete()
+			if ci := o2.info(); ci.NumPending != 11 {
+				t.Fatalf("Expected 11 pending, got %d", ci.NumPending)
+			}
+
+			// Deliver last per subject across all filters.
+			o3, err := mset.addConsumer(&ConsumerConfig{
+				Durable:        "last",
+				AckPolicy:      AckExplicit,
+				DeliverPolicy:  DeliverLastPerSubject,
+				FilterSubjects: []string{"orders.created", "orders.cancelled"},
+			})
+			require_NoError(t, err)
+			defer o3.delete()
+			if ci := o3.info(); ci.NumPending != 2 {
+				t.Fatalf("Expected 2 pending, got %d", ci.NumPending)
+			}
+			rsubj = fmt.Sprintf(JSApiRequestNextT, "ORDERS", "last")
+			for _, expected := range []string{"orders.cancelled", "orders.created"} {
+				m, err := nc.Request(rsubj, nil, time.Second)
+				require_NoError(t, err)
+				if m.Subject != expected {
+					t.Fatalf("Expected %q, got %q", expected, m.Subject)
+				}
+			}
+
+			// Partially overlapping filters should not count or deliver messages twice.
+			js.Publish("orders.created.eu", []byte("CE"))
+			js.Publish("orders.created.us", []byte("CU"))
+			js.Publish("orders.updated.eu", []byte("UE"))
+			js.Publish("orders.updated.us", []byte("UU"))
+			o4, err := mset.addConsumer(&ConsumerConfig{
+				Durable:        "region",
+				AckPolicy:      AckExplicit,
+				FilterSubjects: []string{"orders.*.eu", "orders.created.*"},
+			})
+			require_NoError(t, err)
+			defer o4.delete()
+			if ci := o4.info(); ci.NumPending != 3 {
+				t.Fatalf("Expected 3 pending, got %d", ci.NumPending)
+			}
+			rsubj = fmt.Sprintf(JSApiRequestNextT, "ORDERS", "region")
+			for _, expected := range []string{"CE", "CU", "UE"} {
+				m, err := nc.Request(rsubj, nil, time.Second)
+				require_NoError(t, err)
+				if string(m.Data) != expected {
+					t.Fatalf("Expected %q, got %q on %q", expected, m.Data, m.Subject)
+				}
+				m.Respond(nil)
+			}
+			if ci := o4.info(); ci.NumPending != 0 {
+				t.Fatalf("Expected no pending, got %d", ci.NumPending)
+			}
+			// Removed messages should be skipped.
+			js.Publish("orders.updated.eu", []byte("UE"))
+			js.Publish("orders.created.us", []byte("CU"))
+			sm, err := mset.store.LoadLastMsg("orders.updated.eu", nil)
+			require_NoError(t, err)
+			require_NoError(t, js.DeleteMsg("ORDERS", sm.seq))
+			m, err := nc.Request(rsubj, nil, time.Second)
+			require_NoError(t, err)
+			if string(m.Data) != "CU" {
+				t.Fatalf("Expected %q, got %q on %q", "CU", m.Data, m.Subject)
+			}
+
+			// Filters can not be updated.
+			_, err = mset.addConsumer(&ConsumerConfig{
+				Durable:        "dlc",
+				AckPolicy:      AckExplicit,
+				FilterSubjects: []string{"orders.created"},
+			})
+			require_Error(t, err)
+		})
+	}
+}
+
+func TestJetStreamConsumerPause(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		js.Publish("foo", []byte("OK"))
+	}
+
+	asub, err := nc.SubscribeSync(JSAdvisoryConsumerPausePre + ".TEST.dlc")
+	require_NoError(t, err)
+
+	pause := func(until time.Time) *JSApiConsumerPauseResponse {
+		t.Helper()
+		var data []byte
+		if !until.IsZero() {
+			data, err = json.Marshal(&JSApiConsumerPauseRequest{PauseUntil: until})
+			require_NoError(t, err)
+		}
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", "dlc"), data, time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerPauseResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		if resp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", resp.Error)
+		}
+		return &resp
+	}
+	checkAdvisory := func(paused bool) {
+		t.Helper()
+		m, err := asub.NextMsg(2 * time.Second)
+		require_NoError(t, err)
+		var adv JSConsumerPauseAdvisory
+		require_NoError(t, json.Unmarshal(m.Data, &adv))
+		if adv.Type != JSConsumerPauseAdvisoryType || adv.Paused != paused {
+			t.Fatalf("Unexpected advisory: %+v", adv)
+		}
+	}
+
+	// Deliver one and leave it pending.
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc")
+	_, err = nc.Request(rsubj, nil, time.Second)
+	require_NoError(t, err)
+
+	// Unknown consumers should error.
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiConsumerPauseT, "TEST", "bogus"), nil, time.Second)
+	require_NoError(t, err)
+	var eresp JSApiConsumerPauseResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &eresp))
+	if eresp.Error == nil || eresp.Error.ErrCode != ApiErrors[JSConsumerNotFoundErr].ErrCode {
+		t.Fatalf("Expected consumer not found error, got %+v", eresp.Error)
+	}
+
+	resp := pause(time.Now().Add(time.Hour))
+	if !resp.Paused || resp.PauseRemaining <= 0 {
+		t.Fatalf("Expected to be paused, got %+v", resp)
+	}
+	checkAdvisory(true)
+
+	// No messages should be delivered while paused, the request should just expire.
+	m, err := nc.Request(rsubj, []byte(`{"batch":1,"expires":250000000}`), time.Second)
+	require_NoError(t, err)
+	if len(m.Data) > 0 || m.Header.Get("Status") != "408" {
+		t.Fatalf("Expected the request to expire while paused, got %q %+v", m.Data, m.Header)
+	}
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	if ci.NumAckPending != 1 || ci.NumPending != 4 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+	if info := o.info(); !info.Paused || info.PauseRemaining <= 0 {
+		t.Fatalf("Expected paused info, got %+v", info)
+	}
+
+	// Pause should survive a restart.
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc, _ = jsClientConnect(t, s)
+	defer nc.Close()
+	asub, err = nc.SubscribeSync(JSAdvisoryConsumerPausePre + ".TEST.dlc")
+	require_NoError(t, err)
+
+	mset, err = s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	o = mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+	if info := o.info(); !info.Paused || info.NumAckPending != 1 {
+		t.Fatalf("Expected paused info after restart, got %+v", info)
+	}
+
+	// Pause for a short time and make sure we resume on our own.
+	resp = pause(time.Now().Add(250 * time.Millisecond))
+	if !resp.Paused {
+		t.Fatalf("Expected to be paused, got %+v", resp)
+	}
+	checkAdvisory(true)
+	checkAdvisory(false)
+	m, err = nc.Request(rsubj, nil, time.Second)
+	require_NoError(t, err)
+	if string(m.Data) != "OK" {
+		t.Fatalf("Unexpected message: %q", m.Data)
+	}
+
+	// Resume explicitly with an empty request.
+	pause(time.Now().Add(time.Hour))
+	checkAdvisory(true)
+	if resp = pause(time.Time{}); resp.Paused {
+		t.Fatalf("Expected to be resumed, got %+v", resp)
+	}
+	checkAdvisory(false)
+	_, err = nc.Request(rsubj, nil, time.Second)
+	require_NoError(t, err)
+	if info := o.info(); info.Paused {
+		t.Fatalf("Expected not paused, got %+v", info)
+	}
+}
+
+func TestJetStreamConsumerDeadLetter(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:      "ORDERS",
+		Subjects:  []string{"orders.*"},
+		Retention: WorkQueuePolicy,
+		Storage:   FileStorage,
+	})
+	require_NoError(t, err)
+	defer mset.delete()
+
+	dlq, err := s.GlobalAccount().addStream(&StreamConfig{Name: "DLQ", Subjects: []string{"dlq.orders"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer dlq.delete()
+
+	// Bad configurations.
+	for _, cfg := range []*ConsumerConfig{
+		{Durable: "bad", AckPolicy: AckNone, DeliverSubject: "d", DeadLetter: &DeadLetter{Subject: "dlq.orders"}},
+		{Durable: "bad", AckPolicy: AckExplicit, DeadLetter: &DeadLetter{Subject: "dlq.*"}},
+		{Durable: "bad", AckPolicy: AckExplicit, DeadLetter: &DeadLetter{Subject: "orders.dead"}},
+		{Durable: "bad", AckPolicy: AckExplicit, DeadLetter: &DeadLetter{Stream: "ORDERS", Subject: "dlq.orders"}},
+	} {
+		_, err = mset.addConsumer(cfg)
+		if err == nil || !IsNatsErr(err, JSConsumerDeadLetterInvalidErrF) {
+			t.Fatalf("Expected dead letter error for %+v, got %v", cfg.DeadLetter, err)
+		}
+	}
+
+	o, err := mset.addConsumer(&ConsumerConfig{
+		Durable:    "dlc",
+		AckPolicy:  AckExplicit,
+		MaxDeliver: 2,
+		DeadLetter: &DeadLetter{Stream: "DLQ", Subject: "dlq.orders"},
+	})
+	require_NoError(t, err)
+	defer o.delete()
+
+	nc, _ := jsClientConnect(t, s)
+	defer nc.Close()
+
+	m := nats.NewMsg("orders.created")
+	m.Header.Set(JSMsgId, "id-1")
+	m.Data = []byte("ORDER-1")
+	_, err = nc.RequestMsg(m, time.Second)
+	require_NoError(t, err)
+	_, err = nc.Request("orders.updated", []byte("ORDER-2"), time.Second)
+	require_NoError(t, err)
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "ORDERS", "dlc")
+	next := func(expected string) *nats.Msg {
+		t.Helper()
+		m, err := nc.Request(rsubj, nil, time.Second)
+		require_NoError(t, err)
+		if string(m.Data) != expected {
+			t.Fatalf("Expected %q, got %q", expected, m.Data)
+		}
+		return m
+	}
+	ack := func(m *nats.Msg, body string) {
+		t.Helper()
+		_, err := nc.Request(m.Reply, []byte(body), time.Second)
+		require_NoError(t, err)
+	}
+
+	// Exhaust deliveries for the first message.
+	// A NAK with options is redelivered from the pending timer, so give it a moment.
+	ack(next("ORDER-1"), `-NAK {"reason":"db down"}`)
+	time.Sleep(50 * time.Millisecond)
+	ack(next("ORDER-1"), `-NAK {"reason":"db still down"}`)
+	time.Sleep(50 * time.Millisecond)
+	// The next request will dead letter the first message and deliver the second, which we terminate.
+	ack(next("ORDER-2"), "+TERM bad payload")
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := dlq.state(); state.Msgs != 2 {
+			return fmt.Errorf("Expected 2 dead lettered msgs, got %d", state.Msgs)
+		}
+		return nil
+	})
+
+	checkHeaders := func(seq uint64, data string, expected map[string]string) {
+		t.Helper()
+		sm, err := dlq.store.LoadMsg(seq, nil)
+		require_NoError(t, err)
+		if string(sm.msg) != data {
+			t.Fatalf("Expected %q, got %q", data, sm.msg)
+		}
+		for k, v := range expected {
+			if hv := string(getHeader(k, sm.hdr)); hv != v {
+				t.Fatalf("Expected header %q to be %q, got %q", k, v, hv)
+			}
+		}
+	}
+	checkHeaders(1, "ORDER-1", map[string]string{
+		JSStream:           "ORDERS",
+		JSConsumer:         "dlc",
+		JSSubject:          "orders.created",
+		JSSequence:         "1",
+		JSNumDelivered:     "2",
+		JSDeadLetterReason: deadLetterMaxDeliveries,
+		JSLastNakReason:    "db still down",
+		JSTermReason:       _EMPTY_,
+		JSMsgId:            _EMPTY_,
+	})
+	checkHeaders(2, "ORDER-2", map[string]string{
+		JSSubject:          "orders.updated",
+		JSSequence:         "2",
+		JSNumDelivered:     "1",
+		JSDeadLetterReason: deadLetterTerminated,
+		JSLastNakReason:    _EMPTY_,
+		JSTermReason:       "bad payload",
+	})
+
+	// Both were removed from the work queue once preserved in the dead letter stream.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := mset.state(); state.Msgs != 0 {
+			return fmt.Errorf("Expected dead lettered msgs to be removed from the work queue, got %d", state.Msgs)
+		}
+		return nil
+	})
+
+	// If the dead letter stream rejects the message it should stay in the work queue.
+	cfg := dlq.config()
+	cfg.MaxMsgs, cfg.Discard = 2, DiscardNew
+	require_NoError(t, dlq.update(&cfg))
+	_, err = nc.Request("orders.updated", []byte("ORDER-3"), time.Second)
+	require_NoError(t, err)
+	ack(next("ORDER-3"), "+TERM bad payload")
+	time.Sleep(100 * time.Millisecond)
+	if state := dlq.state(); state.Msgs != 2 {
+		t.Fatalf("Expected 2 dead lettered msgs, got %d", state.Msgs)
+	}
+	if _, err := mset.store.LoadMsg(3, nil); err != nil {
+		t.Fatalf("Expected rejected dead letter to stay in the work queue: %v", err)
+	}
+	if ci := o.info(); ci.NumAckPending != 1 {
+		t.Fatalf("Expected message to still be pending, got %d", ci.NumAckPending)
+	}
+}
+
+func TestJetStreamConsumerDeadLetterRetry(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{
+		Name:      "WORK",
+		Subjects:  []string{"work"},
+		Retention: WorkQueuePolicy,
+		Storage:   FileStorage,
+	})
+	require_NoError(t, err)
+	defer mset.delete()
+
+	nc, _ := jsClientConnect(t, s)
+	defer nc.Close()
+
+	sub, err := nc.SubscribeSync("d")
+	require_NoError(t, err)
+	defer sub.Unsubscribe()
+
+	// There is no dead letter stream yet.
+	o, err := mset.addConsumer(&ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: "d",
+		AckPolicy:      AckExplicit,
+		AckWait:        250 * time.Millisecond,
+		MaxDeliver:     1,
+		DeadLetter:     &DeadLetter{Subject: "dlq.work"},
+	})
+	require_NoError(t, err)
+	defer o.delete()
+
+	_, err = nc.Request("work", []byte("JOB-1"), time.Second)
+	require_NoError(t, err)
+	_, err = sub.NextMsg(time.Second)
+	require_NoError(t, err)
+
+	// Nobody stored the dead lettered copy, so the message needs to stay pending.
+	time.Sleep(600 * time.Millisecond)
+	if _, err := mset.store.LoadMsg(1, nil); err != nil {
+		t.Fatalf("Expected message to stay in the work queue: %v", err)
+	}
+	if ci := o.info(); ci.NumAckPending != 1 {
+		t.Fatalf("Expected message to still be pending, got %d", ci.NumAckPending)
+	}
+	checkSubsPending(t, sub, 0)
+
+	// Once the dead letter stream exists the next attempt should store it.
+	dlq, err := s.GlobalAccount().addStream(&StreamConfig{Name: "DLQ", Subjects: []string{"dlq.work"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer dlq.delete()
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := dlq.state(); state.Msgs != 1 {
+			return fmt.Errorf("Expected 1 dead lettered msg, got %d", state.Msgs)
+		}
+		if state := mset.state(); state.Msgs != 0 {
+			return fmt.Errorf("Expected dead lettered msg to be removed from the work queue, got %d", state.Msgs)
+		}
+		return nil
+	})
+	sm, err := dlq.store.LoadMsg(1, nil)
+	require_NoError(t, err)
+	if dc := string(getHeader(JSNumDelivered, sm.hdr)); dc != "1" {
+		t.Fatalf("Expected 1 delivery, got %q", dc)
+	}
+
+	// Should not be dead lettered again.
+	time.Sleep(500 * time.Millisecond)
+	if state := dlq.state(); state.Msgs != 1 {
+		t.Fatalf("Expected 1 dead lettered msg, got %d", state.Msgs)
+	}
+}
+
+func TestJetStreamConsumerPullMaxBytes(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer mset.delete()
+
+	o, err := mset.addConsumer(&ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit, MaxRequestMaxBytes: 4096})
+	require_NoError(t, err)
+	defer o.delete()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// Each message is 3 bytes of subject and 100 bytes of payload.
+	msg := bytes.Repeat([]byte("Z"), 100)
+	for i := 0; i < 10; i++ {
+		js.Publish("foo", msg)
+	}
+
+	sub, err := nc.SubscribeSync(nats.NewInbox())
+	require_NoError(t, err)
+	defer sub.Unsubscribe()
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc")
+	fetch := func(req string) (int, string) {
+		t.Helper()
+		require_NoError(t, nc.PublishRequest(rsubj, sub.Subject, []byte(req)))
+		var n int
+		for {
+			m, err := sub.NextMsg(time.Second)
+			require_NoError(t, err)
+			if len(m.Data) == 0 {
+				return n, m.Header.Get("Status")
+			}
+			n++
+			m.Ack()
+		}
+	}
+
+	// Stops before going over max bytes.
+	if n, status := fetch(`{"batch":10,"max_bytes":350,"expires":500000000}`); n != 3 || status != "409" {
+		t.Fatalf("Expected 3 msgs and a 409, got %d and %q", n, status)
+	}
+	// A single message larger than max bytes ends the request right away.
+	if n, status := fetch(`{"batch":10,"max_bytes":50,"expires":500000000}`); n != 0 || status != "409" {
+		t.Fatalf("Expected no msgs and a 409, got %d and %q", n, status)
+	}
+	// Message that did not fit is delivered on the next request.
+	if n, status := fetch(`{"batch":10,"max_bytes":1000,"expires":250000000}`); n != 7 || status != "408" {
+		t.Fatalf("Expected 7 msgs and a 408, got %d and %q", n, status)
+	}
+	// Can not exceed the configured limit.
+	if _, status := fetch(`{"batch":10,"max_bytes":8192}`); status != "409" {
+		t.Fatalf("Expected a 409, got %q", status)
+	}
+	if ci := o.info(); ci.Delivered.Stream != 10 || ci.NumPending != 0 {
+		t.Fatalf("Unexpected consumer state: %+v", ci)
+	}
+}
+
+func TestJetStreamConsumerPriorityGroups(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer mset.delete()
+
+	// Bad configurations.
+	_, err = mset.addConsumer(&ConsumerConfig{Durable: "bad", AckPolicy: AckExplicit, PriorityPolicy: PriorityPinnedClient})
+	require_Error(t, err, NewJSConsumerPriorityPolicyWithoutGroupError())
+	_, err = mset.addConsumer(&ConsumerConfig{Durable: "bad", AckPolicy: AckExplicit, PriorityGroups: []string{"bad group"}})
+	require_Error(t, err, NewJSConsumerInvalidGroupNameError())
+	_, err = mset.addConsumer(&ConsumerConfig{Durable: "bad", DeliverSubject: "d", PriorityGroups: []string{"A"}})
+	require_Error(t, err, NewJSConsumerPushWithPriorityGroupError())
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	newSub := func() *nats.Subscription {
+		t.Helper()
+		sub, err := nc.SubscribeSync(nats.NewInbox())
+		require_NoError(t, err)
+		return sub
+	}
+	pull := func(consumer string, sub *nats.Subscription, req string) {
+		t.Helper()
+		require_NoError(t, nc.PublishRequest(fmt.Sprintf(JSApiRequestNextT, "TEST", consumer), sub.Subject, []byte(req)))
+	}
+	expectStatus := func(sub *nats.Subscription, status string) {
+		t.Helper()
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		if len(m.Data) > 0 || m.Header.Get("Status") != status {
+			t.Fatalf("Expected status %q, got %q with %q", status, m.Header.Get("Status"), m.Data)
+		}
+	}
+	expectNone := func(sub *nats.Subscription) {
+		t.Helper()
+		if m, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+			t.Fatalf("Expected no message, got %q with %+v", m.Data, m.Header)
+		}
+	}
+
+	t.Run("Pinned", func(t *testing.T) {
+		o, err := mset.addConsumer(&ConsumerConfig{
+			Durable:        "pinned",
+			AckPolicy:      AckExplicit,
+			PriorityGroups: []string{"A"},
+			PriorityPolicy: PriorityPinnedClient,
+			PinnedTTL:      250 * time.Millisecond,
+		})
+		require_NoError(t, err)
+		defer o.delete()
+
+		// Requests need a valid group.
+		bad := newSub()
+		pull("pinned", bad, `{"batch":1}`)
+		expectStatus(bad, "400")
+		pull("pinned", bad, `{"batch":1,"group":"B"}`)
+		expectStatus(bad, "400")
+		pull("pinned", bad, `{"batch":1,"group":"A","id":"unknown"}`)
+		expectStatus(bad, "423")
+
+		js.Publish("foo", []byte("1"))
+
+		// First one to ask gets pinned.
+		active, standby := newSub(), newSub()
+		pull("pinned", active, `{"batch":1,"group":"A","expires":5000000000}`)
+		m, err := active.NextMsg(time.Second)
+		require_NoError(t, err)
+		pin := m.Header.Get(JSPullRequestPinId)
+		if string(m.Data) != "1" || pin == _EMPTY_ {
+			t.Fatalf("Expected pinned message, got %q with %+v", m.Data, m.Header)
+		}
+		if ci := o.info(); len(ci.PriorityGroups) != 1 || ci.PriorityGroups[0].PinnedClientID != pin {
+			t.Fatalf("Expected pinned client in info, got %+v", ci.PriorityGroups)
+		}
+
+		// The standby waits while the pinned client keeps pulling.
+		pull("pinned", standby, `{"batch":1,"group":"A","expires":5000000000}`)
+		pull("pinned", active, fmt.Sprintf(`{"batch":1,"group":"A","id":%q,"expires":100000000}`, pin))
+		js.Publish("foo", []byte("2"))
+		m, err = active.NextMsg(time.Second)
+		require_NoError(t, err)
+		if string(m.Data) != "2" || m.Header.Get(JSPullRequestPinId) != pin {
+			t.Fatalf("Expected pinned message, got %q with %+v", m.Data, m.Header)
+		}
+		expectNone(standby)
+
+		// Once the pinned client goes away the standby takes over with a new pin.
+		js.Publish("foo", []byte("3"))
+		m, err = standby.NextMsg(time.Second)
+		require_NoError(t, err)
+		if npin := m.Header.Get(JSPullRequestPinId); string(m.Data) != "3" || npin == _EMPTY_ || npin == pin {
+			t.Fatalf("Expected new pin for standby, got %q with %+v", m.Data, m.Header)
+		}
+		// And the old pin is no longer valid.
+		pull("pinned", active, fmt.Sprintf(`{"batch":1,"group":"A","id":%q}`, pin))
+		expectStatus(active, "423")
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		o, err := mset.addConsumer(&ConsumerConfig{
+			Durable:        "overflow",
+			AckPolicy:      AckExplicit,
+			DeliverPolicy:  DeliverNew,
+			PriorityGroups: []string{"A"},
+			PriorityPolicy: PriorityOverflow,
+		})
+		require_NoError(t, err)
+		defer o.delete()
+
+		// Overflow clients only get messages while enough are pending.
+		overflow := newSub()
+		pull("overflow", overflow, `{"batch":10,"group":"A","min_pending":5,"expires":5000000000}`)
+		for i := 0; i < 4; i++ {
+			js.Publish("foo", []byte("OK"))
+		}
+		expectNone(overflow)
+		for i := 0; i < 3; i++ {
+			js.Publish("foo", []byte("OK"))
+		}
+		// Pending goes from 7 back down to 4.
+		for i := 0; i < 3; i++ {
+			_, err := overflow.NextMsg(time.Second)
+			require_NoError(t, err)
+		}
+		expectNone(overflow)
+
+		// Regular requests in the group are served as usual.
+		regular := newSub()
+		pull("overflow", regular, `{"batch":4,"group":"A"}`)
+		for i := 0; i < 4; i++ {
+			_, err := regular.NextMsg(time.Second)
+			require_NoError(t, err)
+		}
+
+		if ci := o.info(); ci.NumPending != 0 || ci.NumAckPending != 7 {
+			t.Fatalf("Unexpected consumer state: %+v", ci)
+		}
+	})
+
+	t.Run("OverflowRequiresPolicy", func(t *testing.T) {
+		o, err := mset.addConsumer(&ConsumerConfig{Durable: "none", AckPolicy: AckExplicit, PriorityGroups: []string{"A"}})
+		require_NoError(t, err)
+		defer o.delete()
+
+		bad := newSub()
+		pull("none", bad, `{"batch":1,"group":"A","min_pending":5}`)
+		expectStatus(bad, "400")
+	})
+}
+
+func TestJetStreamConsumerPartitioned(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*.*"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer mset.delete()
+
+	// Bad configurations.
+	for _, cfg := range []*ConsumerConfig{
+		{Durable: "bad", AckPolicy: AckExplicit, DeliverSubject: "d", Partition: &PartitionConfig{Subject: "orders.*.*", Wildcards: []int{1}, Partitions: 4}},
+		{Durable: "bad", AckPolicy: AckAll, Partition: &PartitionConfig{Subject: "orders.*.*", Wildcards: []int{1}, Partitions: 4}},
+		{Durable: "bad", AckPolicy: AckExplicit, Partition: &PartitionConfig{Subject: "orders.*.*", Wildcards: []int{3}, Partitions: 4}},
+		{Durable: "bad", AckPolicy: AckExplicit, Partition: &PartitionConfig{Subject: "orders.*.*", Wildcards: []int{1}}},
+	} {
+		_, err = mset.addConsumer(cfg)
+		if err == nil || !IsNatsErr(err, JSConsumerPartitionInvalidErrF) {
+			t.Fatalf("Expected partition error for %+v, got %v", cfg.Partition, err)
+		}
+	}
+
+	// Partition on the customer, which is the first wildcard.
+	o, err := mset.addConsumer(&ConsumerConfig{
+		Durable:   "dlc",
+		AckPolicy: AckExplicit,
+		Partition: &PartitionConfig{Subject: "orders.*.*", Wildcards: []int{1}, Partitions: 16, Timeout: 250 * time.Millisecond},
+	})
+	require_NoError(t, err)
+	defer o.delete()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	subA, err := nc.SubscribeSync(nats.NewInbox())
+	require_NoError(t, err)
+	subB, err := nc.SubscribeSync(nats.NewInbox())
+	require_NoError(t, err)
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "ORDERS", "dlc")
+	pull := func(sub *nats.Subscription, expires time.Duration) {
+		t.Helper()
+		req := fmt.Sprintf(`{"batch":100,"expires":%d}`, expires)
+		require_NoError(t, nc.PublishRequest(rsubj, sub.Subject, []byte(req)))
+	}
+	publish := func() {
+		t.Helper()
+		for i := 0; i < 20; i++ {
+			_, err := js.Publish(fmt.Sprintf("orders.c%d.created", i), []byte("OK"))
+			require_NoError(t, err)
+		}
+	}
+
+	// Tracks which client received each customer and the last sequence for ordering.
+	owners, lseqs := make(map[string]string), make(map[string]uint64)
+	receive := func(n int, subs ...*nats.Subscription) map[string]int {
+		t.Helper()
+		counts := make(map[string]int)
+		deadline := time.Now().Add(2 * time.Second)
+		for received := 0; received < n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Only received %d of %d messages", received, n)
+			}
+			for _, sub := range subs {
+				m, err := sub.NextMsg(10 * time.Millisecond)
+				if err != nil {
+					continue
+				}
+				if len(m.Data) == 0 {
+					t.Fatalf("Unexpected status: %q", m.Header.Get("Status"))
+				}
+				received++
+				counts[sub.Subject]++
+				customer := strings.Split(m.Subject, ".")[1]
+				if owner, ok := owners[customer]; ok && owner != sub.Subject {
+					t.Fatalf("Customer %q delivered to more than one client", customer)
+				}
+				owners[customer] = sub.Subject
+				meta, err := m.Metadata()
+				require_NoError(t, err)
+				if meta.Sequence.Stream <= lseqs[customer] {
+					t.Fatalf("Customer %q delivered out of order", customer)
+				}
+				lseqs[customer] = meta.Sequence.Stream
+				m.Ack()
+			}
+		}
+		return counts
+	}
+
+	// With both clients pulling each customer sticks to one of them.
+	pull(subA, 5*time.Second)
+	pull(subB, 500*time.Millisecond)
+	publish()
+	publish()
+	if counts := receive(40, subA, subB); counts[subA.Subject] == 0 || counts[subB.Subject] == 0 {
+		t.Fatalf("Expected both clients to receive messages, got %v", counts)
+	}
+
+	// Client B stops pulling, its messages are held back until its partitions move to A.
+	if m, err := subB.NextMsg(time.Second); err != nil || m.Header.Get("Status") != "408" {
+		t.Fatalf("Expected a 408 for client B, got %v", err)
+	}
+	owners = make(map[string]string)
+	publish()
+	receive(20, subA)
+	if n := len(owners); n != 20 {
+		t.Fatalf("Expected 20 customers, got %d", n)
+	}
+	for customer, owner := range owners {
+		if owner != subA.Subject {
+			t.Fatalf("Expected customer %q to have moved to client A", customer)
+		}
+	}
+
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		if ci := o.info(); ci.NumAckPending != 0 || ci.NumPending != 0 || ci.AckFloor.Stream != 60 {
+			return fmt.Errorf("Unexpected consumer state: %+v", ci)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamConsumerPartitionedHeldRestart(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*.*"}, Storage: FileStorage})
+	require_NoError(t, err)
+	o, err := mset.addConsumer(&ConsumerConfig{
+		Durable:   "dlc",
+		AckPolicy: AckExplicit,
+		Partition: &PartitionConfig{Subject: "orders.*.*", Wildcards: []int{1}, Partitions: 16},
+	})
+	require_NoError(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "ORDERS", "dlc")
+	pull := func(nc *nats.Conn, sub *nats.Subscription, batch int) {
+		t.Helper()
+		req := fmt.Sprintf(`{"batch":%d,"expires":%d}`, batch, 5*time.Second)
+		require_NoError(t, nc.PublishRequest(rsubj, sub.Subject, []byte(req)))
+	}
+	received := make(map[uint64]struct{})
+	receive := func(n int, subs ...*nats.Subscription) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for got := 0; got < n; {
+			if time.Now().After(deadline) {
+				t.Fatalf("Only received %d of %d messages", got, n)
+			}
+			for _, sub := range subs {
+				m, err := sub.NextMsg(10 * time.Millisecond)
+				if err != nil {
+					continue
+				}
+				meta, err := m.Metadata()
+				require_NoError(t, err)
+				if _, ok := received[meta.Sequence.Stream]; ok {
+					t.Fatalf("Message %d delivered more than once", meta.Sequence.Stream)
+				}
+				received[meta.Sequence.Stream] = struct{}{}
+				got++
+				m.Ack()
+			}
+		}
+	}
+
+	// Client A only takes one message, so the rest of its partitions are held back.
+	subA, err := nc.SubscribeSync(nats.NewInbox())
+	require_NoError(t, err)
+	subB, err := nc.SubscribeSync(nats.NewInbox())
+	require_NoError(t, err)
+	pull(nc, subA, 1)
+	pull(nc, subB, 100)
+	for i := 0; i < 20; i++ {
+		_, err := js.Publish(fmt.Sprintf("orders.c%d.created", i), []byte("OK"))
+		require_NoError(t, err)
+	}
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		// Held back messages are still pending.
+		if ci := o.info(); ci.Delivered.Stream != 20 || uint64(ci.NumAckPending)+ci.NumPending != 20 {
+			return fmt.Errorf("Unexpected consumer state: %+v", ci)
+		}
+		return nil
+	})
+	state, err := o.store.State()
+	require_NoError(t, err)
+	held := state.Held
+	if len(held) == 0 {
+		t.Fatalf("Expected messages to be held back")
+	}
+	receive(20-len(held), subA, subB)
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		if ci := o.info(); ci.NumAckPending != 0 {
+			return fmt.Errorf("Expected no ack pending, got %d", ci.NumAckPending)
+		}
+		return nil
+	})
+
+	// Restart, the held back messages should be picked back up without redelivering acked ones.
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().lookupStream("ORDERS")
+	require_NoError(t, err)
+	if o = mset.lookupConsumer("dlc"); o == nil {
+		t.Fatalf("Expected to find consumer")
+	}
+
+	nc = clientConnectToServer(t, s)
+	defer nc.Close()
+	subC, err := nc.SubscribeSync(nats.NewInbox())
+	require_NoError(t, err)
+	pull(nc, subC, 100)
+	receive(len(held), subC)
+	for _, seq := range held {
+		if _, ok := received[seq]; !ok {
+			t.Fatalf("Expected held message %d to be delivered", seq)
+		}
+	}
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		if ci := o.info(); ci.NumAckPending != 0 || ci.NumPending != 0 || ci.AckFloor.Stream != 20 {
+			return fmt.Errorf("Unexpected consumer state: %+v", ci)
+		}
+		return nil
+	})
+	if m, err := subC.NextMsg(100 * time.Millisecond); err == nil && len(m.Data) > 0 {
+		t.Fatalf("Unexpected redelivery of %q", m.Subject)
+	}
+}
+
+func TestJetStreamConsumerReset(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	for i := 1; i <= 10; i++ {
+		js.Publish("foo", []byte(strconv.Itoa(i)))
+	}
+	// Remember when the second half was published.
+	time.Sleep(10 * time.Millisecond)
+	mid := time.Now()
+	for i := 11; i <= 20; i++ {
+		js.Publish("foo", []byte(strconv.Itoa(i)))
+	}
+
+	asub, err := nc.SubscribeSync(JSAdvisoryConsumerResetPre + ".TEST.dlc")
+	require_NoError(t, err)
+
+	reset := func(req string) *JSApiConsumerResetResponse {
+		t.Helper()
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiConsumerResetT, "TEST", "dlc"), []byte(req), time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerResetResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+	checkAdvisory := func(seq uint64) {
+		t.Helper()
+		m, err := asub.NextMsg(2 * time.Second)
+		require_NoError(t, err)
+		var adv JSConsumerResetAdvisory
+		require_NoError(t, json.Unmarshal(m.Data, &adv))
+		if adv.Type != JSConsumerResetAdvisoryType || adv.Seq != seq {
+			t.Fatalf("Unexpected advisory: %+v", adv)
+		}
+	}
+
+	// Bad requests.
+	for _, req := range []string{"", "{}", fmt.Sprintf(`{"seq":2,"start_time":%q}`, mid.Format(time.RFC3339Nano))} {
+		if resp := reset(req); resp.Error == nil {
+			t.Fatalf("Expected an error for %q", req)
+		}
+	}
+
+	// Consume and ack the first 5, leave the next 3 pending and one to be redelivered.
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(8)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 8)
+	for _, m := range msgs[:5] {
+		m.AckSync()
+	}
+	msgs[5].Nak()
+
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+
+	checkNext := func(expected int) {
+		t.Helper()
+		msgs, err := sub.Fetch(1)
+		require_NoError(t, err)
+		meta, err := msgs[0].Metadata()
+		require_NoError(t, err)
+		if string(msgs[0].Data) != strconv.Itoa(expected) || meta.NumDelivered != 1 {
+			t.Fatalf("Expected %d delivered once, got %q with %d deliveries", expected, msgs[0].Data, meta.NumDelivered)
+		}
+		msgs[0].AckSync()
+	}
+
+	// Rewind to the beginning.
+	resp := reset(`{"seq":1}`)
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	if resp.ResetSeq != 1 || resp.ConsumerInfo == nil || resp.NumAckPending != 0 || resp.NumRedelivered != 0 || resp.NumPending != 20 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkAdvisory(1)
+	checkNext(1)
+	checkNext(2)
+
+	// Acks for messages delivered before the reset are ignored.
+	msgs[6].AckSync()
+	if state := o.readStoreState(); state.AckFloor.Stream != 2 || len(state.Pending) != 0 || len(state.Redelivered) != 0 {
+		t.Fatalf("Unexpected stored state: %+v", state)
+	}
+
+	// Seek by time.
+	resp = reset(fmt.Sprintf(`{"start_time":%q}`, mid.Format(time.RFC3339Nano)))
+	if resp.Error != nil || resp.ResetSeq != 11 || resp.NumPending != 10 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkAdvisory(11)
+	checkNext(11)
+
+	// Sequences past the end will only deliver new messages.
+	resp = reset(`{"seq":1000}`)
+	if resp.Error != nil || resp.ResetSeq != 21 || resp.NumPending != 0 {
+		t.Fatalf("Unexpected response: %+v", resp)
+	}
+	checkAdvisory(21)
+	js.Publish("foo", []byte("21"))
+	checkNext(21)
+
+	// Reset state should survive a restart.
+	reset(`{"seq":5}`)
+	checkAdvisory(5)
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+	sub, err = js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	checkNext(5)
+}
+
+func TestJetStreamConsumerAckBatch(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Retention: nats.WorkQueuePolicy})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	for i := 0; i < 300; i++ {
+		js.Publish("foo", []byte("OK"))
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(300)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 300)
+
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+
+	// Bad ranges are ignored and not acknowledged.
+	for _, ack := range []string{"+ACK", "+ACK 10-5", "+ACK 0", "+ACK 1,a", "+NAK 1-10"} {
+		_, err = nc.Request("$JS.ACK.TEST.dlc", []byte(ack), 100*time.Millisecond)
+		require_Error(t, err, nats.ErrTimeout)
+	}
+	if ci := o.info(); ci.NumAckPending != 300 {
+		t.Fatalf("Expected nothing acked, got %+v", ci)
+	}
+
+	_, err = nc.Request("$JS.ACK.TEST.dlc", []byte("+ACK 1-250,260,255-258,257"), time.Second)
+	require_NoError(t, err)
+
+	ci := o.info()
+	if ci.NumAckPending != 45 || ci.AckFloor.Stream != 250 || ci.AckFloor.Consumer != 250 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+	if state := mset.state(); state.Msgs != 45 {
+		t.Fatalf("Expected 45 messages left in the work queue, got %d", state.Msgs)
+	}
+	if state := o.readStoreState(); len(state.Pending) != 45 || state.AckFloor.Stream != 250 {
+		t.Fatalf("Unexpected stored state: %+v", state)
+	}
+
+	// Very wide ranges only look at what is pending.
+	_, err = nc.Request("$JS.ACK.TEST.dlc", []byte("+ACK 251-18446744073709551615"), time.Second)
+	require_NoError(t, err)
+	if ci = o.info(); ci.NumAckPending != 0 || ci.AckFloor.Stream != 300 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+	if state := mset.state(); state.Msgs != 0 {
+		t.Fatalf("Expected no messages left in the work queue, got %d", state.Msgs)
+	}
+
+	// AckAll will use the highest sequence.
+	_, err = js.AddStream(&nats.StreamConfig{Name: "ALL", Subjects: []string{"bar"}})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("ALL", &nats.ConsumerConfig{Durable: "all", AckPolicy: nats.AckAllPolicy})
+	require_NoError(t, err)
+	for i := 0; i < 10; i++ {
+		js.Publish("bar", []byte("OK"))
+	}
+	sub, err = js.PullSubscribe("bar", "all")
+	require_NoError(t, err)
+	msgs, err = sub.Fetch(10)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 10)
+	_, err = nc.Request("$JS.ACK.ALL.all", []byte("+ACK 2,5"), time.Second)
+	require_NoError(t, err)
+	mset, err = s.GlobalAccount().lookupStream("ALL")
+	require_NoError(t, err)
+	o = mset.lookupConsumer("all")
+	require_True(t, o != nil)
+	if ci = o.info(); ci.NumAckPending != 5 || ci.AckFloor.Stream != 5 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+}
+
+func TestJetStreamConsumerHeaderFilter(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Retention: InterestPolicy, Storage: FileStorage})
+	require_NoError(t, err)
+	defer mset.delete()
+
+	// Bad filters.
+	for _, hf := range [][]HeaderPredicate{
+		{{Header: ""}},
+		{{Header: "Bad Header"}},
+		{{Header: "Region", Value: "us", Prefix: "u"}},
+	} {
+		_, err = mset.addConsumer(&ConsumerConfig{Durable: "bad", AckPolicy: AckExplicit, HeaderFilter: hf})
+		if err == nil || !IsNatsErr(err, JSConsumerHeaderFilterInvalidErrF) {
+			t.Fatalf("Expected header filter error for %+v, got %v", hf, err)
+		}
+	}
+
+	us, err := mset.addConsumer(&ConsumerConfig{Durable: "us", AckPolicy: AckExplicit,
+		HeaderFilter: []HeaderPredicate{{Header: "Region", Value: "us"}}})
+	require_NoError(t, err)
+	eu, err := mset.addConsumer(&ConsumerConfig{Durable: "eu", AckPolicy: AckExplicit,
+		HeaderFilter: []HeaderPredicate{{Header: "Region", Prefix: "eu-"}, {Header: "Priority"}}})
+	require_NoError(t, err)
+
+	// Header filters can not be changed.
+	_, err = mset.addConsumer(&ConsumerConfig{Durable: "us", AckPolicy: AckExplicit,
+		HeaderFilter: []HeaderPredicate{{Header: "Region", Value: "eu"}}})
+	require_Error(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	publish := func(region, priority string) {
+		t.Helper()
+		m := nats.NewMsg("foo")
+		if region != _EMPTY_ {
+			m.Header.Set("Region", region)
+		}
+		if priority != _EMPTY_ {
+			m.Header.Set("Priority", priority)
+		}
+		m.Data = []byte(region + "/" + priority)
+		_, err := js.PublishMsg(m)
+		require_NoError(t, err)
+	}
+	publish("us", _EMPTY_)
+	publish("eu-west", _EMPTY_)
+	publish("eu-west", "high")
+	publish(_EMPTY_, "high")
+	publish("usa", "high")
+	publish("eu-central", "low")
+	publish("us", "low")
+
+	// Headers are only checked as messages are reached, so pending is an upper bound until then.
+	if ci := us.info(); ci.NumPending != 7 {
+		t.Fatalf("Expected 7 pending, got %d", ci.NumPending)
+	}
+
+	fetch := func(o *consumer, expected ...string) {
+		t.Helper()
+		sub, err := nc.SubscribeSync(nats.NewInbox())
+		require_NoError(t, err)
+		defer sub.Unsubscribe()
+		req := `{"batch":10,"expires":250000000}`
+		require_NoError(t, nc.PublishRequest(o.requestNextMsgSubject(), sub.Subject, []byte(req)))
+		var got []string
+		for {
+			m, err := sub.NextMsg(time.Second)
+			require_NoError(t, err)
+			if len(m.Data) == 0 {
+				break
+			}
+			got = append(got, string(m.Data))
+			m.AckSync()
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+	}
+	fetch(us, "us/", "us/low")
+	fetch(eu, "eu-west/high", "eu-central/low")
+
+	// Skipped messages are treated as acknowledged.
+	checkFor(t, time.Second, 50*time.Millisecond, func() error {
+		for _, o := range []*consumer{us, eu} {
+			if ci := o.info(); ci.NumPending != 0 || ci.NumAckPending != 0 {
+				return fmt.Errorf("Unexpected consumer info for %q: %+v", o.name, ci)
+			}
+		}
+		if state := mset.state(); state.Msgs != 0 {
+			return fmt.Errorf("Expected all messages to be removed, got %d", state.Msgs)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamConsumerPullRateLimit(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	// Byte limits allow bursts up to the max message size.
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage, MaxMsgSize: 2048})
+	require_NoError(t, err)
+	defer mset.delete()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	msg := make([]byte, 1024)
+	for i := 0; i < 50; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+
+	cfg := &ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit, RateLimitMsgs: 20}
+	o, err := mset.addConsumer(cfg)
+	require_NoError(t, err)
+	defer o.delete()
+
+	// The limit is shared by all pull requests of the consumer.
+	fetch := func(n int) time.Duration {
+		t.Helper()
+		subA, err := nc.SubscribeSync(nats.NewInbox())
+		require_NoError(t, err)
+		defer subA.Unsubscribe()
+		subB, err := nc.SubscribeSync(nats.NewInbox())
+		require_NoError(t, err)
+		defer subB.Unsubscribe()
+		req := []byte(fmt.Sprintf(`{"batch":%d}`, n/2))
+		start := time.Now()
+		require_NoError(t, nc.PublishRequest(o.requestNextMsgSubject(), subA.Subject, req))
+		require_NoError(t, nc.PublishRequest(o.requestNextMsgSubject(), subB.Subject, req))
+		for _, sub := range []*nats.Subscription{subA, subB} {
+			for i := 0; i < n/2; i++ {
+				m, err := sub.NextMsg(5 * time.Second)
+				require_NoError(t, err)
+				m.Ack()
+			}
+		}
+		return time.Since(start)
+	}
+
+	// 10 messages at 20 msgs/sec.
+	if elapsed := fetch(10); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected messages to be rate limited, took %v", elapsed)
+	}
+	if ci := o.info(); ci.Config.RateLimitMsgs != 20 {
+		t.Fatalf("Expected rate limit in consumer info, got %+v", ci.Config)
+	}
+
+	// Now limit bytes, ~20KB/sec.
+	ncfg := *cfg
+	ncfg.RateLimitMsgs, ncfg.RateLimit = 0, 20*1024*8
+	require_NoError(t, o.updateConfig(&ncfg))
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		o.mu.RLock()
+		defer o.mu.RUnlock()
+		if o.mlimit != nil || o.rlimit == nil {
+			return fmt.Errorf("Rate limiters not updated")
+		}
+		return nil
+	})
+	if elapsed := fetch(20); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected messages to be rate limited, took %v", elapsed)
+	}
+
+	// Removing the limits should deliver right away.
+	ncfg.RateLimit = 0
+	require_NoError(t, o.updateConfig(&ncfg))
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		o.mu.RLock()
+		defer o.mu.RUnlock()
+		if o.mlimit != nil || o.rlimit != nil {
+			return fmt.Errorf("Rate limiters not removed")
+		}
+		return nil
+	})
+	if elapsed := fetch(20); elapsed > 250*time.Millisecond {
+		t.Fatalf("Expected messages to not be rate limited, took %v", elapsed)
+	}
+}
+
+func TestJetStreamConsumerMemoryStorage(t *testing.T) {
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer mset.delete()
+
+	// Can not ask for more replicas than the stream has.
+	_, err = mset.addConsumer(&ConsumerConfig{Durable: "bad", AckPolicy: AckExplicit, Replicas: 3})
+	require_Error(t, err, NewJSConsumerReplicasExceedsStreamError())
+
+	o, err := mset.addConsumer(&ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit, MemoryStorage: true})
+	require_NoError(t, err)
+
+	if o.store.Type() != MemoryStorage {
+		t.Fatalf("Expected a memory based consumer store, got %v", o.store.Type())
+	}
+	fo, err := mset.addConsumer(&ConsumerConfig{Durable: "file", AckPolicy: AckExplicit})
+	require_NoError(t, err)
+	odir := filepath.Join(s.JetStreamConfig().StoreDir, "$G", streamsDir, "TEST", consumerDir)
+	if _, err := os.Stat(filepath.Join(odir, "file")); err != nil {
+		t.Fatalf("Expected a consumer directory, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(odir, "dlc")); !os.IsNotExist(err) {
+		t.Fatalf("Expected no consumer directory, got %v", err)
+	}
+	if state := mset.state(); state.Consumers != 2 {
+		t.Fatalf("Expected 2 consumers, got %d", state.Consumers)
+	}
+	require_NoError(t, fo.delete())
+
+	// Storage type can not be changed.
+	_, err = mset.addConsumer(&ConsumerConfig{Durable: "dlc", AckPolicy: AckExplicit})
+	require_Error(t, err)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	for i := 0; i < 10; i++ {
+		js.Publish("foo", []byte("OK"))
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(5)
+	require_NoError(t, err)
+	for _, m := range msgs {
+		m.AckSync()
+	}
+	if ci := o.info(); ci.AckFloor.Stream != 5 || ci.NumPending != 5 {
+		t.Fatalf("Unexpected consumer info: %+v", ci)
+	}
+
+	require_NoError(t, o.delete())
+	if state := mset.state(); state.Consumers != 0 {
+		t.Fatalf("Expected no consumers, got %d", state.Consumers)
+	}
+}
+
+func TestJetStreamServerEncryptionKeyRotation(t *testing.T) {
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	tmpl := `
+		listen: 127.0.0.1:-1
+		jetstream: {key: %q, %s cipher: aes, store_dir: %q}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, "s3cr3t!!", _EMPTY_, storeDir)))
+	defer removeFile(t, conf)
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if opts.JetStreamCipher != AES {
+		t.Fatalf("Expected AES cipher, got %v", opts.JetStreamCipher)
+	}
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	msg := []byte("ENCRYPTED PAYLOAD!!")
+	sendMsgs := func(js nats.JetStreamContext, n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			_, err := js.Publish("foo", msg)
+			require_NoError(t, err)
+		}
+	}
+	sendMsgs(js, 10)
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	for _, m := range fetchMsgs(t, sub, 5, 5*time.Second) {
+		m.AckSync()
+	}
+
+	sdir := filepath.Join(storeDir, JetStreamStoreDir, "$G", "streams", "TEST")
+	keyFiles := []string{
+		filepath.Join(sdir, JetStreamMetaFileKey),
+		filepath.Join(sdir, msgDir, "1.key"),
+		filepath.Join(sdir, consumerDir, "dlc", JetStreamMetaFileKey),
+	}
+	readKeys := func() [][]byte {
+		t.Helper()
+		var keys [][]byte
+		for _, fn := range keyFiles {
+			ekey, err := ioutil.ReadFile(fn)
+			require_NoError(t, err)
+			if len(ekey) != aesKeySize {
+				t.Fatalf("Expected AES key size for %q, got %d", fn, len(ekey))
+			}
+			keys = append(keys, ekey)
+		}
+		return keys
+	}
+	checkRewrapped := func(before, after [][]byte) {
+		t.Helper()
+		for i := range before {
+			if bytes.Equal(before[i], after[i]) {
+				t.Fatalf("Expected %q to be re-wrapped", keyFiles[i])
+			}
+		}
+	}
+	checkRestored := func(s *Server, msgs, ackFloor uint64) {
+		t.Helper()
+		nc, js := jsClientConnect(t, s)
+		defer nc.Close()
+		si, err := js.StreamInfo("TEST")
+		require_NoError(t, err)
+		if si.State.Msgs != msgs {
+			t.Fatalf("Expected %d msgs, got %d", msgs, si.State.Msgs)
+		}
+		ci, err := js.ConsumerInfo("TEST", "dlc")
+		require_NoError(t, err)
+		if ci.AckFloor.Stream != ackFloor {
+			t.Fatalf("Expected ack floor of %d, got %d", ackFloor, ci.AckFloor.Stream)
+		}
+		sendMsgs(js, 1)
+	}
+
+	// Turning encryption off is not allowed.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q}
+	`, storeDir)))
+	if err := s.Reload(); err == nil {
+		t.Fatalf("Expected an error disabling encryption on reload")
+	}
+
+	// Rotate online with a config reload.
+	before := readKeys()
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, "n3wk3y", `prev_key: "s3cr3t!!",`, storeDir)))
+	require_NoError(t, s.Reload())
+	after := readKeys()
+	checkRewrapped(before, after)
+
+	// Operators can tell when the previous key is no longer needed.
+	jsi, err := s.Jsz(nil)
+	require_NoError(t, err)
+	if kr := jsi.KeyRotation; kr == nil || kr.Completed == nil || kr.Streams != 1 || kr.Errors != 0 {
+		t.Fatalf("Unexpected key rotation status: %+v", kr)
+	}
+
+	// Make sure we are still operational.
+	sendMsgs(js, 10)
+
+	// Restart with only the new key.
+	s.Shutdown()
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, "n3wk3y", _EMPTY_, storeDir)))
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	checkRestored(s, 20, 5)
+
+	// Now rotate on restart by configuring the previous key.
+	s.Shutdown()
+	before = readKeys()
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, "l4st0n3", `prev_key: "n3wk3y",`, storeDir)))
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	checkRestored(s, 21, 5)
+	checkRewrapped(before, readKeys())
+
+	s.Shutdown()
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, "l4st0n3", _EMPTY_, storeDir)))
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	checkRestored(s, 22, 5)
+}
+
+func TestJetStreamServerEncryptionKeyProvider(t *testing.T) {
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+
+	keyFile := filepath.Join(createDir(t, "key"), "js.key")
+	defer removeDir(t, filepath.Dir(keyFile))
+	require_NoError(t, ioutil.WriteFile(keyFile, []byte("s3cr3t!!\n"), 0600))
+
+	os.Setenv("JS_KEY_PROVIDER", "s3cr3t!!")
+	defer os.Unsetenv("JS_KEY_PROVIDER")
+
+	// Check the built-in providers directly first.
+	for _, kp := range []KeyProvider{
+		&FileKeyProvider{Path: keyFile},
+		&EnvKeyProvider{Name: "JS_KEY_PROVIDER"},
+	} {
+		key, err := kp.Key()
+		require_NoError(t, err)
+		if key != "s3cr3t!!" {
+			t.Fatalf("Expected key from %T, got %q", kp, key)
+		}
+	}
+	if runtime.GOOS != "windows" {
+		key, err := (&ExecKeyProvider{Command: "sh", Args: []string{"-c", "echo s3cr3t!!"}}).Key()
+		require_NoError(t, err)
+		if key != "s3cr3t!!" {
+			t.Fatalf("Expected key from command, got %q", key)
+		}
+		_, err = (&ExecKeyProvider{Command: "sh", Args: []string{"-c", "echo vault sealed >&2; exit 1"}}).Key()
+		if err == nil || !strings.Contains(err.Error(), "vault sealed") {
+			t.Fatalf("Expected error with command output, got %v", err)
+		}
+		_, err = (&ExecKeyProvider{Command: "sleep", Args: []string{"5"}, Timeout: 50 * time.Millisecond}).Key()
+		if err == nil || !strings.Contains(err.Error(), "timed out") {
+			t.Fatalf("Expected timeout error, got %v", err)
+		}
+
+		// Key files must not be readable by others.
+		badKeyFile := keyFile + ".bad"
+		require_NoError(t, ioutil.WriteFile(badKeyFile, []byte("s3cr3t!!"), 0644))
+		if _, err := (&FileKeyProvider{Path: badKeyFile}).Key(); err == nil || !strings.Contains(err.Error(), "too open") {
+			t.Fatalf("Expected permissions error, got %v", err)
+		}
+	}
+
+	// An unavailable provider should prevent JetStream from starting.
+	for _, kp := range []KeyProvider{
+		&FileKeyProvider{Path: keyFile + ".missing"},
+		&EnvKeyProvider{Name: "JS_KEY_PROVIDER_MISSING"},
+	} {
+		opts := DefaultTestOptions
+		opts.Port = -1
+		opts.JetStreamKeyProvider = kp
+		s := RunServer(&opts)
+		err := s.EnableJetStream(&JetStreamConfig{StoreDir: storeDir})
+		if err == nil || !strings.Contains(err.Error(), "key provider") {
+			t.Fatalf("Expected key provider error for %T, got %v", kp, err)
+		}
+		if s.JetStreamEnabled() {
+			t.Fatalf("Expected JetStream to not be enabled")
+		}
+		s.Shutdown()
+	}
+
+	// Can not have both a static key and a provider.
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {key: "s3cr3t!!", key_provider: {type: env, name: JS_KEY_PROVIDER}, store_dir: %q}
+	`, storeDir)))
+	defer removeFile(t, conf)
+	opts, err := ProcessConfigFile(conf)
+	require_NoError(t, err)
+	if err := validateOptions(opts); err == nil {
+		t.Fatalf("Expected error with both key and key provider")
+	}
+
+	// Now run with a file based provider.
+	tmpl := `
+		listen: 127.0.0.1:-1
+		jetstream: {key_provider: %s, store_dir: %q}
+	`
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, fmt.Sprintf("{type: file, path: %q}", keyFile), storeDir)))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	msg := []byte("ENCRYPTED PAYLOAD!!")
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+	nc.Close()
+	s.Shutdown()
+
+	sdir := filepath.Join(storeDir, JetStreamStoreDir, "$G", "streams", "TEST")
+	if _, err := os.Stat(filepath.Join(sdir, JetStreamMetaFileKey)); err != nil {
+		t.Fatalf("Expected stream to be encrypted: %v", err)
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(sdir, msgDir, "1.blk"))
+	require_NoError(t, err)
+	if bytes.Contains(buf, msg) {
+		t.Fatalf("Found plaintext in message block")
+	}
+
+	// Restart using the same key from the environment.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, "{type: env, name: JS_KEY_PROVIDER}", storeDir)))
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	if si.State.Msgs != 10 {
+		t.Fatalf("Expected 10 msgs, got %d", si.State.Msgs)
+	}
+
+	// A reload with a failing provider should fail and leave us running with our current key.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(tmpl, "{type: env, name: JS_KEY_PROVIDER_MISSING}", storeDir)))
+	if err := s.Reload(); err == nil || !strings.Contains(err.Error(), "key provider") {
+		t.Fatalf("Expected key provider error on reload, got %v", err)
+	}
+	if ek, _ := s.jsEncryptionKeys(); ek != "s3cr3t!!" {
+		t.Fatalf("Expected key to be unchanged")
+	}
+	_, err = js.Publish("foo", msg)
+	require_NoError(t, err)
+}
+
+func TestJetStreamTieredStorage(t *testing.T) {
+	// Tiering requires an archive.
+	s := RunBasicJetStreamServer()
+	if config := s.JetStreamConfig(); config != nil {
+		defer removeDir(t, config.StoreDir)
+	}
+	_, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Storage: FileStorage, Tier: &TierPolicy{Age: time.Second}})
+	require_Error(t, err)
+	// Same for adding it to an existing stream.
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Storage: FileStorage})
+	require_NoError(t, err)
+	cfg := mset.config()
+	cfg.Tier = &TierPolicy{Age: time.Second}
+	require_Error(t, mset.update(&cfg))
+	if mset.config().Tier != nil {
+		t.Fatalf("Expected tier to not be set")
+	}
+	s.Shutdown()
+
+	storeDir := createDir(t, JetStreamStoreDir)
+	defer removeDir(t, storeDir)
+	archiveDir := createDir(t, "js-archive")
+	defer removeDir(t, archiveDir)
+
+	// An archive requires a server name.
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, archive_dir: %q}
+	`, storeDir, archiveDir)))
+	defer removeFile(t, conf)
+	opts, err := ProcessConfigFile(conf)
+	require_NoError(t, err)
+	if _, err = NewServer(opts); err == nil {
+		t.Fatalf("Expected an error without a server name")
+	}
+
+	conf = createConfFile(t, []byte(fmt.Sprintf(`
+		server_name: S1
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, archive_dir: %q}
+	`, storeDir, archiveDir)))
+	defer removeFile(t, conf)
+
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	acc := s.GlobalAccount()
+
+	// Only supported for file storage.
+	_, err = acc.addStream(&StreamConfig{Name: "MEM", Storage: MemoryStorage, Tier: &TierPolicy{Age: time.Second}})
+	require_Error(t, err)
+	_, err = acc.addStream(&StreamConfig{Name: "BAD", Storage: FileStorage, Tier: &TierPolicy{}})
+	require_Error(t, err)
+
+	// Keep the blocks small so we seal a few.
+	_, err = acc.addStream(&StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+		Storage:  FileStorage,
+		MaxBytes: 128 * 1024,
+		Tier:     &TierPolicy{Age: 50 * time.Millisecond},
+	})
+	require_NoError(t, err)
+
+	msg := bytes.Repeat([]byte("Z"), 1024)
+	for i := 0; i < 80; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+
+	streamInfo := func() *JSApiStreamInfoResponse {
+		t.Helper()
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), nil, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamInfoResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		if resp.StreamInfo == nil {
+			t.Fatalf("Unexpected response: %+v", resp)
+		}
+		return &resp
+	}
+
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		resp := streamInfo()
+		if resp.Config.Tier == nil || resp.Config.Tier.Age != 50*time.Millisecond {
+			t.Fatalf("Expected tier to be set in config, got %+v", resp.Config.Tier)
+		}
+		ti := resp.Tier
+		if ti == nil || ti.ColdBlocks == 0 || ti.ColdBytes == 0 || ti.HotBytes == 0 {
+			return fmt.Errorf("Expected cold blocks, got %+v", ti)
+		}
+		return nil
+	})
+
+	fis, err := ioutil.ReadDir(filepath.Join(archiveDir, "S1", "$G", "streams", "TEST", msgDir))
+	require_NoError(t, err)
+	if len(fis) == 0 {
+		t.Fatalf("Expected blocks in the archive")
+	}
+
+	// Messages should be readable from archived blocks.
+	sub, err := js.SubscribeSync("foo")
+	require_NoError(t, err)
+	for i := 0; i < 80; i++ {
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		if !bytes.Equal(m.Data, msg) {
+			t.Fatalf("Unexpected message data")
+		}
+	}
+
+	// Also after a restart.
+	nc.Close()
+	s.Shutdown()
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	nc, _ = jsClientConnect(t, s)
+	defer nc.Close()
+
+	if resp := streamInfo(); resp.State.Msgs != 80 || resp.Tier == nil || resp.Tier.ColdBlocks == 0 {
+		t.Fatalf("Unexpected stream info after restart: %+v, %+v", resp.State, resp.Tier)
+	}
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiMsgGetT, "TEST"), []byte(`{"seq":1}`), time.Second)
+	require_NoError(t, err)
+	var resp JSApiMsgGetResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Message == nil || !bytes.Equal(resp.Message.Data, msg) {
+		t.Fatalf("Unexpected get response: %+v", resp)
+	}
+}
@@ -31,6 +31,10 @@ type memStore struct {
 	maxp      int64
 	scb       StorageUpdateHandler
 	ageChk    *time.Timer
+	ttls      *msgTimers
+	ttlChk    *time.Timer
+	ttlNext   int64
+	scheds    *msgTimers
 	consumers int
 }
 
@@ -60,7 +64,16 @@ func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 	}
 
 	ms.mu.Lock()
+	ocfg := ms.cfg
 	ms.cfg = *cfg
+	// If we now allow message schedules make sure we know about any already stored.
+	if cfg.AllowMsgSchedules && !ocfg.AllowMsgSchedules {
+		for seq, sm := range ms.msgs {
+			ms.trackMsgSchedule(seq, sm.hdr, sm.ts)
+		}
+	} else if !cfg.AllowMsgSchedules {
+		ms.scheds = nil
+	}
 	// Limits checks and enforcement.
 	ms.enforceMsgLimit()
 	ms.enforceBytesLimit()
@@ -98,6 +111,9 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 
 	// Check if we are discarding new messages when we reach the limit.
 	if ms.cfg.Discard == DiscardNew {
+		if asl && ms.cfg.DiscardNewPer {
+			return ErrMaxMsgsPerSubject
+		}
 		if ms.cfg.MaxMsgs > 0 && ms.state.Msgs >= uint64(ms.cfg.MaxMsgs) {
 			// If we are tracking max messages per subject and are at the limit we will replace, so this is ok.
 			if !asl {
@@ -176,6 +192,17 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 		ms.startAgeChk()
 	}
 
+	// Track any per-message TTL.
+	if ms.cfg.AllowMsgTTL && len(hdr) > 0 {
+		if ttl, err := getMessageTTL(hdr); err == nil && ttl > 0 {
+			ms.trackMsgTTL(seq, ts+int64(ttl))
+		}
+	}
+	// Track any message schedule.
+	if ms.cfg.AllowMsgSchedules {
+		ms.trackMsgSchedule(seq, hdr, ts)
+	}
+
 	return nil
 }
 
@@ -425,6 +452,92 @@ func (ms *memStore) expireMsgs() {
 	}
 }
 
+// Will track the expiration of a message with a per-message TTL.
+// Lock should be held.
+func (ms *memStore) trackMsgTTL(seq uint64, exp int64) {
+	if ms.ttls == nil {
+		ms.ttls = newMsgTimers()
+	}
+	ms.ttls.track(seq, exp)
+	if ms.ttlChk == nil || exp < ms.ttlNext {
+		ms.resetTTLChk(exp)
+	}
+}
+
+// Will reset the per-message TTL timer to fire at the expiration time.
+// Lock should be held.
+func (ms *memStore) resetTTLChk(exp int64) {
+	ms.ttlNext = exp
+	fireIn := time.Duration(exp - time.Now().UnixNano())
+	if ms.ttlChk != nil {
+		ms.ttlChk.Reset(fireIn)
+	} else {
+		ms.ttlChk = time.AfterFunc(fireIn, ms.expireMsgTTLs)
+	}
+}
+
+// Will expire msgs whose per-message TTL has passed.
+func (ms *memStore) expireMsgTTLs() {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if ms.msgs == nil || ms.ttls == nil {
+		return
+	}
+	// Anything below our first sequence is already gone.
+	ms.ttls.removeBelow(ms.state.FirstSeq)
+	now := time.Now().UnixNano()
+	for seq := ms.ttls.popExpired(now); seq > 0; seq = ms.ttls.popExpired(now) {
+		// May have already been removed.
+		ms.removeMsg(seq, false)
+	}
+	next := ms.ttls.next()
+	if next == 0 {
+		if ms.ttlChk != nil {
+			ms.ttlChk.Stop()
+			ms.ttlChk = nil
+		}
+		return
+	}
+	ms.resetTTLChk(next)
+}
+
+// Will track a message that is scheduled for a future time.
+// Lock should be held.
+func (ms *memStore) trackMsgSchedule(seq uint64, hdr []byte, ts int64) {
+	if len(hdr) == 0 {
+		return
+	}
+	if due, err := getMessageSchedule(hdr, ts); err == nil && due > 0 {
+		if ms.scheds == nil {
+			ms.scheds = newMsgTimers()
+		}
+		ms.scheds.track(seq, due)
+	}
+}
+
+// MsgSchedules returns the messages scheduled for a future time along with when they are due.
+func (ms *memStore) MsgSchedules() map[uint64]int64 {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.scheds == nil {
+		return nil
+	}
+	// Drop any that are now due or have been removed.
+	ms.scheds.removeBelow(ms.state.FirstSeq)
+	now := time.Now().UnixNano()
+	for ms.scheds.popExpired(now) > 0 {
+	}
+	if ms.scheds.len() == 0 {
+		return nil
+	}
+	sched := make(map[uint64]int64, ms.scheds.len())
+	ms.scheds.iter(func(seq uint64, due int64) {
+		sched[seq] = due
+	})
+	return sched
+}
+
 // PurgeEx will remove messages based on subject filters, sequence and number of messages to keep.
 // Will return the number of purged messages.
 func (ms *memStore) PurgeEx(subject string, sequence, keep uint64) (purged uint64, err error) {
@@ -487,6 +600,7 @@ func (ms *memStore) Purge() (uint64, error) {
 	ms.state.Msgs = 0
 	ms.msgs = make(map[uint64]*StoreMsg)
 	ms.fss = make(map[string]*SimpleState)
+	ms.ttls, ms.scheds = nil, nil
 	ms.mu.Unlock()
 
 	if cb != nil {
@@ -777,6 +891,12 @@ func (ms *memStore) removeMsg(seq uint64, secure bool) bool {
 	ms.state.Msgs--
 	ms.state.Bytes -= ss
 	ms.updateFirstSeq(seq)
+	if ms.ttls != nil {
+		ms.ttls.untrack(seq)
+	}
+	if ms.scheds != nil {
+		ms.scheds.untrack(seq)
+	}
 
 	if secure {
 		if len(sm.hdr) > 0 {
@@ -853,10 +973,10 @@ func (ms *memStore) State() StreamState {
 	return state
 }
 
-func (ms *memStore) Utilization() (total, reported uint64, err error) {
+func (ms *memStore) Utilization() (total, reported, compressed uint64, err error) {
 	ms.mu.RLock()
 	defer ms.mu.RUnlock()
-	return ms.state.Bytes, ms.state.Bytes, nil
+	return ms.state.Bytes, ms.state.Bytes, ms.state.Bytes, nil
 }
 
 func memStoreMsgSize(subj string, hdr, msg []byte) uint64 {
@@ -875,6 +995,10 @@ func (ms *memStore) Stop() error {
 		ms.ageChk.Stop()
 		ms.ageChk = nil
 	}
+	if ms.ttlChk != nil {
+		ms.ttlChk.Stop()
+		ms.ttlChk = nil
+	}
 	ms.msgs = nil
 	ms.mu.Unlock()
 	return nil
@@ -894,41 +1018,276 @@ func (ms *memStore) decConsumers() {
 	ms.mu.Unlock()
 }
 
+// consumerMemStore keeps the state of a consumer in memory only.
 type consumerMemStore struct {
-	ms *memStore
+	mu     sync.Mutex
+	ms     StreamStore
+	cfg    ConsumerConfig
+	state  ConsumerState
+	closed bool
 }
 
-func (ms *memStore) ConsumerStore(_ string, _ *ConsumerConfig) (ConsumerStore, error) {
+func newConsumerMemStore(ms StreamStore, cfg *ConsumerConfig) *consumerMemStore {
+	return &consumerMemStore{ms: ms, cfg: *cfg}
+}
+
+func (ms *memStore) ConsumerStore(_ string, cfg *ConsumerConfig) (ConsumerStore, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("bad consumer config")
+	}
 	ms.incConsumers()
-	return &consumerMemStore{ms}, nil
+	return newConsumerMemStore(ms, cfg), nil
 }
 
 func (ms *memStore) Snapshot(_ time.Duration, _, _ bool) (*SnapshotResult, error) {
 	return nil, fmt.Errorf("no impl")
 }
 
-// No-ops.
-func (os *consumerMemStore) Update(_ *ConsumerState) error                 { return nil }
-func (os *consumerMemStore) UpdateDelivered(_, _, _ uint64, _ int64) error { return nil }
-func (os *consumerMemStore) UpdateAcks(_, _ uint64) error                  { return nil }
-func (os *consumerMemStore) UpdateConfig(_ *ConsumerConfig) error          { return nil }
+func (o *consumerMemStore) Update(state *ConsumerState) error {
+	// Sanity checks.
+	if state.AckFloor.Consumer > state.Delivered.Consumer {
+		return fmt.Errorf("bad ack floor for consumer")
+	}
+	if state.AckFloor.Stream > state.Delivered.Stream {
+		return fmt.Errorf("bad ack floor for stream")
+	}
+
+	// Copy to our state.
+	var pending map[uint64]*Pending
+	var redelivered map[uint64]uint64
+	if len(state.Pending) > 0 {
+		pending = make(map[uint64]*Pending, len(state.Pending))
+		for seq, p := range state.Pending {
+			if seq <= state.AckFloor.Stream || seq > state.Delivered.Stream {
+				return fmt.Errorf("bad pending entry, sequence [%d] out of range", seq)
+			}
+			pending[seq] = &Pending{p.Sequence, p.Timestamp}
+		}
+	}
+	if len(state.Redelivered) > 0 {
+		redelivered = make(map[uint64]uint64, len(state.Redelivered))
+		for seq, dc := range state.Redelivered {
+			redelivered[seq] = dc
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return ErrStoreClosed
+	}
+	// Check to see if this is an outdated update.
+	if state.Delivered.Consumer < o.state.Delivered.Consumer {
+		return fmt.Errorf("old update ignored")
+	}
+
+	o.state.Delivered = state.Delivered
+	o.state.AckFloor = state.AckFloor
+	o.state.Pending = pending
+	o.state.Redelivered = redelivered
+	o.state.PauseUntil = state.PauseUntil
+	o.state.Held = append([]uint64(nil), state.Held...)
+
+	return nil
+}
+
+// UpdateDelivered is called whenever a new message has been delivered.
+func (o *consumerMemStore) UpdateDelivered(dseq, sseq, dc uint64, ts int64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
 
-func (os *consumerMemStore) Stop() error {
-	os.ms.decConsumers()
+	if o.closed {
+		return ErrStoreClosed
+	}
+	if dc != 1 && o.cfg.AckPolicy == AckNone {
+		return ErrNoAckPolicy
+	}
+
+	// On restarts the old leader may get a replay from the raft logs that are old.
+	if dseq <= o.state.AckFloor.Consumer {
+		return nil
+	}
+
+	// For AckNone just update delivered and ackfloor at the same time.
+	if o.cfg.AckPolicy == AckNone {
+		o.state.Delivered.Consumer, o.state.Delivered.Stream = dseq, sseq
+		o.state.AckFloor.Consumer, o.state.AckFloor.Stream = dseq, sseq
+		return nil
+	}
+
+	if o.state.Pending == nil {
+		o.state.Pending = make(map[uint64]*Pending)
+	}
+	// Check for an update to a message already delivered.
+	if sseq <= o.state.Delivered.Stream {
+		if p := o.state.Pending[sseq]; p != nil {
+			p.Sequence, p.Timestamp = dseq, ts
+		}
+	} else {
+		o.state.Pending[sseq] = &Pending{dseq, ts}
+	}
+	if dseq > o.state.Delivered.Consumer {
+		o.state.Delivered.Consumer = dseq
+	}
+	if sseq > o.state.Delivered.Stream {
+		o.state.Delivered.Stream = sseq
+	}
+	if dc > 1 {
+		if o.state.Redelivered == nil {
+			o.state.Redelivered = make(map[uint64]uint64)
+		}
+		o.state.Redelivered[sseq] = dc - 1
+	}
 	return nil
 }
 
-func (os *consumerMemStore) Delete() error {
-	return os.Stop()
+// UpdateAcks is called whenever a consumer with explicit ack or ack all acks a message.
+func (o *consumerMemStore) UpdateAcks(dseq, sseq uint64) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return ErrStoreClosed
+	}
+	if o.cfg.AckPolicy == AckNone {
+		return ErrNoAckPolicy
+	}
+	if len(o.state.Pending) == 0 || o.state.Pending[sseq] == nil {
+		return ErrStoreMsgNotFound
+	}
+
+	// On restarts the old leader may get a replay from the raft logs that are old.
+	if dseq <= o.state.AckFloor.Consumer {
+		return nil
+	}
+
+	// Check for AckAll here.
+	if o.cfg.AckPolicy == AckAll {
+		for seq := o.state.AckFloor.Stream + 1; seq <= sseq; seq++ {
+			delete(o.state.Pending, seq)
+			delete(o.state.Redelivered, seq)
+		}
+		o.state.AckFloor.Consumer, o.state.AckFloor.Stream = dseq, sseq
+		return nil
+	}
+
+	// AckExplicit, use the original delivery sequence.
+	dseq = o.state.Pending[sseq].Sequence
+	delete(o.state.Pending, sseq)
+	delete(o.state.Redelivered, sseq)
+
+	if len(o.state.Pending) == 0 {
+		o.state.AckFloor = o.state.Delivered
+	} else if dseq == o.state.AckFloor.Consumer+1 {
+		first := o.state.AckFloor.Consumer == 0
+		o.state.AckFloor.Consumer, o.state.AckFloor.Stream = dseq, sseq
+
+		if !first && o.state.Delivered.Consumer > dseq {
+			for ss := sseq + 1; ss < o.state.Delivered.Stream; ss++ {
+				if p, ok := o.state.Pending[ss]; ok {
+					if p.Sequence > 0 {
+						o.state.AckFloor.Consumer, o.state.AckFloor.Stream = p.Sequence-1, ss-1
+					}
+					break
+				}
+			}
+		}
+	}
+	// Do not move past any messages held back for partitions.
+	if len(o.state.Held) > 0 && o.state.Held[0] <= o.state.AckFloor.Stream {
+		o.state.AckFloor.Stream = o.state.Held[0] - 1
+	}
+	return nil
+}
+
+// UpdateHeld is called when a consumer holds back or releases a message for a partition or schedule.
+func (o *consumerMemStore) UpdateHeld(sseq uint64, held bool) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	i := sort.Search(len(o.state.Held), func(i int) bool { return o.state.Held[i] >= sseq })
+	if found := i < len(o.state.Held) && o.state.Held[i] == sseq; held == found {
+		return nil
+	}
+	if held {
+		o.state.Held = append(o.state.Held, 0)
+		copy(o.state.Held[i+1:], o.state.Held[i:])
+		o.state.Held[i] = sseq
+	} else {
+		o.state.Held = append(o.state.Held[:i], o.state.Held[i+1:]...)
+	}
+	return nil
 }
-func (os *consumerMemStore) StreamDelete() error {
-	return os.Stop()
+
+func (o *consumerMemStore) UpdateConfig(cfg *ConsumerConfig) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// This is mostly unchecked here. We are assuming the upper layers have done sanity checking.
+	o.cfg = *cfg
+	return nil
 }
 
-func (os *consumerMemStore) State() (*ConsumerState, error) { return nil, nil }
+func (o *consumerMemStore) Stop() error {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	o.mu.Unlock()
+
+	switch ms := o.ms.(type) {
+	case *memStore:
+		ms.decConsumers()
+	case *fileStore:
+		ms.decMemConsumers()
+	}
+	return nil
+}
+
+func (o *consumerMemStore) Delete() error {
+	return o.Stop()
+}
+
+func (o *consumerMemStore) StreamDelete() error {
+	return o.Stop()
+}
+
+// State returns a copy of our current state.
+func (o *consumerMemStore) State() (*ConsumerState, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return nil, ErrStoreClosed
+	}
+	state := &ConsumerState{
+		Delivered:  o.state.Delivered,
+		AckFloor:   o.state.AckFloor,
+		PauseUntil: o.state.PauseUntil,
+	}
+	if len(o.state.Pending) > 0 {
+		state.Pending = make(map[uint64]*Pending, len(o.state.Pending))
+		for seq, p := range o.state.Pending {
+			state.Pending[seq] = &Pending{p.Sequence, p.Timestamp}
+		}
+	}
+	if len(o.state.Redelivered) > 0 {
+		state.Redelivered = make(map[uint64]uint64, len(o.state.Redelivered))
+		for seq, dc := range o.state.Redelivered {
+			state.Redelivered[seq] = dc
+		}
+	}
+	if len(o.state.Held) > 0 {
+		state.Held = append([]uint64(nil), o.state.Held...)
+	}
+	return state, nil
+}
 
 // Type returns the type of the underlying store.
-func (os *consumerMemStore) Type() StorageType { return MemoryStorage }
+func (o *consumerMemStore) Type() StorageType { return MemoryStorage }
 
 // Templates
 type templateMemStore struct{}
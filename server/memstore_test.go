@@ -391,3 +391,84 @@ func TestMemStoreStreamTruncate(t *testing.T) {
 		t.Fatalf("Expected deleted to be %+v, got %+v\n", expected, state.Deleted)
 	}
 }
+
+func TestMemStoreMessageTTL(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, AllowMsgTTL: true})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	ttlHdr := func(ttl string) []byte {
+		return genHeader(nil, JSMessageTTL, ttl)
+	}
+	msg := []byte("Hello World")
+	ms.StoreMsg("foo", ttlHdr("100ms"), msg)
+	ms.StoreMsg("bar", nil, msg)
+	ms.StoreMsg("foo", ttlHdr("1"), msg)
+	ms.StoreMsg("baz", ttlHdr("50ms"), msg)
+
+	checkFor(t, time.Second, 10*time.Millisecond, func() error {
+		if state := ms.State(); state.Msgs != 2 {
+			return fmt.Errorf("Expected 2 msgs, got %d", state.Msgs)
+		}
+		return nil
+	})
+	if _, err := ms.LoadMsg(2, nil); err != nil {
+		t.Fatalf("Expected msg without TTL to remain: %v", err)
+	}
+	if _, err := ms.LoadMsg(3, nil); err != nil {
+		t.Fatalf("Expected msg with longer TTL to remain: %v", err)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if state := ms.State(); state.Msgs != 1 {
+			return fmt.Errorf("Expected 1 msg, got %d", state.Msgs)
+		}
+		return nil
+	})
+
+	// Without the stream option the header is ignored.
+	ms2, err := newMemStore(&StreamConfig{Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms2.Stop()
+	ms2.StoreMsg("foo", ttlHdr("10ms"), msg)
+	time.Sleep(50 * time.Millisecond)
+	if state := ms2.State(); state.Msgs != 1 {
+		t.Fatalf("Expected 1 msg, got %d", state.Msgs)
+	}
+}
+
+func TestMemStoreDiscardNewPerSubject(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{
+		Storage:       MemoryStorage,
+		MaxMsgsPer:    1,
+		Discard:       DiscardNew,
+		DiscardNewPer: true,
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	defer ms.Stop()
+
+	msg := []byte("Hello World")
+	if _, _, err := ms.StoreMsg("foo", nil, msg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, _, err := ms.StoreMsg("foo", nil, msg); err != ErrMaxMsgsPerSubject {
+		t.Fatalf("Expected %v, got %v", ErrMaxMsgsPerSubject, err)
+	}
+	// Other subjects are not affected.
+	if _, _, err := ms.StoreMsg("bar", nil, msg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state := ms.State(); state.Msgs != 2 || state.LastSeq != 2 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	// Once removed we can store again.
+	ms.RemoveMsg(1)
+	if _, _, err := ms.StoreMsg("foo", nil, msg); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+}
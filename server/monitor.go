@@ -2489,6 +2489,9 @@ type JSInfo struct {
 	Bytes     uint64           `json:"bytes"`
 	Meta      *MetaClusterInfo `json:"meta_cluster,omitempty"`
 
+	// KeyRotation is the status of the last encryption key rotation, if any.
+	KeyRotation *JetStreamKeyRotation `json:"key_rotation,omitempty"`
+
 	// aggregate raft info
 	AccountDetails []*AccountDetail `json:"account_details,omitempty"`
 }
@@ -2633,6 +2636,10 @@ func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
 
 	s.js.mu.RLock()
 	jsi.Config = s.js.config
+	if kr := s.js.keyRotation; kr != nil {
+		kr := *kr
+		jsi.KeyRotation = &kr
+	}
 	for _, info := range s.js.accounts {
 		accounts = append(accounts, info)
 	}
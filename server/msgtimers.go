@@ -0,0 +1,184 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "container/heap"
+
+// A msgTimer is a single message sequence tracked by msgTimers.
+type msgTimer struct {
+	seq uint64
+	ts  int64
+	ti  int // Index into the time ordered heap.
+	si  int // Index into the sequence ordered heap.
+}
+
+// msgTimers tracks a time per message sequence, e.g. when a message expires.
+// Entries are ordered by both time and sequence so that the next timer to fire
+// and the lowest sequence tracked can be found without scanning all entries.
+// Not safe for concurrent use, callers are expected to hold their own lock.
+type msgTimers struct {
+	seqs   map[uint64]*msgTimer
+	byTime msgTimeHeap
+	bySeq  msgSeqHeap
+}
+
+func newMsgTimers() *msgTimers {
+	return &msgTimers{seqs: make(map[uint64]*msgTimer)}
+}
+
+// track will add or update the time for the given sequence.
+func (mt *msgTimers) track(seq uint64, ts int64) {
+	if t := mt.seqs[seq]; t != nil {
+		t.ts = ts
+		heap.Fix(&mt.byTime, t.ti)
+		return
+	}
+	t := &msgTimer{seq: seq, ts: ts}
+	mt.seqs[seq] = t
+	heap.Push(&mt.byTime, t)
+	heap.Push(&mt.bySeq, t)
+}
+
+// untrack will remove the sequence and report if it was being tracked.
+func (mt *msgTimers) untrack(seq uint64) bool {
+	t := mt.seqs[seq]
+	if t == nil {
+		return false
+	}
+	mt.remove(t)
+	return true
+}
+
+func (mt *msgTimers) remove(t *msgTimer) {
+	delete(mt.seqs, t.seq)
+	heap.Remove(&mt.byTime, t.ti)
+	heap.Remove(&mt.bySeq, t.si)
+}
+
+// get returns the time tracked for the sequence, if any.
+func (mt *msgTimers) get(seq uint64) (int64, bool) {
+	if t := mt.seqs[seq]; t != nil {
+		return t.ts, true
+	}
+	return 0, false
+}
+
+// len returns the number of sequences being tracked.
+func (mt *msgTimers) len() int {
+	return len(mt.seqs)
+}
+
+// next returns the earliest time tracked, or 0 if none.
+func (mt *msgTimers) next() int64 {
+	if len(mt.byTime) == 0 {
+		return 0
+	}
+	return mt.byTime[0].ts
+}
+
+// first returns the lowest sequence tracked, or 0 if none.
+func (mt *msgTimers) first() uint64 {
+	if len(mt.bySeq) == 0 {
+		return 0
+	}
+	return mt.bySeq[0].seq
+}
+
+// popExpired will remove and return the sequence with the earliest time
+// if that time is at or before now. Returns 0 otherwise.
+func (mt *msgTimers) popExpired(now int64) uint64 {
+	if len(mt.byTime) == 0 || mt.byTime[0].ts > now {
+		return 0
+	}
+	t := mt.byTime[0]
+	mt.remove(t)
+	return t.seq
+}
+
+// removeBelow will remove all sequences lower than seq.
+func (mt *msgTimers) removeBelow(seq uint64) {
+	for len(mt.bySeq) > 0 && mt.bySeq[0].seq < seq {
+		mt.remove(mt.bySeq[0])
+	}
+}
+
+// iter will call f for each sequence tracked, in no particular order.
+func (mt *msgTimers) iter(f func(seq uint64, ts int64)) {
+	for _, t := range mt.byTime {
+		f(t.seq, t.ts)
+	}
+}
+
+// msgTimeHeap implements heap.Interface ordered by time.
+type msgTimeHeap []*msgTimer
+
+func (h msgTimeHeap) Len() int { return len(h) }
+
+func (h msgTimeHeap) Less(i, j int) bool {
+	if h[i].ts == h[j].ts {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].ts < h[j].ts
+}
+
+func (h msgTimeHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].ti = i
+	h[j].ti = j
+}
+
+func (h *msgTimeHeap) Push(x interface{}) {
+	t := x.(*msgTimer)
+	t.ti = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *msgTimeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil // avoid memory leak
+	t.ti = -1
+	*h = old[:n-1]
+	return t
+}
+
+// msgSeqHeap implements heap.Interface ordered by sequence.
+type msgSeqHeap []*msgTimer
+
+func (h msgSeqHeap) Len() int { return len(h) }
+
+func (h msgSeqHeap) Less(i, j int) bool { return h[i].seq < h[j].seq }
+
+func (h msgSeqHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].si = i
+	h[j].si = j
+}
+
+func (h *msgSeqHeap) Push(x interface{}) {
+	t := x.(*msgTimer)
+	t.si = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *msgSeqHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil // avoid memory leak
+	t.si = -1
+	*h = old[:n-1]
+	return t
+}
@@ -0,0 +1,89 @@
+// Copyright 2022 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestMsgTimers(t *testing.T) {
+	mt := newMsgTimers()
+	if mt.next() != 0 || mt.first() != 0 || mt.popExpired(100) != 0 {
+		t.Fatalf("Expected empty timers")
+	}
+
+	// Add in random order with times that do not follow sequence order.
+	seqs := rand.Perm(100)
+	for _, i := range seqs {
+		seq := uint64(i + 1)
+		mt.track(seq, int64(1000-seq))
+	}
+	if mt.len() != 100 {
+		t.Fatalf("Expected 100 entries, got %d", mt.len())
+	}
+	if first := mt.first(); first != 1 {
+		t.Fatalf("Expected first of 1, got %d", first)
+	}
+	if next := mt.next(); next != 900 {
+		t.Fatalf("Expected next of 900, got %d", next)
+	}
+
+	// Update one to fire first.
+	mt.track(50, 10)
+	if next := mt.next(); next != 10 {
+		t.Fatalf("Expected next of 10, got %d", next)
+	}
+	if ts, ok := mt.get(50); !ok || ts != 10 {
+		t.Fatalf("Expected 10 for seq 50, got %d %v", ts, ok)
+	}
+
+	// Remove a few.
+	if !mt.untrack(100) || mt.untrack(100) {
+		t.Fatalf("Expected untrack to only succeed once")
+	}
+	mt.removeBelow(11)
+	if first := mt.first(); first != 11 {
+		t.Fatalf("Expected first of 11, got %d", first)
+	}
+	if mt.len() != 89 {
+		t.Fatalf("Expected 89 entries, got %d", mt.len())
+	}
+
+	// Expire in time order.
+	var got []uint64
+	for seq := mt.popExpired(950); seq > 0; seq = mt.popExpired(950) {
+		got = append(got, seq)
+	}
+	if len(got) != 50 || got[0] != 50 {
+		t.Fatalf("Unexpected expired sequences: %v", got)
+	}
+	if !sort.SliceIsSorted(got[1:], func(i, j int) bool { return got[i+1] > got[j+1] }) {
+		t.Fatalf("Expected expired sequences in time order, got %v", got)
+	}
+	if next := mt.next(); next != 951 {
+		t.Fatalf("Expected next of 951, got %d", next)
+	}
+	var n int
+	mt.iter(func(seq uint64, ts int64) {
+		if ts != int64(1000-seq) {
+			t.Fatalf("Unexpected time %d for seq %d", ts, seq)
+		}
+		n++
+	})
+	if n != mt.len() || n != 39 {
+		t.Fatalf("Expected to iterate 39 entries, got %d", n)
+	}
+}
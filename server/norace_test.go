@@ -2962,7 +2962,7 @@ func TestNoRaceJetStreamFileStoreCompaction(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Unexpected error: %v", err)
 	}
-	total, used, _ := mset.Store().Utilization()
+	total, used, _, _ := mset.Store().Utilization()
 	if pu := 100.0 * float32(used) / float32(total); pu < 80.0 {
 		t.Fatalf("Utilization is less than 80%%, got %.2f", pu)
 	}
@@ -4327,7 +4327,7 @@ func TestNoRaceFileStoreKeyFileCleanup(t *testing.T) {
 		FileStoreConfig{StoreDir: storeDir, BlockSize: 1024 * 1024},
 		StreamConfig{Name: "TEST", Storage: FileStorage},
 		time.Now(),
-		prf)
+		prf, nil)
 	require_NoError(t, err)
 	defer fs.Stop()
 
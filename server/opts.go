@@ -231,6 +231,10 @@ type Options struct {
 	JetStreamDomain       string        `json:"-"`
 	JetStreamExtHint      string        `json:"-"`
 	JetStreamKey          string        `json:"-"`
+	JetStreamOldKey       string        `json:"-"`
+	JetStreamKeyProvider  KeyProvider   `json:"-"`
+	JetStreamCipher       StoreCipher   `json:"-"`
+	JetStreamArchive      BlockArchive  `json:"-"`
 	JetStreamLimits       JSLimitOpts
 	StoreDir              string            `json:"-"`
 	JsAccDefaultDomain    map[string]string `json:"-"` // account to domain name mapping
@@ -281,6 +285,12 @@ type Options struct {
 	// CheckConfig configuration file syntax test was successful and exit.
 	CheckConfig bool `json:"-"`
 
+	// JetStreamVerify is a JetStream store directory to check, after which the server exits.
+	JetStreamVerify string `json:"-"`
+
+	// JetStreamRepair will repair problems found when checking a JetStream store directory.
+	JetStreamRepair bool `json:"-"`
+
 	// ConnectErrorReports specifies the number of failed attempts
 	// at which point server should report the failure of an initial
 	// connection to a route, gateway or leaf node.
@@ -1862,6 +1872,25 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 				doEnable = mv.(bool)
 			case "key", "ek", "encryption_key":
 				opts.JetStreamKey = mv.(string)
+			case "key_provider":
+				kp, err := parseJetStreamKeyProvider(tk, mv, errors, warnings)
+				if err != nil {
+					return err
+				}
+				opts.JetStreamKeyProvider = kp
+			case "prev_key", "prev_ek", "prev_encryption_key":
+				opts.JetStreamOldKey = mv.(string)
+			case "cipher":
+				switch strings.ToLower(mv.(string)) {
+				case "chacha", "chachapoly":
+					opts.JetStreamCipher = ChaCha
+				case "aes":
+					opts.JetStreamCipher = AES
+				default:
+					return &configErr{tk, fmt.Sprintf("Unknown cipher type: %q", mv)}
+				}
+			case "archive_dir", "archive":
+				opts.JetStreamArchive = &DirArchive{Dir: mv.(string)}
 			case "extension_hint":
 				opts.JetStreamExtHint = mv.(string)
 			case "limits":
@@ -1889,6 +1918,70 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 	return nil
 }
 
+// Parse the key provider for JetStream encryption.
+// e.g.
+//   key_provider: {type: file, path: "/etc/nats/js.key"}
+//   key_provider: {type: env, name: "JS_KEY"}
+//   key_provider: {type: exec, command: "/usr/local/bin/vault-key", args: ["js"], timeout: "5s"}
+func parseJetStreamKeyProvider(tk token, v interface{}, errors, warnings *[]error) (KeyProvider, error) {
+	var lt token
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected map to define a key provider, got %T", v)}
+	}
+	var kt, path, name, cmd string
+	var args []string
+	var timeout time.Duration
+	for mk, mv := range m {
+		tk, mv := unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "type":
+			kt = strings.ToLower(mv.(string))
+		case "path", "file":
+			path = mv.(string)
+		case "name", "var":
+			name = mv.(string)
+		case "command", "cmd":
+			cmd = mv.(string)
+		case "args":
+			av, ok := mv.([]interface{})
+			if !ok {
+				return nil, &configErr{tk, fmt.Sprintf("Expected array for key provider args, got %T", mv)}
+			}
+			for _, a := range av {
+				_, a = unwrapValue(a, &lt)
+				as, ok := a.(string)
+				if !ok {
+					return nil, &configErr{tk, fmt.Sprintf("Expected string for key provider arg, got %T", a)}
+				}
+				args = append(args, as)
+			}
+		case "timeout":
+			timeout = parseDuration("timeout", tk, mv, errors, warnings)
+		default:
+			return nil, &configErr{tk, fmt.Sprintf("Unknown field %q for key provider", mk)}
+		}
+	}
+	switch kt {
+	case "file":
+		if path == _EMPTY_ {
+			return nil, &configErr{tk, "Key provider of type 'file' requires a 'path'"}
+		}
+		return &FileKeyProvider{Path: path}, nil
+	case "env":
+		if name == _EMPTY_ {
+			return nil, &configErr{tk, "Key provider of type 'env' requires a 'name'"}
+		}
+		return &EnvKeyProvider{Name: name}, nil
+	case "exec":
+		if cmd == _EMPTY_ {
+			return nil, &configErr{tk, "Key provider of type 'exec' requires a 'command'"}
+		}
+		return &ExecKeyProvider{Command: cmd, Args: args, Timeout: timeout}, nil
+	}
+	return nil, &configErr{tk, fmt.Sprintf("Unknown key provider type: %q", kt)}
+}
+
 // parseLeafNodes will parse the leaf node config.
 func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
 	var lt token
@@ -4590,6 +4683,8 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.BoolVar(&opts.JetStream, "jetstream", false, "Enable JetStream.")
 	fs.StringVar(&opts.StoreDir, "sd", "", "Storage directory.")
 	fs.StringVar(&opts.StoreDir, "store_dir", "", "Storage directory.")
+	fs.StringVar(&opts.JetStreamVerify, "js-verify", "", "Check a JetStream storage directory and exit.")
+	fs.BoolVar(&opts.JetStreamRepair, "js-repair", false, "Repair problems found by --js-verify.")
 
 	// The flags definition above set "default" values to some of the options.
 	// Calling Parse() here will override the default options with any value
@@ -582,6 +582,25 @@ func (jso jetStreamOption) IsJetStreamChange() bool {
 	return true
 }
 
+// jetStreamKeyOption implements the option interface for the JetStream encryption key.
+// The new key has already been resolved, including from a key provider.
+type jetStreamKeyOption struct {
+	noopOption
+	newValue string
+}
+
+// Apply the new key by re-wrapping the keys of all encrypted file based streams.
+func (a *jetStreamKeyOption) Apply(s *Server) {
+	if ek, _ := s.jsEncryptionKeys(); ek == a.newValue {
+		return
+	}
+	s.optsMu.Lock()
+	s.jsKey = a.newValue
+	s.optsMu.Unlock()
+	s.rotateJetStreamKey()
+	s.Noticef("Reloaded: JetStream encryption key")
+}
+
 type ocspOption struct {
 	noopOption
 	newValue *OCSPConfig
@@ -885,7 +904,7 @@ func imposeOrder(value interface{}) error {
 		sort.Strings(value.AllowedOrigins)
 	case string, bool, uint8, int, int32, int64, time.Duration, float64, nil, LeafNodeOpts, ClusterOpts, *tls.Config, PinnedCertSet,
 		*URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication, MQTTOpts, jwt.TagList,
-		*OCSPConfig, map[string]string, JSLimitOpts:
+		*OCSPConfig, map[string]string, JSLimitOpts, StoreCipher, *FileKeyProvider, *EnvKeyProvider, *ExecKeyProvider, *DirArchive:
 		// explicitly skipped types
 	default:
 		// this will fail during unit tests
@@ -911,6 +930,7 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		jsMemLimitsChanged  bool
 		jsFileLimitsChanged bool
 		jsStoreDirChanged   bool
+		jsKeyChanged        bool
 	)
 	for i := 0; i < oldConfig.NumField(); i++ {
 		field := oldConfig.Type().Field(i)
@@ -1130,6 +1150,20 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 					return nil, fmt.Errorf("config reload not supported for jetstream storage directory")
 				}
 			}
+		case "jetstreamkey", "jetstreamkeyprovider":
+			// We can rotate the key of an encrypted store, but not turn encryption on or off.
+			if jsEnabled {
+				cur := s.getOpts()
+				wasEncrypted := cur.JetStreamKey != _EMPTY_ || cur.JetStreamKeyProvider != nil
+				isEncrypted := newOpts.JetStreamKey != _EMPTY_ || newOpts.JetStreamKeyProvider != nil
+				if wasEncrypted != isEncrypted {
+					return nil, fmt.Errorf("config reload not supported for jetstream encryption being enabled or disabled")
+				}
+				jsKeyChanged = true
+			}
+		case "jetstreamoldkey":
+			// Only used during recovery and rotation, nothing to apply.
+			continue
 		case "jetstreammaxmemory", "jetstreammaxstore":
 			old := oldValue.(int64)
 			new := newValue.(int64)
@@ -1250,6 +1284,14 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 		if jsStoreDirChanged {
 			return nil, fmt.Errorf("config reload not supported for jetstream storage dir")
 		}
+		// Resolve the new key now so a failing key provider fails the reload.
+		if jsKeyChanged {
+			key, err := resolveJetStreamKey(newOpts)
+			if err != nil {
+				return nil, fmt.Errorf("config reload failed for jetstream encryption key: %v", err)
+			}
+			diffOpts = append(diffOpts, &jetStreamKeyOption{newValue: key})
+		}
 	}
 
 	return diffOpts, nil
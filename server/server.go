@@ -119,6 +119,7 @@ type Server struct {
 	configFile          string
 	optsMu              sync.RWMutex
 	opts                *Options
+	jsKey               string // Resolved JetStream encryption key, protected by optsMu.
 	running             bool
 	shutdown            bool
 	reloading           bool
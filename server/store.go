@@ -34,6 +34,28 @@ const (
 	AnyStorage = StorageType(44)
 )
 
+// StoreCompression determines how message blocks are compressed on disk.
+type StoreCompression uint8
+
+const (
+	// NoCompression stores message blocks as is.
+	NoCompression = StoreCompression(iota)
+	// S2Compression compresses sealed message blocks with S2.
+	S2Compression
+)
+
+// StoreCipher determines the cipher used to encrypt assets at rest.
+type StoreCipher int
+
+const (
+	// ChaCha specifies XChaCha20-Poly1305 and is the default.
+	// Message block payloads use unauthenticated ChaCha20.
+	ChaCha = StoreCipher(iota)
+	// AES specifies AES-256-GCM.
+	// Message block payloads use unauthenticated AES-CTR.
+	AES
+)
+
 var (
 	// ErrStoreClosed is returned when the store has been closed
 	ErrStoreClosed = errors.New("store is closed")
@@ -101,7 +123,8 @@ type StreamStore interface {
 	Stop() error
 	ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerStore, error)
 	Snapshot(deadline time.Duration, includeConsumers, checkMsgs bool) (*SnapshotResult, error)
-	Utilization() (total, reported uint64, err error)
+	Utilization() (total, reported, compressed uint64, err error)
+	MsgSchedules() map[uint64]int64
 }
 
 // RetentionPolicy determines how messages in a set are retained.
@@ -168,6 +191,7 @@ type ConsumerStore interface {
 	UpdateDelivered(dseq, sseq, dc uint64, ts int64) error
 	UpdateAcks(dseq, sseq uint64) error
 	UpdateConfig(cfg *ConsumerConfig) error
+	UpdateHeld(sseq uint64, held bool) error
 	Update(*ConsumerState) error
 	State() (*ConsumerState, error)
 	Type() StorageType
@@ -194,6 +218,12 @@ type ConsumerState struct {
 	Pending map[uint64]*Pending `json:"pending,omitempty"`
 	// This is for messages that have been redelivered, so count > 1.
 	Redelivered map[uint64]uint64 `json:"redelivered,omitempty"`
+	// PauseUntil is set when delivery has been paused until this time.
+	PauseUntil *time.Time `json:"pause_until,omitempty"`
+	// Held are stream sequences that were not delivered yet since their
+	// partition had a message outstanding or they were scheduled for later.
+	// Always above the ack floor.
+	Held []uint64 `json:"held,omitempty"`
 }
 
 // Represents a pending message for explicit ack or ack all.
@@ -339,6 +369,56 @@ func (st *StorageType) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+const (
+	noCompressionString = "none"
+	s2CompressionString = "s2"
+)
+
+func (alg StoreCompression) String() string {
+	switch alg {
+	case NoCompression:
+		return "None"
+	case S2Compression:
+		return "S2"
+	default:
+		return "Unknown Compression"
+	}
+}
+
+func (alg StoreCompression) MarshalJSON() ([]byte, error) {
+	switch alg {
+	case NoCompression:
+		return json.Marshal(noCompressionString)
+	case S2Compression:
+		return json.Marshal(s2CompressionString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", alg)
+	}
+}
+
+func (alg *StoreCompression) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(noCompressionString), jsonString(_EMPTY_):
+		*alg = NoCompression
+	case jsonString(s2CompressionString):
+		*alg = S2Compression
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
+func (sc StoreCipher) String() string {
+	switch sc {
+	case ChaCha:
+		return "ChaCha20-Poly1305"
+	case AES:
+		return "AES-GCM"
+	default:
+		return "Unknown StoreCipher"
+	}
+}
+
 const (
 	ackNonePolicyString     = "none"
 	ackAllPolicyString      = "all"
@@ -400,6 +480,39 @@ func (rp *ReplayPolicy) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+const (
+	priorityNonePolicyString         = "none"
+	priorityOverflowPolicyString     = "overflow"
+	priorityPinnedClientPolicyString = "pinned_client"
+)
+
+func (pp PriorityPolicy) MarshalJSON() ([]byte, error) {
+	switch pp {
+	case PriorityNone:
+		return json.Marshal(priorityNonePolicyString)
+	case PriorityOverflow:
+		return json.Marshal(priorityOverflowPolicyString)
+	case PriorityPinnedClient:
+		return json.Marshal(priorityPinnedClientPolicyString)
+	default:
+		return nil, fmt.Errorf("can not marshal %v", pp)
+	}
+}
+
+func (pp *PriorityPolicy) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case jsonString(priorityNonePolicyString):
+		*pp = PriorityNone
+	case jsonString(priorityOverflowPolicyString):
+		*pp = PriorityOverflow
+	case jsonString(priorityPinnedClientPolicyString):
+		*pp = PriorityPinnedClient
+	default:
+		return fmt.Errorf("can not unmarshal %q", data)
+	}
+	return nil
+}
+
 const (
 	deliverAllPolicyString       = "all"
 	deliverLastPolicyString      = "last"
@@ -461,6 +574,69 @@ func isClusterResetErr(err error) bool {
 	return err == errLastSeqMismatch || err == ErrStoreEOF || err == errFirstSequenceMismatch
 }
 
+// getMessageTTL returns the per-message TTL from the message headers.
+// Will return 0 if no TTL is present.
+func getMessageTTL(hdr []byte) (time.Duration, error) {
+	if len(hdr) == 0 {
+		return 0, nil
+	}
+	ttl := getHeader(JSMessageTTL, hdr)
+	if len(ttl) == 0 {
+		return 0, nil
+	}
+	return parseMessageTTL(string(ttl))
+}
+
+// parseMessageTTL parses a per-message TTL. This can be a number of
+// seconds or a duration string, e.g. "1m30s".
+func parseMessageTTL(ttl string) (time.Duration, error) {
+	if secs := parseInt64([]byte(ttl)); secs > 0 {
+		return time.Duration(secs) * time.Second, nil
+	}
+	d, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, err
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("message TTL must be positive")
+	}
+	return d, nil
+}
+
+// getMessageSchedule returns the time in unix nanoseconds a message becomes due
+// for delivery based on its headers and stored timestamp.
+// Will return 0 if the message is not scheduled.
+func getMessageSchedule(hdr []byte, ts int64) (int64, error) {
+	if len(hdr) == 0 {
+		return 0, nil
+	}
+	at, delay := getHeader(JSScheduleAt, hdr), getHeader(JSScheduleDelay, hdr)
+	if len(at) == 0 && len(delay) == 0 {
+		return 0, nil
+	}
+	return parseMessageSchedule(string(at), string(delay), ts)
+}
+
+// parseMessageSchedule parses either an absolute RFC3339 time or a delay relative
+// to the stored timestamp. The delay can be a number of seconds or a duration string.
+func parseMessageSchedule(at, delay string, ts int64) (int64, error) {
+	if at != _EMPTY_ && delay != _EMPTY_ {
+		return 0, fmt.Errorf("message schedule can not set both a time and a delay")
+	}
+	if at != _EMPTY_ {
+		t, err := time.Parse(time.RFC3339Nano, at)
+		if err != nil {
+			return 0, err
+		}
+		return t.UnixNano(), nil
+	}
+	d, err := parseMessageTTL(delay)
+	if err != nil {
+		return 0, err
+	}
+	return ts + int64(d), nil
+}
+
 // Copy all fields.
 func (smo *StoreMsg) copy(sm *StoreMsg) {
 	if sm.buf != nil {
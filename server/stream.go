@@ -57,6 +57,26 @@ type StreamConfig struct {
 	Mirror       *StreamSource   `json:"mirror,omitempty"`
 	Sources      []*StreamSource `json:"sources,omitempty"`
 
+	// SubjectTransform will map the subject of inbound messages before they are stored.
+	SubjectTransform *SubjectTransformConfig `json:"subject_transform,omitempty"`
+
+	// RePublish will publish messages to a core NATS subject once they have been stored.
+	RePublish *RePublish `json:"republish,omitempty"`
+
+	// Compression will compress sealed message blocks on disk. Only valid for file storage.
+	Compression StoreCompression `json:"compression,omitempty"`
+
+	// Tier will move sealed message blocks to the server's archive once they are old enough.
+	// Only valid for file storage.
+	Tier *TierPolicy `json:"tier,omitempty"`
+
+	// DiscardNewPer will reject new messages for a subject that has reached MaxMsgsPer
+	// instead of removing the oldest. Requires the DiscardNew policy.
+	DiscardNewPer bool `json:"discard_new_per_subject,omitempty"`
+
+	// Metadata is a set of application defined key/value pairs. Can be updated at any time.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
 	// Optional qualifiers. These can not be modified after set to true.
 
 	// Sealed will seal a stream so no messages can get out or in.
@@ -68,6 +88,22 @@ type StreamConfig struct {
 	// AllowRollup allows messages to be placed into the system and purge
 	// all older messages using a special msg header.
 	AllowRollup bool `json:"allow_rollup_hdrs"`
+
+	// AllowDirect allows direct gets of messages from any replica of the stream.
+	AllowDirect bool `json:"allow_direct"`
+	// MirrorDirect allows a mirror to also answer direct gets for the stream it mirrors.
+	MirrorDirect bool `json:"mirror_direct"`
+
+	// AllowMsgTTL allows messages to set their own expiration with the Nats-TTL header.
+	AllowMsgTTL bool `json:"allow_msg_ttl"`
+
+	// AllowAtomicPublish allows messages to be published in batches that are stored all or none.
+	// With DiscardOld, messages removed to make room for a batch that then fails to store are not restored.
+	AllowAtomicPublish bool `json:"allow_atomic"`
+
+	// AllowMsgSchedules allows messages to be held back from consumers until a future time
+	// with the Nats-Schedule-At or Nats-Delay headers.
+	AllowMsgSchedules bool `json:"allow_msg_schedules"`
 }
 
 // JSPubAckResponse is a formal response to a publish operation.
@@ -103,6 +139,32 @@ type StreamInfo struct {
 	Cluster *ClusterInfo        `json:"cluster,omitempty"`
 	Mirror  *StreamSourceInfo   `json:"mirror,omitempty"`
 	Sources []*StreamSourceInfo `json:"sources,omitempty"`
+
+	Compression *StreamCompressionInfo `json:"compression,omitempty"`
+	Tier        *StreamTierInfo        `json:"tier,omitempty"`
+}
+
+// StreamCompressionInfo shows the raw and compressed sizes of a compressed stream.
+type StreamCompressionInfo struct {
+	Algorithm       StoreCompression `json:"algorithm"`
+	RawBytes        uint64           `json:"raw_bytes"`
+	CompressedBytes uint64           `json:"compressed_bytes"`
+}
+
+// TierPolicy determines when sealed message blocks are moved to the archive.
+// Archived blocks are fetched back as needed and kept in a small cache.
+type TierPolicy struct {
+	// Age of the newest message in a sealed block before it is moved to the archive.
+	Age time.Duration `json:"age"`
+	// CacheBlocks is the number of archived blocks kept in memory once fetched.
+	CacheBlocks int `json:"cache_blocks,omitempty"`
+}
+
+// StreamTierInfo shows how much of a stream's storage is local and how much is archived.
+type StreamTierInfo struct {
+	HotBytes   uint64 `json:"hot_bytes"`
+	ColdBytes  uint64 `json:"cold_bytes"`
+	ColdBlocks int    `json:"cold_blocks"`
 }
 
 // ClusterInfo shows information about the underlying set of servers
@@ -140,10 +202,30 @@ type StreamSource struct {
 	FilterSubject string          `json:"filter_subject,omitempty"`
 	External      *ExternalStream `json:"external,omitempty"`
 
+	// SubjectTransform will map the subject of messages received from this source.
+	SubjectTransform *SubjectTransformConfig `json:"subject_transform,omitempty"`
+
 	// Internal
 	iname string // For indexing when stream names are the same for multiple sources.
 }
 
+// SubjectTransformConfig maps subjects matching the source to the destination.
+// The destination can use the same mapping functions as account subject mappings,
+// e.g. {{wildcard(1)}} or {{partition(3,1)}}. An empty source will match all subjects.
+type SubjectTransformConfig struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+}
+
+// RePublish is for republishing messages once committed to a stream. The source
+// is matched against the stored subject and the destination can use the same
+// mapping functions as subject transforms. An empty source will match all subjects.
+type RePublish struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+	HeadersOnly bool   `json:"headers_only,omitempty"`
+}
+
 // ExternalStream allows you to qualify access to a stream source in another account.
 type ExternalStream struct {
 	ApiPrefix     string `json:"api"`
@@ -171,6 +253,8 @@ type stream struct {
 	consumers map[string]*consumer
 	numFilter int
 	cfg       StreamConfig
+	itr       *transform
+	tr        *transform
 	created   time.Time
 	stype     StorageType
 	tier      string
@@ -191,6 +275,17 @@ type stream struct {
 	// Indicates we have direct consumers.
 	directs int
 
+	// Atomic batches that are being staged by the leader, and their total size.
+	batches    map[string]*batchGroup
+	batchBytes int
+	// Held while storing messages so that an atomic batch is not interleaved with other messages.
+	batchMu sync.Mutex
+
+	// Direct get subscriptions and queue for requests that need to be processed out of line.
+	directSub       *subscription
+	mirrorDirectSub *subscription
+	gets            *ipQueue // of *directGetReq
+
 	// TODO(dlc) - Hide everything below behind two pointers.
 	// Clustered mode.
 	sa       *streamAssignment
@@ -211,6 +306,7 @@ type sourceInfo struct {
 	iname string
 	cname string
 	sub   *subscription
+	tr    *transform
 	msgs  *ipQueue // of *inMsg
 	sseq  uint64
 	dseq  uint64
@@ -236,6 +332,39 @@ const (
 	JSMsgRollup           = "Nats-Rollup"
 	JSMsgSize             = "Nats-Msg-Size"
 	JSResponseType        = "Nats-Response-Type"
+	JSMessageTTL          = "Nats-TTL"
+	JSScheduleAt          = "Nats-Schedule-At"
+	JSScheduleDelay       = "Nats-Delay"
+	JSBatchId             = "Nats-Batch-Id"
+	JSBatchSeq            = "Nats-Batch-Sequence"
+	JSBatchCommit         = "Nats-Batch-Commit"
+)
+
+// Header for pinned pull consumer clients.
+const JSPullRequestPinId = "Nats-Pin-Id"
+
+// Headers for republished messages.
+const (
+	JSStream       = "Nats-Stream"
+	JSSequence     = "Nats-Sequence"
+	JSTimeStamp    = "Nats-Time-Stamp"
+	JSSubject      = "Nats-Subject"
+	JSLastSequence = "Nats-Last-Sequence"
+)
+
+// Headers for dead lettered messages, along with the republish headers.
+const (
+	JSConsumer         = "Nats-Consumer"
+	JSNumDelivered     = "Nats-Num-Delivered"
+	JSDeadLetterReason = "Nats-Dead-Letter-Reason"
+	JSLastNakReason    = "Nats-Last-Nak-Reason"
+	JSTermReason       = "Nats-Term-Reason"
+)
+
+// Reasons a message was dead lettered.
+const (
+	deadLetterMaxDeliveries = "max_deliveries"
+	deadLetterTerminated    = "terminated"
 )
 
 // Rollups, can be subject only or all messages.
@@ -399,10 +528,16 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		tier:      tier,
 		stype:     cfg.Storage,
 		consumers: make(map[string]*consumer),
-		msgs:      s.newIPQueue(qpfx + "messages"), // of *inMsg
+		msgs:      s.newIPQueue(qpfx + "messages"),    // of *inMsg
+		gets:      s.newIPQueue(qpfx + "direct gets"), // of *directGetReq
 		qch:       make(chan struct{}),
 	}
 
+	// Setup our subject transforms for inbound and republished messages if configured.
+	// The config has been checked above so these can not fail.
+	mset.itr, _ = newSubjectTransform(cfg.SubjectTransform)
+	mset.tr, _ = newRePublishTransform(cfg.RePublish)
+
 	// For no-ack consumers when we are interest retention.
 	if cfg.Retention != LimitsPolicy {
 		mset.ackq = s.newIPQueue(qpfx + "acks") // of uint64
@@ -463,6 +598,15 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	// Setup our internal send go routine.
 	mset.setupSendCapabilities()
 
+	// Check if we allow direct gets. This is for all replicas.
+	mset.mu.Lock()
+	err = mset.subscribeToDirect()
+	mset.mu.Unlock()
+	if err != nil {
+		mset.stop(true, false)
+		return nil, err
+	}
+
 	// Reserve resources if MaxBytes present.
 	mset.js.reserveStreamResources(&mset.cfg)
 
@@ -843,6 +987,25 @@ func (jsa *jsAccount) subjectsOverlap(subjects []string) bool {
 // StreamDefaultDuplicatesWindow default duplicates window.
 const StreamDefaultDuplicatesWindow = 2 * time.Minute
 
+// metadataSize returns the combined length of all metadata keys and values.
+func metadataSize(md map[string]string) int {
+	var sz int
+	for k, v := range md {
+		sz += len(k) + len(v)
+	}
+	return sz
+}
+
+// metadataMatches returns true if every key/value pair in filter is present in md.
+func metadataMatches(md, filter map[string]string) bool {
+	for k, v := range filter {
+		if mv, ok := md[k]; !ok || mv != v {
+			return false
+		}
+	}
+	return true
+}
+
 func checkStreamCfg(config *StreamConfig, lim *JSLimitOpts) (StreamConfig, error) {
 	if config == nil {
 		return StreamConfig{}, fmt.Errorf("stream configuration invalid")
@@ -856,6 +1019,9 @@ func checkStreamCfg(config *StreamConfig, lim *JSLimitOpts) (StreamConfig, error
 	if len(config.Description) > JSMaxDescriptionLen {
 		return StreamConfig{}, fmt.Errorf("stream description is too long, maximum allowed is %d", JSMaxDescriptionLen)
 	}
+	if metadataSize(config.Metadata) > JSMaxMetadataLen {
+		return StreamConfig{}, fmt.Errorf("stream metadata exceeds maximum size of %d bytes", JSMaxMetadataLen)
+	}
 
 	cfg := *config
 
@@ -910,6 +1076,31 @@ func checkStreamCfg(config *StreamConfig, lim *JSLimitOpts) (StreamConfig, error
 		return StreamConfig{}, fmt.Errorf("roll-ups require the purge permission")
 	}
 
+	if cfg.Compression != NoCompression && cfg.Storage != FileStorage {
+		return StreamConfig{}, fmt.Errorf("compression is only supported for file storage")
+	}
+
+	if cfg.Tier != nil {
+		if cfg.Storage != FileStorage {
+			return StreamConfig{}, fmt.Errorf("tiered storage is only supported for file storage")
+		}
+		if cfg.Tier.Age <= 0 {
+			return StreamConfig{}, fmt.Errorf("tier age must be greater than zero")
+		}
+		if cfg.Tier.CacheBlocks < 0 {
+			return StreamConfig{}, fmt.Errorf("tier cache blocks can not be negative")
+		}
+	}
+
+	if cfg.DiscardNewPer {
+		if cfg.Discard != DiscardNew {
+			return StreamConfig{}, fmt.Errorf("discard new per subject requires discard new policy to be set")
+		}
+		if cfg.MaxMsgsPer <= 0 {
+			return StreamConfig{}, fmt.Errorf("discard new per subject requires max messages per subject > 0")
+		}
+	}
+
 	if len(cfg.Subjects) == 0 {
 		if cfg.Mirror == nil && len(cfg.Sources) == 0 {
 			cfg.Subjects = append(cfg.Subjects, cfg.Name)
@@ -937,9 +1128,103 @@ func checkStreamCfg(config *StreamConfig, lim *JSLimitOpts) (StreamConfig, error
 			dset[subj] = struct{}{}
 		}
 	}
+
+	// Check any subject transforms.
+	if cfg.SubjectTransform != nil {
+		if cfg.Mirror != nil {
+			return StreamConfig{}, fmt.Errorf("stream mirrors can not have a subject transform")
+		}
+		if err := cfg.SubjectTransform.validate(); err != nil {
+			return StreamConfig{}, err
+		}
+	}
+	if cfg.Mirror != nil && cfg.Mirror.SubjectTransform != nil {
+		if err := cfg.Mirror.SubjectTransform.validate(); err != nil {
+			return StreamConfig{}, err
+		}
+	}
+	for _, ss := range cfg.Sources {
+		if ss != nil && ss.SubjectTransform != nil {
+			if err := ss.SubjectTransform.validate(); err != nil {
+				return StreamConfig{}, err
+			}
+		}
+	}
+
+	// Check for direct gets from mirrors.
+	if cfg.MirrorDirect {
+		if cfg.Mirror == nil {
+			return StreamConfig{}, fmt.Errorf("stream configuration for mirror direct requires a mirror")
+		}
+		if cfg.Mirror.External != nil {
+			return StreamConfig{}, fmt.Errorf("stream configuration for mirror direct can not be used with external mirrors")
+		}
+		if cfg.Mirror.SubjectTransform != nil {
+			return StreamConfig{}, fmt.Errorf("stream configuration for mirror direct can not be used with a subject transform")
+		}
+	}
+
+	// Check for republish.
+	if cfg.RePublish != nil {
+		if cfg.RePublish.Destination == _EMPTY_ {
+			return StreamConfig{}, fmt.Errorf("stream configuration for republish requires a destination")
+		}
+		tr, err := newRePublishTransform(cfg.RePublish)
+		if err != nil {
+			return StreamConfig{}, fmt.Errorf("stream configuration for republish from %q to %q is invalid: %v",
+				cfg.RePublish.Source, cfg.RePublish.Destination, err)
+		}
+		// Make sure we do not form a cycle with our own subjects or publish into the jetstream api.
+		dest := tr.destPattern()
+		for _, subj := range cfg.Subjects {
+			if SubjectsCollide(dest, subj) {
+				return StreamConfig{}, fmt.Errorf("stream configuration for republish destination forms a cycle")
+			}
+		}
+		if SubjectsCollide(dest, "$JS.API.>") {
+			return StreamConfig{}, fmt.Errorf("stream configuration for republish destination overlaps with jetstream api")
+		}
+	}
 	return cfg, nil
 }
 
+// newSubjectTransform will create the transform for the given config.
+// Returns nil if the config is nil.
+func newSubjectTransform(st *SubjectTransformConfig) (*transform, error) {
+	if st == nil {
+		return nil, nil
+	}
+	src := st.Source
+	if src == _EMPTY_ {
+		src = fwcs
+	}
+	return newTransform(src, st.Destination)
+}
+
+// Check that a subject transform is valid.
+func (st *SubjectTransformConfig) validate() error {
+	if st.Destination == _EMPTY_ {
+		return fmt.Errorf("subject transform destination is required")
+	}
+	tr, err := newSubjectTransform(st)
+	if err != nil {
+		return fmt.Errorf("subject transform from %q to %q is invalid: %v", st.Source, st.Destination, err)
+	}
+	if SubjectsCollide(tr.destPattern(), "$JS.API.>") {
+		return fmt.Errorf("subject transform destination overlaps with jetstream api")
+	}
+	return nil
+}
+
+// newRePublishTransform will create the transform for the republish config.
+// Returns nil if the config is nil.
+func newRePublishTransform(rp *RePublish) (*transform, error) {
+	if rp == nil {
+		return nil, nil
+	}
+	return newSubjectTransform(&SubjectTransformConfig{Source: rp.Source, Destination: rp.Destination})
+}
+
 // Config returns the stream's configuration.
 func (mset *stream) config() StreamConfig {
 	mset.mu.RLock()
@@ -957,6 +1242,22 @@ func (mset *stream) fileStoreConfig() (FileStoreConfig, error) {
 	return fs.fileStoreConfig(), nil
 }
 
+// promotedStreamConfig returns the configuration for a mirror being promoted to a standalone stream.
+// The mirror is removed and the optional subjects are assigned, all other settings are kept.
+func promotedStreamConfig(ocfg *StreamConfig, subjects []string, lim *JSLimitOpts) (*StreamConfig, *ApiError) {
+	if ocfg.Mirror == nil {
+		return nil, NewJSStreamNotMirrorError()
+	}
+	ncfg := *ocfg
+	ncfg.Mirror, ncfg.MirrorDirect = nil, false
+	ncfg.Subjects = subjects
+	cfg, err := checkStreamCfg(&ncfg, lim)
+	if err != nil {
+		return nil, NewJSStreamInvalidConfigError(err, Unless(err))
+	}
+	return &cfg, nil
+}
+
 // Do not hold jsAccount or jetStream lock
 func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, lim *JSLimitOpts) (*StreamConfig, error) {
 	cfg, err := checkStreamCfg(new, lim)
@@ -987,6 +1288,10 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, lim *JSLimitOpts
 	if cfg.Template != _EMPTY_ {
 		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not be owned by a template"))
 	}
+	// Only the promote API can remove a mirror.
+	if !reflect.DeepEqual(cfg.Mirror, old.Mirror) {
+		return nil, NewJSStreamMirrorNotUpdatableError()
+	}
 	// Can not change from true to false.
 	if !cfg.Sealed && old.Sealed {
 		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not unseal a sealed stream"))
@@ -1069,13 +1374,44 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, lim *JSLimitOpts
 
 // Update will allow certain configuration properties of an existing stream to be updated.
 func (mset *stream) update(config *StreamConfig) error {
+	return mset.updateConfig(config, false)
+}
+
+// promote will turn a mirror into a standalone stream with the given configuration,
+// which is otherwise checked like any other update.
+func (mset *stream) promote(config *StreamConfig) error {
+	return mset.updateConfig(config, true)
+}
+
+func (mset *stream) updateConfig(config *StreamConfig, promote bool) error {
 	ocfg := mset.config()
-	cfg, err := mset.jsa.configUpdateCheck(&ocfg, config, &mset.srv.getOpts().JetStreamLimits)
+	// Check against the configuration without our mirror, since removing it is allowed here.
+	ccfg := ocfg
+	if promote {
+		ccfg.Mirror = nil
+	}
+	cfg, err := mset.jsa.configUpdateCheck(&ccfg, config, &mset.srv.getOpts().JetStreamLimits)
 	if err != nil {
 		return NewJSStreamInvalidConfigError(err, Unless(err))
 	}
+	// Tiering needs the archive our store was created with.
+	if cfg.Tier != nil {
+		if fs, ok := mset.store.(*fileStore); !ok || fs.fileStoreConfig().Archive == nil {
+			return NewJSStreamInvalidConfigError(errNoArchive)
+		}
+	}
+
+	// If we are promoting a mirror make sure the mirror consumer is stopped first.
+	promoted := promote && ocfg.Mirror != nil
+	if promoted {
+		mset.cancelMirrorConsumer()
+	}
 
 	mset.mu.Lock()
+	if promoted {
+		// Any inbound mirror messages will be ignored from here on.
+		mset.mirror = nil
+	}
 	if mset.isLeader() {
 		// Now check for subject interest differences.
 		current := make(map[string]struct{}, len(ocfg.Subjects))
@@ -1124,6 +1460,7 @@ func (mset *stream) update(config *StreamConfig) error {
 					mset.cfg.Sources = append(mset.cfg.Sources, s)
 					qname := fmt.Sprintf("[ACC:%s] stream source '%s' from '%s' msgs", mset.acc.Name, mset.cfg.Name, s.Name)
 					si := &sourceInfo{name: s.Name, iname: s.iname, msgs: mset.srv.newIPQueue(qname) /* of *inMsg */}
+					si.tr, _ = newSubjectTransform(s.SubjectTransform)
 					mset.sources[s.iname] = si
 					mset.setStartingSequenceForSource(s.iname)
 					mset.setSourceConsumer(s.iname, si.sseq+1)
@@ -1144,7 +1481,7 @@ func (mset *stream) update(config *StreamConfig) error {
 		// In cases such as R1->R3, only one update is needed
 		if _, ok := mset.jsa.limits[targetTier]; ok {
 			// error never set
-			_, reported, _ := mset.store.Utilization()
+			_, reported, _, _ := mset.store.Utilization()
 			mset.jsa.updateUsage(mset.tier, mset.stype, -int64(reported))
 			mset.jsa.updateUsage(targetTier, mset.stype, int64(reported))
 			mset.tier = targetTier
@@ -1156,6 +1493,32 @@ func (mset *stream) update(config *StreamConfig) error {
 	// Now update config and store's version of our config.
 	mset.cfg = *cfg
 
+	// Update any subject transforms.
+	mset.itr, _ = newSubjectTransform(cfg.SubjectTransform)
+	mset.tr, _ = newRePublishTransform(cfg.RePublish)
+
+	// Check for changes to direct gets.
+	if !cfg.AllowDirect && mset.directSub != nil {
+		mset.unsubscribe(mset.directSub)
+		mset.directSub = nil
+	}
+	if !cfg.MirrorDirect && mset.mirrorDirectSub != nil {
+		mset.unsubscribe(mset.mirrorDirectSub)
+		mset.mirrorDirectSub = nil
+	}
+	if err := mset.subscribeToDirect(); err != nil {
+		mset.mu.Unlock()
+		return err
+	}
+	if mset.mirror != nil && cfg.Mirror != nil {
+		mset.mirror.tr, _ = newSubjectTransform(cfg.Mirror.SubjectTransform)
+	}
+	for _, ssi := range cfg.Sources {
+		if si := mset.sources[ssi.iname]; si != nil {
+			si.tr, _ = newSubjectTransform(ssi.SubjectTransform)
+		}
+	}
+
 	// If we are the leader never suppres update advisory, simply send.
 	if mset.isLeader() {
 		mset.sendUpdateAdvisoryLocked()
@@ -1272,6 +1635,45 @@ func (mset *stream) hasSources() bool {
 	return len(mset.sources) > 0
 }
 
+// compressionInfo returns the compression details for the stream, if any.
+func (mset *stream) compressionInfo() *StreamCompressionInfo {
+	mset.mu.RLock()
+	alg, store := mset.cfg.Compression, mset.store
+	mset.mu.RUnlock()
+
+	if alg == NoCompression || store == nil {
+		return nil
+	}
+	total, _, compressed, err := store.Utilization()
+	if err != nil {
+		return nil
+	}
+	return &StreamCompressionInfo{Algorithm: alg, RawBytes: total, CompressedBytes: compressed}
+}
+
+// tierInfo returns the local and archived storage for the stream, if tiered.
+func (mset *stream) tierInfo() *StreamTierInfo {
+	mset.mu.RLock()
+	fs, ok := mset.store.(*fileStore)
+	mset.mu.RUnlock()
+
+	if !ok {
+		return nil
+	}
+	hot, cold, blocks := fs.tierUsage()
+	// Blocks can remain in the archive after the policy is removed.
+	if blocks == 0 && !mset.isTiered() {
+		return nil
+	}
+	return &StreamTierInfo{HotBytes: hot, ColdBytes: cold, ColdBlocks: blocks}
+}
+
+func (mset *stream) isTiered() bool {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.cfg.Tier != nil
+}
+
 func (mset *stream) sourcesInfo() (sis []*StreamSourceInfo) {
 	mset.mu.RLock()
 	defer mset.mu.RUnlock()
@@ -1293,6 +1695,7 @@ func allSubjects(cfg *StreamConfig, acc *Account) ([]string, bool) {
 		if len(subjs) > 0 {
 			subjects = append(subjects, subjs...)
 		}
+		subjects = appendTransformSubject(subjects, cfg.Mirror.SubjectTransform)
 	} else if len(cfg.Sources) > 0 {
 		var subjs []string
 		seen = make(map[string]bool)
@@ -1301,12 +1704,23 @@ func allSubjects(cfg *StreamConfig, acc *Account) ([]string, bool) {
 			if len(subjs) > 0 {
 				subjects = append(subjects, subjs...)
 			}
+			subjects = appendTransformSubject(subjects, si.SubjectTransform)
 		}
 	}
+	subjects = appendTransformSubject(subjects, cfg.SubjectTransform)
 
 	return subjects, hasExt
 }
 
+// Messages can be stored under the destination of a subject transform,
+// so add that to the subjects as a pattern.
+func appendTransformSubject(subjects []string, st *SubjectTransformConfig) []string {
+	if tr, _ := newSubjectTransform(st); tr != nil {
+		subjects = append(subjects, tr.destPattern())
+	}
+	return subjects
+}
+
 // Return the subjects for a stream source.
 func (a *Account) streamSourceSubjects(ss *StreamSource, seen map[string]bool) (subjects []string, hasExt bool) {
 	if ss != nil && ss.External != nil {
@@ -1339,6 +1753,7 @@ func (js *jetStream) streamSourceSubjectsClustered(accountName, streamName strin
 	if len(cfg.Subjects) > 0 {
 		subjects = append(subjects, cfg.Subjects...)
 	}
+	subjects = appendTransformSubject(subjects, cfg.SubjectTransform)
 
 	// Check if we need to keep going.
 	var sources []*StreamSource
@@ -1357,6 +1772,7 @@ func (js *jetStream) streamSourceSubjectsClustered(accountName, streamName strin
 				if len(subjs) > 0 {
 					subjects = append(subjects, subjs...)
 				}
+				subjects = appendTransformSubject(subjects, ss.SubjectTransform)
 				if hasExt {
 					break
 				}
@@ -1382,6 +1798,7 @@ func (a *Account) streamSourceSubjectsNotClustered(streamName string, seen map[s
 	if len(cfg.Subjects) > 0 {
 		subjects = append(subjects, cfg.Subjects...)
 	}
+	subjects = appendTransformSubject(subjects, cfg.SubjectTransform)
 
 	var subjs []string
 	if cfg.Mirror != nil {
@@ -1389,12 +1806,14 @@ func (a *Account) streamSourceSubjectsNotClustered(streamName string, seen map[s
 		if len(subjs) > 0 {
 			subjects = append(subjects, subjs...)
 		}
+		subjects = appendTransformSubject(subjects, cfg.Mirror.SubjectTransform)
 	} else if len(cfg.Sources) > 0 {
 		for _, si := range cfg.Sources {
 			subjs, hasExt = a.streamSourceSubjects(si, seen)
 			if len(subjs) > 0 {
 				subjects = append(subjects, subjs...)
 			}
+			subjects = appendTransformSubject(subjects, si.SubjectTransform)
 			if hasExt {
 				break
 			}
@@ -1598,6 +2017,13 @@ func (mset *stream) processInboundMirrorMsg(m *inMsg) bool {
 	}
 
 	js, stype := mset.js, mset.cfg.Storage
+	// Map the subject if we have a transform.
+	subj := m.subj
+	if tr := mset.mirror.tr; tr != nil {
+		if nsubj, err := tr.match(subj); err == nil {
+			subj = nsubj
+		}
+	}
 	mset.mu.Unlock()
 
 	s := mset.srv
@@ -1607,10 +2033,10 @@ func (mset *stream) processInboundMirrorMsg(m *inMsg) bool {
 			s.resourcesExeededError()
 			err = ApiErrors[JSInsufficientResourcesErr]
 		} else {
-			err = node.Propose(encodeStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts))
+			err = node.Propose(encodeStreamMsg(subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts))
 		}
 	} else {
-		err = mset.processJetStreamMsg(m.subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts)
+		err = mset.processJetStreamMsg(subj, _EMPTY_, m.hdr, m.msg, sseq-1, ts)
 	}
 	if err != nil {
 		if err == errLastSeqMismatch {
@@ -1685,7 +2111,7 @@ func (mset *stream) skipMsgs(start, end uint64) {
 				node.ProposeDirect(entries)
 				// We need to re-craete `entries` because there is a reference
 				// to it in the node's pae map.
-				entries = entries[:0]
+				entries = nil
 			}
 		} else {
 			mset.lseq = store.SkipMsg()
@@ -1736,6 +2162,7 @@ func (mset *stream) setupMirrorConsumer() error {
 	if !isReset {
 		qname := fmt.Sprintf("[ACC:%s] stream mirror '%s' of '%s' msgs", mset.acc.Name, mset.cfg.Name, mset.cfg.Mirror.Name)
 		mset.mirror = &sourceInfo{name: mset.cfg.Mirror.Name, msgs: mset.srv.newIPQueue(qname) /* of *inMsg */}
+		mset.mirror.tr, _ = newSubjectTransform(mset.cfg.Mirror.SubjectTransform)
 	}
 
 	if !mset.mirror.grr {
@@ -2216,6 +2643,13 @@ func (mset *stream) processInboundSourceMsg(si *sourceInfo, m *inMsg) bool {
 	} else {
 		si.lag = pending - 1
 	}
+	// Map the subject if we have a transform.
+	subj := m.subj
+	if si.tr != nil {
+		if nsubj, err := si.tr.match(subj); err == nil {
+			subj = nsubj
+		}
+	}
 	mset.mu.Unlock()
 
 	hdr, msg := m.hdr, m.msg
@@ -2230,9 +2664,9 @@ func (mset *stream) processInboundSourceMsg(si *sourceInfo, m *inMsg) bool {
 	var err error
 	// If we are clustered we need to propose this message to the underlying raft group.
 	if node != nil {
-		err = mset.processClusteredInboundMsg(m.subj, _EMPTY_, hdr, msg)
+		err = mset.processClusteredInboundMsg(subj, _EMPTY_, hdr, msg)
 	} else {
-		err = mset.processJetStreamMsg(m.subj, _EMPTY_, hdr, msg, 0, 0)
+		err = mset.processJetStreamMsg(subj, _EMPTY_, hdr, msg, 0, 0)
 	}
 
 	if err != nil {
@@ -2356,6 +2790,7 @@ func (mset *stream) startingSequenceForSources() {
 		}
 		qname := fmt.Sprintf("[ACC:%s] stream source '%s' from '%s' msgs", mset.acc.Name, mset.cfg.Name, ssi.Name)
 		si := &sourceInfo{name: ssi.Name, iname: ssi.iname, msgs: mset.srv.newIPQueue(qname) /* of *inMsg */}
+		si.tr, _ = newSubjectTransform(ssi.SubjectTransform)
 		mset.sources[ssi.iname] = si
 	}
 
@@ -2572,6 +3007,127 @@ func (mset *stream) unsubscribeUnlocked(sub *subscription) {
 	mset.mu.Unlock()
 }
 
+// Lock should be held.
+func (mset *stream) queueSubscribeInternal(subject, group string, cb msgHandler) (*subscription, error) {
+	c := mset.client
+	if c == nil {
+		return nil, fmt.Errorf("invalid stream")
+	}
+	if cb == nil {
+		return nil, fmt.Errorf("undefined message handler")
+	}
+
+	mset.sid++
+
+	// Now create the subscription
+	return c.processSub([]byte(subject), []byte(group), []byte(strconv.Itoa(mset.sid)), cb, false)
+}
+
+// Queue group used for direct gets so that only one replica or mirror answers.
+const dgetGroup = "_sys_"
+
+// Will subscribe to direct gets for our stream, and for the stream we mirror if configured.
+// Lock should be held.
+func (mset *stream) subscribeToDirect() error {
+	if mset.catchup {
+		return nil
+	}
+	if mset.cfg.AllowDirect && mset.directSub == nil {
+		dsubj := fmt.Sprintf(JSDirectMsgGetT, mset.cfg.Name)
+		sub, err := mset.queueSubscribeInternal(dsubj, dgetGroup, mset.processDirectGetRequest)
+		if err != nil {
+			return err
+		}
+		mset.directSub = sub
+	}
+	if mset.cfg.MirrorDirect && mset.cfg.Mirror != nil && mset.mirrorDirectSub == nil {
+		dsubj := fmt.Sprintf(JSDirectMsgGetT, mset.cfg.Mirror.Name)
+		sub, err := mset.queueSubscribeInternal(dsubj, dgetGroup, mset.processDirectGetRequest)
+		if err != nil {
+			return err
+		}
+		mset.mirrorDirectSub = sub
+	}
+	return nil
+}
+
+// Lock should be held.
+func (mset *stream) unsubscribeToDirect() {
+	if mset.directSub != nil {
+		mset.unsubscribe(mset.directSub)
+		mset.directSub = nil
+	}
+	if mset.mirrorDirectSub != nil {
+		mset.unsubscribe(mset.mirrorDirectSub)
+		mset.mirrorDirectSub = nil
+	}
+}
+
+// A direct get request that needs to be processed out of line.
+type directGetReq struct {
+	reply string
+	req   JSApiMsgGetRequest
+}
+
+// processDirectGetRequest handles direct get requests for messages in this stream.
+func (mset *stream) processDirectGetRequest(_ *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if len(reply) == 0 {
+		return
+	}
+	_, msg := c.msgParts(rmsg)
+	if len(msg) == 0 {
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, []byte("NATS/1.0 408 Empty Request\r\n\r\n"), nil, nil, 0))
+		return
+	}
+	var req JSApiMsgGetRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, []byte("NATS/1.0 408 Malformed Request\r\n\r\n"), nil, nil, 0))
+		return
+	}
+	// Check that we have one and only one option set.
+	if req.Seq > 0 && req.LastFor != _EMPTY_ || req.Seq == 0 && req.LastFor == _EMPTY_ {
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, []byte("NATS/1.0 408 Bad Request\r\n\r\n"), nil, nil, 0))
+		return
+	}
+
+	// If this did not come directly from a client we do not want to block the
+	// route or gateway, so queue this up for our internal loop.
+	if c.kind == ROUTER || c.kind == GATEWAY || c.kind == LEAF {
+		mset.gets.push(&directGetReq{reply, req})
+		return
+	}
+	mset.getDirectRequest(&req, reply)
+}
+
+// getDirectRequest will load the requested message and send it to the reply subject
+// with its stream metadata in headers.
+func (mset *stream) getDirectRequest(req *JSApiMsgGetRequest, reply string) {
+	mset.mu.RLock()
+	store, name := mset.store, mset.cfg.Name
+	mset.mu.RUnlock()
+
+	var svp StoreMsg
+	var sm *StoreMsg
+	var err error
+
+	if req.Seq > 0 {
+		sm, err = store.LoadMsg(req.Seq, &svp)
+	} else {
+		sm, err = store.LoadLastMsg(req.LastFor, &svp)
+	}
+	if err != nil {
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, []byte("NATS/1.0 404 Message Not Found\r\n\r\n"), nil, nil, 0))
+		return
+	}
+
+	hdr := genHeader(sm.hdr, JSStream, name)
+	hdr = genHeader(hdr, JSSubject, sm.subj)
+	hdr = genHeader(hdr, JSSequence, strconv.FormatUint(sm.seq, 10))
+	hdr = genHeader(hdr, JSTimeStamp, time.Unix(0, sm.ts).UTC().Format(time.RFC3339Nano))
+
+	mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, copyBytes(sm.msg), nil, 0))
+}
+
 func (mset *stream) setupStore(fsCfg *FileStoreConfig) error {
 	mset.mu.Lock()
 	mset.created = time.Now().UTC()
@@ -2586,7 +3142,17 @@ func (mset *stream) setupStore(fsCfg *FileStoreConfig) error {
 		mset.store = ms
 	case FileStorage:
 		s := mset.srv
-		fs, err := newFileStoreWithCreated(*fsCfg, mset.cfg, mset.created, s.jsKeyGen(mset.acc.Name))
+		opts := s.getOpts()
+		fsCfg.Cipher = opts.JetStreamCipher
+		// Our blocks are kept in the archive under our server name, using the same layout as our store directory.
+		// This keeps replicas on servers sharing an archive from overwriting each other's blocks.
+		if opts.JetStreamArchive != nil {
+			fsCfg.Archive = opts.JetStreamArchive
+			fsCfg.ArchivePrefix = filepath.ToSlash(filepath.Join(opts.ServerName, mset.acc.Name, streamsDir, mset.cfg.Name))
+		}
+		ek, oldek := s.jsEncryptionKeys()
+		prf, oldprf := s.jsKeyGen(ek, mset.acc.Name), s.jsKeyGen(oldek, mset.acc.Name)
+		fs, err := newFileStoreWithCreated(*fsCfg, mset.cfg, mset.created, prf, oldprf)
 		if err != nil {
 			mset.mu.Unlock()
 			return err
@@ -2818,13 +3384,533 @@ func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, _ *Ac
 	}
 
 	// If we are clustered we need to propose this message to the underlying raft group.
-	if isClustered {
+	if isBatchMsg(hdr) {
+		mset.processBatchMsg(subject, reply, hdr, msg)
+	} else if isClustered {
 		mset.processClusteredInboundMsg(subject, reply, hdr, msg)
 	} else {
 		mset.processJetStreamMsg(subject, reply, hdr, msg, 0, 0)
 	}
 }
 
+// Limits for atomic batches.
+const (
+	// Maximum number of messages in a single batch.
+	streamMaxBatchSize = 1000
+	// Maximum number of batches a stream will stage at once.
+	streamMaxBatchInflight = 50
+	// Maximum number of bytes in a single batch, which is also the size of its raft entry.
+	streamMaxBatchBytes = 8 * 1024 * 1024
+	// Maximum number of bytes a stream will stage at once across all batches.
+	streamMaxBatchInflightBytes = 64 * 1024 * 1024
+	// Maximum number of bytes for a batch id.
+	streamMaxBatchIdLen = 64
+	// Batches that have not seen a message in this time are abandoned.
+	streamBatchTimeout = 10 * time.Second
+)
+
+// batchGroup holds the messages of an atomic batch until it is committed.
+type batchGroup struct {
+	msgs  []*inMsg
+	bytes int
+	tmr   *time.Timer
+}
+
+// Fast check if this message is part of an atomic batch.
+func isBatchMsg(hdr []byte) bool {
+	return len(hdr) > 0 && len(getHeader(JSBatchId, hdr)) > 0
+}
+
+// Will send an error response for an atomic batch.
+func (mset *stream) sendBatchError(reply string, apiErr *ApiError) {
+	mset.mu.RLock()
+	name, outq, noAck := mset.cfg.Name, mset.outq, mset.cfg.NoAck
+	mset.mu.RUnlock()
+
+	if reply == _EMPTY_ || noAck || outq == nil {
+		return
+	}
+	b, _ := json.Marshal(&JSPubAckResponse{PubAck: &PubAck{Stream: name}, Error: apiErr})
+	outq.sendMsg(reply, b)
+}
+
+// processBatchMsg will stage a message that is part of an atomic batch. When the
+// batch is committed all of its messages will be stored or none will be.
+// Only the commit message receives a publish acknowledgement.
+func (mset *stream) processBatchMsg(subject, reply string, hdr, msg []byte) {
+	mset.mu.Lock()
+	if !mset.cfg.AllowAtomicPublish {
+		mset.mu.Unlock()
+		mset.sendBatchError(reply, NewJSAtomicPublishDisabledError())
+		return
+	}
+
+	id := string(getHeader(JSBatchId, hdr))
+	seq := parseInt64(getHeader(JSBatchSeq, hdr))
+	commit := len(getHeader(JSBatchCommit, hdr)) > 0
+
+	bg := mset.batches[id]
+	if len(id) > streamMaxBatchIdLen || seq <= 0 || (seq > 1 && (bg == nil || int(seq) != len(bg.msgs)+1)) {
+		mset.abandonBatchLocked(id)
+		mset.mu.Unlock()
+		mset.sendBatchError(reply, NewJSAtomicPublishIncompleteBatchError())
+		return
+	}
+	if seq == 1 {
+		// Starting over with the same id replaces the old batch.
+		mset.abandonBatchLocked(id)
+		if len(mset.batches) >= streamMaxBatchInflight {
+			mset.mu.Unlock()
+			mset.sendBatchError(reply, NewJSAtomicPublishIncompleteBatchError())
+			return
+		}
+		if mset.batches == nil {
+			mset.batches = make(map[string]*batchGroup)
+		}
+		bg = &batchGroup{}
+		bg.tmr = time.AfterFunc(streamBatchTimeout, func() {
+			mset.mu.Lock()
+			if mset.batches[id] == bg {
+				mset.abandonBatchLocked(id)
+			}
+			mset.mu.Unlock()
+		})
+		mset.batches[id] = bg
+	} else {
+		bg.tmr.Reset(streamBatchTimeout)
+	}
+
+	if len(bg.msgs) >= streamMaxBatchSize {
+		mset.abandonBatchLocked(id)
+		mset.mu.Unlock()
+		mset.sendBatchError(reply, NewJSAtomicPublishTooLargeBatchError(streamMaxBatchSize))
+		return
+	}
+	// Staged batches are held in memory, so limit their size as well.
+	sz := len(subject) + len(hdr) + len(msg)
+	if bg.bytes+sz > streamMaxBatchBytes {
+		mset.abandonBatchLocked(id)
+		mset.mu.Unlock()
+		mset.sendBatchError(reply, NewJSAtomicPublishTooManyBytesError(streamMaxBatchBytes))
+		return
+	}
+	if mset.batchBytes+sz > streamMaxBatchInflightBytes {
+		mset.abandonBatchLocked(id)
+		mset.mu.Unlock()
+		mset.sendBatchError(reply, NewJSAtomicPublishTooManyBytesError(streamMaxBatchInflightBytes))
+		return
+	}
+	bg.bytes += sz
+	mset.batchBytes += sz
+
+	// Only the commit message will respond.
+	if !commit {
+		reply = _EMPTY_
+	}
+	bg.msgs = append(bg.msgs, &inMsg{subject, reply, copyBytes(hdr), copyBytes(msg)})
+
+	if !commit {
+		mset.mu.Unlock()
+		return
+	}
+
+	// We have the whole batch.
+	msgs := bg.msgs
+	mset.abandonBatchLocked(id)
+	isClustered := mset.node != nil
+	mset.mu.Unlock()
+
+	if isClustered {
+		mset.processClusteredBatch(msgs)
+	} else {
+		mset.processJetStreamBatch(msgs, 0, 0)
+	}
+}
+
+// Will remove a staged batch.
+// Lock should be held.
+func (mset *stream) abandonBatchLocked(id string) {
+	if bg := mset.batches[id]; bg != nil {
+		bg.tmr.Stop()
+		mset.batchBytes -= bg.bytes
+		delete(mset.batches, id)
+	}
+}
+
+// checkBatch will check the messages of a batch for anything that would
+// fail regardless of the state of the stream.
+// Lock should be held.
+func (mset *stream) checkBatch(msgs []*inMsg) *ApiError {
+	if mset.cfg.Sealed {
+		return NewJSStreamSealedError()
+	}
+	maxMsgSize := int(mset.cfg.MaxMsgSize)
+	ids := make(map[string]struct{})
+	for i, im := range msgs {
+		if maxMsgSize >= 0 && (len(im.hdr)+len(im.msg)) > maxMsgSize {
+			return NewJSStreamMessageExceedsMaximumError()
+		}
+		if len(im.hdr) > math.MaxUint16 {
+			return NewJSStreamHeaderExceedsMaximumError()
+		}
+		// Expectations can only be placed on the first message.
+		if i > 0 {
+			for _, h := range []string{JSExpectedLastSeq, JSExpectedLastSubjSeq, JSExpectedLastMsgId} {
+				if len(getHeader(h, im.hdr)) > 0 {
+					return NewJSAtomicPublishUnsupportedHeaderBatchError(h)
+				}
+			}
+		}
+		if getRollup(im.hdr) != _EMPTY_ {
+			return NewJSAtomicPublishUnsupportedHeaderBatchError(JSMsgRollup)
+		}
+		if sname := getExpectedStream(im.hdr); sname != _EMPTY_ && sname != mset.cfg.Name {
+			return NewJSStreamNotMatchError()
+		}
+		if ttl := getHeader(JSMessageTTL, im.hdr); len(ttl) > 0 {
+			if !mset.cfg.AllowMsgTTL {
+				return NewJSMessageTTLDisabledError()
+			}
+			if _, err := parseMessageTTL(string(ttl)); err != nil {
+				return NewJSMessageTTLInvalidError()
+			}
+		}
+		if apiErr := mset.checkMsgSchedule(im.hdr); apiErr != nil {
+			return apiErr
+		}
+		if msgId := getMsgId(im.hdr); msgId != _EMPTY_ {
+			if _, ok := ids[msgId]; ok {
+				return NewJSAtomicPublishDuplicateMsgIdError()
+			}
+			ids[msgId] = struct{}{}
+		}
+	}
+	return nil
+}
+
+// checkBatchState will check the messages of a batch against the current
+// state of the stream. Subjects should already be transformed.
+// In clustered mode this is done when the batch is applied.
+// Lock should be held.
+func (mset *stream) checkBatchState(msgs []*inMsg) *ApiError {
+	if len(msgs) == 0 {
+		return nil
+	}
+	var size uint64
+	for _, im := range msgs {
+		if msgId := getMsgId(im.hdr); msgId != _EMPTY_ && mset.checkMsgId(msgId) != nil {
+			return NewJSAtomicPublishDuplicateMsgIdError()
+		}
+		size += uint64(len(im.hdr) + len(im.msg))
+	}
+
+	// Expectations on the first message.
+	hdr := msgs[0].hdr
+	if seq := getExpectedLastSeq(hdr); seq > 0 && seq != mset.lseq {
+		return NewJSStreamWrongLastSequenceError(mset.lseq)
+	}
+	if lmsgId := getExpectedLastMsgId(hdr); lmsgId != _EMPTY_ {
+		if mset.lmsgId == _EMPTY_ && !mset.ddloaded {
+			mset.rebuildDedupe()
+		}
+		if lmsgId != mset.lmsgId {
+			return NewJSStreamWrongLastMsgIDError(mset.lmsgId)
+		}
+	}
+	if seq, exists := getExpectedLastSeqPerSubject(hdr); exists {
+		subject := msgs[0].subj
+		var smv StoreMsg
+		var fseq uint64
+		sm, err := mset.store.LoadLastMsg(subject, &smv)
+		if sm != nil {
+			fseq = sm.seq
+		}
+		if err == ErrStoreMsgNotFound && seq == 0 {
+			fseq, err = 0, nil
+		}
+		if err != nil || fseq != seq {
+			return NewJSStreamWrongLastSequenceError(fseq)
+		}
+	}
+
+	// Check limits if we would discard new messages.
+	if mset.cfg.Discard == DiscardNew {
+		var state StreamState
+		mset.store.FastState(&state)
+		if mset.cfg.MaxMsgs > 0 && state.Msgs+uint64(len(msgs)) > uint64(mset.cfg.MaxMsgs) {
+			return NewJSStreamStoreFailedError(ErrMaxMsgs, Unless(ErrMaxMsgs))
+		}
+		if mset.cfg.MaxBytes > 0 && state.Bytes+size > uint64(mset.cfg.MaxBytes) {
+			return NewJSStreamStoreFailedError(ErrMaxBytes, Unless(ErrMaxBytes))
+		}
+		// Check the per subject limits as well if we are rejecting those.
+		if mset.cfg.DiscardNewPer && mset.cfg.MaxMsgsPer > 0 {
+			counts := make(map[string]uint64)
+			for _, im := range msgs {
+				n, ok := counts[im.subj]
+				if !ok {
+					n = mset.store.FilteredState(state.FirstSeq, im.subj).Msgs
+				}
+				if n++; n > uint64(mset.cfg.MaxMsgsPer) {
+					return NewJSStreamMaxMsgsPerSubjectError()
+				}
+				counts[im.subj] = n
+			}
+		}
+	}
+	return nil
+}
+
+// processJetStreamBatch will store all of the messages of an atomic batch or none of them.
+// For clustering the lower layers will pass the expected lseq and timestamp for the batch.
+// Only the last message of the batch, the commit, will receive a response.
+// Note that if storing fails part way through, the messages of the batch that were stored are
+// removed, but older messages already removed by DiscardOld limits to make room can not be restored.
+func (mset *stream) processJetStreamBatch(msgs []*inMsg, lseq uint64, ts int64) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	// Make sure no other messages are stored while we store the batch.
+	mset.batchMu.Lock()
+	defer mset.batchMu.Unlock()
+
+	mset.mu.Lock()
+	store := mset.store
+	c, s := mset.client, mset.srv
+	if c == nil {
+		mset.mu.Unlock()
+		return nil
+	}
+
+	var accName string
+	if mset.acc != nil {
+		accName = mset.acc.Name
+	}
+	js, jsa, stype, tierName, name := mset.js, mset.jsa, mset.cfg.Storage, mset.tier, mset.cfg.Name
+	reply := msgs[len(msgs)-1].rply
+	canRespond := !mset.cfg.NoAck && len(reply) > 0 && mset.isLeader()
+
+	// On any failure none of the messages will be stored.
+	reject := func(apiErr *ApiError) error {
+		mset.clfs += uint64(len(msgs))
+		mset.mu.Unlock()
+		if canRespond {
+			mset.sendBatchError(reply, apiErr)
+		}
+		return apiErr
+	}
+
+	// For clustering check that the batch lines up with our last sequence.
+	if lseq > 0 && lseq != (mset.lseq+mset.clfs) {
+		// We may be able to recover here if we have no state whatsoever.
+		var state StreamState
+		mset.store.FastState(&state)
+		if mset.lseq != 0 || state.FirstSeq != 0 {
+			mset.mu.Unlock()
+			if canRespond {
+				mset.sendBatchError(reply, ApiErrors[JSStreamSequenceNotMatchErr])
+			}
+			return errLastSeqMismatch
+		}
+		mset.store.Compact(lseq + 1)
+		mset.lseq = lseq
+	}
+
+	// Prepare our messages the same way we would if they were stored individually.
+	for _, im := range msgs {
+		if len(im.hdr) > 0 {
+			im.hdr = removeHeaderIfPresent(im.hdr, ClientInfoHdr)
+		}
+		if mset.itr != nil {
+			if nsubj, err := mset.itr.match(im.subj); err == nil {
+				im.subj = nsubj
+			}
+		}
+	}
+	apiErr := mset.checkBatch(msgs)
+	if apiErr == nil {
+		apiErr = mset.checkBatchState(msgs)
+	}
+	if apiErr != nil {
+		return reject(apiErr)
+	}
+	if js.limitsExceeded(stype) {
+		s.resourcesExeededError()
+		err := reject(NewJSInsufficientResourcesError())
+		// Stepdown regardless.
+		if node := mset.raftNode(); node != nil {
+			node.StepDown()
+		}
+		return err
+	}
+
+	// If we are interest based retention messages no one is interested in are skipped.
+	noInterest := func(subject string) bool {
+		if mset.cfg.Retention != InterestPolicy {
+			return false
+		}
+		if len(mset.consumers) == 0 {
+			return true
+		}
+		if mset.numFilter == 0 {
+			return false
+		}
+		for _, o := range mset.consumers {
+			if o.isFilteredMatch(subject) {
+				return false
+			}
+		}
+		return true
+	}
+	skip := make([]bool, len(msgs))
+	for i, im := range msgs {
+		skip[i] = noInterest(im.subj)
+	}
+
+	// Grab timestamp if not already set.
+	if ts == 0 && lseq > 0 {
+		ts = time.Now().UnixNano()
+	}
+
+	// Assume this will succeed.
+	olseq, olmsgId, clfs := mset.lseq, mset.lmsgId, mset.clfs
+	mset.lseq += uint64(len(msgs))
+	mset.lmsgId = getMsgId(msgs[len(msgs)-1].hdr)
+	// Check if we need to republish these messages. Only the leader will do so.
+	// Grab the last sequence for each subject to help subscribers detect gaps.
+	tr, rpHdrsOnly := mset.tr, false
+	var rplseqs map[string]uint64
+	if tr != nil && mset.isLeader() {
+		rpHdrsOnly, rplseqs = mset.cfg.RePublish.HeadersOnly, make(map[string]uint64)
+		for _, im := range msgs {
+			if _, ok := rplseqs[im.subj]; !ok {
+				var smv StoreMsg
+				if sm, _ := store.LoadLastMsg(im.subj, &smv); sm != nil {
+					rplseqs[im.subj] = sm.seq
+				} else {
+					rplseqs[im.subj] = 0
+				}
+			}
+		}
+	} else {
+		tr = nil
+	}
+	// Same as with single messages we can not hold the lock while storing.
+	mset.mu.Unlock()
+
+	var err error
+	seqs := make([]uint64, len(msgs))
+	tss := make([]int64, len(msgs))
+	var stored int
+	for i, im := range msgs {
+		if skip[i] {
+			seqs[i], stored = store.SkipMsg(), i+1
+			continue
+		}
+		if lseq == 0 && ts == 0 {
+			seqs[i], tss[i], err = store.StoreMsg(im.subj, im.hdr, im.msg)
+		} else {
+			// Make sure to take into account any message assignments that we had to skip (clfs).
+			seqs[i], tss[i] = lseq+uint64(i)+1-clfs, ts
+			err = store.StoreRawMsg(im.subj, im.hdr, im.msg, seqs[i], ts)
+		}
+		if err != nil {
+			break
+		}
+		stored = i + 1
+	}
+	if err == nil && jsa.limitsExceeded(stype, tierName) {
+		s.Warnf("JetStream resource limits exceeded for account: %q", accName)
+		err = NewJSAccountResourcesExceededError()
+	}
+
+	if err != nil {
+		// Remove anything we did store so the batch is all or none.
+		for i := 0; i < stored; i++ {
+			if !skip[i] {
+				store.RemoveMsg(seqs[i])
+			}
+		}
+		mset.mu.Lock()
+		var state StreamState
+		mset.store.FastState(&state)
+		mset.lseq = state.LastSeq
+		mset.lmsgId = olmsgId
+		// Anything we did not assign a sequence to needs to be skipped in case we are clustered.
+		if used := state.LastSeq - olseq; used < uint64(len(msgs)) {
+			mset.clfs += uint64(len(msgs)) - used
+		}
+		mset.mu.Unlock()
+
+		switch err {
+		case ErrMaxMsgs, ErrMaxBytes, ErrMaxMsgsPerSubject, ErrMsgTooLarge:
+			s.Debugf("JetStream failed to store a batch on stream '%s > %s': %v", accName, name, err)
+		case ErrStoreClosed:
+		default:
+			if _, ok := err.(*ApiError); !ok {
+				s.Errorf("JetStream failed to store a batch on stream '%s > %s': %v", accName, name, err)
+			}
+		}
+		if canRespond {
+			apiErr, ok := err.(*ApiError)
+			if !ok {
+				if err == ErrMaxMsgsPerSubject {
+					apiErr = NewJSStreamMaxMsgsPerSubjectError()
+				} else {
+					apiErr = NewJSStreamStoreFailedError(err, Unless(err))
+				}
+			}
+			mset.sendBatchError(reply, apiErr)
+		}
+		return err
+	}
+
+	// No errors, this is the normal path.
+	for i, im := range msgs {
+		if skip[i] {
+			continue
+		}
+		seq, subject := seqs[i], im.subj
+		if msgId := getMsgId(im.hdr); msgId != _EMPTY_ {
+			mset.storeMsgId(&ddentry{msgId, seq, tss[i]})
+		}
+		if tr != nil {
+			if rpsubj, err := tr.match(subject); err == nil {
+				mset.republish(rpsubj, subject, im.hdr, im.msg, seq, rplseqs[subject], tss[i], rpHdrsOnly)
+			}
+			rplseqs[subject] = seq
+		}
+	}
+
+	// Send response here.
+	if canRespond {
+		mset.mu.RLock()
+		response := append([]byte(nil), mset.pubAck...)
+		outq := mset.outq
+		mset.mu.RUnlock()
+		response = append(response, strconv.FormatUint(seqs[len(seqs)-1], 10)...)
+		response = append(response, '}')
+		outq.sendMsg(reply, response)
+	}
+
+	mset.mu.Lock()
+	for _, o := range mset.consumers {
+		o.mu.Lock()
+		if o.isLeader() {
+			for i, im := range msgs {
+				if !skip[i] && seqs[i] > o.lsgap && o.isFilteredMatch(im.subj) {
+					o.sgap++
+				}
+			}
+			o.signalNewMessages()
+		}
+		o.mu.Unlock()
+	}
+	mset.mu.Unlock()
+
+	return nil
+}
+
 var (
 	errLastSeqMismatch = errors.New("last sequence mismatch")
 	errMsgIdDuplicate  = errors.New("msgid is duplicate")
@@ -2832,6 +3918,10 @@ var (
 
 // processJetStreamMsg is where we try to actually process the stream msg.
 func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte, lseq uint64, ts int64) error {
+	// Make sure we are not interleaved with an atomic batch.
+	mset.batchMu.Lock()
+	defer mset.batchMu.Unlock()
+
 	mset.mu.Lock()
 	store := mset.store
 	c, s := mset.client, mset.srv
@@ -2859,6 +3949,14 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	var buf [256]byte
 	pubAck := append(buf[:0], mset.pubAck...)
 
+	// Map the subject if we have an inbound subject transform.
+	// Subjects that do not match the transform source are stored as is.
+	if mset.itr != nil {
+		if nsubj, err := mset.itr.match(subject); err == nil {
+			subject = nsubj
+		}
+	}
+
 	// For clustering the lower layers will pass our expected lseq. If it is present check for that here.
 	if lseq > 0 && lseq != (mset.lseq+mset.clfs) {
 		isMisMatch := true
@@ -3005,6 +4103,31 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 				return fmt.Errorf("rollup value invalid: %q", rollup)
 			}
 		}
+		// Check for per-message TTLs and schedules. Mirrored or sourced messages are stored as is.
+		if mset.cfg.Mirror == nil && len(getHeader(JSStreamSource, hdr)) == 0 {
+			var apiErr *ApiError
+			if ttl := getHeader(JSMessageTTL, hdr); len(ttl) > 0 {
+				if !mset.cfg.AllowMsgTTL {
+					apiErr = NewJSMessageTTLDisabledError()
+				} else if _, err := parseMessageTTL(string(ttl)); err != nil {
+					apiErr = NewJSMessageTTLInvalidError()
+				}
+			}
+			if apiErr == nil {
+				apiErr = mset.checkMsgSchedule(hdr)
+			}
+			if apiErr != nil {
+				mset.clfs++
+				mset.mu.Unlock()
+				if canRespond {
+					resp.PubAck = &PubAck{Stream: name}
+					resp.Error = apiErr
+					b, _ := json.Marshal(resp)
+					outq.sendMsg(reply, b)
+				}
+				return apiErr
+			}
+		}
 	}
 
 	// Response Ack.
@@ -3067,7 +4190,7 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 			// Assume no interest and check to disqualify.
 			noInterest = true
 			for _, o := range mset.consumers {
-				if o.cfg.FilterSubject == _EMPTY_ || subjectIsSubsetMatch(subject, o.cfg.FilterSubject) {
+				if o.isFilteredMatch(subject) {
 					noInterest = false
 					break
 				}
@@ -3105,6 +4228,21 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	clfs := mset.clfs
 	mset.lseq++
 	tierName := mset.tier
+
+	// Check if we need to republish this message. Only the leader will do so.
+	var rpsubj string
+	var rplseq uint64
+	var rpHdrsOnly bool
+	if mset.tr != nil && isLeader {
+		if tsubj, err := mset.tr.match(subject); err == nil {
+			rpsubj, rpHdrsOnly = tsubj, mset.cfg.RePublish.HeadersOnly
+			// Grab the last sequence for this subject to help subscribers detect gaps.
+			var smv StoreMsg
+			if sm, _ := store.LoadLastMsg(subject, &smv); sm != nil {
+				rplseq = sm.seq
+			}
+		}
+	}
 	// We hold the lock to this point to make sure nothing gets between us since we check for pre-conditions.
 	// Currently can not hold while calling store b/c we have inline storage update calls that may need the lock.
 	// Note that upstream that sets seq/ts should be serialized as much as possible.
@@ -3139,7 +4277,11 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 
 		if canRespond {
 			resp.PubAck = &PubAck{Stream: name}
-			resp.Error = NewJSStreamStoreFailedError(err, Unless(err))
+			if err == ErrMaxMsgsPerSubject {
+				resp.Error = NewJSStreamMaxMsgsPerSubjectError()
+			} else {
+				resp.Error = NewJSStreamStoreFailedError(err, Unless(err))
+			}
 			response, _ = json.Marshal(resp)
 		}
 	} else if jsa.limitsExceeded(stype, tierName) {
@@ -3169,6 +4311,9 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		} else if rollupAll {
 			mset.purge(&JSApiStreamPurgeRequest{Keep: 1})
 		}
+		if rpsubj != _EMPTY_ {
+			mset.republish(rpsubj, subject, hdr, msg, seq, rplseq, ts, rpHdrsOnly)
+		}
 		if canRespond {
 			response = append(pubAck, strconv.FormatUint(seq, 10)...)
 			response = append(response, '}')
@@ -3198,6 +4343,39 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	return err
 }
 
+// republish will send a stored message to its republish destination with
+// headers describing where and at what sequence it was stored.
+func (mset *stream) republish(dsubj, subj string, hdr, msg []byte, seq, lseq uint64, ts int64, hdrsOnly bool) {
+	hdr = genHeader(hdr, JSStream, mset.name())
+	hdr = genHeader(hdr, JSSubject, subj)
+	hdr = genHeader(hdr, JSSequence, strconv.FormatUint(seq, 10))
+	hdr = genHeader(hdr, JSTimeStamp, time.Unix(0, ts).UTC().Format(time.RFC3339Nano))
+	hdr = genHeader(hdr, JSLastSequence, strconv.FormatUint(lseq, 10))
+	if hdrsOnly {
+		hdr = genHeader(hdr, JSMsgSize, strconv.Itoa(len(msg)))
+		msg = nil
+	} else {
+		msg = copyBytes(msg)
+	}
+	mset.outq.send(newJSPubMsg(dsubj, _EMPTY_, _EMPTY_, hdr, msg, nil, 0))
+}
+
+// checkMsgSchedule will make sure any message schedule headers are allowed and valid.
+// Lock should be held.
+func (mset *stream) checkMsgSchedule(hdr []byte) *ApiError {
+	at, delay := getHeader(JSScheduleAt, hdr), getHeader(JSScheduleDelay, hdr)
+	if len(at) == 0 && len(delay) == 0 {
+		return nil
+	}
+	if !mset.cfg.AllowMsgSchedules {
+		return NewJSMessageScheduleDisabledError()
+	}
+	if _, err := parseMessageSchedule(string(at), string(delay), 0); err != nil {
+		return NewJSMessageScheduleInvalidError()
+	}
+	return nil
+}
+
 // Internal message for use by jetstream subsystem.
 type jsPubMsg struct {
 	dsubj string // Subject to send to, e.g. _INBOX.xxx
@@ -3327,7 +4505,7 @@ func (mset *stream) internalLoop() {
 	c := s.createInternalJetStreamClient()
 	c.registerWithAccount(mset.acc)
 	defer c.closeConnection(ClientClosed)
-	outq, qch, msgs := mset.outq, mset.qch, mset.msgs
+	outq, qch, msgs, gets := mset.outq, mset.qch, mset.msgs, mset.gets
 
 	// For the ack msgs queue for interest retention.
 	var (
@@ -3406,13 +4584,22 @@ func (mset *stream) internalLoop() {
 			for _, imi := range ims {
 				im := imi.(*inMsg)
 				// If we are clustered we need to propose this message to the underlying raft group.
-				if isClustered {
+				if isBatchMsg(im.hdr) {
+					mset.processBatchMsg(im.subj, im.rply, im.hdr, im.msg)
+				} else if isClustered {
 					mset.processClusteredInboundMsg(im.subj, im.rply, im.hdr, im.msg)
 				} else {
 					mset.processJetStreamMsg(im.subj, im.rply, im.hdr, im.msg, 0, 0)
 				}
 			}
 			msgs.recycle(&ims)
+		case <-gets.ch:
+			dgs := gets.pop()
+			for _, dgi := range dgs {
+				dg := dgi.(*directGetReq)
+				mset.getDirectRequest(&dg.req, dg.reply)
+			}
+			gets.recycle(&dgs)
 		case <-amch:
 			seqs := ackq.pop()
 			for _, seq := range seqs {
@@ -3483,6 +4670,12 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 	mset.stopClusterSubs()
 	// Unsubscribe from direct stream.
 	mset.unsubscribeToStream()
+	// Stop answering direct gets.
+	mset.unsubscribeToDirect()
+	// Drop any batches we were staging.
+	for id := range mset.batches {
+		mset.abandonBatchLocked(id)
+	}
 
 	// Our info sub if we spun it up.
 	if mset.infoSub != nil {
@@ -3535,6 +4728,7 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 		mset.msgs.unregister()
 		mset.ackq.unregister()
 		mset.outq.unregister()
+		mset.gets.unregister()
 	}
 
 	// Clustered cleanup.
@@ -3618,7 +4812,7 @@ func (mset *stream) numConsumers() int {
 
 func (mset *stream) setConsumer(o *consumer) {
 	mset.consumers[o.name] = o
-	if o.cfg.FilterSubject != _EMPTY_ {
+	if len(o.subjf) > 0 {
 		mset.numFilter++
 	}
 	if o.cfg.Direct {
@@ -3627,7 +4821,7 @@ func (mset *stream) setConsumer(o *consumer) {
 }
 
 func (mset *stream) removeConsumer(o *consumer) {
-	if o.cfg.FilterSubject != _EMPTY_ && mset.numFilter > 0 {
+	if len(o.subjf) > 0 && mset.numFilter > 0 {
 		mset.numFilter--
 	}
 	if o.cfg.Direct && mset.directs > 0 {
@@ -3686,15 +4880,19 @@ func (mset *stream) Store() StreamStore {
 	return mset.store
 }
 
-// Determines if the new proposed partition is unique amongst all consumers.
+// Determines if the new proposed partitions are unique amongst all consumers.
 // Lock should be held.
-func (mset *stream) partitionUnique(partition string) bool {
+func (mset *stream) partitionUnique(partitions []string) bool {
 	for _, o := range mset.consumers {
-		if o.cfg.FilterSubject == _EMPTY_ {
+		if len(o.subjf) == 0 {
 			return false
 		}
-		if subjectIsSubsetMatch(partition, o.cfg.FilterSubject) {
-			return false
+		for _, partition := range partitions {
+			for _, filter := range o.subjf {
+				if subjectIsSubsetMatch(partition, filter) {
+					return false
+				}
+			}
 		}
 	}
 	return true